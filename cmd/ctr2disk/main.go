@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/cloudboss/easyto/pkg/constants"
 	"github.com/cloudboss/easyto/pkg/ctr2disk"
+	"github.com/cloudboss/easyto/pkg/diskformat"
+	"github.com/cloudboss/easyto/pkg/login"
+	"github.com/cloudboss/easyto/pkg/privesc"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
@@ -19,6 +23,38 @@ var (
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
 
+			changes := []string{}
+			if len(cfg.changes) > 0 {
+				err := json.Unmarshal([]byte(cfg.changes), &changes)
+				if err != nil {
+					return fmt.Errorf("failed to parse changes: %w", err)
+				}
+			}
+
+			users := []login.UserSpec{}
+			if len(cfg.users) > 0 {
+				err := json.Unmarshal([]byte(cfg.users), &users)
+				if err != nil {
+					return fmt.Errorf("failed to parse users: %w", err)
+				}
+			}
+
+			loginPassword := cfg.loginPasswordHash
+			if len(cfg.loginPasswordFile) > 0 {
+				hash, err := login.ReadPasswordHashFile(afero.NewOsFs(), cfg.loginPasswordFile)
+				if err != nil {
+					return fmt.Errorf("failed to read login password hash: %w", err)
+				}
+				loginPassword = hash
+			}
+			if len(cfg.loginPasswordPlain) > 0 {
+				hash, err := login.HashPasswordFile(afero.NewOsFs(), cfg.loginPasswordPlain)
+				if err != nil {
+					return fmt.Errorf("failed to hash login password: %w", err)
+				}
+				loginPassword = hash
+			}
+
 			builder, err := ctr2disk.NewBuilder(
 				afero.NewOsFs(),
 				ctr2disk.WithAssetDir(cfg.assetDir),
@@ -29,6 +65,18 @@ var (
 				ctr2disk.WithServices(cfg.services),
 				ctr2disk.WithLoginUser(cfg.loginUser),
 				ctr2disk.WithLoginShell(cfg.loginShell),
+				ctr2disk.WithRootReadOnly(cfg.rootReadOnly),
+				ctr2disk.WithRootNoAuto(cfg.rootNoAuto),
+				ctr2disk.WithChanges(changes),
+				ctr2disk.WithSidecarImages(cfg.sidecarImages),
+				ctr2disk.WithLockUsers(cfg.lockUsers),
+				ctr2disk.WithRemoveUsers(cfg.removeUsers),
+				ctr2disk.WithLoginCheck(cfg.loginCheck),
+				ctr2disk.WithUsers(users),
+				ctr2disk.WithLoginPassword(loginPassword),
+				ctr2disk.WithPrivilegeEscalation(cfg.privilegeEscalation),
+				ctr2disk.WithFormat(cfg.format),
+				ctr2disk.WithOutput(cfg.output),
 				ctr2disk.WithDebug(cfg.debug),
 			)
 			if err != nil {
@@ -46,14 +94,28 @@ var (
 )
 
 type config struct {
-	assetDir      string
-	image         string
-	vmImageDevice string
-	vmImageMount  string
-	services      []string
-	loginUser     string
-	loginShell    string
-	debug         bool
+	assetDir            string
+	image               string
+	vmImageDevice       string
+	vmImageMount        string
+	services            []string
+	loginUser           string
+	loginShell          string
+	rootReadOnly        bool
+	rootNoAuto          bool
+	changes             string
+	sidecarImages       []string
+	lockUsers           []string
+	removeUsers         []string
+	loginCheck          string
+	users               string
+	loginPasswordHash   string
+	loginPasswordFile   string
+	loginPasswordPlain  string
+	privilegeEscalation string
+	format              string
+	output              string
+	debug               bool
 }
 
 func init() {
@@ -81,6 +143,50 @@ func init() {
 	cmd.Flags().StringVar(&cfg.loginShell, "login-shell", loginShell,
 		"Login shell to use for the login user if ssh service is enabled.")
 
+	cmd.Flags().BoolVar(&cfg.rootReadOnly, "root-read-only", false,
+		"Set the read-only GPT attribute on the root partition.")
+
+	cmd.Flags().BoolVar(&cfg.rootNoAuto, "root-no-auto", false,
+		"Set the no-auto GPT attribute on the root partition so it is not automatically mounted.")
+
+	cmd.Flags().StringVar(&cfg.changes, "changes", "",
+		"JSON list of Dockerfile-style instructions to apply to the image config, e.g. '[\"ENV A=1\"]'.")
+
+	cmd.Flags().StringSliceVar(&cfg.sidecarImages, "sidecar-images", []string{},
+		"Comma separated list of sidecar images to merge into the VM image, each in the form [name=]image.")
+
+	cmd.Flags().StringSliceVar(&cfg.lockUsers, "lock-users", []string{},
+		"Comma separated list of users in the container image whose passwords will be locked.")
+
+	cmd.Flags().StringSliceVar(&cfg.removeUsers, "remove-users", []string{},
+		"Comma separated list of users to remove from the container image.")
+
+	cmd.Flags().StringVar(&cfg.loginCheck, "login-check", ctr2disk.LoginCheckWarn,
+		"Policy for problems found in the container image's login files, one of warn or fail.")
+
+	cmd.Flags().StringVar(&cfg.users, "users", "",
+		"JSON list of login users to create in the VM image if ssh service is enabled.")
+
+	cmd.Flags().StringVar(&cfg.loginPasswordHash, "login-password-hash", "",
+		"Password hash in crypt format to set for the login user if ssh service is enabled.")
+
+	cmd.Flags().StringVar(&cfg.loginPasswordFile, "login-password-file", "",
+		"Path to a file containing a password hash in crypt format to set for the login user if ssh service is enabled.")
+
+	cmd.Flags().StringVar(&cfg.loginPasswordPlain, "login-password-plaintext-file", "",
+		"Path to a file containing a plaintext password to hash with SHA-512 crypt and set for the login user if ssh service is enabled.")
+	cmd.MarkFlagsMutuallyExclusive("login-password-hash", "login-password-file",
+		"login-password-plaintext-file")
+
+	cmd.Flags().StringVar(&cfg.privilegeEscalation, "privilege-escalation", privesc.MethodNone,
+		"Configure passwordless privilege escalation for the wheel group if ssh service is enabled, one of none, auto, sudo, or doas.")
+
+	cmd.Flags().StringVar(&cfg.format, "format", diskformat.FormatRaw,
+		"Format of the disk image written to --output, one of raw, qcow2, vhd, or vmdk.")
+
+	cmd.Flags().StringVarP(&cfg.output, "output", "o", "",
+		"File to write the disk image to after it is built on the VM image device, required unless format is raw.")
+
 	cmd.Flags().BoolVar(&cfg.debug, "debug", false, "Enable debug output.")
 }
 
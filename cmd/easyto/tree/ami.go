@@ -1,19 +1,24 @@
 package tree
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"github.com/cloudboss/easyto/pkg/amibuild"
 	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/cloudboss/easyto/pkg/imageconfig"
+	"github.com/cloudboss/easyto/pkg/login"
+	"github.com/cloudboss/easyto/pkg/privesc"
 	"github.com/cloudboss/easyto/pkg/sourceami"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
@@ -25,155 +30,75 @@ var (
 		PreRunE: func(cmd *cobra.Command, args []string) error {
 			cmd.SilenceUsage = true
 
-			assetDir, err := expandPath(amiCfg.assetDir)
+			err := loadConfigFile(cmd.Flags(), amiCfg.configFile, amiCfg.profile)
 			if err != nil {
-				return fmt.Errorf("failed to expand asset directory path: %w", err)
+				return err
 			}
-			if _, err = os.Stat(assetDir); os.IsNotExist(err) {
-				return fmt.Errorf("asset directory does not exist: %s", assetDir)
-			}
-			amiCfg.assetDir = assetDir
-
-			packerDir, err := expandPath(amiCfg.packerDir)
-			if err != nil {
-				return fmt.Errorf("failed to expand packer directory path: %w", err)
-			}
-			if _, err = os.Stat(packerDir); os.IsNotExist(err) {
-				return fmt.Errorf("packer directory does not exist: %s", packerDir)
-			}
-			amiCfg.packerDir = packerDir
-
-			svcErr := validateServices(amiCfg.services)
-			sshErr := validateSSHInterface(amiCfg.sshInterface)
-			modeErr := validateBuilderImageMode(amiCfg.builderImageMode, amiCfg.builderImage)
-			return errors.Join(svcErr, sshErr, modeErr)
+			return validateAMIConfig(cmd.Flags().Changed, amiCfg)
 		},
 		RunE: func(cmd *cobra.Command, args []string) error {
-			ctx := context.Background()
-
-			resp, err := sourceami.Resolve(ctx, amiCfg.builderImage, constants.ETVersion)
-			if err != nil {
-				return fmt.Errorf("failed to resolve builder AMI: %w", err)
-			}
-
-			if amiCfg.builderImage != "" && amiCfg.builderImageMode == "" {
-				fmt.Println("No --builder-image-mode specified, defaulting to slow mode")
-			}
-
-			if amiCfg.builderImageMode != "" {
-				switch amiCfg.builderImageMode {
-				case "fast":
-					resp.Mode = sourceami.ModeFast
-				case "slow":
-					resp.Mode = sourceami.ModeSlow
-				}
-			}
-
-			var packerSubdir, sshUsername string
-			switch resp.Mode {
-			case sourceami.ModeFast:
-				packerSubdir = "fast"
-				sshUsername = "cloudboss"
-			case sourceami.ModeSlow:
-				packerSubdir = "slow"
-				sshUsername = "admin"
-				if amiCfg.builderImage == "" {
-					fmt.Printf("Builder AMI %s%s not found, falling back to slow mode\n",
-						constants.AMIPatternCloudboss, constants.ETVersion)
-				}
-			}
-
-			if amiCfg.builderImage != "" {
-				sshUsername = amiCfg.builderImageLoginUser
-			}
-
-			if amiCfg.debug {
-				fmt.Printf("Using %s path with AMI %s\n", packerSubdir, resp.AMI)
-			}
-
-			quotedServices := bytes.NewBufferString("")
-			err = json.NewEncoder(quotedServices).Encode(amiCfg.services)
-			if err != nil {
-				return fmt.Errorf("unexpected value for services: %w", err)
-			}
-
-			quotedTags := bytes.NewBufferString("")
-			err = json.NewEncoder(quotedTags).Encode(parseTags(amiCfg.tags))
-			if err != nil {
-				return fmt.Errorf("unexpected value for tags: %w", err)
-			}
-
-			packerArgs := []string{
-				"build",
-				"-var", fmt.Sprintf("ami_name=%s", amiCfg.amiName),
-				"-var", fmt.Sprintf("ami_tags=%s", quotedTags.String()),
-				"-var", fmt.Sprintf("builder_instance_type=%s", amiCfg.builderInstanceType),
-				"-var", fmt.Sprintf("container_image=%s", amiCfg.containerImage),
-				"-var", fmt.Sprintf("debug=%t", amiCfg.debug),
-				"-var", fmt.Sprintf("is_public=%t", amiCfg.public),
-				"-var", fmt.Sprintf("login_user=%s", amiCfg.loginUser),
-				"-var", fmt.Sprintf("login_shell=%s", amiCfg.loginShell),
-				"-var", fmt.Sprintf("root_device_name=%s", amiCfg.rootDeviceName),
-				"-var", fmt.Sprintf("root_vol_size=%d", amiCfg.size),
-				"-var", fmt.Sprintf("services=%s", quotedServices.String()),
-				"-var", fmt.Sprintf("source_ami=%s", resp.AMI),
-				"-var", fmt.Sprintf("ssh_interface=%s", amiCfg.sshInterface),
-				"-var", fmt.Sprintf("ssh_username=%s", sshUsername),
-				"-var", fmt.Sprintf("subnet_id=%s", amiCfg.subnetID),
-			}
-
-			if resp.Mode == sourceami.ModeSlow {
-				packerArgs = append(packerArgs, "-var", fmt.Sprintf("asset_dir=%s", amiCfg.assetDir))
-			}
-
-			packerArgs = append(packerArgs, "build.pkr.hcl")
-
-			packerWorkDir := filepath.Join(amiCfg.packerDir, packerSubdir)
-			packer := exec.Command(filepath.Join(amiCfg.packerDir, "packer"), packerArgs...)
-
-			packer.Stdin = os.Stdin
-			packer.Stdout = os.Stdout
-			packer.Stderr = os.Stderr
-
-			packer.Dir = packerWorkDir
-
-			packer.Env = append(os.Environ(), []string{
-				"CHECKPOINT_DISABLE=1",
-				fmt.Sprintf("PACKER_PLUGIN_PATH=%s/plugins", amiCfg.packerDir),
-			}...)
-
-			if amiCfg.debug {
-				fmt.Printf("%+v\n", packer)
+			ctx, stop := signalContext()
+			defer stop()
+
+			// The AMI may have been created even if copying or sharing it
+			// failed, so the result is shown along with the error.
+			result, err := buildAMI(ctx, amiCfg, os.Stdout)
+			if result != nil {
+				printResult(os.Stdout, result)
 			}
-
-			cmd.SilenceUsage = true
-
-			return packer.Run()
+			return err
 		},
 	}
 )
 
 type amiConfig struct {
-	amiName               string
-	assetDir              string
-	builderImage          string
-	builderImageLoginUser string
-	builderImageMode      string
-	builderInstanceType   string
-	containerImage        string
-	debug                 bool
-	loginUser             string
-	loginShell            string
-	packerDir             string
-	public                bool
-	rootDeviceName        string
-	services              []string
-	size                  int
-	sshInterface          string
-	subnetID              string
-	tags                  []string
+	amiName                string
+	assetDir               string
+	builderConnection      string
+	builderImage           string
+	builderImageLoginUser  string
+	builderImageMode       string
+	builderInstanceProfile string
+	builderInstanceType    string
+	changes                []string
+	configFile             string
+	containerImage         string
+	copyToRegions          []string
+	debug                  bool
+	encrypt                bool
+	iops                   int
+	kmsKeyID               string
+	local                  string
+	lockUsers              []string
+	loginCheck             string
+	loginPasswordFile      string
+	loginPasswordHash      string
+	loginPasswordPlain     string
+	loginUser              string
+	loginShell             string
+	privilegeEscalation    string
+	profile                string
+	public                 bool
+	removeUsers            []string
+	rootDeviceName         string
+	services               []string
+	shareAccounts          []string
+	shareOrgARNs           []string
+	shareOUARNs            []string
+	sidecarImages          []string
+	size                   int
+	sshInterface           string
+	subnetID               string
+	tags                   []string
+	throughput             int
+	users                  []login.UserSpec
+	usersFile              string
+	volumeType             string
 }
 
+// defaultAssetDir is the asset directory of the release the executable is in.
+var defaultAssetDir string
+
 func init() {
 	this, err := os.Executable()
 	if err != nil {
@@ -186,71 +111,146 @@ func init() {
 		fmt.Fprintf(os.Stderr, "Unable to get real path of executable: %s\n", err)
 		os.Exit(1)
 	}
-	assetDir, err := filepath.Abs(filepath.Join(filepath.Dir(realThis), "..", "assets"))
+	defaultAssetDir, err = filepath.Abs(filepath.Join(filepath.Dir(realThis), "..", "assets"))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to get absolute path of asset directory: %s\n", err)
 		os.Exit(1)
 	}
-	packerDir, err := filepath.Abs(filepath.Join(filepath.Dir(realThis), "..", "packer"))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to get absolute path of packer directory: %s\n", err)
-		os.Exit(1)
-	}
 
-	AMICmd.Flags().StringVarP(&amiCfg.amiName, "ami-name", "a", "", "Name of the AMI.")
-	AMICmd.MarkFlagRequired("ami-name")
+	addAMIFlags(AMICmd, amiCfg)
+	AMICmd.AddCommand(AMIBuildAllCmd)
+}
+
+// addAMIFlags adds the flags of the ami subcommand to cmd, with their values
+// stored in cfg.
+func addAMIFlags(cmd *cobra.Command, cfg *amiConfig) {
+	flags := cmd.Flags()
 
-	AMICmd.Flags().StringVarP(&amiCfg.assetDir, "asset-directory", "A", assetDir,
+	flags.StringVarP(&cfg.amiName, "ami-name", "a", "", "Name of the AMI.")
+	cmd.MarkFlagRequired("ami-name")
+
+	flags.StringVarP(&cfg.assetDir, "asset-directory", "A", defaultAssetDir,
 		"Path to a directory containing asset files.")
 
-	AMICmd.Flags().StringVar(&amiCfg.builderImage, "builder-image", "",
+	flags.StringVar(&cfg.builderImage, "builder-image", "",
 		"AMI ID or name pattern for the builder image. If not specified, uses the easyto builder AMI matching the current version, falling back to Debian.")
 
-	AMICmd.Flags().StringVar(&amiCfg.builderImageLoginUser, "builder-image-login-user", "cloudboss",
+	flags.StringVar(&cfg.builderImageLoginUser, "builder-image-login-user", "cloudboss",
 		"SSH login user for the builder image when using --builder-image.")
 
-	AMICmd.Flags().StringVar(&amiCfg.builderImageMode, "builder-image-mode", "",
+	flags.StringVar(&cfg.builderImageMode, "builder-image-mode", "",
 		"Build mode to use with --builder-image. Must be 'fast' or 'slow'. Fast mode assumes easyto is pre-installed on the builder image.")
 
-	AMICmd.Flags().StringVar(&amiCfg.builderInstanceType, "builder-instance-type", "t3.micro",
+	flags.StringVar(&cfg.builderConnection, "builder-connection", amibuild.ConnectionSSH,
+		"How to run commands on the builder instance. Must be 'ssh' or 'ssm'.")
+
+	flags.StringVar(&cfg.builderInstanceProfile, "builder-instance-profile", "",
+		"Name or ARN of an instance profile for the builder instance. Required with --builder-connection=ssm.")
+
+	flags.StringVar(&cfg.builderInstanceType, "builder-instance-type", "t3.micro",
 		"EC2 instance type to use for builder instance.")
 
-	AMICmd.Flags().StringVarP(&amiCfg.packerDir, "packer-directory", "P", packerDir,
-		"Path to a directory containing packer and its configuration.")
+	flags.StringArrayVar(&cfg.changes, "change", []string{},
+		"Dockerfile-style instruction to apply to the container image config, one of CMD, ENTRYPOINT, ENV, USER, or WORKDIR. May be specified multiple times.")
+
+	flags.StringVar(&cfg.configFile, "config", "",
+		"Path to a configuration file to load options from. Flags given on the command line override options in the file.")
+
+	flags.StringVar(&cfg.profile, "profile", "",
+		"Name of the profile in the configuration file to use in addition to its defaults.")
 
-	AMICmd.Flags().StringVarP(&amiCfg.containerImage, "container-image", "c", "",
-		"Name of the container image.")
-	AMICmd.MarkFlagRequired("container-image")
+	flags.StringVarP(&cfg.containerImage, "container-image", "c", "",
+		"Name of the container image. Required unless --local is given, in which case it is only used to tag the AMI.")
 
-	AMICmd.Flags().IntVarP(&amiCfg.size, "size", "S", 10,
+	flags.StringSliceVar(&cfg.copyToRegions, "copy-to-region", []string{},
+		"Region to copy the AMI to after it is built. May be specified multiple times or as a comma separated list.")
+
+	flags.StringVar(&cfg.local, "local", "",
+		"Path to a raw disk image built locally with ctr2disk to upload with the EBS direct APIs instead of running a builder instance.")
+
+	flags.IntVarP(&cfg.size, "size", "S", 10,
 		"Size of the image root volume in GB.")
 
-	AMICmd.Flags().StringVar(&amiCfg.loginUser, "login-user", "cloudboss",
+	flags.StringVar(&cfg.volumeType, "volume-type", "gp2",
+		"EBS volume type of the image root volume, one of 'gp2', 'gp3', 'io1', 'io2', or 'standard'.")
+
+	flags.IntVar(&cfg.iops, "iops", 0,
+		"IOPS of the image root volume. Required for io1 and io2, optional for gp3.")
+
+	flags.IntVar(&cfg.throughput, "throughput", 0,
+		"Throughput of the image root volume in MiB/s. Only for gp3.")
+
+	flags.BoolVar(&cfg.encrypt, "encrypt", false,
+		"Encrypt the snapshot of the image root volume.")
+
+	flags.StringVar(&cfg.kmsKeyID, "kms-key-id", "",
+		"ID, alias, or ARN of the KMS key to encrypt the snapshot with instead of the default EBS key. Requires --encrypt.")
+
+	flags.StringVar(&cfg.loginCheck, "login-check", "warn",
+		"Policy for problems found in the container image's login files, one of 'warn' or 'fail'.")
+
+	flags.StringVar(&cfg.loginPasswordHash, "login-password-hash", "",
+		"Password hash in crypt format to set for the login user. Requires the ssh service.")
+
+	flags.StringVar(&cfg.loginPasswordFile, "login-password-file", "",
+		"Path to a file containing a password hash in crypt format to set for the login user. Requires the ssh service.")
+
+	flags.StringVar(&cfg.loginPasswordPlain, "login-password-plaintext-file", "",
+		"Path to a file containing a plaintext password to hash with SHA-512 crypt and set for the login user. Requires the ssh service.")
+
+	flags.StringVar(&cfg.privilegeEscalation, "privilege-escalation", privesc.MethodNone,
+		"Allow the login user to run commands as root without a password, one of 'none', 'auto', 'sudo', or 'doas'. Requires the ssh service.")
+
+	flags.StringVar(&cfg.loginUser, "login-user", "cloudboss",
 		"Login user to create in the VM image if ssh service is enabled.")
 
 	loginShell := filepath.Join(constants.DirETBin, "sh")
-	AMICmd.Flags().StringVar(&amiCfg.loginShell, "login-shell", loginShell,
+	flags.StringVar(&cfg.loginShell, "login-shell", loginShell,
 		"Shell to use for the login user if ssh service is enabled.")
 
-	AMICmd.Flags().StringVar(&amiCfg.rootDeviceName, "root-device-name", "/dev/xvda",
+	flags.StringSliceVar(&cfg.lockUsers, "lock-users", []string{},
+		"Comma separated list of users in the container image whose passwords will be locked.")
+
+	flags.StringSliceVar(&cfg.removeUsers, "remove-users", []string{},
+		"Comma separated list of users to remove from the container image.")
+
+	flags.StringVar(&cfg.rootDeviceName, "root-device-name", "/dev/xvda",
 		"Name of the AMI root device.")
 
-	AMICmd.Flags().StringSliceVar(&amiCfg.services, "services", []string{"chrony"},
+	flags.StringSliceVar(&cfg.services, "services", []string{"chrony"},
 		"Comma separated list of services to enable [chrony,ssh]. Use an empty string to disable all services.")
 
-	AMICmd.Flags().StringVarP(&amiCfg.sshInterface, "ssh-interface", "i", "public_ip",
+	flags.StringArrayVar(&cfg.sidecarImages, "sidecar-image", []string{},
+		"Sidecar container image to merge into the AMI in the form [name=]image. May be specified multiple times.")
+
+	flags.StringSliceVar(&cfg.shareAccounts, "share-with-account", []string{},
+		"AWS account ID to share the AMI and its snapshots with. May be specified multiple times or as a comma separated list.")
+
+	flags.StringSliceVar(&cfg.shareOrgARNs, "share-with-org-arn", []string{},
+		"ARN of an AWS organization to share the AMI with. May be specified multiple times or as a comma separated list.")
+
+	flags.StringSliceVar(&cfg.shareOUARNs, "share-with-ou-arn", []string{},
+		"ARN of an AWS organizational unit to share the AMI with. May be specified multiple times or as a comma separated list.")
+
+	flags.StringVarP(&cfg.sshInterface, "ssh-interface", "i", "public_ip",
 		"The interface for ssh connection to the builder. Must be one of 'public_ip' or 'private_ip'.")
 
-	AMICmd.Flags().StringVarP(&amiCfg.subnetID, "subnet-id", "s", "",
-		"ID of the subnet in which to run the image builder.")
-	AMICmd.MarkFlagRequired("subnet-id")
+	flags.StringVarP(&cfg.subnetID, "subnet-id", "s", "",
+		"ID of the subnet in which to run the image builder. Required unless --local is given.")
 
-	AMICmd.Flags().BoolVar(&amiCfg.debug, "debug", false, "Enable debug output.")
+	flags.StringVar(&cfg.usersFile, "users-file", "",
+		"Path to a YAML file defining login users to create in the AMI. Requires the ssh service.")
 
-	AMICmd.Flags().BoolVar(&amiCfg.public, "public", false, "Make the AMI and its snapshots public.")
+	flags.BoolVar(&cfg.debug, "debug", false, "Enable debug output.")
 
-	AMICmd.Flags().StringArrayVar(&amiCfg.tags, "tag", []string{},
+	flags.BoolVar(&cfg.public, "public", false, "Make the AMI and its snapshots public.")
+
+	flags.StringArrayVar(&cfg.tags, "tag", []string{},
 		"Tag to apply to the AMI in the form key=value. May be specified multiple times. If no '=' is given, the tag has no value.")
+
+	for _, group := range amiExclusiveFlags {
+		cmd.MarkFlagsMutuallyExclusive(group...)
+	}
 }
 
 func expandPath(pth string) (string, error) {
@@ -269,6 +269,107 @@ func expandPath(pth string) (string, error) {
 	return filepath.Abs(expanded)
 }
 
+// validateAMIConfig validates the options of the ami subcommand, after any
+// configuration file has been loaded.
+func validateAMIConfig(changed func(string) bool, cfg *amiConfig) error {
+	distribution := cfg.distribution()
+	distributionErr := distribution.Validate()
+	volumeErr := validateRootVolume(cfg)
+	if len(cfg.local) > 0 {
+		return errors.Join(validateLocal(changed, cfg), distributionErr, volumeErr)
+	}
+
+	assetDir, err := expandPath(cfg.assetDir)
+	if err != nil {
+		return fmt.Errorf("failed to expand asset directory path: %w", err)
+	}
+	if _, err = os.Stat(assetDir); os.IsNotExist(err) {
+		return fmt.Errorf("asset directory does not exist: %s", assetDir)
+	}
+	cfg.assetDir = assetDir
+
+	svcErr := validateServices(cfg.services)
+	sshErr := validateSSHInterface(cfg.sshInterface)
+	connectionErr := validateBuilderConnection(cfg)
+	modeErr := validateBuilderImageMode(cfg.builderImageMode, cfg.builderImage)
+	changesErr := imageconfig.ValidateChanges(cfg.changes)
+	_, sidecarErr := imageconfig.ParseSidecars(cfg.sidecarImages)
+	loginCheckErr := validateLoginCheck(cfg.loginCheck)
+	usersErr := loadUsersFile(cfg)
+	passwordErr := loadLoginPassword(cfg)
+	privescErr := validatePrivilegeEscalation(cfg)
+	requiredErr := validateBuilderRequired(cfg)
+	return errors.Join(requiredErr, svcErr, sshErr, connectionErr, modeErr, changesErr,
+		sidecarErr, loginCheckErr, usersErr, passwordErr, privescErr, distributionErr, volumeErr)
+}
+
+// amiExclusiveFlags are the groups of ami flags that cannot be used together.
+var amiExclusiveFlags = [][]string{
+	{"login-password-hash", "login-password-file", "login-password-plaintext-file"},
+}
+
+// builderFlags configure the builder instance or ctr2disk, so they have no
+// effect when a local image is uploaded.
+var builderFlags = []string{
+	"asset-directory",
+	"builder-connection",
+	"builder-image",
+	"builder-image-login-user",
+	"builder-image-mode",
+	"builder-instance-profile",
+	"builder-instance-type",
+	"change",
+	"lock-users",
+	"login-check",
+	"login-password-file",
+	"login-password-hash",
+	"login-password-plaintext-file",
+	"login-shell",
+	"login-user",
+	"privilege-escalation",
+	"remove-users",
+	"services",
+	"sidecar-image",
+	"ssh-interface",
+	"subnet-id",
+	"users-file",
+}
+
+func validateLocal(changed func(string) bool, cfg *amiConfig) error {
+	var errs []error
+	for _, name := range builderFlags {
+		if changed(name) {
+			errs = append(errs, fmt.Errorf("--%s cannot be used with --local", name))
+		}
+	}
+
+	local, err := expandPath(cfg.local)
+	if err != nil {
+		return fmt.Errorf("failed to expand local image path: %w", err)
+	}
+	info, err := os.Stat(local)
+	switch {
+	case err != nil:
+		errs = append(errs, fmt.Errorf("failed to read local image: %w", err))
+	case !info.Mode().IsRegular():
+		errs = append(errs, fmt.Errorf("local image is not a regular file: %s", local))
+	}
+	cfg.local = local
+
+	return errors.Join(errs...)
+}
+
+func validateBuilderRequired(cfg *amiConfig) error {
+	var errs []error
+	if len(cfg.containerImage) == 0 {
+		errs = append(errs, errors.New("--container-image is required unless --local is given"))
+	}
+	if len(cfg.subnetID) == 0 {
+		errs = append(errs, errors.New("--subnet-id is required unless --local is given"))
+	}
+	return errors.Join(errs...)
+}
+
 func validateServices(services []string) error {
 	for _, svc := range services {
 		switch svc {
@@ -283,13 +384,117 @@ func validateServices(services []string) error {
 
 func validateSSHInterface(sshInterface string) error {
 	switch sshInterface {
-	case "public_ip", "private_ip":
+	case amibuild.SSHInterfacePublicIP, amibuild.SSHInterfacePrivateIP:
 		return nil
 	default:
 		return fmt.Errorf("invalid ssh interface %s", sshInterface)
 	}
 }
 
+func validateBuilderConnection(cfg *amiConfig) error {
+	switch cfg.builderConnection {
+	case amibuild.ConnectionSSH:
+		return nil
+	case amibuild.ConnectionSSM:
+		if len(cfg.builderInstanceProfile) == 0 {
+			return errors.New("--builder-connection=ssm requires --builder-instance-profile")
+		}
+		if cfg.builderImageMode == "slow" {
+			return errors.New("--builder-connection=ssm requires --builder-image-mode=fast")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid builder connection %s, must be 'ssh' or 'ssm'",
+			cfg.builderConnection)
+	}
+}
+
+func loadUsersFile(cfg *amiConfig) error {
+	if len(cfg.usersFile) == 0 {
+		return nil
+	}
+
+	usersFile, err := expandPath(cfg.usersFile)
+	if err != nil {
+		return fmt.Errorf("failed to expand users file path: %w", err)
+	}
+
+	data, err := os.ReadFile(usersFile)
+	if err != nil {
+		return fmt.Errorf("failed to read users file: %w", err)
+	}
+
+	users, err := login.ParseUsersFile(data)
+	if err != nil {
+		return err
+	}
+
+	if len(users) > 0 && !slices.Contains(cfg.services, "ssh") {
+		return errors.New("users file requires the ssh service")
+	}
+
+	cfg.users = users
+	return nil
+}
+
+func loadLoginPassword(cfg *amiConfig) error {
+	if len(cfg.loginPasswordFile) > 0 {
+		passwordFile, err := expandPath(cfg.loginPasswordFile)
+		if err != nil {
+			return fmt.Errorf("failed to expand login password file path: %w", err)
+		}
+		hash, err := login.ReadPasswordHashFile(afero.NewOsFs(), passwordFile)
+		if err != nil {
+			return err
+		}
+		cfg.loginPasswordHash = hash
+	}
+	if len(cfg.loginPasswordPlain) > 0 {
+		passwordFile, err := expandPath(cfg.loginPasswordPlain)
+		if err != nil {
+			return fmt.Errorf("failed to expand login password plaintext file path: %w", err)
+		}
+		hash, err := login.HashPasswordFile(afero.NewOsFs(), passwordFile)
+		if err != nil {
+			return err
+		}
+		cfg.loginPasswordHash = hash
+	}
+
+	if len(cfg.loginPasswordHash) == 0 {
+		return nil
+	}
+
+	if err := login.ValidatePasswordHash(cfg.loginPasswordHash); err != nil {
+		return fmt.Errorf("invalid login password hash: %w", err)
+	}
+
+	if !slices.Contains(cfg.services, "ssh") {
+		return errors.New("login password requires the ssh service")
+	}
+
+	return nil
+}
+
+func validatePrivilegeEscalation(cfg *amiConfig) error {
+	if err := privesc.ValidateMethod(cfg.privilegeEscalation); err != nil {
+		return err
+	}
+	if cfg.privilegeEscalation != privesc.MethodNone && !slices.Contains(cfg.services, "ssh") {
+		return errors.New("privilege escalation requires the ssh service")
+	}
+	return nil
+}
+
+func validateLoginCheck(loginCheck string) error {
+	switch loginCheck {
+	case "warn", "fail":
+		return nil
+	default:
+		return fmt.Errorf("invalid login check %s", loginCheck)
+	}
+}
+
 func parseTags(rawTags []string) map[string]string {
 	tags := map[string]string{}
 	for _, t := range rawTags {
@@ -317,3 +522,139 @@ func validateBuilderImageMode(mode, builderImage string) error {
 		return fmt.Errorf("invalid builder image mode %s, must be 'fast' or 'slow'", mode)
 	}
 }
+
+// buildAMI builds an AMI from cfg, writing its progress to output.
+func buildAMI(ctx context.Context, cfg *amiConfig, output io.Writer) (*amibuild.Result, error) {
+	if len(cfg.local) > 0 {
+		return amibuild.Build(ctx, amibuild.Config{
+			AMIName:        cfg.amiName,
+			ContainerImage: cfg.containerImage,
+			LocalImage:     cfg.local,
+			RootDeviceName: cfg.rootDeviceName,
+			VolumeSize:     int32(cfg.size),
+			RootVolume:     cfg.rootVolume(),
+			Public:         cfg.public,
+			Distribution:   cfg.distribution(),
+			Tags:           parseTags(cfg.tags),
+			Output:         output,
+		})
+	}
+
+	resp, err := sourceami.Resolve(ctx, cfg.builderImage, constants.ETVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve builder AMI: %w", err)
+	}
+
+	if cfg.builderImage != "" && cfg.builderImageMode == "" {
+		fmt.Fprintln(output, "No --builder-image-mode specified, defaulting to slow mode")
+	}
+
+	if cfg.builderImageMode != "" {
+		switch cfg.builderImageMode {
+		case "fast":
+			resp.Mode = sourceami.ModeFast
+		case "slow":
+			resp.Mode = sourceami.ModeSlow
+		}
+	}
+
+	var sshUsername string
+	switch resp.Mode {
+	case sourceami.ModeFast:
+		sshUsername = "cloudboss"
+	case sourceami.ModeSlow:
+		sshUsername = "admin"
+		if cfg.builderImage == "" {
+			fmt.Fprintf(output, "Builder AMI %s%s not found, falling back to slow mode\n",
+				constants.AMIPatternCloudboss, constants.ETVersion)
+		}
+	}
+
+	if cfg.builderImage != "" {
+		sshUsername = cfg.builderImageLoginUser
+	}
+
+	if cfg.debug {
+		fmt.Fprintf(output, "Using builder AMI %s\n", resp.AMI)
+	}
+
+	return amibuild.Build(ctx, amibuild.Config{
+		AMIName:         cfg.amiName,
+		ContainerImage:  cfg.containerImage,
+		SourceAMI:       resp.AMI,
+		Mode:            resp.Mode,
+		AssetDir:        cfg.assetDir,
+		InstanceType:    cfg.builderInstanceType,
+		InstanceProfile: cfg.builderInstanceProfile,
+		SubnetID:        cfg.subnetID,
+		RootDeviceName:  cfg.rootDeviceName,
+		VolumeSize:      int32(cfg.size),
+		RootVolume:      cfg.rootVolume(),
+		Public:          cfg.public,
+		Distribution:    cfg.distribution(),
+		Tags:            parseTags(cfg.tags),
+		Connection:      cfg.builderConnection,
+		SSHInterface:    cfg.sshInterface,
+		SSHUsername:     sshUsername,
+		Ctr2Disk: amibuild.Ctr2DiskOptions{
+			Changes:             cfg.changes,
+			LockUsers:           cfg.lockUsers,
+			LoginCheck:          cfg.loginCheck,
+			LoginPasswordHash:   cfg.loginPasswordHash,
+			LoginShell:          cfg.loginShell,
+			LoginUser:           cfg.loginUser,
+			PrivilegeEscalation: cfg.privilegeEscalation,
+			RemoveUsers:         cfg.removeUsers,
+			Services:            cfg.services,
+			SidecarImages:       cfg.sidecarImages,
+			Users:               cfg.users,
+			Debug:               cfg.debug,
+		},
+		Output: output,
+	})
+}
+
+func (c *amiConfig) distribution() amibuild.Distribution {
+	return amibuild.Distribution{
+		Regions:                c.copyToRegions,
+		Accounts:               c.shareAccounts,
+		OrganizationARNs:       c.shareOrgARNs,
+		OrganizationalUnitARNs: c.shareOUARNs,
+	}
+}
+
+func (c *amiConfig) rootVolume() amibuild.RootVolume {
+	return amibuild.RootVolume{
+		Type:       c.volumeType,
+		IOPS:       int32(c.iops),
+		Throughput: int32(c.throughput),
+		Encrypted:  c.encrypt,
+		KMSKeyID:   c.kmsKeyID,
+	}
+}
+
+// validateRootVolume checks the root volume options against the other
+// options they depend on.
+func validateRootVolume(cfg *amiConfig) error {
+	buildCfg := amibuild.Config{
+		VolumeSize:   int32(cfg.size),
+		RootVolume:   cfg.rootVolume(),
+		Public:       cfg.public,
+		Distribution: cfg.distribution(),
+		LocalImage:   cfg.local,
+	}
+	return buildCfg.ValidateRootVolume()
+}
+
+// printResult prints the AMI that was built, and its ID in each region if it
+// was copied to other regions.
+func printResult(w io.Writer, result *amibuild.Result) {
+	fmt.Fprintf(w, "Created AMI %s\n", result.AMI)
+	if len(result.Regions) < 2 {
+		return
+	}
+	fmt.Fprintln(w, "AMIs by region:")
+	for _, region := range slices.Sorted(maps.Keys(result.Regions)) {
+		fmt.Fprintf(w, "  %s: %s\n", region, result.Regions[region])
+	}
+}
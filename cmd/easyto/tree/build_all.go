@@ -0,0 +1,128 @@
+package tree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudboss/easyto/pkg/batch"
+	"github.com/cloudboss/easyto/pkg/buildconfig"
+	"github.com/spf13/cobra"
+)
+
+var (
+	buildAllCfg    = &buildAllConfig{}
+	AMIBuildAllCmd = &cobra.Command{
+		Use:   "build-all manifest",
+		Short: "Build many AMIs from a manifest",
+		Long: `Build the AMIs listed in a manifest, running several builds at a time. The
+output of each build is prefixed with its AMI name, and a summary of all
+builds is shown at the end. The command fails if any build fails.`,
+		Args: cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			if buildAllCfg.concurrency < 1 {
+				return errors.New("--concurrency must be at least 1")
+			}
+			builds, err := loadManifest(args[0])
+			if err != nil {
+				return err
+			}
+			buildAllCfg.builds = builds
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signalContext()
+			defer stop()
+
+			jobs := make([]batch.Job, len(buildAllCfg.builds))
+			for i, cfg := range buildAllCfg.builds {
+				jobs[i] = batch.Job{
+					Name: cfg.amiName,
+					Run: func(ctx context.Context, output io.Writer) (string, error) {
+						result, err := buildAMI(ctx, cfg, output)
+						if result == nil {
+							return "", err
+						}
+						printResult(output, result)
+						return result.AMI, err
+					},
+				}
+			}
+
+			results := batch.Run(ctx, jobs, buildAllCfg.concurrency, os.Stdout)
+
+			fmt.Println()
+			if err := batch.WriteSummary(os.Stdout, results); err != nil {
+				return fmt.Errorf("failed to write summary: %w", err)
+			}
+			if failed := batch.Failed(results); failed > 0 {
+				return fmt.Errorf("%d of %d builds failed", failed, len(results))
+			}
+			return nil
+		},
+	}
+)
+
+type buildAllConfig struct {
+	builds      []*amiConfig
+	concurrency int
+}
+
+func init() {
+	AMIBuildAllCmd.Flags().IntVarP(&buildAllCfg.concurrency, "concurrency", "j", 4,
+		"Maximum number of builds to run at the same time.")
+}
+
+// loadManifest returns the configuration of each build in the manifest at
+// path, validated the same as the flags of the ami subcommand.
+func loadManifest(path string) ([]*amiConfig, error) {
+	path, err := expandPath(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand manifest path: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	manifest, err := buildconfig.LoadManifest(data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	builds := make([]*amiConfig, len(manifest))
+	names := map[string]int{}
+	var errs []error
+	for i, options := range manifest {
+		cfg := &amiConfig{}
+		cmd := &cobra.Command{}
+		addAMIFlags(cmd, cfg)
+
+		err := applyOptions(cmd.Flags(), options, filepath.Dir(path))
+		if err == nil {
+			err = errors.Join(cmd.ValidateRequiredFlags(), cmd.ValidateFlagGroups())
+		}
+		if err == nil {
+			err = validateAMIConfig(cmd.Flags().Changed, cfg)
+		}
+		if err == nil {
+			if j, ok := names[cfg.amiName]; ok {
+				err = fmt.Errorf("ami-name %s is the same as build %d", cfg.amiName, j+1)
+			}
+			names[cfg.amiName] = i
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid build %d in manifest: %w", i+1, err))
+			continue
+		}
+		builds[i] = cfg
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return builds, nil
+}
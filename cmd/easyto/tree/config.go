@@ -0,0 +1,191 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cloudboss/easyto/pkg/buildconfig"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configPrintOptions = map[string]any{}
+	ConfigCmd          = &cobra.Command{
+		Use:   "config",
+		Short: "Work with build configuration files",
+	}
+	ConfigPrintCmd = &cobra.Command{
+		Use:   "print",
+		Short: "Print the effective options of the ami subcommand",
+		Long: `Print the options the ami subcommand would use when given the same flags,
+after loading the configuration file and profile given with --config and
+--profile. The output can be used as a profile in a configuration file.`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			err := loadConfigFile(cmd.Flags(), amiCfg.configFile, amiCfg.profile)
+			if err != nil {
+				return err
+			}
+			// Validation expands paths and hashes passwords, so the options
+			// are captured before it.
+			configPrintOptions = effectiveOptions(cmd.Flags())
+			return validateAMIConfig(cmd.Flags().Changed, amiCfg)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			encoder := yaml.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent(2)
+			if err := encoder.Encode(configPrintOptions); err != nil {
+				return fmt.Errorf("failed to encode configuration: %w", err)
+			}
+			return encoder.Close()
+		},
+	}
+
+	// configPathOptions are options whose values are paths. Relative paths
+	// in a configuration file are relative to the directory of the file.
+	configPathOptions = []string{
+		"asset-directory",
+		"local",
+		"login-password-file",
+		"login-password-plaintext-file",
+		"users-file",
+	}
+)
+
+func init() {
+	// This runs after the init of ami.go, so the ami flags are defined. The
+	// flags are shared, so they set the same configuration as for ami.
+	ConfigPrintCmd.Flags().AddFlagSet(AMICmd.Flags())
+
+	ConfigCmd.AddCommand(ConfigPrintCmd)
+}
+
+// loadConfigFile sets the flags in flags that were not given on the command
+// line from the options in the configuration file at path.
+func loadConfigFile(flags *pflag.FlagSet, path, profile string) error {
+	if len(path) == 0 {
+		if len(profile) > 0 {
+			return errors.New("--profile requires --config")
+		}
+		return nil
+	}
+
+	path, err := expandPath(path)
+	if err != nil {
+		return fmt.Errorf("failed to expand configuration file path: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %w", err)
+	}
+	options, err := buildconfig.Load(data, profile, nil)
+	if err != nil {
+		return err
+	}
+	if err := applyOptions(flags, options, filepath.Dir(path)); err != nil {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyOptions sets the flags in flags that were not given on the command line
+// from options. Relative paths in options are relative to dir.
+func applyOptions(flags *pflag.FlagSet, options buildconfig.Options, dir string) error {
+	commandLine := map[string]bool{}
+	flags.Visit(func(flag *pflag.Flag) {
+		commandLine[flag.Name] = true
+	})
+
+	var errs []error
+	for _, name := range options.Names() {
+		flag := flags.Lookup(name)
+		if flag == nil || name == "config" || name == "profile" || name == "help" {
+			errs = append(errs, fmt.Errorf("unknown option %s", name))
+			continue
+		}
+		if commandLine[name] || exclusiveChanged(name, commandLine) {
+			continue
+		}
+		values := options[name]
+		if slices.Contains(configPathOptions, name) {
+			for i, value := range values {
+				if !filepath.IsAbs(value) && !strings.HasPrefix(value, "~/") {
+					values[i] = filepath.Join(dir, value)
+				}
+			}
+		}
+		if err := setFlag(flag, values); err != nil {
+			errs = append(errs, fmt.Errorf("invalid option %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// exclusiveChanged returns true if a flag that is mutually exclusive with the
+// flag name was given on the command line, so that it overrides name in the
+// file.
+func exclusiveChanged(name string, commandLine map[string]bool) bool {
+	for _, group := range amiExclusiveFlags {
+		if !slices.Contains(group, name) {
+			continue
+		}
+		for _, other := range group {
+			if other != name && commandLine[other] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func setFlag(flag *pflag.Flag, values []string) error {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		if err := slice.Replace(values); err != nil {
+			return err
+		}
+	} else {
+		if len(values) != 1 {
+			return fmt.Errorf("takes a single value, found %d", len(values))
+		}
+		if err := flag.Value.Set(values[0]); err != nil {
+			return err
+		}
+	}
+	flag.Changed = true
+	return nil
+}
+
+// effectiveOptions returns the values of flags, other than those that load a
+// configuration file, by name.
+func effectiveOptions(flags *pflag.FlagSet) map[string]any {
+	options := map[string]any{}
+	flags.VisitAll(func(flag *pflag.Flag) {
+		switch flag.Name {
+		case "config", "profile", "help":
+			return
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			options[flag.Name] = slices.Clone(slice.GetSlice())
+			return
+		}
+		switch flag.Value.Type() {
+		case "bool":
+			value, _ := strconv.ParseBool(flag.Value.String())
+			options[flag.Name] = value
+		case "int":
+			value, _ := strconv.Atoi(flag.Value.String())
+			options[flag.Name] = value
+		default:
+			options[flag.Name] = flag.Value.String()
+		}
+	})
+	return options
+}
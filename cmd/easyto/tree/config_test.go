@@ -0,0 +1,283 @@
+package tree
+
+import (
+	"testing"
+
+	"github.com/cloudboss/easyto/pkg/buildconfig"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAMIFlags returns the flags of the ami subcommand after parsing args.
+func testAMIFlags(t *testing.T, args ...string) (*pflag.FlagSet, *amiConfig) {
+	cfg := &amiConfig{}
+	cmd := &cobra.Command{}
+	addAMIFlags(cmd, cfg)
+	require.NoError(t, cmd.Flags().Parse(args))
+	return cmd.Flags(), cfg
+}
+
+func TestApplyOptions(t *testing.T) {
+	testCases := []struct {
+		description string
+		args        []string
+		options     buildconfig.Options
+		check       func(t *testing.T, cfg *amiConfig)
+		errContains []string
+	}{
+		{
+			description: "Options from the file",
+			options: buildconfig.Options{
+				"ami-name":       {"app"},
+				"services":       {"chrony", "ssh"},
+				"size":           {"20"},
+				"public":         {"true"},
+				"copy-to-region": {"us-west-2"},
+			},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, "app", cfg.amiName)
+				assert.Equal(t, []string{"chrony", "ssh"}, cfg.services)
+				assert.Equal(t, 20, cfg.size)
+				assert.True(t, cfg.public)
+				assert.Equal(t, []string{"us-west-2"}, cfg.copyToRegions)
+			},
+		},
+		{
+			description: "Command line overrides the file",
+			args:        []string{"--ami-name", "cli", "--services", "ssh", "--size", "30"},
+			options: buildconfig.Options{
+				"ami-name":    {"file"},
+				"services":    {"chrony"},
+				"size":        {"20"},
+				"volume-type": {"gp3"},
+			},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, "cli", cfg.amiName)
+				assert.Equal(t, []string{"ssh"}, cfg.services)
+				assert.Equal(t, 30, cfg.size)
+				assert.Equal(t, "gp3", cfg.volumeType)
+			},
+		},
+		{
+			description: "Command line overrides a mutually exclusive option",
+			args:        []string{"--login-password-hash", "$6$salt$hash"},
+			options: buildconfig.Options{
+				"login-password-file": {"password"},
+			},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, "$6$salt$hash", cfg.loginPasswordHash)
+				assert.Empty(t, cfg.loginPasswordFile)
+			},
+		},
+		{
+			description: "Mutually exclusive option from the file",
+			args:        []string{"--login-password-plaintext-file", "/secret"},
+			options: buildconfig.Options{
+				"login-password-hash": {"$6$salt$hash"},
+				"login-password-file": {"password"},
+			},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, "/secret", cfg.loginPasswordPlain)
+				assert.Empty(t, cfg.loginPasswordHash)
+				assert.Empty(t, cfg.loginPasswordFile)
+			},
+		},
+		{
+			description: "Relative paths are relative to the file",
+			options: buildconfig.Options{
+				"asset-directory":     {"assets"},
+				"local":               {"../images/disk.raw"},
+				"login-password-file": {"/etc/easyto/password"},
+				"users-file":          {"~/users.yaml"},
+				"container-image":     {"app/worker"},
+			},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, "/config/assets", cfg.assetDir)
+				assert.Equal(t, "/images/disk.raw", cfg.local)
+				assert.Equal(t, "/etc/easyto/password", cfg.loginPasswordFile)
+				assert.Equal(t, "~/users.yaml", cfg.usersFile)
+				assert.Equal(t, "app/worker", cfg.containerImage)
+			},
+		},
+		{
+			description: "Relative paths on the command line are unchanged",
+			args:        []string{"--local", "disk.raw"},
+			options: buildconfig.Options{
+				"local": {"other.raw"},
+			},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, "disk.raw", cfg.local)
+			},
+		},
+		{
+			description: "Invalid options",
+			options: buildconfig.Options{
+				"ami-names": {"app"},
+				"config":    {"other.yaml"},
+				"profile":   {"prod"},
+				"size":      {"large"},
+				"subnet-id": {"subnet-1", "subnet-2"},
+			},
+			errContains: []string{
+				"unknown option ami-names",
+				"unknown option config",
+				"unknown option profile",
+				"invalid option size",
+				"invalid option subnet-id: takes a single value, found 2",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			flags, cfg := testAMIFlags(t, tc.args...)
+			err := applyOptions(flags, tc.options, "/config")
+			if len(tc.errContains) > 0 {
+				for _, s := range tc.errContains {
+					assert.ErrorContains(t, err, s)
+				}
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestApplyOptionsSatisfiesRequiredFlags(t *testing.T) {
+	cfg := &amiConfig{}
+	cmd := &cobra.Command{}
+	addAMIFlags(cmd, cfg)
+	require.Error(t, cmd.ValidateRequiredFlags())
+
+	err := applyOptions(cmd.Flags(), buildconfig.Options{"ami-name": {"app"}}, "/config")
+	require.NoError(t, err)
+	assert.NoError(t, cmd.ValidateRequiredFlags())
+}
+
+func TestExclusiveChanged(t *testing.T) {
+	testCases := []struct {
+		description string
+		name        string
+		commandLine map[string]bool
+		result      bool
+	}{
+		{
+			description: "Other flag in group given",
+			name:        "login-password-file",
+			commandLine: map[string]bool{"login-password-hash": true},
+			result:      true,
+		},
+		{
+			description: "Same flag given",
+			name:        "login-password-file",
+			commandLine: map[string]bool{"login-password-file": true},
+			result:      false,
+		},
+		{
+			description: "Unrelated flag given",
+			name:        "login-password-file",
+			commandLine: map[string]bool{"login-user": true},
+			result:      false,
+		},
+		{
+			description: "Flag not in a group",
+			name:        "login-user",
+			commandLine: map[string]bool{"login-password-hash": true},
+			result:      false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.Equal(t, tc.result, exclusiveChanged(tc.name, tc.commandLine))
+		})
+	}
+}
+
+func TestSetFlag(t *testing.T) {
+	testCases := []struct {
+		description string
+		name        string
+		values      []string
+		check       func(t *testing.T, cfg *amiConfig)
+		errContains string
+	}{
+		{
+			description: "String",
+			name:        "subnet-id",
+			values:      []string{"subnet-123"},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, "subnet-123", cfg.subnetID)
+			},
+		},
+		{
+			description: "Slice replaces default",
+			name:        "services",
+			values:      []string{"ssh"},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, []string{"ssh"}, cfg.services)
+			},
+		},
+		{
+			description: "Array",
+			name:        "tag",
+			values:      []string{"team=platform", "env=prod"},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.Equal(t, []string{"team=platform", "env=prod"}, cfg.tags)
+			},
+		},
+		{
+			description: "Bool",
+			name:        "encrypt",
+			values:      []string{"true"},
+			check: func(t *testing.T, cfg *amiConfig) {
+				assert.True(t, cfg.encrypt)
+			},
+		},
+		{
+			description: "Multiple values for a single value flag",
+			name:        "volume-type",
+			values:      []string{"gp2", "gp3"},
+			errContains: "takes a single value, found 2",
+		},
+		{
+			description: "Invalid int",
+			name:        "iops",
+			values:      []string{"fast"},
+			errContains: "invalid syntax",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			flags, cfg := testAMIFlags(t)
+			flag := flags.Lookup(tc.name)
+			err := setFlag(flag, tc.values)
+			if len(tc.errContains) > 0 {
+				assert.ErrorContains(t, err, tc.errContains)
+				assert.False(t, flag.Changed)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, flag.Changed)
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestEffectiveOptions(t *testing.T) {
+	flags, _ := testAMIFlags(t, "--config", "easyto.yaml", "--profile", "prod",
+		"--ami-name", "app", "--services", "chrony,ssh", "--size", "20", "--public")
+
+	options := effectiveOptions(flags)
+	assert.NotContains(t, options, "config")
+	assert.NotContains(t, options, "profile")
+	assert.NotContains(t, options, "help")
+	assert.Equal(t, "app", options["ami-name"])
+	assert.Equal(t, []string{"chrony", "ssh"}, options["services"])
+	assert.Equal(t, []string{}, options["tag"])
+	assert.Equal(t, 20, options["size"])
+	assert.Equal(t, true, options["public"])
+	assert.Equal(t, false, options["encrypt"])
+	assert.Equal(t, "gp2", options["volume-type"])
+}
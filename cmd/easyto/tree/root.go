@@ -1,6 +1,11 @@
 package tree
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/spf13/cobra"
 )
 
@@ -13,6 +18,20 @@ var (
 
 func init() {
 	RootCmd.AddCommand(AMICmd)
+	RootCmd.AddCommand(ConfigCmd)
 	RootCmd.AddCommand(CopyBuilderCmd)
+	RootCmd.AddCommand(TestCmd)
+	RootCmd.AddCommand(UserDataCmd)
+	RootCmd.AddCommand(ValidateCmd)
 	RootCmd.AddCommand(VersionCmd)
 }
+
+// signalContext returns a context that is canceled on SIGINT or SIGTERM, so
+// that commands which create AWS resources can stop and clean them up. After
+// the first signal the default handling is restored, so that a second one
+// exits immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	return ctx, stop
+}
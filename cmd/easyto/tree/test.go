@@ -0,0 +1,149 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/cloudboss/easyto/pkg/imagetest"
+	"github.com/cloudboss/easyto/pkg/userdata"
+	"github.com/spf13/cobra"
+)
+
+var (
+	testCfg = &testConfig{}
+	TestCmd = &cobra.Command{
+		Use:   "test",
+		Short: "Smoke test an AMI by launching an instance from it",
+		Long: "Smoke test an AMI by launching an instance from it and watching its console " +
+			"output until the command starts, optionally checking that a TCP port is open. " +
+			"The instance is always terminated afterwards, and the exit code is nonzero if " +
+			"the test fails.",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			var successErr, failureErr, userDataErr error
+			testCfg.successRegexp, successErr = compilePattern("success", testCfg.successPattern)
+			if len(testCfg.failurePattern) > 0 {
+				testCfg.failureRegexp, failureErr = compilePattern("failure", testCfg.failurePattern)
+			}
+			if len(testCfg.userDataFile) > 0 {
+				userDataErr = loadTestUserData(testCfg)
+			}
+			sshErr := validateSSHInterface(testCfg.sshInterface)
+			return errors.Join(successErr, failureErr, userDataErr, sshErr)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signalContext()
+			defer stop()
+
+			cfg := imagetest.Config{
+				AMI:              testCfg.ami,
+				UserData:         testCfg.userData,
+				InstanceType:     testCfg.instanceType,
+				SubnetID:         testCfg.subnetID,
+				SecurityGroupIDs: testCfg.securityGroupIDs,
+				InstanceProfile:  testCfg.instanceProfile,
+				Port:             testCfg.port,
+				Interface:        testCfg.sshInterface,
+				SuccessPattern:   testCfg.successRegexp,
+				FailurePattern:   testCfg.failureRegexp,
+				Timeout:          testCfg.timeout,
+				Output:           os.Stderr,
+			}
+			if !testCfg.quiet {
+				cfg.Console = os.Stdout
+			}
+
+			result, err := imagetest.Run(ctx, cfg)
+			if err != nil {
+				return err
+			}
+
+			cmd.Printf("Test of %s passed on instance %s\n", testCfg.ami, result.InstanceID)
+			return nil
+		},
+	}
+)
+
+type testConfig struct {
+	ami              string
+	failurePattern   string
+	failureRegexp    *regexp.Regexp
+	instanceProfile  string
+	instanceType     string
+	port             int
+	quiet            bool
+	securityGroupIDs []string
+	sshInterface     string
+	subnetID         string
+	successPattern   string
+	successRegexp    *regexp.Regexp
+	timeout          time.Duration
+	userData         []byte
+	userDataFile     string
+}
+
+func init() {
+	TestCmd.Flags().StringVar(&testCfg.ami, "ami", "", "ID of the AMI to test.")
+	TestCmd.MarkFlagRequired("ami")
+
+	TestCmd.Flags().StringVar(&testCfg.failurePattern, "failure-pattern", imagetest.DefaultFailurePattern,
+		"Regular expression matching console output that means the test failed. Set to an empty string to disable.")
+
+	TestCmd.Flags().StringVar(&testCfg.instanceProfile, "instance-profile", "",
+		"Name or ARN of an instance profile to attach to the test instance.")
+
+	TestCmd.Flags().StringVar(&testCfg.instanceType, "instance-type", "t3.micro",
+		"Instance type of the test instance.")
+
+	TestCmd.Flags().IntVar(&testCfg.port, "port", 0,
+		"TCP port that must accept a connection after the command starts for the test to pass.")
+
+	TestCmd.Flags().BoolVar(&testCfg.quiet, "quiet", false,
+		"Do not print the instance's console output.")
+
+	TestCmd.Flags().StringSliceVar(&testCfg.securityGroupIDs, "security-group-ids", []string{},
+		"IDs of security groups for the test instance. Defaults to the VPC's default security group.")
+
+	TestCmd.Flags().StringVarP(&testCfg.sshInterface, "ssh-interface", "i", imagetest.InterfacePublicIP,
+		"Interface of the test instance to connect to with --port, either public_ip or private_ip.")
+
+	TestCmd.Flags().StringVarP(&testCfg.subnetID, "subnet-id", "s", "",
+		"ID of the subnet in which to run the test instance. Defaults to a subnet in the default VPC.")
+
+	TestCmd.Flags().StringVar(&testCfg.successPattern, "success-pattern", imagetest.DefaultSuccessPattern,
+		"Regular expression matching console output that means the command started.")
+
+	TestCmd.Flags().DurationVar(&testCfg.timeout, "timeout", 10*time.Minute,
+		"How long to wait for the command to start and the port to open once the instance is running.")
+
+	TestCmd.Flags().StringVar(&testCfg.userDataFile, "user-data", "",
+		"Path to a user data file for the test instance, which is validated before it is used.")
+}
+
+func compilePattern(name, pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s pattern: %w", name, err)
+	}
+	return re, nil
+}
+
+func loadTestUserData(cfg *testConfig) error {
+	userDataFile, err := expandPath(cfg.userDataFile)
+	if err != nil {
+		return fmt.Errorf("failed to expand user data path: %w", err)
+	}
+	data, err := os.ReadFile(userDataFile)
+	if err != nil {
+		return fmt.Errorf("failed to read user data: %w", err)
+	}
+	if _, err = userdata.Parse(data); err != nil {
+		return err
+	}
+	cfg.userData = data
+	return nil
+}
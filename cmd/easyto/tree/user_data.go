@@ -0,0 +1,239 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cloudboss/easyto/pkg/userdata"
+	"github.com/spf13/cobra"
+)
+
+var (
+	userDataRenderCfg = &userDataRenderConfig{}
+	UserDataCmd       = &cobra.Command{
+		Use:   "user-data",
+		Short: "Work with instance user data",
+	}
+	UserDataRenderCmd = &cobra.Command{
+		Use:   "render",
+		Short: "Render user data from flags or an input file",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			return userdata.ValidateFormat(userDataRenderCfg.format)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			userData, err := buildUserData(cmd.InOrStdin(), cmd.Flags().Changed,
+				userDataRenderCfg)
+			if err != nil {
+				return err
+			}
+
+			rendered, size, err := userdata.Render(userData, userDataRenderCfg.format)
+			if err != nil {
+				return err
+			}
+			if size > userdata.MaxSize {
+				cmd.PrintErrf("Warning: user data is %d bytes, which exceeds the EC2 limit of %d bytes\n",
+					size, userdata.MaxSize)
+			}
+
+			if len(userDataRenderCfg.output) == 0 || userDataRenderCfg.output == "-" {
+				_, err = cmd.OutOrStdout().Write(rendered)
+				return err
+			}
+			output, err := expandPath(userDataRenderCfg.output)
+			if err != nil {
+				return fmt.Errorf("failed to expand output path: %w", err)
+			}
+			if err = os.WriteFile(output, rendered, 0644); err != nil {
+				return fmt.Errorf("failed to write user data: %w", err)
+			}
+			return nil
+		},
+	}
+)
+
+type userDataRenderConfig struct {
+	args                []string
+	command             []string
+	debug               bool
+	disableServices     []string
+	env                 []string
+	envFromIMDS         []string
+	format              string
+	initScripts         []string
+	input               string
+	modules             []string
+	output              string
+	readonlyRootFS      bool
+	replaceInit         bool
+	runAsGroupID        int
+	runAsUserID         int
+	shutdownGracePeriod int
+	sysctls             []string
+	workingDir          string
+}
+
+func init() {
+	UserDataCmd.AddCommand(UserDataRenderCmd)
+
+	UserDataRenderCmd.Flags().StringSliceVar(&userDataRenderCfg.args, "args", []string{},
+		"Arguments to the command. Replaces args from the input file.")
+
+	UserDataRenderCmd.Flags().StringSliceVar(&userDataRenderCfg.command, "command", []string{},
+		"Command to run, overriding the image's entrypoint. Replaces command from the input file.")
+
+	UserDataRenderCmd.Flags().BoolVar(&userDataRenderCfg.debug, "debug", false,
+		"Enable debug logging on boot.")
+
+	UserDataRenderCmd.Flags().StringSliceVar(&userDataRenderCfg.disableServices, "disable-services",
+		[]string{}, "Services to disable at runtime.")
+
+	UserDataRenderCmd.Flags().StringArrayVar(&userDataRenderCfg.env, "env", []string{},
+		"Environment variable in the form name=value. May be specified multiple times.")
+
+	UserDataRenderCmd.Flags().StringArrayVar(&userDataRenderCfg.envFromIMDS, "env-from-imds", []string{},
+		"Environment variable from instance metadata in the form name=path. May be specified multiple times.")
+
+	UserDataRenderCmd.Flags().StringVarP(&userDataRenderCfg.format, "format", "f", userdata.FormatRaw,
+		"Output format, one of raw, gzip, or base64. The base64 format is base64 encoded gzip.")
+
+	UserDataRenderCmd.Flags().StringArrayVar(&userDataRenderCfg.initScripts, "init-script", []string{},
+		"Path to an init script to run on boot. May be specified multiple times.")
+
+	UserDataRenderCmd.Flags().StringVarP(&userDataRenderCfg.input, "input", "I", "",
+		"Path to a JSON or YAML file with user data to start from, or - for standard input.")
+
+	UserDataRenderCmd.Flags().StringSliceVar(&userDataRenderCfg.modules, "modules", []string{},
+		"Kernel modules to load on boot.")
+
+	UserDataRenderCmd.Flags().StringVarP(&userDataRenderCfg.output, "output", "o", "",
+		"Path to write the user data to. Defaults to standard output.")
+
+	UserDataRenderCmd.Flags().BoolVar(&userDataRenderCfg.readonlyRootFS, "readonly-root-fs", false,
+		"Mount the root filesystem as readonly.")
+
+	UserDataRenderCmd.Flags().BoolVar(&userDataRenderCfg.replaceInit, "replace-init", false,
+		"Replace init with the command.")
+
+	UserDataRenderCmd.Flags().IntVar(&userDataRenderCfg.runAsGroupID, "run-as-group-id", 0,
+		"Group ID to run the command as.")
+
+	UserDataRenderCmd.Flags().IntVar(&userDataRenderCfg.runAsUserID, "run-as-user-id", 0,
+		"User ID to run the command as.")
+
+	UserDataRenderCmd.Flags().IntVar(&userDataRenderCfg.shutdownGracePeriod, "shutdown-grace-period", 10,
+		"Seconds to wait for processes to exit on shutdown before killing them.")
+
+	UserDataRenderCmd.Flags().StringArrayVar(&userDataRenderCfg.sysctls, "sysctl", []string{},
+		"Sysctl in the form name=value. May be specified multiple times.")
+
+	UserDataRenderCmd.Flags().StringVar(&userDataRenderCfg.workingDir, "working-dir", "",
+		"Directory to run the command in.")
+}
+
+// buildUserData returns the user data from the input file if one is given,
+// with values from flags that were set applied to it. List flags append to
+// the lists in the input file, except for command and args, which replace them.
+func buildUserData(
+	stdin io.Reader,
+	changed func(flag string) bool,
+	cfg *userDataRenderConfig,
+) (*userdata.UserData, error) {
+	userData := &userdata.UserData{}
+	if len(cfg.input) > 0 {
+		var (
+			data []byte
+			err  error
+		)
+		if cfg.input == "-" {
+			data, err = io.ReadAll(stdin)
+		} else {
+			data, err = os.ReadFile(cfg.input)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input: %w", err)
+		}
+		if userData, err = userdata.Parse(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if changed("args") {
+		userData.Args = cfg.args
+	}
+	if changed("command") {
+		userData.Command = cfg.command
+	}
+	if changed("debug") {
+		userData.Debug = cfg.debug
+	}
+	if changed("replace-init") {
+		userData.ReplaceInit = cfg.replaceInit
+	}
+	if changed("shutdown-grace-period") {
+		userData.ShutdownGracePeriod = &cfg.shutdownGracePeriod
+	}
+	if changed("working-dir") {
+		userData.WorkingDir = cfg.workingDir
+	}
+
+	if changed("readonly-root-fs") || changed("run-as-group-id") ||
+		changed("run-as-user-id") {
+		if userData.Security == nil {
+			userData.Security = &userdata.Security{}
+		}
+		if changed("readonly-root-fs") {
+			userData.Security.ReadonlyRootFS = cfg.readonlyRootFS
+		}
+		if changed("run-as-group-id") {
+			userData.Security.RunAsGroupID = &cfg.runAsGroupID
+		}
+		if changed("run-as-user-id") {
+			userData.Security.RunAsUserID = &cfg.runAsUserID
+		}
+	}
+
+	userData.DisableServices = append(userData.DisableServices, cfg.disableServices...)
+	userData.Modules = append(userData.Modules, cfg.modules...)
+
+	env, envErr := parseNameValues("env", "name=value", cfg.env)
+	userData.Env = append(userData.Env, env...)
+	sysctls, sysctlErr := parseNameValues("sysctl", "name=value", cfg.sysctls)
+	userData.Sysctls = append(userData.Sysctls, sysctls...)
+	imds, imdsErr := parseNameValues("env-from-imds", "name=path", cfg.envFromIMDS)
+	for _, nv := range imds {
+		userData.EnvFrom = append(userData.EnvFrom, userdata.EnvFrom{
+			IMDS: &userdata.IMDSEnv{Name: nv.Name, Path: nv.Value},
+		})
+	}
+	if err := errors.Join(envErr, sysctlErr, imdsErr); err != nil {
+		return nil, err
+	}
+
+	for _, initScript := range cfg.initScripts {
+		data, err := os.ReadFile(initScript)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read init script: %w", err)
+		}
+		userData.InitScripts = append(userData.InitScripts, string(data))
+	}
+
+	return userData, nil
+}
+
+func parseNameValues(flag, form string, values []string) ([]userdata.NameValue, error) {
+	nameValues := []userdata.NameValue{}
+	for _, value := range values {
+		name, val, ok := strings.Cut(value, "=")
+		if !ok || len(name) == 0 {
+			return nil, fmt.Errorf("invalid --%s %q, must be in the form %s", flag, value, form)
+		}
+		nameValues = append(nameValues, userdata.NameValue{Name: name, Value: val})
+	}
+	return nameValues, nil
+}
@@ -0,0 +1,61 @@
+package tree
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cloudboss/easyto/pkg/userdata"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ValidateCmd = &cobra.Command{
+		Use:   "validate FILE...",
+		Short: "Validate user data files",
+		Long: "Validate user data files against the user data schema. Files may be " +
+			"gzipped, and a FILE of - reads from standard input.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			invalid := 0
+			for _, path := range args {
+				problems, err := validateUserDataFile(cmd.InOrStdin(), path)
+				if err != nil {
+					return err
+				}
+				for _, problem := range problems {
+					fmt.Fprintf(cmd.OutOrStdout(), "%s:%s\n", path, problem)
+				}
+				if len(problems) > 0 {
+					invalid++
+				}
+			}
+			if invalid > 0 {
+				return fmt.Errorf("%d of %d files are invalid", invalid, len(args))
+			}
+			return nil
+		},
+	}
+)
+
+func validateUserDataFile(stdin io.Reader, path string) ([]userdata.Problem, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if path == "-" {
+		data, err = io.ReadAll(stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	problems, err := userdata.Validate(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return problems, nil
+}
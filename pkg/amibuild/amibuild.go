@@ -0,0 +1,923 @@
+// Package amibuild orchestrates an AMI build. It launches a builder instance
+// with an extra EBS volume, runs ctr2disk on the builder to write the VM image
+// to the volume, snapshots the volume, and registers an AMI from the snapshot.
+// Alternatively, a VM image built locally is uploaded to a snapshot with the
+// EBS direct APIs and an AMI is registered from that.
+package amibuild
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ebs"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/cloudboss/easyto/pkg/login"
+	"github.com/cloudboss/easyto/pkg/sourceami"
+	"github.com/google/uuid"
+)
+
+const (
+	ConnectionSSH = "ssh"
+	ConnectionSSM = "ssm"
+
+	SSHInterfacePublicIP  = "public_ip"
+	SSHInterfacePrivateIP = "private_ip"
+
+	TagContainerImage = "cloudboss.co/easyto/container-image"
+
+	// volumeDevice is where the volume that becomes the AMI's root volume is
+	// attached to the builder.
+	volumeDevice = "/dev/xvdf"
+	// remoteAssetDir is where assets are uploaded to the builder in slow mode.
+	remoteAssetDir = "/tmp/assets"
+
+	connectTimeout  = 5 * time.Minute
+	instanceTimeout = 10 * time.Minute
+	snapshotTimeout = 60 * time.Minute
+	imageTimeout    = 30 * time.Minute
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid build configuration")
+
+	// assetFiles are uploaded to the builder in slow mode.
+	assetFiles = []string{
+		"base.tar",
+		"boot.tar",
+		"chrony.tar",
+		"ctr2disk",
+		"init.tar",
+		"kernel.tar",
+		"ssh.tar",
+	}
+)
+
+// EC2Client is the subset of the EC2 API used to orchestrate a build.
+type EC2Client interface {
+	DescribeSubnets(
+		ctx context.Context,
+		params *ec2.DescribeSubnetsInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DescribeSubnetsOutput, error)
+	CreateKeyPair(
+		ctx context.Context,
+		params *ec2.CreateKeyPairInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.CreateKeyPairOutput, error)
+	DeleteKeyPair(
+		ctx context.Context,
+		params *ec2.DeleteKeyPairInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DeleteKeyPairOutput, error)
+	CreateSecurityGroup(
+		ctx context.Context,
+		params *ec2.CreateSecurityGroupInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.CreateSecurityGroupOutput, error)
+	AuthorizeSecurityGroupIngress(
+		ctx context.Context,
+		params *ec2.AuthorizeSecurityGroupIngressInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.AuthorizeSecurityGroupIngressOutput, error)
+	DeleteSecurityGroup(
+		ctx context.Context,
+		params *ec2.DeleteSecurityGroupInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DeleteSecurityGroupOutput, error)
+	RunInstances(
+		ctx context.Context,
+		params *ec2.RunInstancesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.RunInstancesOutput, error)
+	DescribeInstances(
+		ctx context.Context,
+		params *ec2.DescribeInstancesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DescribeInstancesOutput, error)
+	StopInstances(
+		ctx context.Context,
+		params *ec2.StopInstancesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.StopInstancesOutput, error)
+	TerminateInstances(
+		ctx context.Context,
+		params *ec2.TerminateInstancesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.TerminateInstancesOutput, error)
+	CreateSnapshot(
+		ctx context.Context,
+		params *ec2.CreateSnapshotInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.CreateSnapshotOutput, error)
+	DeleteSnapshot(
+		ctx context.Context,
+		params *ec2.DeleteSnapshotInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DeleteSnapshotOutput, error)
+	RegisterImage(
+		ctx context.Context,
+		params *ec2.RegisterImageInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.RegisterImageOutput, error)
+	ModifyImageAttribute(
+		ctx context.Context,
+		params *ec2.ModifyImageAttributeInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.ModifyImageAttributeOutput, error)
+	ModifySnapshotAttribute(
+		ctx context.Context,
+		params *ec2.ModifySnapshotAttributeInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.ModifySnapshotAttributeOutput, error)
+}
+
+type InstanceRunningWaiter interface {
+	Wait(
+		ctx context.Context,
+		params *ec2.DescribeInstancesInput,
+		maxWaitDur time.Duration,
+		optFns ...func(*ec2.InstanceRunningWaiterOptions),
+	) error
+}
+
+type InstanceStoppedWaiter interface {
+	Wait(
+		ctx context.Context,
+		params *ec2.DescribeInstancesInput,
+		maxWaitDur time.Duration,
+		optFns ...func(*ec2.InstanceStoppedWaiterOptions),
+	) error
+}
+
+type InstanceTerminatedWaiter interface {
+	Wait(
+		ctx context.Context,
+		params *ec2.DescribeInstancesInput,
+		maxWaitDur time.Duration,
+		optFns ...func(*ec2.InstanceTerminatedWaiterOptions),
+	) error
+}
+
+type SnapshotCompletedWaiter interface {
+	Wait(
+		ctx context.Context,
+		params *ec2.DescribeSnapshotsInput,
+		maxWaitDur time.Duration,
+		optFns ...func(*ec2.SnapshotCompletedWaiterOptions),
+	) error
+}
+
+type ImageAvailableWaiter interface {
+	Wait(
+		ctx context.Context,
+		params *ec2.DescribeImagesInput,
+		maxWaitDur time.Duration,
+		optFns ...func(*ec2.ImageAvailableWaiterOptions),
+	) error
+}
+
+// Waiters wait for EC2 resources to reach the states needed by the build.
+type Waiters struct {
+	InstanceRunning    InstanceRunningWaiter
+	InstanceStopped    InstanceStoppedWaiter
+	InstanceTerminated InstanceTerminatedWaiter
+	SnapshotCompleted  SnapshotCompletedWaiter
+	ImageAvailable     ImageAvailableWaiter
+}
+
+// NewWaiters returns Waiters that use client.
+func NewWaiters(client *ec2.Client) Waiters {
+	return Waiters{
+		InstanceRunning:    ec2.NewInstanceRunningWaiter(client),
+		InstanceStopped:    ec2.NewInstanceStoppedWaiter(client),
+		InstanceTerminated: ec2.NewInstanceTerminatedWaiter(client),
+		SnapshotCompleted:  ec2.NewSnapshotCompletedWaiter(client),
+		ImageAvailable:     ec2.NewImageAvailableWaiter(client),
+	}
+}
+
+// Ctr2DiskOptions are passed to ctr2disk on the builder.
+type Ctr2DiskOptions struct {
+	Changes             []string
+	LockUsers           []string
+	LoginCheck          string
+	LoginPasswordHash   string
+	LoginShell          string
+	LoginUser           string
+	PrivilegeEscalation string
+	RemoveUsers         []string
+	Services            []string
+	SidecarImages       []string
+	Users               []login.UserSpec
+	Debug               bool
+}
+
+type Config struct {
+	AMIName         string
+	ContainerImage  string
+	Architecture    string
+	SourceAMI       string
+	Mode            int
+	AssetDir        string
+	InstanceType    string
+	InstanceProfile string
+	SubnetID        string
+	RootDeviceName  string
+	VolumeSize      int32
+	RootVolume      RootVolume
+	Public          bool
+	Distribution    Distribution
+	Tags            map[string]string
+	Connection      string
+	SSHInterface    string
+	SSHUsername     string
+	Ctr2Disk        Ctr2DiskOptions
+	// LocalImage is the path to a raw disk image to upload directly to a
+	// snapshot instead of building one on a builder instance.
+	LocalImage string
+	Output     io.Writer
+}
+
+type Result struct {
+	AMI        string
+	SnapshotID string
+	// Regions maps each region the AMI is available in to its ID there. It
+	// is only set by Build, which knows the region of the build.
+	Regions map[string]string
+}
+
+// Validate returns an error if the configuration cannot be used for a build.
+func (c *Config) Validate() error {
+	var errs []error
+	if len(c.AMIName) == 0 {
+		errs = append(errs, errors.New("AMI name must be defined"))
+	}
+	if c.VolumeSize < 1 {
+		errs = append(errs, fmt.Errorf("volume size must be at least 1 GB: %d", c.VolumeSize))
+	}
+	if len(c.LocalImage) == 0 {
+		errs = append(errs, c.validateBuilder()...)
+	}
+	if err := c.Distribution.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.ValidateRootVolume(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// validateBuilder returns the problems with the parts of the configuration
+// used to run ctr2disk on a builder instance, which a local image skips.
+func (c *Config) validateBuilder() []error {
+	var errs []error
+	if len(c.ContainerImage) == 0 {
+		errs = append(errs, errors.New("container image must be defined"))
+	}
+	if len(c.SourceAMI) == 0 {
+		errs = append(errs, errors.New("source AMI must be defined"))
+	}
+	if len(c.SubnetID) == 0 {
+		errs = append(errs, errors.New("subnet ID must be defined"))
+	}
+	switch c.Mode {
+	case sourceami.ModeFast:
+	case sourceami.ModeSlow:
+		if len(c.AssetDir) == 0 {
+			errs = append(errs, errors.New("asset directory must be defined in slow mode"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown build mode %d", c.Mode))
+	}
+	switch c.Connection {
+	case ConnectionSSH:
+		if c.SSHInterface != SSHInterfacePublicIP && c.SSHInterface != SSHInterfacePrivateIP {
+			errs = append(errs, fmt.Errorf("ssh interface must be one of %s or %s: %s",
+				SSHInterfacePublicIP, SSHInterfacePrivateIP, c.SSHInterface))
+		}
+		if len(c.SSHUsername) == 0 {
+			errs = append(errs, errors.New("ssh username must be defined"))
+		}
+	case ConnectionSSM:
+		if len(c.InstanceProfile) == 0 {
+			errs = append(errs, errors.New("ssm connection requires an instance profile"))
+		}
+		if c.Mode == sourceami.ModeSlow {
+			errs = append(errs, errors.New("ssm connection requires a builder image with easyto installed"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("connection must be one of %s or %s: %s",
+			ConnectionSSH, ConnectionSSM, c.Connection))
+	}
+	return errs
+}
+
+// Build creates an AMI using clients from the default AWS configuration. If
+// cfg.LocalImage is defined, the AMI is imported from it with the EBS direct
+// APIs instead of being built on a builder instance. The AMI is then copied to
+// the regions in cfg.Distribution.
+func Build(ctx context.Context, cfg Config) (*Result, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	if slices.Contains(cfg.Distribution.Regions, awsCfg.Region) {
+		return nil, fmt.Errorf("%w: cannot copy AMI to its own region %s", ErrInvalidConfig,
+			awsCfg.Region)
+	}
+
+	result, err := buildOrImport(ctx, cfg, awsCfg)
+	if err != nil {
+		return result, err
+	}
+
+	result.Regions = map[string]string{awsCfg.Region: result.AMI}
+	if len(cfg.Distribution.Regions) == 0 {
+		return result, nil
+	}
+	copies, err := CopyWithClients(ctx, cfg, awsCfg.Region, result.AMI,
+		func(region string) (CopyClient, ImageAvailableWaiter) {
+			client := ec2.NewFromConfig(awsCfg, func(o *ec2.Options) {
+				o.Region = region
+			})
+			return client, ec2.NewImageAvailableWaiter(client)
+		})
+	maps.Copy(result.Regions, copies)
+	return result, err
+}
+
+func buildOrImport(ctx context.Context, cfg Config, awsCfg aws.Config) (*Result, error) {
+	client := ec2.NewFromConfig(awsCfg)
+
+	if len(cfg.LocalImage) > 0 {
+		return ImportWithClients(ctx, cfg, client, ebs.NewFromConfig(awsCfg),
+			NewWaiters(client))
+	}
+
+	var connector Connector
+	switch cfg.Connection {
+	case ConnectionSSM:
+		connector = &SSMConnector{Client: ssm.NewFromConfig(awsCfg), Timeout: connectTimeout}
+	default:
+		connector = &SSHConnector{
+			Username:  cfg.SSHUsername,
+			Interface: cfg.SSHInterface,
+			Timeout:   connectTimeout,
+		}
+	}
+
+	return BuildWithClients(ctx, cfg, client, NewWaiters(client), connector)
+}
+
+// BuildWithClients creates an AMI using the given clients. All temporary
+// resources are removed when it returns, whether or not the build succeeded.
+func BuildWithClients(
+	ctx context.Context,
+	cfg Config,
+	client EC2Client,
+	waiters Waiters,
+	connector Connector,
+) (result *Result, err error) {
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.LocalImage) > 0 {
+		return nil, fmt.Errorf("%w: local image must be imported with ImportWithClients",
+			ErrInvalidConfig)
+	}
+	if len(cfg.Architecture) == 0 {
+		cfg.Architecture = "x86_64"
+	}
+
+	b := &build{
+		cfg:       cfg,
+		client:    client,
+		waiters:   waiters,
+		connector: connector,
+		suffix:    uuid.NewString()[:8],
+	}
+	defer func() {
+		err = errors.Join(err, b.cleanup(err != nil))
+	}()
+
+	return b.run(ctx)
+}
+
+type build struct {
+	cfg       Config
+	client    EC2Client
+	ebs       EBSClient
+	waiters   Waiters
+	connector Connector
+	suffix    string
+
+	keyName         string
+	privateKey      []byte
+	securityGroupID string
+	instanceID      string
+	snapshotID      string
+	registered      bool
+}
+
+func (b *build) run(ctx context.Context) (*Result, error) {
+	if err := b.createSecurityGroup(ctx); err != nil {
+		return nil, err
+	}
+	if err := b.createKeyPair(ctx); err != nil {
+		return nil, err
+	}
+
+	instance, err := b.launchInstance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = b.provision(ctx, instance); err != nil {
+		return nil, err
+	}
+
+	if err = b.snapshotVolume(ctx); err != nil {
+		return nil, err
+	}
+
+	return b.register(ctx)
+}
+
+// register registers an AMI from the snapshot, and makes it public or shares
+// it if configured to.
+func (b *build) register(ctx context.Context) (*Result, error) {
+	amiID, err := b.registerImage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{AMI: amiID, SnapshotID: b.snapshotID}
+
+	snapshotIDs := []string{b.snapshotID}
+	if b.cfg.Public {
+		if err = makePublic(ctx, b.client, amiID, snapshotIDs, b.log); err != nil {
+			return result, err
+		}
+	}
+	if err = share(ctx, b.client, b.cfg.Distribution, amiID, snapshotIDs, b.log); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+func (b *build) createSecurityGroup(ctx context.Context) error {
+	subnets, err := b.client.DescribeSubnets(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: []string{b.cfg.SubnetID},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to describe subnet %s: %w", b.cfg.SubnetID, err)
+	}
+	if len(subnets.Subnets) == 0 {
+		return fmt.Errorf("subnet %s not found", b.cfg.SubnetID)
+	}
+
+	name := "easyto-builder-" + b.suffix
+	b.log("Creating temporary security group %s...\n", name)
+	sg, err := b.client.CreateSecurityGroup(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(name),
+		Description: aws.String("Temporary group for easyto builder " + b.cfg.AMIName),
+		VpcId:       subnets.Subnets[0].VpcId,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create security group: %w", err)
+	}
+	b.securityGroupID = aws.ToString(sg.GroupId)
+
+	port := b.connector.IngressPort()
+	if port == 0 {
+		return nil
+	}
+	_, err = b.client.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: aws.String(b.securityGroupID),
+		IpPermissions: []ec2types.IpPermission{
+			{
+				IpProtocol: aws.String("tcp"),
+				FromPort:   aws.Int32(port),
+				ToPort:     aws.Int32(port),
+				IpRanges:   []ec2types.IpRange{{CidrIp: aws.String("0.0.0.0/0")}},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to authorize ingress to security group %s: %w",
+			b.securityGroupID, err)
+	}
+	return nil
+}
+
+func (b *build) createKeyPair(ctx context.Context) error {
+	if !b.connector.NeedsKeyPair() {
+		return nil
+	}
+
+	name := "easyto-builder-" + b.suffix
+	b.log("Creating temporary key pair %s...\n", name)
+	kp, err := b.client.CreateKeyPair(ctx, &ec2.CreateKeyPairInput{
+		KeyName: aws.String(name),
+		KeyType: ec2types.KeyTypeEd25519,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create key pair: %w", err)
+	}
+	b.keyName = name
+	b.privateKey = []byte(aws.ToString(kp.KeyMaterial))
+	return nil
+}
+
+func (b *build) launchInstance(ctx context.Context) (*ec2types.Instance, error) {
+	input := &ec2.RunInstancesInput{
+		ImageId:      aws.String(b.cfg.SourceAMI),
+		InstanceType: ec2types.InstanceType(b.cfg.InstanceType),
+		MinCount:     aws.Int32(1),
+		MaxCount:     aws.Int32(1),
+		NetworkInterfaces: []ec2types.InstanceNetworkInterfaceSpecification{
+			{
+				DeviceIndex:              aws.Int32(0),
+				SubnetId:                 aws.String(b.cfg.SubnetID),
+				Groups:                   []string{b.securityGroupID},
+				AssociatePublicIpAddress: aws.Bool(b.cfg.Connection == ConnectionSSH && b.cfg.SSHInterface == SSHInterfacePublicIP),
+				DeleteOnTermination:      aws.Bool(true),
+			},
+		},
+		BlockDeviceMappings: []ec2types.BlockDeviceMapping{
+			{
+				DeviceName: aws.String(volumeDevice),
+				Ebs: &ec2types.EbsBlockDevice{
+					DeleteOnTermination: aws.Bool(true),
+					VolumeSize:          aws.Int32(b.cfg.VolumeSize),
+					VolumeType:          ec2types.VolumeTypeGp2,
+				},
+			},
+		},
+		InstanceInitiatedShutdownBehavior: ec2types.ShutdownBehaviorStop,
+		TagSpecifications: []ec2types.TagSpecification{
+			nameTag(ec2types.ResourceTypeInstance, "ami-builder-"+b.cfg.AMIName),
+			nameTag(ec2types.ResourceTypeVolume, "ami-volume-"+b.cfg.AMIName),
+		},
+	}
+	if len(b.keyName) > 0 {
+		input.KeyName = aws.String(b.keyName)
+	}
+	// The snapshot and the AMI are encrypted if the volume they come from is.
+	if b.cfg.RootVolume.Encrypted {
+		volume := input.BlockDeviceMappings[0].Ebs
+		volume.Encrypted = aws.Bool(true)
+		if len(b.cfg.RootVolume.KMSKeyID) > 0 {
+			volume.KmsKeyId = aws.String(b.cfg.RootVolume.KMSKeyID)
+		}
+	}
+	if len(b.cfg.InstanceProfile) > 0 {
+		input.IamInstanceProfile = &ec2types.IamInstanceProfileSpecification{}
+		if strings.HasPrefix(b.cfg.InstanceProfile, "arn:") {
+			input.IamInstanceProfile.Arn = aws.String(b.cfg.InstanceProfile)
+		} else {
+			input.IamInstanceProfile.Name = aws.String(b.cfg.InstanceProfile)
+		}
+	}
+
+	b.log("Launching builder instance from %s...\n", b.cfg.SourceAMI)
+	out, err := b.client.RunInstances(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to launch builder instance: %w", err)
+	}
+	if len(out.Instances) == 0 {
+		return nil, errors.New("no builder instance was launched")
+	}
+	b.instanceID = aws.ToString(out.Instances[0].InstanceId)
+
+	b.log("Waiting for builder instance %s to be running...\n", b.instanceID)
+	err = b.waiters.InstanceRunning.Wait(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{b.instanceID},
+	}, instanceTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for builder instance %s: %w", b.instanceID, err)
+	}
+
+	return b.describeInstance(ctx)
+}
+
+func (b *build) describeInstance(ctx context.Context) (*ec2types.Instance, error) {
+	out, err := b.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{b.instanceID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe builder instance %s: %w", b.instanceID, err)
+	}
+	for _, reservation := range out.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.ToString(instance.InstanceId) == b.instanceID {
+				return &instance, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("builder instance %s not found", b.instanceID)
+}
+
+func (b *build) provision(ctx context.Context, instance *ec2types.Instance) error {
+	b.log("Connecting to builder instance %s...\n", b.instanceID)
+	runner, err := b.connector.Connect(ctx, instance, b.privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to connect to builder instance %s: %w", b.instanceID, err)
+	}
+	defer runner.Close()
+
+	if b.cfg.Mode == sourceami.ModeSlow {
+		if err = b.uploadAssets(ctx, runner); err != nil {
+			return err
+		}
+	}
+
+	script, err := b.ctr2diskScript()
+	if err != nil {
+		return err
+	}
+
+	b.log("Running ctr2disk on builder instance %s...\n", b.instanceID)
+	output := b.cfg.Output
+	if output == nil {
+		output = io.Discard
+	}
+	if err = runner.Run(ctx, script, output, output); err != nil {
+		return fmt.Errorf("failed to run ctr2disk: %w", err)
+	}
+	return nil
+}
+
+func (b *build) uploadAssets(ctx context.Context, runner Runner) error {
+	for _, name := range assetFiles {
+		localPath := filepath.Join(b.cfg.AssetDir, name)
+		b.log("Uploading %s...\n", localPath)
+		err := func() error {
+			f, err := os.Open(localPath)
+			if err != nil {
+				return fmt.Errorf("failed to open asset: %w", err)
+			}
+			defer f.Close()
+			return runner.Upload(ctx, remoteAssetDir+"/"+name, 0755, f)
+		}()
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// ctr2diskScript returns a shell script to run ctr2disk on the builder. In
+// fast mode the assets are found relative to the easyto executable on the
+// PATH, and in slow mode they are where uploadAssets put them.
+func (b *build) ctr2diskScript() (string, error) {
+	args, err := b.cfg.Ctr2Disk.args()
+	if err != nil {
+		return "", err
+	}
+	args = append(args,
+		"--container-image="+b.cfg.ContainerImage,
+		"--vm-image-device="+volumeDevice,
+	)
+
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	script := strings.Builder{}
+	script.WriteString("set -e\n")
+	if b.cfg.Mode == sourceami.ModeFast {
+		script.WriteString(`easyto_path=$(command -v easyto) || { echo "easyto not found in PATH" >&2; exit 1; }` + "\n")
+		script.WriteString(`asset_dir=$(realpath "$(dirname "$(realpath "${easyto_path}")")/../assets")` + "\n")
+	} else {
+		script.WriteString("asset_dir=" + shellQuote(remoteAssetDir) + "\n")
+	}
+	script.WriteString(`"${asset_dir}/ctr2disk" --asset-dir="${asset_dir}" ` +
+		strings.Join(quoted, " ") + "\n")
+	return script.String(), nil
+}
+
+func (o *Ctr2DiskOptions) args() ([]string, error) {
+	changes, err := json.Marshal(nonNil(o.Changes))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected value for changes: %w", err)
+	}
+	users, err := json.Marshal(nonNil(o.Users))
+	if err != nil {
+		return nil, fmt.Errorf("unexpected value for users: %w", err)
+	}
+
+	args := []string{
+		"--changes=" + string(changes),
+		"--lock-users=" + strings.Join(o.LockUsers, ","),
+		"--login-check=" + o.LoginCheck,
+		"--login-password-hash=" + o.LoginPasswordHash,
+		"--login-shell=" + o.LoginShell,
+		"--login-user=" + o.LoginUser,
+		"--privilege-escalation=" + o.PrivilegeEscalation,
+		"--remove-users=" + strings.Join(o.RemoveUsers, ","),
+		"--services=" + strings.Join(o.Services, ","),
+		"--sidecar-images=" + strings.Join(o.SidecarImages, ","),
+		"--users=" + string(users),
+	}
+	if o.Debug {
+		args = append(args, "--debug")
+	}
+	return args, nil
+}
+
+func (b *build) snapshotVolume(ctx context.Context) error {
+	instance, err := b.describeInstance(ctx)
+	if err != nil {
+		return err
+	}
+	volumeID := ""
+	for _, bdm := range instance.BlockDeviceMappings {
+		if aws.ToString(bdm.DeviceName) == volumeDevice && bdm.Ebs != nil {
+			volumeID = aws.ToString(bdm.Ebs.VolumeId)
+		}
+	}
+	if len(volumeID) == 0 {
+		return fmt.Errorf("no volume attached to builder instance %s at %s",
+			b.instanceID, volumeDevice)
+	}
+
+	b.log("Stopping builder instance %s...\n", b.instanceID)
+	_, err = b.client.StopInstances(ctx, &ec2.StopInstancesInput{
+		InstanceIds: []string{b.instanceID},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to stop builder instance %s: %w", b.instanceID, err)
+	}
+	err = b.waiters.InstanceStopped.Wait(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{b.instanceID},
+	}, instanceTimeout)
+	if err != nil {
+		return fmt.Errorf("failed waiting for builder instance %s to stop: %w", b.instanceID, err)
+	}
+
+	b.log("Creating snapshot of volume %s...\n", volumeID)
+	snapshot, err := b.client.CreateSnapshot(ctx, &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(volumeID),
+		Description: aws.String(b.cfg.AMIName),
+		TagSpecifications: []ec2types.TagSpecification{
+			nameTag(ec2types.ResourceTypeSnapshot, b.cfg.AMIName),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot of volume %s: %w", volumeID, err)
+	}
+	b.snapshotID = aws.ToString(snapshot.SnapshotId)
+
+	b.log("Waiting for snapshot %s to complete...\n", b.snapshotID)
+	err = b.waiters.SnapshotCompleted.Wait(ctx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []string{b.snapshotID},
+	}, snapshotTimeout)
+	if err != nil {
+		return fmt.Errorf("failed waiting for snapshot %s: %w", b.snapshotID, err)
+	}
+	return nil
+}
+
+func (b *build) registerImage(ctx context.Context) (string, error) {
+	tags := []ec2types.Tag{}
+	for key, value := range b.cfg.Tags {
+		tags = append(tags, ec2types.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	if len(b.cfg.ContainerImage) > 0 {
+		tags = append(tags, ec2types.Tag{
+			Key:   aws.String(TagContainerImage),
+			Value: aws.String(b.cfg.ContainerImage),
+		})
+	}
+
+	b.log("Registering AMI %s...\n", b.cfg.AMIName)
+	out, err := b.client.RegisterImage(ctx, &ec2.RegisterImageInput{
+		Name:               aws.String(b.cfg.AMIName),
+		Description:        aws.String(b.cfg.AMIName),
+		Architecture:       ec2types.ArchitectureValues(b.cfg.Architecture),
+		BootMode:           ec2types.BootModeValuesUefi,
+		EnaSupport:         aws.Bool(true),
+		SriovNetSupport:    aws.String("simple"),
+		VirtualizationType: aws.String("hvm"),
+		RootDeviceName:     aws.String(b.cfg.RootDeviceName),
+		BlockDeviceMappings: []ec2types.BlockDeviceMapping{
+			{
+				DeviceName: aws.String(b.cfg.RootDeviceName),
+				Ebs:        b.cfg.RootVolume.blockDevice(b.snapshotID, b.cfg.VolumeSize),
+			},
+		},
+		TagSpecifications: []ec2types.TagSpecification{
+			{ResourceType: ec2types.ResourceTypeImage, Tags: tags},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to register AMI: %w", err)
+	}
+	b.registered = true
+	amiID := aws.ToString(out.ImageId)
+
+	b.log("Waiting for AMI %s to become available...\n", amiID)
+	err = b.waiters.ImageAvailable.Wait(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{amiID},
+	}, imageTimeout)
+	if err != nil {
+		return amiID, fmt.Errorf("failed waiting for AMI %s: %w", amiID, err)
+	}
+	return amiID, nil
+}
+
+// cleanup removes the temporary resources created for the build. The snapshot
+// is only removed if the build failed before an AMI was registered from it.
+// A fresh context is used so that cleanup happens even if the build's context
+// was canceled.
+func (b *build) cleanup(failed bool) error {
+	ctx := context.Background()
+	var errs []error
+
+	if len(b.instanceID) > 0 {
+		b.log("Terminating builder instance %s...\n", b.instanceID)
+		_, err := b.client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: []string{b.instanceID},
+		})
+		if err == nil {
+			err = b.waiters.InstanceTerminated.Wait(ctx, &ec2.DescribeInstancesInput{
+				InstanceIds: []string{b.instanceID},
+			}, instanceTimeout)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to terminate builder instance %s: %w",
+				b.instanceID, err))
+		}
+	}
+
+	if failed && !b.registered && len(b.snapshotID) > 0 {
+		b.log("Deleting snapshot %s...\n", b.snapshotID)
+		_, err := b.client.DeleteSnapshot(ctx, &ec2.DeleteSnapshotInput{
+			SnapshotId: aws.String(b.snapshotID),
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete snapshot %s: %w", b.snapshotID, err))
+		}
+	}
+
+	if len(b.keyName) > 0 {
+		b.log("Deleting temporary key pair %s...\n", b.keyName)
+		_, err := b.client.DeleteKeyPair(ctx, &ec2.DeleteKeyPairInput{
+			KeyName: aws.String(b.keyName),
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete key pair %s: %w", b.keyName, err))
+		}
+	}
+
+	if len(b.securityGroupID) > 0 {
+		b.log("Deleting temporary security group %s...\n", b.securityGroupID)
+		_, err := b.client.DeleteSecurityGroup(ctx, &ec2.DeleteSecurityGroupInput{
+			GroupId: aws.String(b.securityGroupID),
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete security group %s: %w",
+				b.securityGroupID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (b *build) log(format string, args ...any) {
+	if b.cfg.Output != nil {
+		fmt.Fprintf(b.cfg.Output, format, args...)
+	}
+}
+
+func nameTag(resourceType ec2types.ResourceType, name string) ec2types.TagSpecification {
+	return ec2types.TagSpecification{
+		ResourceType: resourceType,
+		Tags:         []ec2types.Tag{{Key: aws.String("Name"), Value: aws.String(name)}},
+	}
+}
+
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
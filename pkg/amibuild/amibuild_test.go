@@ -0,0 +1,778 @@
+package amibuild
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudboss/easyto/pkg/login"
+	"github.com/cloudboss/easyto/pkg/sourceami"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockEC2Client records the calls made to it and returns errors for the
+// operations named in errs.
+type mockEC2Client struct {
+	calls []string
+	errs  map[string]error
+
+	runInstancesInput  *ec2.RunInstancesInput
+	ingressInput       *ec2.AuthorizeSecurityGroupIngressInput
+	registerImageInput *ec2.RegisterImageInput
+	imageAttributes    []*ec2.ModifyImageAttributeInput
+	snapshotAttributes []*ec2.ModifySnapshotAttributeInput
+	noVolume           bool
+}
+
+func (m *mockEC2Client) call(name string) error {
+	m.calls = append(m.calls, name)
+	return m.errs[name]
+}
+
+func (m *mockEC2Client) DescribeSubnets(
+	ctx context.Context,
+	input *ec2.DescribeSubnetsInput,
+	opts ...func(*ec2.Options),
+) (*ec2.DescribeSubnetsOutput, error) {
+	if err := m.call("DescribeSubnets"); err != nil {
+		return nil, err
+	}
+	return &ec2.DescribeSubnetsOutput{
+		Subnets: []ec2types.Subnet{{SubnetId: aws.String("subnet-123"), VpcId: aws.String("vpc-123")}},
+	}, nil
+}
+
+func (m *mockEC2Client) CreateKeyPair(
+	ctx context.Context,
+	input *ec2.CreateKeyPairInput,
+	opts ...func(*ec2.Options),
+) (*ec2.CreateKeyPairOutput, error) {
+	if err := m.call("CreateKeyPair"); err != nil {
+		return nil, err
+	}
+	return &ec2.CreateKeyPairOutput{KeyName: input.KeyName, KeyMaterial: aws.String("key")}, nil
+}
+
+func (m *mockEC2Client) DeleteKeyPair(
+	ctx context.Context,
+	input *ec2.DeleteKeyPairInput,
+	opts ...func(*ec2.Options),
+) (*ec2.DeleteKeyPairOutput, error) {
+	return &ec2.DeleteKeyPairOutput{}, m.call("DeleteKeyPair")
+}
+
+func (m *mockEC2Client) CreateSecurityGroup(
+	ctx context.Context,
+	input *ec2.CreateSecurityGroupInput,
+	opts ...func(*ec2.Options),
+) (*ec2.CreateSecurityGroupOutput, error) {
+	if err := m.call("CreateSecurityGroup"); err != nil {
+		return nil, err
+	}
+	return &ec2.CreateSecurityGroupOutput{GroupId: aws.String("sg-123")}, nil
+}
+
+func (m *mockEC2Client) AuthorizeSecurityGroupIngress(
+	ctx context.Context,
+	input *ec2.AuthorizeSecurityGroupIngressInput,
+	opts ...func(*ec2.Options),
+) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	m.ingressInput = input
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, m.call("AuthorizeSecurityGroupIngress")
+}
+
+func (m *mockEC2Client) DeleteSecurityGroup(
+	ctx context.Context,
+	input *ec2.DeleteSecurityGroupInput,
+	opts ...func(*ec2.Options),
+) (*ec2.DeleteSecurityGroupOutput, error) {
+	return &ec2.DeleteSecurityGroupOutput{}, m.call("DeleteSecurityGroup")
+}
+
+func (m *mockEC2Client) RunInstances(
+	ctx context.Context,
+	input *ec2.RunInstancesInput,
+	opts ...func(*ec2.Options),
+) (*ec2.RunInstancesOutput, error) {
+	m.runInstancesInput = input
+	if err := m.call("RunInstances"); err != nil {
+		return nil, err
+	}
+	return &ec2.RunInstancesOutput{
+		Instances: []ec2types.Instance{{InstanceId: aws.String("i-123")}},
+	}, nil
+}
+
+func (m *mockEC2Client) DescribeInstances(
+	ctx context.Context,
+	input *ec2.DescribeInstancesInput,
+	opts ...func(*ec2.Options),
+) (*ec2.DescribeInstancesOutput, error) {
+	if err := m.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	instance := ec2types.Instance{
+		InstanceId:       aws.String("i-123"),
+		PublicIpAddress:  aws.String("192.0.2.1"),
+		PrivateIpAddress: aws.String("10.0.0.1"),
+		BlockDeviceMappings: []ec2types.InstanceBlockDeviceMapping{
+			{
+				DeviceName: aws.String("/dev/xvda"),
+				Ebs:        &ec2types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-root")},
+			},
+		},
+	}
+	if !m.noVolume {
+		instance.BlockDeviceMappings = append(instance.BlockDeviceMappings,
+			ec2types.InstanceBlockDeviceMapping{
+				DeviceName: aws.String(volumeDevice),
+				Ebs:        &ec2types.EbsInstanceBlockDevice{VolumeId: aws.String("vol-123")},
+			})
+	}
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []ec2types.Reservation{{Instances: []ec2types.Instance{instance}}},
+	}, nil
+}
+
+func (m *mockEC2Client) StopInstances(
+	ctx context.Context,
+	input *ec2.StopInstancesInput,
+	opts ...func(*ec2.Options),
+) (*ec2.StopInstancesOutput, error) {
+	return &ec2.StopInstancesOutput{}, m.call("StopInstances")
+}
+
+func (m *mockEC2Client) TerminateInstances(
+	ctx context.Context,
+	input *ec2.TerminateInstancesInput,
+	opts ...func(*ec2.Options),
+) (*ec2.TerminateInstancesOutput, error) {
+	return &ec2.TerminateInstancesOutput{}, m.call("TerminateInstances")
+}
+
+func (m *mockEC2Client) CreateSnapshot(
+	ctx context.Context,
+	input *ec2.CreateSnapshotInput,
+	opts ...func(*ec2.Options),
+) (*ec2.CreateSnapshotOutput, error) {
+	if err := m.call("CreateSnapshot"); err != nil {
+		return nil, err
+	}
+	return &ec2.CreateSnapshotOutput{SnapshotId: aws.String("snap-123")}, nil
+}
+
+func (m *mockEC2Client) DeleteSnapshot(
+	ctx context.Context,
+	input *ec2.DeleteSnapshotInput,
+	opts ...func(*ec2.Options),
+) (*ec2.DeleteSnapshotOutput, error) {
+	return &ec2.DeleteSnapshotOutput{}, m.call("DeleteSnapshot")
+}
+
+func (m *mockEC2Client) RegisterImage(
+	ctx context.Context,
+	input *ec2.RegisterImageInput,
+	opts ...func(*ec2.Options),
+) (*ec2.RegisterImageOutput, error) {
+	m.registerImageInput = input
+	if err := m.call("RegisterImage"); err != nil {
+		return nil, err
+	}
+	return &ec2.RegisterImageOutput{ImageId: aws.String("ami-123")}, nil
+}
+
+func (m *mockEC2Client) ModifyImageAttribute(
+	ctx context.Context,
+	input *ec2.ModifyImageAttributeInput,
+	opts ...func(*ec2.Options),
+) (*ec2.ModifyImageAttributeOutput, error) {
+	m.imageAttributes = append(m.imageAttributes, input)
+	return &ec2.ModifyImageAttributeOutput{}, m.call("ModifyImageAttribute")
+}
+
+func (m *mockEC2Client) ModifySnapshotAttribute(
+	ctx context.Context,
+	input *ec2.ModifySnapshotAttributeInput,
+	opts ...func(*ec2.Options),
+) (*ec2.ModifySnapshotAttributeOutput, error) {
+	m.snapshotAttributes = append(m.snapshotAttributes, input)
+	return &ec2.ModifySnapshotAttributeOutput{}, m.call("ModifySnapshotAttribute")
+}
+
+type mockWaiter struct {
+	name   string
+	client *mockEC2Client
+}
+
+func (m *mockWaiter) wait() error {
+	return m.client.call("Wait" + m.name)
+}
+
+type mockInstanceRunningWaiter struct{ mockWaiter }
+
+func (m *mockInstanceRunningWaiter) Wait(
+	ctx context.Context,
+	params *ec2.DescribeInstancesInput,
+	maxWaitDur time.Duration,
+	optFns ...func(*ec2.InstanceRunningWaiterOptions),
+) error {
+	return m.wait()
+}
+
+type mockInstanceStoppedWaiter struct{ mockWaiter }
+
+func (m *mockInstanceStoppedWaiter) Wait(
+	ctx context.Context,
+	params *ec2.DescribeInstancesInput,
+	maxWaitDur time.Duration,
+	optFns ...func(*ec2.InstanceStoppedWaiterOptions),
+) error {
+	return m.wait()
+}
+
+type mockInstanceTerminatedWaiter struct{ mockWaiter }
+
+func (m *mockInstanceTerminatedWaiter) Wait(
+	ctx context.Context,
+	params *ec2.DescribeInstancesInput,
+	maxWaitDur time.Duration,
+	optFns ...func(*ec2.InstanceTerminatedWaiterOptions),
+) error {
+	return m.wait()
+}
+
+type mockSnapshotCompletedWaiter struct{ mockWaiter }
+
+func (m *mockSnapshotCompletedWaiter) Wait(
+	ctx context.Context,
+	params *ec2.DescribeSnapshotsInput,
+	maxWaitDur time.Duration,
+	optFns ...func(*ec2.SnapshotCompletedWaiterOptions),
+) error {
+	return m.wait()
+}
+
+type mockImageAvailableWaiter struct{ mockWaiter }
+
+func (m *mockImageAvailableWaiter) Wait(
+	ctx context.Context,
+	params *ec2.DescribeImagesInput,
+	maxWaitDur time.Duration,
+	optFns ...func(*ec2.ImageAvailableWaiterOptions),
+) error {
+	return m.wait()
+}
+
+func mockWaiters(client *mockEC2Client) Waiters {
+	return Waiters{
+		InstanceRunning:    &mockInstanceRunningWaiter{mockWaiter{"InstanceRunning", client}},
+		InstanceStopped:    &mockInstanceStoppedWaiter{mockWaiter{"InstanceStopped", client}},
+		InstanceTerminated: &mockInstanceTerminatedWaiter{mockWaiter{"InstanceTerminated", client}},
+		SnapshotCompleted:  &mockSnapshotCompletedWaiter{mockWaiter{"SnapshotCompleted", client}},
+		ImageAvailable:     &mockImageAvailableWaiter{mockWaiter{"ImageAvailable", client}},
+	}
+}
+
+type mockConnector struct {
+	keyPair    bool
+	port       int32
+	connectErr error
+	runner     *mockRunner
+	privateKey []byte
+}
+
+func (m *mockConnector) Connect(
+	ctx context.Context,
+	instance *ec2types.Instance,
+	privateKey []byte,
+) (Runner, error) {
+	m.privateKey = privateKey
+	if m.connectErr != nil {
+		return nil, m.connectErr
+	}
+	return m.runner, nil
+}
+
+func (m *mockConnector) NeedsKeyPair() bool {
+	return m.keyPair
+}
+
+func (m *mockConnector) IngressPort() int32 {
+	return m.port
+}
+
+type mockRunner struct {
+	uploads map[string]string
+	scripts []string
+	runErr  error
+	closed  bool
+}
+
+func (m *mockRunner) Upload(ctx context.Context, path string, mode os.FileMode, r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if m.uploads == nil {
+		m.uploads = map[string]string{}
+	}
+	m.uploads[path] = string(b)
+	return nil
+}
+
+func (m *mockRunner) Run(ctx context.Context, script string, stdout, stderr io.Writer) error {
+	m.scripts = append(m.scripts, script)
+	io.WriteString(stdout, "ctr2disk output\n")
+	return m.runErr
+}
+
+func (m *mockRunner) Close() error {
+	m.closed = true
+	return nil
+}
+
+func testConfig() Config {
+	return Config{
+		AMIName:        "test-ami",
+		ContainerImage: "alpine:latest",
+		SourceAMI:      "ami-builder",
+		Mode:           sourceami.ModeFast,
+		InstanceType:   "t3.micro",
+		SubnetID:       "subnet-123",
+		RootDeviceName: "/dev/xvda",
+		VolumeSize:     10,
+		Tags:           map[string]string{"team": "dev"},
+		Connection:     ConnectionSSH,
+		SSHInterface:   SSHInterfacePublicIP,
+		SSHUsername:    "cloudboss",
+		Ctr2Disk: Ctr2DiskOptions{
+			LoginCheck:          "warn",
+			LoginShell:          "/.easyto/bin/sh",
+			LoginUser:           "cloudboss",
+			PrivilegeEscalation: "none",
+			Services:            []string{"chrony", "ssh"},
+		},
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	testCases := []struct {
+		description string
+		modify      func(*Config)
+		errContains []string
+	}{
+		{
+			description: "Valid ssh config",
+			modify:      func(c *Config) {},
+		},
+		{
+			description: "Valid ssm config",
+			modify: func(c *Config) {
+				c.Connection = ConnectionSSM
+				c.InstanceProfile = "builder"
+				c.SSHInterface = ""
+				c.SSHUsername = ""
+			},
+		},
+		{
+			description: "Missing required fields",
+			modify: func(c *Config) {
+				c.AMIName = ""
+				c.ContainerImage = ""
+				c.SourceAMI = ""
+				c.SubnetID = ""
+				c.VolumeSize = 0
+			},
+			errContains: []string{
+				"AMI name must be defined",
+				"container image must be defined",
+				"source AMI must be defined",
+				"subnet ID must be defined",
+				"volume size must be at least 1 GB: 0",
+			},
+		},
+		{
+			description: "Valid local image config",
+			modify: func(c *Config) {
+				*c = Config{AMIName: "test-ami", VolumeSize: 10, LocalImage: "disk.raw"}
+			},
+		},
+		{
+			description: "Local image without AMI name",
+			modify: func(c *Config) {
+				*c = Config{VolumeSize: 10, LocalImage: "disk.raw"}
+			},
+			errContains: []string{"AMI name must be defined"},
+		},
+		{
+			description: "Slow mode without asset directory",
+			modify:      func(c *Config) { c.Mode = sourceami.ModeSlow },
+			errContains: []string{"asset directory must be defined in slow mode"},
+		},
+		{
+			description: "Invalid ssh interface",
+			modify:      func(c *Config) { c.SSHInterface = "ipv6" },
+			errContains: []string{"ssh interface must be one of public_ip or private_ip: ipv6"},
+		},
+		{
+			description: "Missing ssh username",
+			modify:      func(c *Config) { c.SSHUsername = "" },
+			errContains: []string{"ssh username must be defined"},
+		},
+		{
+			description: "SSM without instance profile in slow mode",
+			modify: func(c *Config) {
+				c.Connection = ConnectionSSM
+				c.Mode = sourceami.ModeSlow
+				c.AssetDir = "/assets"
+			},
+			errContains: []string{
+				"ssm connection requires an instance profile",
+				"ssm connection requires a builder image with easyto installed",
+			},
+		},
+		{
+			description: "Invalid connection",
+			modify:      func(c *Config) { c.Connection = "telnet" },
+			errContains: []string{"connection must be one of ssh or ssm: telnet"},
+		},
+		{
+			description: "Invalid distribution",
+			modify: func(c *Config) {
+				c.Distribution = Distribution{Regions: []string{"us-west-2", "us-west-2"}}
+			},
+			errContains: []string{"region us-west-2 is given more than once"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			cfg := testConfig()
+			tc.modify(&cfg)
+			err := cfg.Validate()
+			if len(tc.errContains) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidConfig)
+			for _, s := range tc.errContains {
+				assert.ErrorContains(t, err, s)
+			}
+		})
+	}
+}
+
+func TestBuildWithClients(t *testing.T) {
+	client := &mockEC2Client{}
+	runner := &mockRunner{}
+	connector := &mockConnector{keyPair: true, port: 22, runner: runner}
+	output := &bytes.Buffer{}
+	cfg := testConfig()
+	cfg.Output = output
+
+	result, err := BuildWithClients(context.Background(), cfg, client, mockWaiters(client), connector)
+	require.NoError(t, err)
+	assert.Equal(t, &Result{AMI: "ami-123", SnapshotID: "snap-123"}, result)
+
+	assert.Equal(t, []string{
+		"DescribeSubnets",
+		"CreateSecurityGroup",
+		"AuthorizeSecurityGroupIngress",
+		"CreateKeyPair",
+		"RunInstances",
+		"WaitInstanceRunning",
+		"DescribeInstances",
+		"DescribeInstances",
+		"StopInstances",
+		"WaitInstanceStopped",
+		"CreateSnapshot",
+		"WaitSnapshotCompleted",
+		"RegisterImage",
+		"WaitImageAvailable",
+		"TerminateInstances",
+		"WaitInstanceTerminated",
+		"DeleteKeyPair",
+		"DeleteSecurityGroup",
+	}, client.calls)
+
+	assert.Equal(t, int32(22), *client.ingressInput.IpPermissions[0].FromPort)
+	assert.Equal(t, []byte("key"), connector.privateKey)
+	assert.True(t, runner.closed)
+	assert.Empty(t, runner.uploads)
+
+	run := client.runInstancesInput
+	assert.Equal(t, "ami-builder", *run.ImageId)
+	assert.Equal(t, ec2types.InstanceType("t3.micro"), run.InstanceType)
+	assert.Equal(t, "subnet-123", *run.NetworkInterfaces[0].SubnetId)
+	assert.Equal(t, []string{"sg-123"}, run.NetworkInterfaces[0].Groups)
+	assert.True(t, *run.NetworkInterfaces[0].AssociatePublicIpAddress)
+	assert.NotNil(t, run.KeyName)
+	assert.Nil(t, run.IamInstanceProfile)
+	assert.Equal(t, volumeDevice, *run.BlockDeviceMappings[0].DeviceName)
+	assert.Equal(t, int32(10), *run.BlockDeviceMappings[0].Ebs.VolumeSize)
+
+	require.Len(t, runner.scripts, 1)
+	script := runner.scripts[0]
+	assert.Contains(t, script, `easyto_path=$(command -v easyto)`)
+	assert.Contains(t, script, `"${asset_dir}/ctr2disk" --asset-dir="${asset_dir}" '--changes=[]'`)
+	assert.Contains(t, script, `'--services=chrony,ssh'`)
+	assert.Contains(t, script, `'--users=[]'`)
+	assert.Contains(t, script, `'--container-image=alpine:latest' '--vm-image-device=/dev/xvdf'`)
+	assert.NotContains(t, script, "--debug")
+
+	register := client.registerImageInput
+	assert.Equal(t, "test-ami", *register.Name)
+	assert.Equal(t, ec2types.ArchitectureValuesX8664, register.Architecture)
+	assert.Equal(t, ec2types.BootModeValuesUefi, register.BootMode)
+	assert.Equal(t, "/dev/xvda", *register.RootDeviceName)
+	assert.Equal(t, "snap-123", *register.BlockDeviceMappings[0].Ebs.SnapshotId)
+	assert.ElementsMatch(t, []ec2types.Tag{
+		{Key: aws.String("team"), Value: aws.String("dev")},
+		{Key: aws.String(TagContainerImage), Value: aws.String("alpine:latest")},
+	}, register.TagSpecifications[0].Tags)
+
+	assert.Contains(t, output.String(), "ctr2disk output\n")
+}
+
+func TestBuildWithClientsSlowMode(t *testing.T) {
+	assetDir := t.TempDir()
+	for _, name := range assetFiles {
+		err := os.WriteFile(filepath.Join(assetDir, name), []byte(name+" contents"), 0644)
+		require.NoError(t, err)
+	}
+
+	client := &mockEC2Client{}
+	runner := &mockRunner{}
+	connector := &mockConnector{keyPair: true, port: 22, runner: runner}
+	cfg := testConfig()
+	cfg.Mode = sourceami.ModeSlow
+	cfg.AssetDir = assetDir
+	cfg.SSHInterface = SSHInterfacePrivateIP
+	cfg.Ctr2Disk.Debug = true
+	cfg.Ctr2Disk.Changes = []string{"USER app"}
+	cfg.Ctr2Disk.Users = []login.UserSpec{{Name: "alice"}}
+
+	_, err := BuildWithClients(context.Background(), cfg, client, mockWaiters(client), connector)
+	require.NoError(t, err)
+
+	assert.Len(t, runner.uploads, len(assetFiles))
+	assert.Equal(t, "ctr2disk contents", runner.uploads["/tmp/assets/ctr2disk"])
+	assert.False(t, *client.runInstancesInput.NetworkInterfaces[0].AssociatePublicIpAddress)
+
+	script := runner.scripts[0]
+	assert.Contains(t, script, "asset_dir='/tmp/assets'\n")
+	assert.NotContains(t, script, "command -v easyto")
+	assert.Contains(t, script, `'--changes=["USER app"]'`)
+	assert.Contains(t, script, `'--users=[{"name":"alice"}]'`)
+	assert.Contains(t, script, "'--debug'")
+}
+
+func TestBuildWithClientsSSM(t *testing.T) {
+	client := &mockEC2Client{}
+	runner := &mockRunner{}
+	connector := &mockConnector{runner: runner}
+	cfg := testConfig()
+	cfg.Connection = ConnectionSSM
+	cfg.InstanceProfile = "arn:aws:iam::123456789012:instance-profile/builder"
+
+	_, err := BuildWithClients(context.Background(), cfg, client, mockWaiters(client), connector)
+	require.NoError(t, err)
+
+	assert.NotContains(t, client.calls, "AuthorizeSecurityGroupIngress")
+	assert.NotContains(t, client.calls, "CreateKeyPair")
+	assert.NotContains(t, client.calls, "DeleteKeyPair")
+	assert.Empty(t, connector.privateKey)
+
+	run := client.runInstancesInput
+	assert.Nil(t, run.KeyName)
+	assert.False(t, *run.NetworkInterfaces[0].AssociatePublicIpAddress)
+	assert.Equal(t, cfg.InstanceProfile, *run.IamInstanceProfile.Arn)
+	assert.Nil(t, run.IamInstanceProfile.Name)
+}
+
+func TestBuildWithClientsPublic(t *testing.T) {
+	client := &mockEC2Client{}
+	connector := &mockConnector{keyPair: true, port: 22, runner: &mockRunner{}}
+	cfg := testConfig()
+	cfg.Public = true
+
+	_, err := BuildWithClients(context.Background(), cfg, client, mockWaiters(client), connector)
+	require.NoError(t, err)
+	assert.Contains(t, client.calls, "ModifyImageAttribute")
+	assert.Contains(t, client.calls, "ModifySnapshotAttribute")
+}
+
+func TestBuildWithClientsErrors(t *testing.T) {
+	testCases := []struct {
+		description string
+		errs        map[string]error
+		connectErr  error
+		runErr      error
+		noVolume    bool
+		errContains []string
+		called      []string
+		notCalled   []string
+		hasResult   bool
+	}{
+		{
+			description: "Subnet lookup fails",
+			errs:        map[string]error{"DescribeSubnets": errors.New("no access")},
+			errContains: []string{"failed to describe subnet subnet-123: no access"},
+			notCalled:   []string{"CreateSecurityGroup", "DeleteSecurityGroup", "TerminateInstances"},
+		},
+		{
+			description: "Key pair creation fails",
+			errs:        map[string]error{"CreateKeyPair": errors.New("quota")},
+			errContains: []string{"failed to create key pair: quota"},
+			called:      []string{"DeleteSecurityGroup"},
+			notCalled:   []string{"RunInstances", "DeleteKeyPair", "TerminateInstances"},
+		},
+		{
+			description: "Launch fails",
+			errs:        map[string]error{"RunInstances": errors.New("capacity")},
+			errContains: []string{"failed to launch builder instance: capacity"},
+			called:      []string{"DeleteKeyPair", "DeleteSecurityGroup"},
+			notCalled:   []string{"TerminateInstances"},
+		},
+		{
+			description: "Connect fails",
+			connectErr:  errors.New("timeout"),
+			errContains: []string{"failed to connect to builder instance i-123: timeout"},
+			called:      []string{"TerminateInstances", "DeleteKeyPair", "DeleteSecurityGroup"},
+			notCalled:   []string{"CreateSnapshot"},
+		},
+		{
+			description: "ctr2disk fails",
+			runErr:      errors.New("exit status 1"),
+			errContains: []string{"failed to run ctr2disk: exit status 1"},
+			called:      []string{"TerminateInstances", "DeleteKeyPair", "DeleteSecurityGroup"},
+			notCalled:   []string{"StopInstances", "CreateSnapshot"},
+		},
+		{
+			description: "Volume not attached",
+			noVolume:    true,
+			errContains: []string{"no volume attached to builder instance i-123 at /dev/xvdf"},
+			notCalled:   []string{"CreateSnapshot"},
+		},
+		{
+			description: "Snapshot fails",
+			errs:        map[string]error{"WaitSnapshotCompleted": errors.New("snapshot error")},
+			errContains: []string{"failed waiting for snapshot snap-123: snapshot error"},
+			called:      []string{"DeleteSnapshot", "TerminateInstances"},
+			notCalled:   []string{"RegisterImage"},
+		},
+		{
+			description: "Register fails",
+			errs:        map[string]error{"RegisterImage": errors.New("duplicate name")},
+			errContains: []string{"failed to register AMI: duplicate name"},
+			called:      []string{"DeleteSnapshot", "TerminateInstances"},
+		},
+		{
+			description: "Image wait fails",
+			errs:        map[string]error{"WaitImageAvailable": errors.New("image failed")},
+			errContains: []string{"failed waiting for AMI ami-123: image failed"},
+			notCalled:   []string{"DeleteSnapshot"},
+		},
+		{
+			description: "Making public fails",
+			errs:        map[string]error{"ModifyImageAttribute": errors.New("blocked")},
+			errContains: []string{"failed to make AMI public: blocked"},
+			notCalled:   []string{"DeleteSnapshot"},
+			hasResult:   true,
+		},
+		{
+			description: "Cleanup fails",
+			errs: map[string]error{
+				"WaitInstanceTerminated": errors.New("still running"),
+				"DeleteSecurityGroup":    errors.New("dependency violation"),
+			},
+			errContains: []string{
+				"failed to terminate builder instance i-123: still running",
+				"failed to delete security group sg-123: dependency violation",
+			},
+			called:    []string{"DeleteKeyPair"},
+			hasResult: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			client := &mockEC2Client{errs: tc.errs, noVolume: tc.noVolume}
+			runner := &mockRunner{runErr: tc.runErr}
+			connector := &mockConnector{
+				keyPair:    true,
+				port:       22,
+				connectErr: tc.connectErr,
+				runner:     runner,
+			}
+			cfg := testConfig()
+			cfg.Public = true
+
+			result, err := BuildWithClients(context.Background(), cfg, client,
+				mockWaiters(client), connector)
+			for _, s := range tc.errContains {
+				assert.ErrorContains(t, err, s)
+			}
+			assert.Equal(t, tc.hasResult, result != nil)
+			for _, name := range tc.called {
+				assert.Contains(t, client.calls, name)
+			}
+			for _, name := range tc.notCalled {
+				assert.NotContains(t, client.calls, name)
+			}
+		})
+	}
+}
+
+func TestBuildWithClientsInvalidConfig(t *testing.T) {
+	client := &mockEC2Client{}
+	cfg := testConfig()
+	cfg.SubnetID = ""
+
+	_, err := BuildWithClients(context.Background(), cfg, client, mockWaiters(client),
+		&mockConnector{})
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	assert.Empty(t, client.calls)
+}
+
+func TestCtr2DiskArgs(t *testing.T) {
+	opts := Ctr2DiskOptions{
+		Changes:             []string{"ENV A=b c"},
+		LockUsers:           []string{"root", "admin"},
+		LoginCheck:          "fail",
+		LoginPasswordHash:   "$6$salt$hash",
+		LoginShell:          "/bin/bash",
+		LoginUser:           "ops",
+		PrivilegeEscalation: "sudo",
+		RemoveUsers:         []string{"games"},
+		Services:            []string{"ssh"},
+		SidecarImages:       []string{"log=fluent/fluent-bit"},
+		Users:               []login.UserSpec{{Name: "alice", UID: aws.Uint32(2000)}},
+		Debug:               true,
+	}
+	args, err := opts.args()
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		`--changes=["ENV A=b c"]`,
+		"--lock-users=root,admin",
+		"--login-check=fail",
+		"--login-password-hash=$6$salt$hash",
+		"--login-shell=/bin/bash",
+		"--login-user=ops",
+		"--privilege-escalation=sudo",
+		"--remove-users=games",
+		"--services=ssh",
+		"--sidecar-images=log=fluent/fluent-bit",
+		`--users=[{"name":"alice","uid":2000}]`,
+		"--debug",
+	}, args)
+	assert.False(t, strings.Contains(strings.Join(args, " "), "null"))
+}
@@ -0,0 +1,355 @@
+package amibuild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// copyTimeout is how long to wait for a copy of an AMI in another region to
+// become available.
+const copyTimeout = 60 * time.Minute
+
+var (
+	accountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+	orgARNPattern    = regexp.MustCompile(
+		`^arn:aws[a-z-]*:organizations::[0-9]{12}:organization/o-[a-z0-9]{10,32}$`)
+	ouARNPattern = regexp.MustCompile(
+		`^arn:aws[a-z-]*:organizations::[0-9]{12}:ou/o-[a-z0-9]{10,32}/ou-[a-z0-9]{4,32}-[a-z0-9]{8,32}$`)
+	regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-[0-9]+$`)
+)
+
+// Distribution configures where an AMI is made available after it is
+// registered. It is copied to Regions, and it and its copies are shared with
+// Accounts, OrganizationARNs, and OrganizationalUnitARNs. Accounts are also
+// given permission to create volumes from the snapshots. Organizations and
+// organizational units can launch the AMI without permission on the
+// snapshots, which EBS does not support for them.
+type Distribution struct {
+	Regions                []string
+	Accounts               []string
+	OrganizationARNs       []string
+	OrganizationalUnitARNs []string
+}
+
+// Validate returns an error if any region, account, or ARN is malformed or
+// given more than once.
+func (d *Distribution) Validate() error {
+	var errs []error
+	errs = append(errs, validateList("region", d.Regions, regionPattern)...)
+	errs = append(errs, validateList("account ID", d.Accounts, accountIDPattern)...)
+	errs = append(errs, validateList("organization ARN", d.OrganizationARNs, orgARNPattern)...)
+	errs = append(errs, validateList("organizational unit ARN", d.OrganizationalUnitARNs,
+		ouARNPattern)...)
+	return errors.Join(errs...)
+}
+
+func (d *Distribution) shared() bool {
+	return len(d.Accounts) > 0 || len(d.OrganizationARNs) > 0 ||
+		len(d.OrganizationalUnitARNs) > 0
+}
+
+func validateList(kind string, values []string, pattern *regexp.Regexp) []error {
+	var errs []error
+	seen := map[string]bool{}
+	for _, value := range values {
+		if !pattern.MatchString(value) {
+			errs = append(errs, fmt.Errorf("invalid %s %q", kind, value))
+		}
+		if seen[value] {
+			errs = append(errs, fmt.Errorf("%s %s is given more than once", kind, value))
+		}
+		seen[value] = true
+	}
+	return errs
+}
+
+// CopyClient is the subset of the EC2 API used to copy an AMI to a region.
+type CopyClient interface {
+	CopyImage(
+		ctx context.Context,
+		params *ec2.CopyImageInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.CopyImageOutput, error)
+	DescribeImages(
+		ctx context.Context,
+		params *ec2.DescribeImagesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DescribeImagesOutput, error)
+	sharingClient
+}
+
+// RegionClients returns the clients to use in the region an AMI is copied to.
+type RegionClients func(region string) (CopyClient, ImageAvailableWaiter)
+
+// PublicClient is the subset of the EC2 API used by MakeImagePublic.
+type PublicClient interface {
+	DescribeImages(
+		ctx context.Context,
+		params *ec2.DescribeImagesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DescribeImagesOutput, error)
+	sharingClient
+}
+
+// sharingClient is the subset of the EC2 API used to share an AMI.
+type sharingClient interface {
+	ModifyImageAttribute(
+		ctx context.Context,
+		params *ec2.ModifyImageAttributeInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.ModifyImageAttributeOutput, error)
+	ModifySnapshotAttribute(
+		ctx context.Context,
+		params *ec2.ModifySnapshotAttributeInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.ModifySnapshotAttributeOutput, error)
+}
+
+// CopyWithClients copies the AMI amiID in sourceRegion to each region in
+// cfg.Distribution at the same time, and waits for the copies to become
+// available. Each copy is made public or shared the same as the source AMI.
+// It returns the IDs of the copies by region, including those that succeeded
+// if others failed.
+func CopyWithClients(
+	ctx context.Context,
+	cfg Config,
+	sourceRegion string,
+	amiID string,
+	clients RegionClients,
+) (map[string]string, error) {
+	if slices.Contains(cfg.Distribution.Regions, sourceRegion) {
+		return nil, fmt.Errorf("%w: cannot copy AMI to its own region %s", ErrInvalidConfig,
+			sourceRegion)
+	}
+
+	c := &copier{
+		cfg:          cfg,
+		sourceRegion: sourceRegion,
+		amiID:        amiID,
+		copies:       map[string]string{},
+	}
+	group := errgroup.Group{}
+	errs := make([]error, len(cfg.Distribution.Regions))
+	for i, region := range cfg.Distribution.Regions {
+		group.Go(func() error {
+			client, waiter := clients(region)
+			errs[i] = c.copyTo(ctx, region, client, waiter)
+			return nil
+		})
+	}
+	group.Wait()
+
+	return maps.Clone(c.copies), errors.Join(errs...)
+}
+
+type copier struct {
+	cfg          Config
+	sourceRegion string
+	amiID        string
+
+	mu     sync.Mutex
+	copies map[string]string
+}
+
+func (c *copier) copyTo(
+	ctx context.Context,
+	region string,
+	client CopyClient,
+	waiter ImageAvailableWaiter,
+) error {
+	input := &ec2.CopyImageInput{
+		Name:          aws.String(c.cfg.AMIName),
+		Description:   aws.String(c.cfg.AMIName),
+		SourceImageId: aws.String(c.amiID),
+		SourceRegion:  aws.String(c.sourceRegion),
+		CopyImageTags: aws.Bool(true),
+	}
+	// The key is looked up in the region of the copy, so it must be given
+	// by an ID or alias that exists there.
+	if c.cfg.RootVolume.Encrypted {
+		input.Encrypted = aws.Bool(true)
+		if len(c.cfg.RootVolume.KMSKeyID) > 0 {
+			input.KmsKeyId = aws.String(c.cfg.RootVolume.KMSKeyID)
+		}
+	}
+
+	c.log("Copying AMI %s to %s...\n", c.amiID, region)
+	out, err := client.CopyImage(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to copy AMI to %s: %w", region, err)
+	}
+	copyID := aws.ToString(out.ImageId)
+
+	c.log("Waiting for AMI %s in %s to become available...\n", copyID, region)
+	err = waiter.Wait(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{copyID},
+	}, copyTimeout)
+	if err != nil {
+		return fmt.Errorf("failed waiting for AMI %s in %s: %w", copyID, region, err)
+	}
+
+	if c.cfg.Public || c.cfg.Distribution.shared() {
+		snapshotIDs, err := imageSnapshots(ctx, client, copyID)
+		if err != nil {
+			return fmt.Errorf("failed to get snapshots of AMI %s in %s: %w", copyID, region, err)
+		}
+		if c.cfg.Public {
+			if err = makePublic(ctx, client, copyID, snapshotIDs, c.log); err != nil {
+				return err
+			}
+		}
+		if err = share(ctx, client, c.cfg.Distribution, copyID, snapshotIDs, c.log); err != nil {
+			return err
+		}
+	}
+
+	c.log("Copied AMI %s to %s as %s\n", c.amiID, region, copyID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.copies[region] = copyID
+	return nil
+}
+
+func (c *copier) log(format string, args ...any) {
+	if c.cfg.Output != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		fmt.Fprintf(c.cfg.Output, format, args...)
+	}
+}
+
+func imageSnapshots(ctx context.Context, client PublicClient, amiID string) ([]string, error) {
+	out, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []string{amiID},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Images) == 0 {
+		return nil, fmt.Errorf("AMI %s not found", amiID)
+	}
+	var snapshotIDs []string
+	for _, bdm := range out.Images[0].BlockDeviceMappings {
+		if bdm.Ebs != nil && bdm.Ebs.SnapshotId != nil {
+			snapshotIDs = append(snapshotIDs, *bdm.Ebs.SnapshotId)
+		}
+	}
+	return snapshotIDs, nil
+}
+
+// MakeImagePublic makes the AMI amiID and the snapshots of its volumes
+// public, writing progress messages with log.
+func MakeImagePublic(
+	ctx context.Context,
+	client PublicClient,
+	amiID string,
+	log func(string, ...any),
+) error {
+	snapshotIDs, err := imageSnapshots(ctx, client, amiID)
+	if err != nil {
+		return fmt.Errorf("failed to get snapshots of AMI %s: %w", amiID, err)
+	}
+	return makePublic(ctx, client, amiID, snapshotIDs, log)
+}
+
+func makePublic(
+	ctx context.Context,
+	client sharingClient,
+	amiID string,
+	snapshotIDs []string,
+	log func(string, ...any),
+) error {
+	log("Making AMI %s public...\n", amiID)
+	_, err := client.ModifyImageAttribute(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId: aws.String(amiID),
+		LaunchPermission: &ec2types.LaunchPermissionModifications{
+			Add: []ec2types.LaunchPermission{
+				{Group: ec2types.PermissionGroupAll},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to make AMI public: %w", err)
+	}
+
+	for _, snapshotID := range snapshotIDs {
+		log("Making snapshot %s public...\n", snapshotID)
+		_, err = client.ModifySnapshotAttribute(ctx, &ec2.ModifySnapshotAttributeInput{
+			SnapshotId:    aws.String(snapshotID),
+			Attribute:     ec2types.SnapshotAttributeNameCreateVolumePermission,
+			OperationType: ec2types.OperationTypeAdd,
+			GroupNames:    []string{"all"},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to make snapshot %s public: %w", snapshotID, err)
+		}
+	}
+	return nil
+}
+
+// share grants the accounts, organizations, and organizational units in d
+// permission to launch the AMI, and the accounts permission to create volumes
+// from its snapshots.
+func share(
+	ctx context.Context,
+	client sharingClient,
+	d Distribution,
+	amiID string,
+	snapshotIDs []string,
+	log func(string, ...any),
+) error {
+	if !d.shared() {
+		return nil
+	}
+
+	permissions := []ec2types.LaunchPermission{}
+	for _, account := range d.Accounts {
+		permissions = append(permissions, ec2types.LaunchPermission{UserId: aws.String(account)})
+	}
+	for _, arn := range d.OrganizationARNs {
+		permissions = append(permissions, ec2types.LaunchPermission{OrganizationArn: aws.String(arn)})
+	}
+	for _, arn := range d.OrganizationalUnitARNs {
+		permissions = append(permissions,
+			ec2types.LaunchPermission{OrganizationalUnitArn: aws.String(arn)})
+	}
+
+	log("Sharing AMI %s...\n", amiID)
+	_, err := client.ModifyImageAttribute(ctx, &ec2.ModifyImageAttributeInput{
+		ImageId: aws.String(amiID),
+		LaunchPermission: &ec2types.LaunchPermissionModifications{
+			Add: permissions,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to share AMI %s: %w", amiID, err)
+	}
+
+	if len(d.Accounts) == 0 {
+		return nil
+	}
+	for _, snapshotID := range snapshotIDs {
+		log("Sharing snapshot %s...\n", snapshotID)
+		_, err = client.ModifySnapshotAttribute(ctx, &ec2.ModifySnapshotAttributeInput{
+			SnapshotId:    aws.String(snapshotID),
+			Attribute:     ec2types.SnapshotAttributeNameCreateVolumePermission,
+			OperationType: ec2types.OperationTypeAdd,
+			UserIds:       d.Accounts,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to share snapshot %s: %w", snapshotID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package amibuild
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testOrgARN = "arn:aws:organizations::123456789012:organization/o-a1b2c3d4e5"
+	testOUARN  = "arn:aws:organizations::123456789012:ou/o-a1b2c3d4e5/ou-ab12-cd34ef56"
+)
+
+// mockCopyClient is a CopyClient for one region. Its copy of an AMI has the
+// ID ami-<region> and a snapshot with the ID snap-<region>.
+type mockCopyClient struct {
+	region  string
+	errs    map[string]error
+	waitErr error
+
+	copyImageInput     *ec2.CopyImageInput
+	imageAttributes    []*ec2.ModifyImageAttributeInput
+	snapshotAttributes []*ec2.ModifySnapshotAttributeInput
+}
+
+func (m *mockCopyClient) CopyImage(
+	ctx context.Context,
+	input *ec2.CopyImageInput,
+	opts ...func(*ec2.Options),
+) (*ec2.CopyImageOutput, error) {
+	m.copyImageInput = input
+	if err := m.errs["CopyImage"]; err != nil {
+		return nil, err
+	}
+	return &ec2.CopyImageOutput{ImageId: aws.String("ami-" + m.region)}, nil
+}
+
+func (m *mockCopyClient) DescribeImages(
+	ctx context.Context,
+	input *ec2.DescribeImagesInput,
+	opts ...func(*ec2.Options),
+) (*ec2.DescribeImagesOutput, error) {
+	if err := m.errs["DescribeImages"]; err != nil {
+		return nil, err
+	}
+	return &ec2.DescribeImagesOutput{
+		Images: []ec2types.Image{{
+			ImageId: aws.String(input.ImageIds[0]),
+			BlockDeviceMappings: []ec2types.BlockDeviceMapping{
+				{Ebs: &ec2types.EbsBlockDevice{SnapshotId: aws.String("snap-" + m.region)}},
+			},
+		}},
+	}, nil
+}
+
+func (m *mockCopyClient) ModifyImageAttribute(
+	ctx context.Context,
+	input *ec2.ModifyImageAttributeInput,
+	opts ...func(*ec2.Options),
+) (*ec2.ModifyImageAttributeOutput, error) {
+	m.imageAttributes = append(m.imageAttributes, input)
+	return &ec2.ModifyImageAttributeOutput{}, m.errs["ModifyImageAttribute"]
+}
+
+func (m *mockCopyClient) ModifySnapshotAttribute(
+	ctx context.Context,
+	input *ec2.ModifySnapshotAttributeInput,
+	opts ...func(*ec2.Options),
+) (*ec2.ModifySnapshotAttributeOutput, error) {
+	m.snapshotAttributes = append(m.snapshotAttributes, input)
+	return &ec2.ModifySnapshotAttributeOutput{}, m.errs["ModifySnapshotAttribute"]
+}
+
+func (m *mockCopyClient) Wait(
+	ctx context.Context,
+	params *ec2.DescribeImagesInput,
+	maxWaitDur time.Duration,
+	optFns ...func(*ec2.ImageAvailableWaiterOptions),
+) error {
+	return m.waitErr
+}
+
+func mockRegionClients(clients ...*mockCopyClient) RegionClients {
+	return func(region string) (CopyClient, ImageAvailableWaiter) {
+		for _, client := range clients {
+			if client.region == region {
+				return client, client
+			}
+		}
+		panic("no client for region " + region)
+	}
+}
+
+func TestDistributionValidate(t *testing.T) {
+	testCases := []struct {
+		description  string
+		distribution Distribution
+		errContains  []string
+	}{
+		{
+			description: "Empty",
+		},
+		{
+			description: "Valid",
+			distribution: Distribution{
+				Regions:                []string{"us-west-2", "eu-central-1", "us-gov-west-1"},
+				Accounts:               []string{"123456789012", "210987654321"},
+				OrganizationARNs:       []string{testOrgARN},
+				OrganizationalUnitARNs: []string{testOUARN},
+			},
+		},
+		{
+			description: "Invalid values",
+			distribution: Distribution{
+				Regions:                []string{"uswest2"},
+				Accounts:               []string{"12345"},
+				OrganizationARNs:       []string{"o-a1b2c3d4e5"},
+				OrganizationalUnitARNs: []string{testOrgARN},
+			},
+			errContains: []string{
+				`invalid region "uswest2"`,
+				`invalid account ID "12345"`,
+				`invalid organization ARN "o-a1b2c3d4e5"`,
+				`invalid organizational unit ARN "` + testOrgARN + `"`,
+			},
+		},
+		{
+			description: "Duplicates",
+			distribution: Distribution{
+				Regions:  []string{"us-west-2", "us-west-2"},
+				Accounts: []string{"123456789012", "123456789012"},
+			},
+			errContains: []string{
+				"region us-west-2 is given more than once",
+				"account ID 123456789012 is given more than once",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := tc.distribution.Validate()
+			if len(tc.errContains) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			for _, s := range tc.errContains {
+				assert.ErrorContains(t, err, s)
+			}
+		})
+	}
+}
+
+func TestBuildWithClientsShare(t *testing.T) {
+	client := &mockEC2Client{}
+	connector := &mockConnector{keyPair: true, port: 22, runner: &mockRunner{}}
+	cfg := testConfig()
+	cfg.Distribution = Distribution{
+		Accounts:               []string{"123456789012"},
+		OrganizationARNs:       []string{testOrgARN},
+		OrganizationalUnitARNs: []string{testOUARN},
+	}
+
+	result, err := BuildWithClients(context.Background(), cfg, client, mockWaiters(client), connector)
+	require.NoError(t, err)
+
+	require.Len(t, client.imageAttributes, 1)
+	assert.Equal(t, result.AMI, *client.imageAttributes[0].ImageId)
+	assert.Equal(t, []ec2types.LaunchPermission{
+		{UserId: aws.String("123456789012")},
+		{OrganizationArn: aws.String(testOrgARN)},
+		{OrganizationalUnitArn: aws.String(testOUARN)},
+	}, client.imageAttributes[0].LaunchPermission.Add)
+
+	require.Len(t, client.snapshotAttributes, 1)
+	assert.Equal(t, result.SnapshotID, *client.snapshotAttributes[0].SnapshotId)
+	assert.Equal(t, []string{"123456789012"}, client.snapshotAttributes[0].UserIds)
+	assert.Empty(t, client.snapshotAttributes[0].GroupNames)
+}
+
+func TestBuildWithClientsShareOrganizationOnly(t *testing.T) {
+	client := &mockEC2Client{}
+	connector := &mockConnector{keyPair: true, port: 22, runner: &mockRunner{}}
+	cfg := testConfig()
+	cfg.Distribution = Distribution{OrganizationARNs: []string{testOrgARN}}
+
+	_, err := BuildWithClients(context.Background(), cfg, client, mockWaiters(client), connector)
+	require.NoError(t, err)
+	assert.Len(t, client.imageAttributes, 1)
+	assert.Empty(t, client.snapshotAttributes, "snapshots cannot be shared with organizations")
+}
+
+func TestCopyWithClients(t *testing.T) {
+	west := &mockCopyClient{region: "us-west-2"}
+	europe := &mockCopyClient{region: "eu-central-1"}
+	output := &bytes.Buffer{}
+	cfg := testConfig()
+	cfg.Output = output
+	cfg.Public = true
+	cfg.Distribution = Distribution{
+		Regions:  []string{"us-west-2", "eu-central-1"},
+		Accounts: []string{"123456789012"},
+	}
+
+	copies, err := CopyWithClients(context.Background(), cfg, "us-east-1", "ami-123",
+		mockRegionClients(west, europe))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"us-west-2":    "ami-us-west-2",
+		"eu-central-1": "ami-eu-central-1",
+	}, copies)
+
+	for _, client := range []*mockCopyClient{west, europe} {
+		copyInput := client.copyImageInput
+		assert.Equal(t, "ami-123", *copyInput.SourceImageId)
+		assert.Equal(t, "us-east-1", *copyInput.SourceRegion)
+		assert.Equal(t, cfg.AMIName, *copyInput.Name)
+		assert.True(t, *copyInput.CopyImageTags)
+
+		require.Len(t, client.imageAttributes, 2)
+		assert.Equal(t, ec2types.PermissionGroupAll,
+			client.imageAttributes[0].LaunchPermission.Add[0].Group)
+		assert.Equal(t, "123456789012",
+			*client.imageAttributes[1].LaunchPermission.Add[0].UserId)
+		for _, input := range client.imageAttributes {
+			assert.Equal(t, "ami-"+client.region, *input.ImageId)
+		}
+
+		require.Len(t, client.snapshotAttributes, 2)
+		assert.Equal(t, []string{"all"}, client.snapshotAttributes[0].GroupNames)
+		assert.Equal(t, []string{"123456789012"}, client.snapshotAttributes[1].UserIds)
+		for _, input := range client.snapshotAttributes {
+			assert.Equal(t, "snap-"+client.region, *input.SnapshotId)
+		}
+	}
+
+	assert.Contains(t, output.String(), "Copied AMI ami-123 to us-west-2 as ami-us-west-2\n")
+	assert.Contains(t, output.String(), "Copied AMI ami-123 to eu-central-1 as ami-eu-central-1\n")
+}
+
+func TestCopyWithClientsNotShared(t *testing.T) {
+	west := &mockCopyClient{
+		region: "us-west-2",
+		errs:   map[string]error{"DescribeImages": errors.New("not called")},
+	}
+	cfg := testConfig()
+	cfg.Distribution = Distribution{Regions: []string{"us-west-2"}}
+
+	copies, err := CopyWithClients(context.Background(), cfg, "us-east-1", "ami-123",
+		mockRegionClients(west))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"us-west-2": "ami-us-west-2"}, copies)
+	assert.Empty(t, west.imageAttributes)
+	assert.Empty(t, west.snapshotAttributes)
+}
+
+func TestCopyWithClientsEncrypted(t *testing.T) {
+	west := &mockCopyClient{region: "us-west-2"}
+	cfg := testConfig()
+	cfg.Distribution = Distribution{Regions: []string{"us-west-2"}}
+	cfg.RootVolume = RootVolume{Encrypted: true, KMSKeyID: "alias/ami"}
+
+	_, err := CopyWithClients(context.Background(), cfg, "us-east-1", "ami-123",
+		mockRegionClients(west))
+	require.NoError(t, err)
+	assert.True(t, *west.copyImageInput.Encrypted)
+	assert.Equal(t, "alias/ami", *west.copyImageInput.KmsKeyId)
+}
+
+func TestCopyWithClientsErrors(t *testing.T) {
+	testCases := []struct {
+		description string
+		client      *mockCopyClient
+		errContains string
+	}{
+		{
+			description: "Copy fails",
+			client: &mockCopyClient{
+				errs: map[string]error{"CopyImage": errors.New("quota")},
+			},
+			errContains: "failed to copy AMI to eu-central-1: quota",
+		},
+		{
+			description: "Wait fails",
+			client:      &mockCopyClient{waitErr: errors.New("timeout")},
+			errContains: "failed waiting for AMI ami-eu-central-1 in eu-central-1: timeout",
+		},
+		{
+			description: "Describe fails",
+			client: &mockCopyClient{
+				errs: map[string]error{"DescribeImages": errors.New("denied")},
+			},
+			errContains: "failed to get snapshots of AMI ami-eu-central-1 in eu-central-1: denied",
+		},
+		{
+			description: "Share fails",
+			client: &mockCopyClient{
+				errs: map[string]error{"ModifySnapshotAttribute": errors.New("denied")},
+			},
+			errContains: "failed to share snapshot snap-eu-central-1: denied",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			west := &mockCopyClient{region: "us-west-2"}
+			europe := tc.client
+			europe.region = "eu-central-1"
+			cfg := testConfig()
+			cfg.Distribution = Distribution{
+				Regions:  []string{"us-west-2", "eu-central-1"},
+				Accounts: []string{"123456789012"},
+			}
+
+			copies, err := CopyWithClients(context.Background(), cfg, "us-east-1", "ami-123",
+				mockRegionClients(west, europe))
+			assert.ErrorContains(t, err, tc.errContains)
+			assert.Equal(t, map[string]string{"us-west-2": "ami-us-west-2"}, copies,
+				"other regions are still copied")
+		})
+	}
+}
+
+func TestCopyWithClientsOwnRegion(t *testing.T) {
+	cfg := testConfig()
+	cfg.Distribution = Distribution{Regions: []string{"us-west-2", "us-east-1"}}
+
+	_, err := CopyWithClients(context.Background(), cfg, "us-east-1", "ami-123",
+		mockRegionClients())
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	assert.ErrorContains(t, err, "cannot copy AMI to its own region us-east-1")
+}
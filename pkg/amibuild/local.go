@@ -0,0 +1,232 @@
+package amibuild
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ebs"
+	ebstypes "github.com/aws/aws-sdk-go-v2/service/ebs/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// blockSize is the size in bytes of every block in a snapshot.
+	blockSize = 512 * 1024
+
+	// uploadTimeout is the number of minutes after which EBS puts a snapshot
+	// in the error state if the upload of a local image has not completed.
+	uploadTimeout = 60
+)
+
+var (
+	// uploadConcurrency is the number of blocks of a local image that are
+	// uploaded at the same time.
+	uploadConcurrency = 16
+
+	zeroBlock = make([]byte, blockSize)
+)
+
+// EBSClient is the subset of the EBS direct APIs used to upload a local image.
+type EBSClient interface {
+	StartSnapshot(
+		ctx context.Context,
+		params *ebs.StartSnapshotInput,
+		optFns ...func(*ebs.Options),
+	) (*ebs.StartSnapshotOutput, error)
+	PutSnapshotBlock(
+		ctx context.Context,
+		params *ebs.PutSnapshotBlockInput,
+		optFns ...func(*ebs.Options),
+	) (*ebs.PutSnapshotBlockOutput, error)
+	CompleteSnapshot(
+		ctx context.Context,
+		params *ebs.CompleteSnapshotInput,
+		optFns ...func(*ebs.Options),
+	) (*ebs.CompleteSnapshotOutput, error)
+}
+
+// ImportWithClients creates an AMI from the raw disk image at cfg.LocalImage
+// without a builder instance. The image is uploaded to a new snapshot with
+// the EBS direct APIs, leaving out blocks that are all zeros, and an AMI is
+// registered from the snapshot. The snapshot is removed if the import fails
+// before the AMI is registered.
+func ImportWithClients(
+	ctx context.Context,
+	cfg Config,
+	client EC2Client,
+	ebsClient EBSClient,
+	waiters Waiters,
+) (result *Result, err error) {
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.LocalImage) == 0 {
+		return nil, fmt.Errorf("%w: local image must be defined", ErrInvalidConfig)
+	}
+	if len(cfg.Architecture) == 0 {
+		cfg.Architecture = "x86_64"
+	}
+
+	b := &build{
+		cfg:     cfg,
+		client:  client,
+		ebs:     ebsClient,
+		waiters: waiters,
+	}
+	defer func() {
+		err = errors.Join(err, b.cleanup(err != nil))
+	}()
+
+	if err = b.uploadImage(ctx); err != nil {
+		return nil, err
+	}
+	return b.register(ctx)
+}
+
+func (b *build) uploadImage(ctx context.Context) error {
+	image, err := os.Open(b.cfg.LocalImage)
+	if err != nil {
+		return fmt.Errorf("failed to open local image: %w", err)
+	}
+	defer image.Close()
+
+	info, err := image.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get size of local image: %w", err)
+	}
+	size := info.Size()
+	if size == 0 {
+		return fmt.Errorf("local image %s is empty", b.cfg.LocalImage)
+	}
+	if size > int64(b.cfg.VolumeSize)<<30 {
+		return fmt.Errorf("local image %s is %d bytes, larger than the volume size of %d GB",
+			b.cfg.LocalImage, size, b.cfg.VolumeSize)
+	}
+
+	b.log("Starting snapshot for local image %s...\n", b.cfg.LocalImage)
+	input := &ebs.StartSnapshotInput{
+		VolumeSize:  aws.Int64(int64(b.cfg.VolumeSize)),
+		ClientToken: aws.String(uuid.NewString()),
+		Description: aws.String(b.cfg.AMIName),
+		Tags:        []ebstypes.Tag{{Key: aws.String("Name"), Value: aws.String(b.cfg.AMIName)}},
+		Timeout:     aws.Int32(uploadTimeout),
+	}
+	if b.cfg.RootVolume.Encrypted {
+		input.Encrypted = aws.Bool(true)
+		if len(b.cfg.RootVolume.KMSKeyID) > 0 {
+			input.KmsKeyArn = aws.String(b.cfg.RootVolume.KMSKeyID)
+		}
+	}
+	started, err := b.ebs.StartSnapshot(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to start snapshot: %w", err)
+	}
+	b.snapshotID = aws.ToString(started.SnapshotId)
+
+	blocks := int((size + blockSize - 1) / blockSize)
+	b.log("Uploading %d blocks to snapshot %s...\n", blocks, b.snapshotID)
+	checksums, err := b.putBlocks(ctx, image, size, blocks)
+	if err != nil {
+		return err
+	}
+
+	// The aggregate checksum is the checksum of the checksums of the blocks
+	// that were written, in order of block index.
+	changed := int32(0)
+	aggregate := sha256.New()
+	for _, checksum := range checksums {
+		if checksum != nil {
+			changed++
+			aggregate.Write(checksum)
+		}
+	}
+	b.log("Completing snapshot %s with %d of %d blocks written...\n",
+		b.snapshotID, changed, blocks)
+	completed, err := b.ebs.CompleteSnapshot(ctx, &ebs.CompleteSnapshotInput{
+		SnapshotId:                aws.String(b.snapshotID),
+		ChangedBlocksCount:        aws.Int32(changed),
+		Checksum:                  aws.String(base64.StdEncoding.EncodeToString(aggregate.Sum(nil))),
+		ChecksumAlgorithm:         ebstypes.ChecksumAlgorithmChecksumAlgorithmSha256,
+		ChecksumAggregationMethod: ebstypes.ChecksumAggregationMethodChecksumAggregationLinear,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete snapshot %s: %w", b.snapshotID, err)
+	}
+	if completed.Status == ebstypes.StatusError {
+		return fmt.Errorf("snapshot %s is in the error state", b.snapshotID)
+	}
+
+	b.log("Waiting for snapshot %s to complete...\n", b.snapshotID)
+	err = b.waiters.SnapshotCompleted.Wait(ctx, &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []string{b.snapshotID},
+	}, snapshotTimeout)
+	if err != nil {
+		return fmt.Errorf("failed waiting for snapshot %s: %w", b.snapshotID, err)
+	}
+	return nil
+}
+
+// putBlocks uploads the blocks of image that are not all zeros and returns
+// the SHA256 checksum of each block by index, or nil for blocks that were
+// left out.
+func (b *build) putBlocks(ctx context.Context, image io.ReaderAt, size int64, blocks int) ([][]byte, error) {
+	checksums := make([][]byte, blocks)
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(uploadConcurrency)
+	for index := range blocks {
+		group.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			checksum, err := b.putBlock(ctx, image, size, index)
+			if err != nil {
+				return err
+			}
+			checksums[index] = checksum
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+func (b *build) putBlock(ctx context.Context, image io.ReaderAt, size int64, index int) ([]byte, error) {
+	offset := int64(index) * blockSize
+	data := make([]byte, blockSize)
+	// The last block is padded with zeros if the image is not a whole number
+	// of blocks.
+	n, err := image.ReadAt(data[:min(blockSize, size-offset)], offset)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read block %d of local image: %w", index, err)
+	}
+	clear(data[n:])
+	if bytes.Equal(data, zeroBlock) {
+		return nil, nil
+	}
+
+	checksum := sha256.Sum256(data)
+	_, err = b.ebs.PutSnapshotBlock(ctx, &ebs.PutSnapshotBlockInput{
+		SnapshotId:        aws.String(b.snapshotID),
+		BlockIndex:        aws.Int32(int32(index)),
+		BlockData:         bytes.NewReader(data),
+		DataLength:        aws.Int32(blockSize),
+		Checksum:          aws.String(base64.StdEncoding.EncodeToString(checksum[:])),
+		ChecksumAlgorithm: ebstypes.ChecksumAlgorithmChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write block %d to snapshot %s: %w",
+			index, b.snapshotID, err)
+	}
+	return checksum[:], nil
+}
@@ -0,0 +1,298 @@
+package amibuild
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ebs"
+	ebstypes "github.com/aws/aws-sdk-go-v2/service/ebs/types"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEBSClient is an in-memory stand-in for the EBS direct APIs. It checks
+// the checksum of every block and the aggregate checksum on completion, the
+// same as the real service.
+type fakeEBSClient struct {
+	mu         sync.Mutex
+	errs       map[string]error
+	status     ebstypes.Status
+	volumeSize int64
+	started    *ebs.StartSnapshotInput
+	blocks     map[int32][]byte
+	checksums  map[int32][]byte
+	completed  *ebs.CompleteSnapshotInput
+}
+
+func newFakeEBSClient() *fakeEBSClient {
+	return &fakeEBSClient{
+		errs:      map[string]error{},
+		status:    ebstypes.StatusCompleted,
+		blocks:    map[int32][]byte{},
+		checksums: map[int32][]byte{},
+	}
+}
+
+func (f *fakeEBSClient) StartSnapshot(
+	ctx context.Context,
+	params *ebs.StartSnapshotInput,
+	optFns ...func(*ebs.Options),
+) (*ebs.StartSnapshotOutput, error) {
+	if err := f.errs["StartSnapshot"]; err != nil {
+		return nil, err
+	}
+	f.volumeSize = aws.ToInt64(params.VolumeSize)
+	f.started = params
+	return &ebs.StartSnapshotOutput{
+		SnapshotId: aws.String("snap-local"),
+		BlockSize:  aws.Int32(blockSize),
+		Status:     ebstypes.StatusPending,
+	}, nil
+}
+
+func (f *fakeEBSClient) PutSnapshotBlock(
+	ctx context.Context,
+	params *ebs.PutSnapshotBlockInput,
+	optFns ...func(*ebs.Options),
+) (*ebs.PutSnapshotBlockOutput, error) {
+	if err := f.errs["PutSnapshotBlock"]; err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(params.BlockData)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != int(aws.ToInt32(params.DataLength)) || len(data) != blockSize {
+		return nil, errors.New("invalid data length")
+	}
+	checksum := sha256.Sum256(data)
+	if base64.StdEncoding.EncodeToString(checksum[:]) != aws.ToString(params.Checksum) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	index := aws.ToInt32(params.BlockIndex)
+	f.blocks[index] = data
+	f.checksums[index] = checksum[:]
+	return &ebs.PutSnapshotBlockOutput{
+		Checksum:          params.Checksum,
+		ChecksumAlgorithm: params.ChecksumAlgorithm,
+	}, nil
+}
+
+func (f *fakeEBSClient) CompleteSnapshot(
+	ctx context.Context,
+	params *ebs.CompleteSnapshotInput,
+	optFns ...func(*ebs.Options),
+) (*ebs.CompleteSnapshotOutput, error) {
+	if err := f.errs["CompleteSnapshot"]; err != nil {
+		return nil, err
+	}
+	f.completed = params
+	if int(aws.ToInt32(params.ChangedBlocksCount)) != len(f.blocks) {
+		return nil, errors.New("changed blocks count mismatch")
+	}
+	indexes := []int{}
+	for index := range f.checksums {
+		indexes = append(indexes, int(index))
+	}
+	sort.Ints(indexes)
+	aggregate := sha256.New()
+	for _, index := range indexes {
+		aggregate.Write(f.checksums[int32(index)])
+	}
+	if base64.StdEncoding.EncodeToString(aggregate.Sum(nil)) != aws.ToString(params.Checksum) {
+		return nil, errors.New("aggregate checksum mismatch")
+	}
+	return &ebs.CompleteSnapshotOutput{Status: f.status}, nil
+}
+
+// snapshot returns the contents of the snapshot up to size bytes.
+func (f *fakeEBSClient) snapshot(size int64) []byte {
+	data := make([]byte, size)
+	for index, block := range f.blocks {
+		offset := int64(index) * blockSize
+		copy(data[offset:], block[:min(int64(len(block)), size-offset)])
+	}
+	return data
+}
+
+// writeLocalImage writes an image that is not a whole number of blocks, with
+// data in the first block, the fourth block, and at the end of the partial
+// last block.
+func writeLocalImage(t *testing.T) (string, []byte) {
+	image := make([]byte, 5*blockSize+4096)
+	copy(image[100:], "EFI PART")
+	copy(image[3*blockSize+512:], bytes.Repeat([]byte{0xee}, 1024))
+	copy(image[len(image)-10:], "last bytes")
+	path := filepath.Join(t.TempDir(), "disk.raw")
+	require.NoError(t, os.WriteFile(path, image, 0644))
+	return path, image
+}
+
+func testLocalConfig(path string) Config {
+	return Config{
+		AMIName:        "test-ami",
+		RootDeviceName: "/dev/xvda",
+		VolumeSize:     1,
+		LocalImage:     path,
+	}
+}
+
+func TestImportWithClients(t *testing.T) {
+	origConcurrency := uploadConcurrency
+	uploadConcurrency = 2
+	t.Cleanup(func() { uploadConcurrency = origConcurrency })
+
+	path, image := writeLocalImage(t)
+	client := &mockEC2Client{}
+	ebsClient := newFakeEBSClient()
+	output := &bytes.Buffer{}
+	cfg := testLocalConfig(path)
+	cfg.Output = output
+
+	result, err := ImportWithClients(context.Background(), cfg, client, ebsClient, mockWaiters(client))
+	require.NoError(t, err)
+	assert.Equal(t, &Result{AMI: "ami-123", SnapshotID: "snap-local"}, result)
+
+	assert.Equal(t, []string{
+		"WaitSnapshotCompleted",
+		"RegisterImage",
+		"WaitImageAvailable",
+	}, client.calls)
+
+	assert.Equal(t, int64(1), ebsClient.volumeSize)
+	assert.Len(t, ebsClient.blocks, 3, "zero blocks are left out")
+	assert.Contains(t, ebsClient.blocks, int32(0))
+	assert.Contains(t, ebsClient.blocks, int32(3))
+	assert.Contains(t, ebsClient.blocks, int32(5))
+	assert.Equal(t, image, ebsClient.snapshot(int64(len(image))))
+	assert.Equal(t, ebstypes.ChecksumAggregationMethodChecksumAggregationLinear,
+		ebsClient.completed.ChecksumAggregationMethod)
+
+	register := client.registerImageInput
+	assert.Equal(t, ec2types.BootModeValuesUefi, register.BootMode)
+	assert.Equal(t, ec2types.ArchitectureValuesX8664, register.Architecture)
+	assert.Equal(t, "snap-local", *register.BlockDeviceMappings[0].Ebs.SnapshotId)
+	assert.Equal(t, int32(1), *register.BlockDeviceMappings[0].Ebs.VolumeSize)
+	assert.Empty(t, register.TagSpecifications[0].Tags, "no container image tag")
+
+	assert.Contains(t, output.String(), "Completing snapshot snap-local with 3 of 6 blocks written")
+}
+
+func TestImportWithClientsErrors(t *testing.T) {
+	testCases := []struct {
+		description string
+		modify      func(*Config)
+		ebsErrs     map[string]error
+		ec2Errs     map[string]error
+		status      ebstypes.Status
+		errContains string
+		called      []string
+		notCalled   []string
+	}{
+		{
+			description: "Missing local image",
+			modify:      func(c *Config) { c.LocalImage = "/nonexistent/disk.raw" },
+			errContains: "failed to open local image",
+			notCalled:   []string{"DeleteSnapshot"},
+		},
+		{
+			description: "Invalid volume size",
+			modify:      func(c *Config) { c.VolumeSize = 0 },
+			errContains: "volume size must be at least 1 GB",
+		},
+		{
+			description: "Start snapshot fails",
+			ebsErrs:     map[string]error{"StartSnapshot": errors.New("denied")},
+			errContains: "failed to start snapshot: denied",
+			notCalled:   []string{"DeleteSnapshot"},
+		},
+		{
+			description: "Put block fails",
+			ebsErrs:     map[string]error{"PutSnapshotBlock": errors.New("throttled")},
+			errContains: "failed to write block",
+			called:      []string{"DeleteSnapshot"},
+			notCalled:   []string{"RegisterImage"},
+		},
+		{
+			description: "Complete snapshot fails",
+			ebsErrs:     map[string]error{"CompleteSnapshot": errors.New("bad checksum")},
+			errContains: "failed to complete snapshot snap-local: bad checksum",
+			called:      []string{"DeleteSnapshot"},
+		},
+		{
+			description: "Snapshot in error state",
+			status:      ebstypes.StatusError,
+			errContains: "snapshot snap-local is in the error state",
+			called:      []string{"DeleteSnapshot"},
+		},
+		{
+			description: "Register fails",
+			ec2Errs:     map[string]error{"RegisterImage": errors.New("quota")},
+			errContains: "failed to register AMI: quota",
+			called:      []string{"DeleteSnapshot"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			path, _ := writeLocalImage(t)
+			client := &mockEC2Client{errs: tc.ec2Errs}
+			ebsClient := newFakeEBSClient()
+			for name, err := range tc.ebsErrs {
+				ebsClient.errs[name] = err
+			}
+			if len(tc.status) > 0 {
+				ebsClient.status = tc.status
+			}
+			cfg := testLocalConfig(path)
+			if tc.modify != nil {
+				tc.modify(&cfg)
+			}
+
+			_, err := ImportWithClients(context.Background(), cfg, client, ebsClient,
+				mockWaiters(client))
+			assert.ErrorContains(t, err, tc.errContains)
+			for _, name := range tc.called {
+				assert.Contains(t, client.calls, name)
+			}
+			for _, name := range tc.notCalled {
+				assert.NotContains(t, client.calls, name)
+			}
+		})
+	}
+}
+
+func TestImportWithClientsTooLarge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.raw")
+	image, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, image.Truncate(1<<30+blockSize))
+	require.NoError(t, image.Close())
+
+	client := &mockEC2Client{}
+	_, err = ImportWithClients(context.Background(), testLocalConfig(path), client,
+		newFakeEBSClient(), mockWaiters(client))
+	assert.ErrorContains(t, err, "larger than the volume size of 1 GB")
+	assert.Empty(t, client.calls)
+}
+
+func TestBuildWithClientsLocalImage(t *testing.T) {
+	client := &mockEC2Client{}
+	_, err := BuildWithClients(context.Background(), testLocalConfig("/tmp/disk.raw"), client,
+		mockWaiters(client), &mockConnector{})
+	assert.ErrorIs(t, err, ErrInvalidConfig)
+	assert.Empty(t, client.calls)
+}
@@ -0,0 +1,287 @@
+package amibuild
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrUploadUnsupported = errors.New("file upload is not supported by this connection")
+
+	// retryInterval is how long to wait between attempts to reach the
+	// builder, and between checks of a running SSM command.
+	retryInterval = 5 * time.Second
+)
+
+// Runner runs commands on the builder instance as root.
+type Runner interface {
+	// Upload writes the contents of r to path on the builder with the given mode.
+	Upload(ctx context.Context, path string, mode os.FileMode, r io.Reader) error
+	// Run runs a shell script on the builder, writing its output to stdout
+	// and stderr. An error is returned if the script exits nonzero.
+	Run(ctx context.Context, script string, stdout, stderr io.Writer) error
+	Close() error
+}
+
+// Connector connects to a running builder instance. The privateKey is the
+// key material of the temporary key pair the instance was launched with,
+// which is empty if no key pair was created.
+type Connector interface {
+	Connect(ctx context.Context, instance *ec2types.Instance, privateKey []byte) (Runner, error)
+	// NeedsKeyPair returns true if the connector needs a temporary key pair.
+	NeedsKeyPair() bool
+	// IngressPort returns the port the connector needs to reach on the
+	// instance, or 0 if it does not need inbound access.
+	IngressPort() int32
+}
+
+// SSHConnector connects to the builder with ssh using the temporary key pair.
+type SSHConnector struct {
+	Username  string
+	Interface string
+	Timeout   time.Duration
+}
+
+func (c *SSHConnector) NeedsKeyPair() bool {
+	return true
+}
+
+func (c *SSHConnector) IngressPort() int32 {
+	return 22
+}
+
+func (c *SSHConnector) Connect(
+	ctx context.Context,
+	instance *ec2types.Instance,
+	privateKey []byte,
+) (Runner, error) {
+	address := aws.ToString(instance.PrivateIpAddress)
+	if c.Interface == SSHInterfacePublicIP {
+		address = aws.ToString(instance.PublicIpAddress)
+	}
+	if len(address) == 0 {
+		return nil, fmt.Errorf("instance %s has no %s address",
+			aws.ToString(instance.InstanceId), c.Interface)
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+	sshConfig := &ssh.ClientConfig{
+		User: c.Username,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		// The instance is new and its host key is not known in advance.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         30 * time.Second,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(address, "22")
+	for {
+		client, err := ssh.Dial("tcp", addr, sshConfig)
+		if err == nil {
+			return &sshRunner{client: client}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("unable to connect to %s: %w", addr, err)
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+type sshRunner struct {
+	client *ssh.Client
+}
+
+func (r *sshRunner) Upload(ctx context.Context, dest string, mode os.FileMode, rd io.Reader) error {
+	return r.withSession(ctx, func(session *ssh.Session) error {
+		session.Stdin = rd
+		command := fmt.Sprintf("mkdir -p %s && cat > %s && chmod %o %s",
+			shellQuote(path.Dir(dest)), shellQuote(dest), mode.Perm(), shellQuote(dest))
+		if out, err := session.CombinedOutput(command); err != nil {
+			return fmt.Errorf("unable to upload %s: %w: %s", dest, err, out)
+		}
+		return nil
+	})
+}
+
+func (r *sshRunner) Run(ctx context.Context, script string, stdout, stderr io.Writer) error {
+	return r.withSession(ctx, func(session *ssh.Session) error {
+		session.Stdout = stdout
+		session.Stderr = stderr
+		return session.Run("sudo -n sh -c " + shellQuote(script))
+	})
+}
+
+// withSession calls fn with a new session. If ctx is done before fn returns,
+// the connection is closed so that fn does not wait for the command on the
+// builder to finish, and the error from ctx is returned.
+func (r *sshRunner) withSession(ctx context.Context, fn func(*ssh.Session) error) error {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("unable to create ssh session: %w", err)
+	}
+	defer session.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		r.client.Close()
+	})
+	defer stop()
+
+	err = fn(session)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (r *sshRunner) Close() error {
+	return r.client.Close()
+}
+
+type SSMAPI interface {
+	SendCommand(
+		ctx context.Context,
+		params *ssm.SendCommandInput,
+		optFns ...func(*ssm.Options),
+	) (*ssm.SendCommandOutput, error)
+	GetCommandInvocation(
+		ctx context.Context,
+		params *ssm.GetCommandInvocationInput,
+		optFns ...func(*ssm.Options),
+	) (*ssm.GetCommandInvocationOutput, error)
+}
+
+// SSMConnector runs commands on the builder with SSM Run Command. The builder
+// must run the SSM agent and have an instance profile that allows it to
+// register with SSM. Output is returned when the command finishes rather than
+// streamed, and SSM truncates it to the last 24000 characters.
+type SSMConnector struct {
+	Client  SSMAPI
+	Timeout time.Duration
+}
+
+func (c *SSMConnector) NeedsKeyPair() bool {
+	return false
+}
+
+func (c *SSMConnector) IngressPort() int32 {
+	return 0
+}
+
+func (c *SSMConnector) Connect(
+	ctx context.Context,
+	instance *ec2types.Instance,
+	privateKey []byte,
+) (Runner, error) {
+	return &ssmRunner{
+		client:     c.Client,
+		instanceID: aws.ToString(instance.InstanceId),
+		timeout:    c.Timeout,
+	}, nil
+}
+
+type ssmRunner struct {
+	client     SSMAPI
+	instanceID string
+	timeout    time.Duration
+}
+
+func (r *ssmRunner) Upload(ctx context.Context, dest string, mode os.FileMode, rd io.Reader) error {
+	return fmt.Errorf("%w: %s", ErrUploadUnsupported, dest)
+}
+
+func (r *ssmRunner) Run(ctx context.Context, script string, stdout, stderr io.Writer) error {
+	commandID, err := r.sendCommand(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	for {
+		out, err := r.client.GetCommandInvocation(ctx, &ssm.GetCommandInvocationInput{
+			CommandId:  aws.String(commandID),
+			InstanceId: aws.String(r.instanceID),
+		})
+		var notExist *ssmtypes.InvocationDoesNotExist
+		switch {
+		case errors.As(err, &notExist):
+		case err != nil:
+			return fmt.Errorf("unable to get status of command %s: %w", commandID, err)
+		default:
+			switch out.Status {
+			case ssmtypes.CommandInvocationStatusPending,
+				ssmtypes.CommandInvocationStatusInProgress,
+				ssmtypes.CommandInvocationStatusDelayed:
+			default:
+				io.WriteString(stdout, aws.ToString(out.StandardOutputContent))
+				io.WriteString(stderr, aws.ToString(out.StandardErrorContent))
+				if out.Status != ssmtypes.CommandInvocationStatusSuccess {
+					return fmt.Errorf("command %s finished with status %s and exit code %d",
+						commandID, out.Status, out.ResponseCode)
+				}
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// sendCommand sends the script to the instance, retrying until the instance
+// has registered with SSM.
+func (r *ssmRunner) sendCommand(ctx context.Context, script string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	for {
+		out, err := r.client.SendCommand(ctx, &ssm.SendCommandInput{
+			DocumentName: aws.String("AWS-RunShellScript"),
+			InstanceIds:  []string{r.instanceID},
+			Parameters: map[string][]string{
+				"commands":         {script},
+				"executionTimeout": {"7200"},
+			},
+		})
+		if err == nil {
+			return aws.ToString(out.Command.CommandId), nil
+		}
+		var invalidInstance *ssmtypes.InvalidInstanceId
+		if !errors.As(err, &invalidInstance) {
+			return "", fmt.Errorf("unable to send command to %s: %w", r.instanceID, err)
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("instance %s did not register with SSM: %w", r.instanceID, err)
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (r *ssmRunner) Close() error {
+	return nil
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
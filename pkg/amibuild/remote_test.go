@@ -0,0 +1,324 @@
+package amibuild
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type mockSSMClient struct {
+	sendErrs    []error
+	invocations []*ssm.GetCommandInvocationOutput
+	getErrs     []error
+	sendInput   *ssm.SendCommandInput
+	sends       int
+	gets        int
+}
+
+func (m *mockSSMClient) SendCommand(
+	ctx context.Context,
+	input *ssm.SendCommandInput,
+	opts ...func(*ssm.Options),
+) (*ssm.SendCommandOutput, error) {
+	m.sendInput = input
+	m.sends++
+	if len(m.sendErrs) > 0 {
+		err := m.sendErrs[0]
+		m.sendErrs = m.sendErrs[1:]
+		return nil, err
+	}
+	return &ssm.SendCommandOutput{
+		Command: &ssmtypes.Command{CommandId: aws.String("cmd-123")},
+	}, nil
+}
+
+func (m *mockSSMClient) GetCommandInvocation(
+	ctx context.Context,
+	input *ssm.GetCommandInvocationInput,
+	opts ...func(*ssm.Options),
+) (*ssm.GetCommandInvocationOutput, error) {
+	m.gets++
+	if len(m.getErrs) > 0 {
+		err := m.getErrs[0]
+		m.getErrs = m.getErrs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+	out := m.invocations[0]
+	if len(m.invocations) > 1 {
+		m.invocations = m.invocations[1:]
+	}
+	return out, nil
+}
+
+func TestSSMRunnerRun(t *testing.T) {
+	interval := retryInterval
+	retryInterval = time.Millisecond
+	defer func() { retryInterval = interval }()
+
+	invocation := func(status ssmtypes.CommandInvocationStatus, code int32) *ssm.GetCommandInvocationOutput {
+		return &ssm.GetCommandInvocationOutput{
+			Status:                status,
+			ResponseCode:          code,
+			StandardOutputContent: aws.String("out"),
+			StandardErrorContent:  aws.String("err"),
+		}
+	}
+
+	testCases := []struct {
+		description string
+		client      *mockSSMClient
+		timeout     time.Duration
+		sends       int
+		errContains string
+		output      bool
+	}{
+		{
+			description: "Success after instance registers",
+			client: &mockSSMClient{
+				sendErrs: []error{&ssmtypes.InvalidInstanceId{}, &ssmtypes.InvalidInstanceId{}},
+				getErrs:  []error{&ssmtypes.InvocationDoesNotExist{}},
+				invocations: []*ssm.GetCommandInvocationOutput{
+					invocation(ssmtypes.CommandInvocationStatusPending, -1),
+					invocation(ssmtypes.CommandInvocationStatusInProgress, -1),
+					invocation(ssmtypes.CommandInvocationStatusSuccess, 0),
+				},
+			},
+			timeout: time.Minute,
+			sends:   3,
+			output:  true,
+		},
+		{
+			description: "Command fails",
+			client: &mockSSMClient{
+				invocations: []*ssm.GetCommandInvocationOutput{
+					invocation(ssmtypes.CommandInvocationStatusFailed, 2),
+				},
+			},
+			timeout:     time.Minute,
+			sends:       1,
+			errContains: "command cmd-123 finished with status Failed and exit code 2",
+			output:      true,
+		},
+		{
+			description: "Send fails",
+			client: &mockSSMClient{
+				sendErrs: []error{errors.New("access denied")},
+			},
+			timeout:     time.Minute,
+			sends:       1,
+			errContains: "unable to send command to i-123: access denied",
+		},
+		{
+			description: "Instance never registers",
+			client: &mockSSMClient{
+				sendErrs: []error{
+					&ssmtypes.InvalidInstanceId{}, &ssmtypes.InvalidInstanceId{},
+					&ssmtypes.InvalidInstanceId{}, &ssmtypes.InvalidInstanceId{},
+					&ssmtypes.InvalidInstanceId{}, &ssmtypes.InvalidInstanceId{},
+					&ssmtypes.InvalidInstanceId{}, &ssmtypes.InvalidInstanceId{},
+				},
+			},
+			timeout:     0,
+			sends:       1,
+			errContains: "instance i-123 did not register with SSM",
+		},
+		{
+			description: "Status check fails",
+			client: &mockSSMClient{
+				getErrs: []error{errors.New("throttled")},
+			},
+			timeout:     time.Minute,
+			sends:       1,
+			errContains: "unable to get status of command cmd-123: throttled",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			connector := &SSMConnector{Client: tc.client, Timeout: tc.timeout}
+			assert.False(t, connector.NeedsKeyPair())
+			assert.Equal(t, int32(0), connector.IngressPort())
+
+			runner, err := connector.Connect(context.Background(),
+				&ec2types.Instance{InstanceId: aws.String("i-123")}, nil)
+			require.NoError(t, err)
+			defer runner.Close()
+
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			err = runner.Run(context.Background(), "echo hi", stdout, stderr)
+			if tc.errContains != "" {
+				assert.ErrorContains(t, err, tc.errContains)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.sends, tc.client.sends)
+			if tc.output {
+				assert.Equal(t, "out", stdout.String())
+				assert.Equal(t, "err", stderr.String())
+			}
+			assert.Equal(t, []string{"echo hi"}, tc.client.sendInput.Parameters["commands"])
+			assert.Equal(t, "AWS-RunShellScript", *tc.client.sendInput.DocumentName)
+		})
+	}
+}
+
+func TestSSMRunnerUpload(t *testing.T) {
+	runner := &ssmRunner{instanceID: "i-123"}
+	err := runner.Upload(context.Background(), "/tmp/assets/ctr2disk", 0755, strings.NewReader(""))
+	assert.ErrorIs(t, err, ErrUploadUnsupported)
+}
+
+func TestSSHConnectorConnectErrors(t *testing.T) {
+	testCases := []struct {
+		description string
+		connector   *SSHConnector
+		instance    *ec2types.Instance
+		key         []byte
+		errContains string
+	}{
+		{
+			description: "No public address",
+			connector:   &SSHConnector{Interface: SSHInterfacePublicIP},
+			instance: &ec2types.Instance{
+				InstanceId:       aws.String("i-123"),
+				PrivateIpAddress: aws.String("10.0.0.1"),
+			},
+			errContains: "instance i-123 has no public_ip address",
+		},
+		{
+			description: "Invalid private key",
+			connector:   &SSHConnector{Interface: SSHInterfacePrivateIP},
+			instance: &ec2types.Instance{
+				InstanceId:       aws.String("i-123"),
+				PrivateIpAddress: aws.String("10.0.0.1"),
+			},
+			key:         []byte("not a key"),
+			errContains: "unable to parse private key",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.True(t, tc.connector.NeedsKeyPair())
+			assert.Equal(t, int32(22), tc.connector.IngressPort())
+			_, err := tc.connector.Connect(context.Background(), tc.instance, tc.key)
+			assert.ErrorContains(t, err, tc.errContains)
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"", `''`},
+		{"abc", `'abc'`},
+		{"a b", `'a b'`},
+		{`$6$salt$hash`, `'$6$salt$hash'`},
+		{"it's", `'it'\''s'`},
+		{`["CMD [\"sh\"]"]`, `'["CMD [\"sh\"]"]'`},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, shellQuote(tc.input))
+	}
+}
+
+// newHangingSSHClient returns a client connected to an in-process ssh server
+// that accepts commands but never finishes them.
+func newHangingSSHClient(t *testing.T) *ssh.Client {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, channels, requests, err := ssh.NewServerConn(serverConn, serverConfig)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(requests)
+		for newChannel := range channels {
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, channel)
+			go func() {
+				for req := range requests {
+					req.Reply(req.Type == "exec", nil)
+				}
+			}()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "cloudboss",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSSHRunnerCanceled(t *testing.T) {
+	testCases := []struct {
+		description string
+		call        func(ctx context.Context, runner Runner) error
+	}{
+		{
+			description: "Run",
+			call: func(ctx context.Context, runner Runner) error {
+				return runner.Run(ctx, "sleep 3600", io.Discard, io.Discard)
+			},
+		},
+		{
+			description: "Upload",
+			call: func(ctx context.Context, runner Runner) error {
+				return runner.Upload(ctx, "/tmp/assets/ctr2disk", 0755, strings.NewReader("data"))
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			runner := &sshRunner{client: newHangingSSHClient(t)}
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- tc.call(ctx, runner)
+			}()
+			select {
+			case err := <-errc:
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			case <-time.After(5 * time.Second):
+				t.Fatal("runner did not return after its context was done")
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package amibuild
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+// volumeLimits are the limits EC2 places on the IOPS and throughput of a
+// volume type. A zero maxIOPS or maxThroughput means the volume type does
+// not take the setting.
+type volumeLimits struct {
+	iopsRequired  bool
+	minIOPS       int32
+	maxIOPS       int32
+	iopsPerGB     int32
+	minThroughput int32
+	maxThroughput int32
+}
+
+// rootVolumeTypes are the volume types that can be used for a root volume,
+// which excludes st1 and sc1.
+var rootVolumeTypes = map[ec2types.VolumeType]volumeLimits{
+	ec2types.VolumeTypeGp2:      {},
+	ec2types.VolumeTypeStandard: {},
+	ec2types.VolumeTypeGp3: {
+		minIOPS:       3000,
+		maxIOPS:       80000,
+		iopsPerGB:     500,
+		minThroughput: 125,
+		maxThroughput: 2000,
+	},
+	ec2types.VolumeTypeIo1: {iopsRequired: true, minIOPS: 100, maxIOPS: 64000, iopsPerGB: 50},
+	ec2types.VolumeTypeIo2: {iopsRequired: true, minIOPS: 100, maxIOPS: 256000, iopsPerGB: 1000},
+}
+
+// gp3IOPSPerThroughput is the number of IOPS a gp3 volume must have for each
+// MiB/s of throughput.
+const gp3IOPSPerThroughput = 4
+
+// RootVolume configures the root volume of the AMI. If Encrypted is true, the
+// snapshot is encrypted with the KMS key KMSKeyID, or with the default EBS
+// key if it is empty.
+type RootVolume struct {
+	Type       string
+	IOPS       int32
+	Throughput int32
+	Encrypted  bool
+	KMSKeyID   string
+}
+
+func (v *RootVolume) volumeType() ec2types.VolumeType {
+	if len(v.Type) == 0 {
+		return ec2types.VolumeTypeGp2
+	}
+	return ec2types.VolumeType(v.Type)
+}
+
+// ValidateRootVolume returns an error if the root volume options are not a
+// combination supported by EC2 for the volume size, or cannot be used with
+// the local image or distribution of the AMI.
+func (c *Config) ValidateRootVolume() error {
+	var errs []error
+	v := c.RootVolume
+	volumeType := v.volumeType()
+
+	limits, ok := rootVolumeTypes[volumeType]
+	if !ok {
+		types := slices.Sorted(maps.Keys(rootVolumeTypes))
+		return fmt.Errorf("volume type must be one of %s: %s", joinTypes(types), v.Type)
+	}
+
+	switch {
+	case v.IOPS == 0 && limits.iopsRequired:
+		errs = append(errs, fmt.Errorf("volume type %s requires iops", volumeType))
+	case v.IOPS != 0 && limits.maxIOPS == 0:
+		errs = append(errs, fmt.Errorf("iops is not supported for volume type %s", volumeType))
+	case v.IOPS != 0 && (v.IOPS < limits.minIOPS || v.IOPS > limits.maxIOPS):
+		errs = append(errs, fmt.Errorf("iops for volume type %s must be between %d and %d: %d",
+			volumeType, limits.minIOPS, limits.maxIOPS, v.IOPS))
+	case v.IOPS > max(limits.minIOPS, limits.iopsPerGB*c.VolumeSize):
+		errs = append(errs, fmt.Errorf("iops for volume type %s can be at most %d per GB, %d for %d GB: %d",
+			volumeType, limits.iopsPerGB, max(limits.minIOPS, limits.iopsPerGB*c.VolumeSize),
+			c.VolumeSize, v.IOPS))
+	}
+
+	if v.Throughput != 0 {
+		iops := max(v.IOPS, limits.minIOPS)
+		switch {
+		case limits.maxThroughput == 0:
+			errs = append(errs, fmt.Errorf("throughput is not supported for volume type %s",
+				volumeType))
+		case v.Throughput < limits.minThroughput || v.Throughput > limits.maxThroughput:
+			errs = append(errs, fmt.Errorf("throughput for volume type %s must be between %d and %d MiB/s: %d",
+				volumeType, limits.minThroughput, limits.maxThroughput, v.Throughput))
+		case v.Throughput*gp3IOPSPerThroughput > iops:
+			errs = append(errs, fmt.Errorf("throughput for volume type %s can be at most %d MiB/s with %d iops: %d",
+				volumeType, iops/gp3IOPSPerThroughput, iops, v.Throughput))
+		}
+	}
+
+	if len(v.KMSKeyID) > 0 {
+		if !v.Encrypted {
+			errs = append(errs, errors.New("KMS key requires encryption"))
+		}
+		if len(c.LocalImage) > 0 && !strings.HasPrefix(v.KMSKeyID, "arn:") {
+			errs = append(errs, fmt.Errorf("KMS key for a local image must be a key ARN: %s",
+				v.KMSKeyID))
+		}
+		if len(c.Distribution.Regions) > 0 && strings.HasPrefix(v.KMSKeyID, "arn:") {
+			errs = append(errs, fmt.Errorf("KMS key must be a key ID or alias to copy the AMI to other regions: %s",
+				v.KMSKeyID))
+		}
+	}
+	if v.Encrypted {
+		if c.Public {
+			errs = append(errs, errors.New("an encrypted AMI cannot be made public"))
+		}
+		if c.Distribution.shared() && len(v.KMSKeyID) == 0 {
+			errs = append(errs, errors.New("sharing an encrypted AMI requires a KMS key, as the default EBS key cannot be shared"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// blockDevice returns the root device of the AMI, created from snapshotID. The
+// encryption of the device is that of the snapshot.
+func (v *RootVolume) blockDevice(snapshotID string, size int32) *ec2types.EbsBlockDevice {
+	device := &ec2types.EbsBlockDevice{
+		DeleteOnTermination: aws.Bool(true),
+		SnapshotId:          aws.String(snapshotID),
+		VolumeSize:          aws.Int32(size),
+		VolumeType:          v.volumeType(),
+	}
+	if v.IOPS != 0 {
+		device.Iops = aws.Int32(v.IOPS)
+	}
+	if v.Throughput != 0 {
+		device.Throughput = aws.Int32(v.Throughput)
+	}
+	return device
+}
+
+func joinTypes(types []ec2types.VolumeType) string {
+	names := make([]string, len(types))
+	for i, volumeType := range types {
+		names[i] = string(volumeType)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,202 @@
+package amibuild
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKMSKeyARN = "arn:aws:kms:us-east-1:123456789012:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+
+func TestConfigValidateRootVolume(t *testing.T) {
+	testCases := []struct {
+		description string
+		modify      func(*Config)
+		errContains []string
+	}{
+		{
+			description: "Default",
+			modify:      func(c *Config) {},
+		},
+		{
+			description: "gp3 with iops and throughput",
+			modify: func(c *Config) {
+				c.RootVolume = RootVolume{Type: "gp3", IOPS: 4000, Throughput: 1000}
+			},
+		},
+		{
+			description: "gp3 with baseline iops on a small volume",
+			modify: func(c *Config) {
+				c.VolumeSize = 1
+				c.RootVolume = RootVolume{Type: "gp3", IOPS: 3000, Throughput: 750}
+			},
+		},
+		{
+			description: "io2 with iops",
+			modify:      func(c *Config) { c.RootVolume = RootVolume{Type: "io2", IOPS: 10000} },
+		},
+		{
+			description: "Throughput-optimized type",
+			modify:      func(c *Config) { c.RootVolume = RootVolume{Type: "st1"} },
+			errContains: []string{"volume type must be one of gp2, gp3, io1, io2, standard: st1"},
+		},
+		{
+			description: "io1 without iops",
+			modify:      func(c *Config) { c.RootVolume = RootVolume{Type: "io1"} },
+			errContains: []string{"volume type io1 requires iops"},
+		},
+		{
+			description: "gp2 with iops and throughput",
+			modify: func(c *Config) {
+				c.RootVolume = RootVolume{Type: "gp2", IOPS: 3000, Throughput: 125}
+			},
+			errContains: []string{
+				"iops is not supported for volume type gp2",
+				"throughput is not supported for volume type gp2",
+			},
+		},
+		{
+			description: "gp3 iops out of range",
+			modify:      func(c *Config) { c.RootVolume = RootVolume{Type: "gp3", IOPS: 90000} },
+			errContains: []string{"iops for volume type gp3 must be between 3000 and 80000: 90000"},
+		},
+		{
+			description: "io1 iops too high for size",
+			modify:      func(c *Config) { c.RootVolume = RootVolume{Type: "io1", IOPS: 1000} },
+			errContains: []string{"iops for volume type io1 can be at most 50 per GB, 500 for 10 GB: 1000"},
+		},
+		{
+			description: "gp3 throughput out of range",
+			modify:      func(c *Config) { c.RootVolume = RootVolume{Type: "gp3", Throughput: 100} },
+			errContains: []string{"throughput for volume type gp3 must be between 125 and 2000 MiB/s: 100"},
+		},
+		{
+			description: "gp3 throughput too high for iops",
+			modify:      func(c *Config) { c.RootVolume = RootVolume{Type: "gp3", Throughput: 1000} },
+			errContains: []string{"throughput for volume type gp3 can be at most 750 MiB/s with 3000 iops: 1000"},
+		},
+		{
+			description: "KMS key without encryption",
+			modify:      func(c *Config) { c.RootVolume = RootVolume{KMSKeyID: "alias/ami"} },
+			errContains: []string{"KMS key requires encryption"},
+		},
+		{
+			description: "Encrypted and public",
+			modify: func(c *Config) {
+				c.Public = true
+				c.RootVolume = RootVolume{Encrypted: true}
+			},
+			errContains: []string{"an encrypted AMI cannot be made public"},
+		},
+		{
+			description: "Encrypted and shared with the default key",
+			modify: func(c *Config) {
+				c.Distribution = Distribution{Accounts: []string{"123456789012"}}
+				c.RootVolume = RootVolume{Encrypted: true}
+			},
+			errContains: []string{"sharing an encrypted AMI requires a KMS key"},
+		},
+		{
+			description: "Encrypted and shared with a KMS key",
+			modify: func(c *Config) {
+				c.Distribution = Distribution{Accounts: []string{"123456789012"}}
+				c.RootVolume = RootVolume{Encrypted: true, KMSKeyID: "alias/ami"}
+			},
+		},
+		{
+			description: "Local image with a KMS key alias",
+			modify: func(c *Config) {
+				c.LocalImage = "disk.raw"
+				c.RootVolume = RootVolume{Encrypted: true, KMSKeyID: "alias/ami"}
+			},
+			errContains: []string{"KMS key for a local image must be a key ARN: alias/ami"},
+		},
+		{
+			description: "Copied with a KMS key ARN",
+			modify: func(c *Config) {
+				c.Distribution = Distribution{Regions: []string{"us-west-2"}}
+				c.RootVolume = RootVolume{Encrypted: true, KMSKeyID: testKMSKeyARN}
+			},
+			errContains: []string{"KMS key must be a key ID or alias to copy the AMI to other regions"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			cfg := testConfig()
+			tc.modify(&cfg)
+			err := cfg.ValidateRootVolume()
+			if len(tc.errContains) == 0 {
+				assert.NoError(t, err)
+				assert.NoError(t, cfg.Validate())
+				return
+			}
+			for _, s := range tc.errContains {
+				assert.ErrorContains(t, err, s)
+			}
+			assert.ErrorIs(t, cfg.Validate(), ErrInvalidConfig)
+		})
+	}
+}
+
+func TestBuildWithClientsRootVolume(t *testing.T) {
+	client := &mockEC2Client{}
+	connector := &mockConnector{keyPair: true, port: 22, runner: &mockRunner{}}
+	cfg := testConfig()
+	cfg.RootVolume = RootVolume{
+		Type:       "gp3",
+		IOPS:       4000,
+		Throughput: 500,
+		Encrypted:  true,
+		KMSKeyID:   "alias/ami",
+	}
+
+	_, err := BuildWithClients(context.Background(), cfg, client, mockWaiters(client), connector)
+	require.NoError(t, err)
+
+	builderVolume := client.runInstancesInput.BlockDeviceMappings[0].Ebs
+	assert.True(t, *builderVolume.Encrypted)
+	assert.Equal(t, "alias/ami", *builderVolume.KmsKeyId)
+
+	root := client.registerImageInput.BlockDeviceMappings[0].Ebs
+	assert.Equal(t, ec2types.VolumeTypeGp3, root.VolumeType)
+	assert.Equal(t, int32(4000), *root.Iops)
+	assert.Equal(t, int32(500), *root.Throughput)
+	assert.Nil(t, root.Encrypted, "encryption comes from the snapshot")
+	assert.Nil(t, root.KmsKeyId)
+}
+
+func TestBuildWithClientsRootVolumeDefault(t *testing.T) {
+	client := &mockEC2Client{}
+	connector := &mockConnector{keyPair: true, port: 22, runner: &mockRunner{}}
+
+	_, err := BuildWithClients(context.Background(), testConfig(), client, mockWaiters(client),
+		connector)
+	require.NoError(t, err)
+
+	assert.Nil(t, client.runInstancesInput.BlockDeviceMappings[0].Ebs.Encrypted)
+	root := client.registerImageInput.BlockDeviceMappings[0].Ebs
+	assert.Equal(t, ec2types.VolumeTypeGp2, root.VolumeType)
+	assert.Nil(t, root.Iops)
+	assert.Nil(t, root.Throughput)
+}
+
+func TestImportWithClientsEncrypted(t *testing.T) {
+	path, _ := writeLocalImage(t)
+	client := &mockEC2Client{}
+	ebsClient := newFakeEBSClient()
+	cfg := testLocalConfig(path)
+	cfg.RootVolume = RootVolume{Type: "io1", IOPS: 100, Encrypted: true, KMSKeyID: testKMSKeyARN}
+
+	_, err := ImportWithClients(context.Background(), cfg, client, ebsClient, mockWaiters(client))
+	require.NoError(t, err)
+
+	assert.True(t, aws.ToBool(ebsClient.started.Encrypted))
+	assert.Equal(t, testKMSKeyARN, aws.ToString(ebsClient.started.KmsKeyArn))
+	root := client.registerImageInput.BlockDeviceMappings[0].Ebs
+	assert.Equal(t, ec2types.VolumeTypeIo1, root.VolumeType)
+	assert.Equal(t, int32(100), *root.Iops)
+}
@@ -0,0 +1,159 @@
+// Package batch runs many builds concurrently, writing their output to a
+// shared writer with each line prefixed by the name of its build.
+package batch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Job is a build to run in a batch.
+type Job struct {
+	// Name identifies the build in its output and in the summary.
+	Name string
+	// Run runs the build, writing its output to output, and returns the ID
+	// of what it built. The ID may be returned with an error if the build
+	// created something before it failed.
+	Run func(ctx context.Context, output io.Writer) (string, error)
+}
+
+// Result is the result of a Job.
+type Result struct {
+	Name     string
+	ID       string
+	Err      error
+	Duration time.Duration
+}
+
+// Run runs jobs with at most concurrency of them at a time, and returns their
+// results in the same order as jobs. A failed job does not stop the others,
+// but jobs that have not started when ctx is done are not run.
+func Run(ctx context.Context, jobs []Job, concurrency int, output io.Writer) []Result {
+	results := make([]Result, len(jobs))
+	mu := &sync.Mutex{}
+
+	group := errgroup.Group{}
+	group.SetLimit(max(concurrency, 1))
+	for i, job := range jobs {
+		group.Go(func() error {
+			results[i] = runJob(ctx, job, &prefixWriter{
+				mu:     mu,
+				w:      output,
+				prefix: "[" + job.Name + "] ",
+			})
+			return nil
+		})
+	}
+	group.Wait()
+
+	return results
+}
+
+func runJob(ctx context.Context, job Job, output *prefixWriter) Result {
+	defer output.Flush()
+
+	result := Result{Name: job.Name}
+	if err := ctx.Err(); err != nil {
+		result.Err = err
+		return result
+	}
+
+	start := time.Now()
+	result.ID, result.Err = job.Run(ctx, output)
+	result.Duration = time.Since(start)
+
+	if result.Err != nil {
+		output.Flush()
+		fmt.Fprintf(output, "Build failed: %s\n", result.Err)
+	}
+	return result
+}
+
+// Failed returns the number of results that have an error.
+func Failed(results []Result) int {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// WriteSummary writes a table of results to w. The ID of a failed result is
+// shown if it has one.
+func WriteSummary(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSTATUS\tID\tDURATION\tERROR")
+	for _, result := range results {
+		status, id, errMsg := "ok", result.ID, "-"
+		if len(id) == 0 {
+			id = "-"
+		}
+		if result.Err != nil {
+			status = "failed"
+			errMsg = strings.ReplaceAll(result.Err.Error(), "\n", "; ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", result.Name, status, id,
+			result.Duration.Round(time.Second), errMsg)
+	}
+	return tw.Flush()
+}
+
+// prefixWriter writes whole lines to w with prefix. Its mutex is shared by
+// the writers of all jobs, so that their lines are not interleaved.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, b...)
+	end := bytes.LastIndexByte(p.buf, '\n')
+	if end < 0 {
+		return len(b), nil
+	}
+	lines := p.buf[:end+1]
+	p.buf = slices.Clone(p.buf[end+1:])
+	if err := p.write(lines); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes any partial line that remains.
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) == 0 {
+		return nil
+	}
+	lines := append(p.buf, '\n')
+	p.buf = nil
+	return p.write(lines)
+}
+
+func (p *prefixWriter) write(lines []byte) error {
+	out := &bytes.Buffer{}
+	for line := range bytes.Lines(lines) {
+		out.WriteString(p.prefix)
+		out.Write(line)
+	}
+	_, err := p.w.Write(out.Bytes())
+	return err
+}
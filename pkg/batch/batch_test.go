@@ -0,0 +1,128 @@
+package batch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	job := func(name string, err error) Job {
+		return Job{
+			Name: name,
+			Run: func(ctx context.Context, output io.Writer) (string, error) {
+				n := running.Add(1)
+				defer running.Add(-1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				fmt.Fprintf(output, "building %s\n", name)
+				time.Sleep(10 * time.Millisecond)
+				fmt.Fprint(output, "no newline")
+				if err != nil {
+					return "", err
+				}
+				return "ami-" + name, nil
+			},
+		}
+	}
+	jobs := []Job{
+		job("a", nil),
+		job("b", errors.New("boom")),
+		job("c", nil),
+		job("d", nil),
+		job("e", nil),
+	}
+
+	output := &bytes.Buffer{}
+	results := Run(context.Background(), jobs, 2, output)
+
+	assert.Equal(t, int32(2), maxRunning.Load())
+	require.Len(t, results, len(jobs))
+	for i, result := range results {
+		assert.Equal(t, jobs[i].Name, result.Name)
+	}
+	assert.Equal(t, "ami-a", results[0].ID)
+	assert.NoError(t, results[0].Err)
+	assert.EqualError(t, results[1].Err, "boom")
+	assert.Empty(t, results[1].ID)
+	assert.Equal(t, 1, Failed(results))
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	assert.Len(t, lines, 11)
+	assert.Contains(t, lines, "[a] building a")
+	assert.Contains(t, lines, "[a] no newline")
+	assert.Contains(t, lines, "[b] Build failed: boom")
+	for _, line := range lines {
+		assert.Regexp(t, `^\[[a-e]\] `, line)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	results := Run(ctx, []Job{{
+		Name: "a",
+		Run: func(ctx context.Context, output io.Writer) (string, error) {
+			called = true
+			return "ami-a", nil
+		},
+	}}, 1, io.Discard)
+
+	assert.False(t, called)
+	assert.ErrorIs(t, results[0].Err, context.Canceled)
+	assert.Equal(t, 1, Failed(results))
+}
+
+func TestWriteSummary(t *testing.T) {
+	output := &bytes.Buffer{}
+	err := WriteSummary(output, []Result{
+		{Name: "postgres", ID: "ami-123", Duration: 754 * time.Second},
+		{Name: "redis", Err: errors.Join(errors.New("one"), errors.New("two")),
+			Duration: 1500 * time.Millisecond},
+		{Name: "nginx", ID: "ami-456", Err: errors.New("failed to copy AMI"),
+			Duration: 90 * time.Second},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, ""+
+		"NAME      STATUS  ID       DURATION  ERROR\n"+
+		"postgres  ok      ami-123  12m34s    -\n"+
+		"redis     failed  -        2s        one; two\n"+
+		"nginx     failed  ami-456  1m30s     failed to copy AMI\n",
+		output.String())
+}
+
+func TestPrefixWriter(t *testing.T) {
+	output := &bytes.Buffer{}
+	w := &prefixWriter{mu: &sync.Mutex{}, w: output, prefix: "[x] "}
+
+	n, err := w.Write([]byte("one\ntw"))
+	require.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, "[x] one\n", output.String())
+
+	_, err = w.Write([]byte("o\nthree\n\nfou"))
+	require.NoError(t, err)
+	assert.Equal(t, "[x] one\n[x] two\n[x] three\n[x] \n", output.String())
+
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "[x] one\n[x] two\n[x] three\n[x] \n[x] fou\n", output.String())
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "[x] one\n[x] two\n[x] three\n[x] \n[x] fou\n", output.String())
+}
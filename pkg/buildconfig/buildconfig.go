@@ -0,0 +1,220 @@
+// Package buildconfig loads build options from a configuration file with
+// named profiles. Options are named the same as the command line flags they
+// set. The options under defaults apply to every profile, and an option in a
+// profile replaces the same option in defaults. String values may refer to
+// environment variables as $VAR or ${VAR}, and $$ is a literal $.
+//
+// For example:
+//
+//	defaults:
+//	  subnet-id: subnet-e358acdfe25b8fb3b
+//	  services: [chrony]
+//	profiles:
+//	  prod:
+//	    ami-name: app-${VERSION}
+//	    container-image: registry.example.com/app:${VERSION}
+//	    tag:
+//	      team: platform
+//
+// A manifest of many builds has the same defaults, and a list of builds in
+// place of the profiles.
+package buildconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidConfig  = errors.New("invalid configuration file")
+	ErrUnknownProfile = errors.New("unknown profile")
+	ErrUndefinedEnv   = errors.New("undefined environment variable")
+)
+
+// File is the structure of a configuration file.
+type File struct {
+	Defaults map[string]any            `yaml:"defaults"`
+	Profiles map[string]map[string]any `yaml:"profiles"`
+}
+
+// Manifest is the structure of a manifest of many builds. The options under
+// defaults apply to every build, and an option in a build replaces the same
+// option in defaults.
+type Manifest struct {
+	Defaults map[string]any   `yaml:"defaults"`
+	Builds   []map[string]any `yaml:"builds"`
+}
+
+// Options maps option names to their values. An option with a single value
+// has one element, and an option with a list of values has one element for
+// each, which may be none. A map of values is turned into key=value elements
+// ordered by key.
+type Options map[string][]string
+
+// Names returns the names of the options in order.
+func (o Options) Names() []string {
+	return slices.Sorted(maps.Keys(o))
+}
+
+// Load returns the options in data for the given profile, or only the
+// defaults if profile is empty. Environment variables are looked up with
+// lookupEnv, which is os.LookupEnv if nil.
+func Load(data []byte, profile string, lookupEnv func(string) (string, bool)) (Options, error) {
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+
+	file := File{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	raw := maps.Clone(file.Defaults)
+	if raw == nil {
+		raw = map[string]any{}
+	}
+	if len(profile) > 0 {
+		options, ok := file.Profiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("%w %q, must be one of %v", ErrUnknownProfile, profile,
+				slices.Sorted(maps.Keys(file.Profiles)))
+		}
+		maps.Copy(raw, options)
+	}
+
+	options, err := toOptions(raw, lookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	return options, nil
+}
+
+// LoadManifest returns the options of each build in the manifest in data,
+// with the defaults of the manifest applied. Environment variables are looked
+// up with lookupEnv, which is os.LookupEnv if nil.
+func LoadManifest(data []byte, lookupEnv func(string) (string, bool)) ([]Options, error) {
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+
+	manifest := Manifest{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&manifest); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	if len(manifest.Builds) == 0 {
+		return nil, fmt.Errorf("%w: no builds defined", ErrInvalidConfig)
+	}
+
+	builds := make([]Options, len(manifest.Builds))
+	var errs []error
+	for i, build := range manifest.Builds {
+		raw := maps.Clone(manifest.Defaults)
+		if raw == nil {
+			raw = map[string]any{}
+		}
+		maps.Copy(raw, build)
+		options, err := toOptions(raw, lookupEnv)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("build %d: %w", i+1, err))
+			continue
+		}
+		builds[i] = options
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	return builds, nil
+}
+
+func toOptions(raw map[string]any, lookupEnv func(string) (string, bool)) (Options, error) {
+	options := Options{}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(raw)) {
+		values, err := optionValues(raw[name], lookupEnv)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("option %s: %w", name, err))
+			continue
+		}
+		options[name] = values
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+func optionValues(value any, lookupEnv func(string) (string, bool)) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, errors.New("must have a value")
+	case []any:
+		values := []string{}
+		for _, elem := range v {
+			s, err := scalar(elem, lookupEnv)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	case map[string]any:
+		values := []string{}
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			s, err := scalar(v[key], lookupEnv)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, key+"="+s)
+		}
+		return values, nil
+	default:
+		s, err := scalar(v, lookupEnv)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+}
+
+func scalar(value any, lookupEnv func(string) (string, bool)) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return expand(v, lookupEnv)
+	case nil:
+		return "", nil
+	case bool, int, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+func expand(s string, lookupEnv func(string) (string, bool)) (string, error) {
+	var missing []string
+	expanded := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		value, ok := lookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w %s", ErrUndefinedEnv, strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
@@ -0,0 +1,224 @@
+package buildconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFile = `
+defaults:
+  subnet-id: subnet-123
+  builder-instance-type: t3.micro
+  services: [chrony]
+  size: 10
+profiles:
+  prod:
+    ami-name: app-${VERSION}
+    container-image: registry.example.com/app:$VERSION
+    services: [chrony, ssh]
+    public: true
+    tag:
+      team: platform
+      cost: $$5
+  dev:
+    ami-name: app-dev
+    services: []
+    subnet-id: subnet-456
+`
+
+func TestLoad(t *testing.T) {
+	env := map[string]string{"VERSION": "1.2.3"}
+	lookupEnv := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	testCases := []struct {
+		description string
+		data        string
+		profile     string
+		options     Options
+		err         error
+		errContains string
+	}{
+		{
+			description: "Defaults only",
+			data:        testFile,
+			options: Options{
+				"builder-instance-type": {"t3.micro"},
+				"services":              {"chrony"},
+				"size":                  {"10"},
+				"subnet-id":             {"subnet-123"},
+			},
+		},
+		{
+			description: "Profile with environment variables",
+			data:        testFile,
+			profile:     "prod",
+			options: Options{
+				"ami-name":              {"app-1.2.3"},
+				"builder-instance-type": {"t3.micro"},
+				"container-image":       {"registry.example.com/app:1.2.3"},
+				"public":                {"true"},
+				"services":              {"chrony", "ssh"},
+				"size":                  {"10"},
+				"subnet-id":             {"subnet-123"},
+				"tag":                   {"cost=$5", "team=platform"},
+			},
+		},
+		{
+			description: "Profile replaces defaults",
+			data:        testFile,
+			profile:     "dev",
+			options: Options{
+				"ami-name":              {"app-dev"},
+				"builder-instance-type": {"t3.micro"},
+				"services":              {},
+				"size":                  {"10"},
+				"subnet-id":             {"subnet-456"},
+			},
+		},
+		{
+			description: "Empty file",
+			data:        "",
+			options:     Options{},
+		},
+		{
+			description: "Unknown profile",
+			data:        testFile,
+			profile:     "staging",
+			err:         ErrUnknownProfile,
+			errContains: `unknown profile "staging", must be one of [dev prod]`,
+		},
+		{
+			description: "Undefined environment variable",
+			data:        "defaults:\n  ami-name: app-${MISSING}-$OTHER\n",
+			err:         ErrUndefinedEnv,
+			errContains: "option ami-name: undefined environment variable MISSING, OTHER",
+		},
+		{
+			description: "Unknown top level field",
+			data:        "default:\n  size: 10\n",
+			err:         ErrInvalidConfig,
+			errContains: "field default not found",
+		},
+		{
+			description: "Option without a value",
+			data:        "defaults:\n  ami-name:\n",
+			err:         ErrInvalidConfig,
+			errContains: "option ami-name: must have a value",
+		},
+		{
+			description: "Nested list",
+			data:        "defaults:\n  services: [[chrony]]\n",
+			err:         ErrInvalidConfig,
+			errContains: "option services: unsupported value [chrony]",
+		},
+		{
+			description: "Invalid YAML",
+			data:        "defaults: [",
+			err:         ErrInvalidConfig,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			options, err := Load([]byte(tc.data), tc.profile, lookupEnv)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.options, options)
+		})
+	}
+}
+
+func TestOptionsNames(t *testing.T) {
+	options := Options{"size": {"10"}, "ami-name": {"app"}, "public": {"true"}}
+	assert.Equal(t, []string{"ami-name", "public", "size"}, options.Names())
+}
+
+const testManifest = `
+defaults:
+  subnet-id: subnet-123
+  services: [chrony]
+builds:
+  - ami-name: postgres-${VERSION}
+    container-image: postgres:16
+  - ami-name: redis-${VERSION}
+    container-image: redis:7
+    services: [chrony, ssh]
+`
+
+func TestLoadManifest(t *testing.T) {
+	lookupEnv := func(name string) (string, bool) {
+		if name == "VERSION" {
+			return "1.2.3", true
+		}
+		return "", false
+	}
+
+	testCases := []struct {
+		description string
+		data        string
+		builds      []Options
+		err         error
+		errContains string
+	}{
+		{
+			description: "Builds with defaults",
+			data:        testManifest,
+			builds: []Options{
+				{
+					"ami-name":        {"postgres-1.2.3"},
+					"container-image": {"postgres:16"},
+					"services":        {"chrony"},
+					"subnet-id":       {"subnet-123"},
+				},
+				{
+					"ami-name":        {"redis-1.2.3"},
+					"container-image": {"redis:7"},
+					"services":        {"chrony", "ssh"},
+					"subnet-id":       {"subnet-123"},
+				},
+			},
+		},
+		{
+			description: "Builds without defaults",
+			data:        "builds:\n  - ami-name: app\n",
+			builds:      []Options{{"ami-name": {"app"}}},
+		},
+		{
+			description: "No builds",
+			data:        "defaults:\n  size: 10\n",
+			err:         ErrInvalidConfig,
+			errContains: "no builds defined",
+		},
+		{
+			description: "Invalid build",
+			data:        "builds:\n  - ami-name: app\n  - ami-name: app-$MISSING\n",
+			err:         ErrUndefinedEnv,
+			errContains: "build 2: option ami-name: undefined environment variable MISSING",
+		},
+		{
+			description: "Profiles are not allowed",
+			data:        "profiles:\n  prod:\n    size: 10\n",
+			err:         ErrInvalidConfig,
+			errContains: "field profiles not found",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			builds, err := LoadManifest([]byte(tc.data), lookupEnv)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.builds, builds)
+		})
+	}
+}
@@ -6,14 +6,21 @@ const (
 	AMIPatternCloudboss = "ghcr.io--cloudboss--easyto-builder--"
 	AMIPatternDebian    = "debian-12-*"
 
-	DirProc = "/proc"
+	DirProc     = "/proc"
+	DirSidecars = "sidecars"
 
 	FileEtcPasswd  = "/etc/passwd"
 	FileEtcShadow  = "/etc/shadow"
 	FileEtcGroup   = "/etc/group"
 	FileEtcGShadow = "/etc/gshadow"
+	FileEtcSubUID  = "/etc/subuid"
+	FileEtcSubGID  = "/etc/subgid"
 
-	FileMetadata = "metadata.json"
+	FileEtcLoginDefs = "/etc/login.defs"
+
+	FileMetadata  = "metadata.json"
+	FileVolumes   = "volumes.json"
+	FileProcesses = "processes.json"
 
 	GroupNameWheel = "wheel"
 
@@ -21,6 +28,8 @@ const (
 	ModeEtcShadow  = 0
 	ModeEtcGroup   = 0644
 	ModeEtcGShadow = 0
+	ModeEtcSubUID  = 0644
+	ModeEtcSubGID  = 0644
 )
 
 // "Constants" that are defined with ldflags during compile.
@@ -11,6 +11,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/cloudboss/easyto/pkg/amibuild"
 	"github.com/cloudboss/easyto/pkg/constants"
 )
 
@@ -169,7 +170,8 @@ func CopyWithClients(
 	}
 
 	if cfg.Public {
-		err = makePublic(ctx, cfg, destEC2Client, *copyOutput.ImageId)
+		err = amibuild.MakeImagePublic(ctx, destEC2Client, *copyOutput.ImageId,
+			func(format string, args ...any) { log(cfg.Output, format, args...) })
 		if err != nil {
 			return result, err
 		}
@@ -178,51 +180,6 @@ func CopyWithClients(
 	return result, nil
 }
 
-func makePublic(ctx context.Context, cfg Config, client EC2Client, amiID string) error {
-	log(cfg.Output, "Making AMI %s public...\n", amiID)
-
-	_, err := client.ModifyImageAttribute(ctx, &ec2.ModifyImageAttributeInput{
-		ImageId: aws.String(amiID),
-		LaunchPermission: &ec2types.LaunchPermissionModifications{
-			Add: []ec2types.LaunchPermission{
-				{Group: ec2types.PermissionGroupAll},
-			},
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("failed to make AMI public: %w", err)
-	}
-
-	describeOutput, err := client.DescribeImages(ctx, &ec2.DescribeImagesInput{
-		ImageIds: []string{amiID},
-	})
-	if err != nil {
-		return fmt.Errorf("failed to describe AMI for snapshots: %w", err)
-	}
-
-	if len(describeOutput.Images) == 0 {
-		return fmt.Errorf("AMI %s not found after copy", amiID)
-	}
-
-	for _, bdm := range describeOutput.Images[0].BlockDeviceMappings {
-		if bdm.Ebs != nil && bdm.Ebs.SnapshotId != nil {
-			log(cfg.Output, "Making snapshot %s public...\n", *bdm.Ebs.SnapshotId)
-			_, err := client.ModifySnapshotAttribute(ctx, &ec2.ModifySnapshotAttributeInput{
-				SnapshotId:    bdm.Ebs.SnapshotId,
-				Attribute:     ec2types.SnapshotAttributeNameCreateVolumePermission,
-				OperationType: ec2types.OperationTypeAdd,
-				GroupNames:    []string{"all"},
-			})
-			if err != nil {
-				return fmt.Errorf("failed to make snapshot %s public: %w", *bdm.Ebs.SnapshotId, err)
-			}
-		}
-	}
-
-	log(cfg.Output, "AMI and snapshots are now public\n")
-	return nil
-}
-
 func log(w io.Writer, format string, args ...any) {
 	if w != nil {
 		fmt.Fprintf(w, format, args...)
@@ -9,13 +9,20 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/cloudboss/easyto/embed"
 	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/cloudboss/easyto/pkg/diskformat"
+	"github.com/cloudboss/easyto/pkg/imageconfig"
 	"github.com/cloudboss/easyto/pkg/login"
+	"github.com/cloudboss/easyto/pkg/privesc"
+	"github.com/cloudboss/easyto/pkg/rootfs"
 	diskfs "github.com/diskfs/go-diskfs"
 	filebackend "github.com/diskfs/go-diskfs/backend/file"
 	diskpkg "github.com/diskfs/go-diskfs/disk"
@@ -45,6 +52,17 @@ const (
 	archiveInit       = "init.tar"
 	archiveKernel     = "kernel.tar"
 	archiveSSH        = "ssh.tar"
+
+	// GPT partition attribute flags from the Discoverable Partitions Specification.
+	gptAttrReadOnly uint64 = 1 << 60
+	gptAttrNoAuto   uint64 = 1 << 63
+)
+
+const (
+	// LoginCheckWarn logs problems found in the image's login files.
+	LoginCheckWarn = "warn"
+	// LoginCheckFail fails the build on problems found in the image's login files.
+	LoginCheckFail = "fail"
 )
 
 var (
@@ -87,18 +105,50 @@ func newErrExtract(code rune, wrap error) error {
 	return fmt.Errorf("%w: %w", err, wrap)
 }
 
+// Volume is an entry in the volume manifest, describing a directory that the
+// container image declares with VOLUME and which is expected to be persistent.
+type Volume struct {
+	Path    string `json:"path"`
+	UserID  int    `json:"user-id"`
+	GroupID int    `json:"group-id"`
+}
+
+// Process is an entry in the process manifest, describing a sidecar command
+// that init supervises alongside the main command. Root is the path within the
+// VM image where the sidecar image is extracted.
+type Process struct {
+	Name   string         `json:"name"`
+	Image  string         `json:"image"`
+	Root   string         `json:"root"`
+	Config *v1.ConfigFile `json:"config"`
+}
+
 type Builder struct {
-	AssetDir       string
-	CTRImageName   string
-	CTRImageSource string
-	VMImageDevice  string
-	VMImageMount   string
-	Services       []string
-	LoginUser      string
-	LoginShell     string
-	Debug          bool
+	AssetDir            string
+	CTRImageName        string
+	CTRImageSource      string
+	VMImageDevice       string
+	VMImageMount        string
+	Services            []string
+	LoginUser           string
+	LoginShell          string
+	Architecture        string
+	RootReadOnly        bool
+	RootNoAuto          bool
+	Changes             []string
+	SidecarImages       []string
+	LockUsers           []string
+	RemoveUsers         []string
+	LoginCheck          string
+	Users               []login.UserSpec
+	LoginPassword       string
+	PrivilegeEscalation string
+	Format              string
+	Output              string
+	Debug               bool
 
 	kernelVersion  string
+	sidecars       []imageconfig.Sidecar
 	pathBase       string
 	pathBootloader string
 	pathChrony     string
@@ -159,6 +209,84 @@ func WithLoginShell(loginShell string) BuilderOpt {
 	}
 }
 
+func WithArchitecture(arch string) BuilderOpt {
+	return func(b *Builder) {
+		b.Architecture = arch
+	}
+}
+
+func WithRootReadOnly(readOnly bool) BuilderOpt {
+	return func(b *Builder) {
+		b.RootReadOnly = readOnly
+	}
+}
+
+func WithRootNoAuto(noAuto bool) BuilderOpt {
+	return func(b *Builder) {
+		b.RootNoAuto = noAuto
+	}
+}
+
+func WithChanges(changes []string) BuilderOpt {
+	return func(b *Builder) {
+		b.Changes = changes
+	}
+}
+
+func WithSidecarImages(sidecarImages []string) BuilderOpt {
+	return func(b *Builder) {
+		b.SidecarImages = sidecarImages
+	}
+}
+
+func WithLockUsers(lockUsers []string) BuilderOpt {
+	return func(b *Builder) {
+		b.LockUsers = lockUsers
+	}
+}
+
+func WithRemoveUsers(removeUsers []string) BuilderOpt {
+	return func(b *Builder) {
+		b.RemoveUsers = removeUsers
+	}
+}
+
+func WithLoginCheck(loginCheck string) BuilderOpt {
+	return func(b *Builder) {
+		b.LoginCheck = loginCheck
+	}
+}
+
+func WithUsers(users []login.UserSpec) BuilderOpt {
+	return func(b *Builder) {
+		b.Users = users
+	}
+}
+
+func WithLoginPassword(passwordHash string) BuilderOpt {
+	return func(b *Builder) {
+		b.LoginPassword = passwordHash
+	}
+}
+
+func WithPrivilegeEscalation(method string) BuilderOpt {
+	return func(b *Builder) {
+		b.PrivilegeEscalation = method
+	}
+}
+
+func WithFormat(format string) BuilderOpt {
+	return func(b *Builder) {
+		b.Format = format
+	}
+}
+
+func WithOutput(output string) BuilderOpt {
+	return func(b *Builder) {
+		b.Output = output
+	}
+}
+
 func WithDebug(debug bool) BuilderOpt {
 	return func(b *Builder) {
 		b.Debug = debug
@@ -166,7 +294,12 @@ func WithDebug(debug bool) BuilderOpt {
 }
 
 func NewBuilder(fs afero.Fs, opts ...BuilderOpt) (*Builder, error) {
-	builder := &Builder{}
+	builder := &Builder{
+		Architecture:        runtime.GOARCH,
+		LoginCheck:          LoginCheckWarn,
+		PrivilegeEscalation: privesc.MethodNone,
+		Format:              diskformat.FormatRaw,
+	}
 	for _, opt := range opts {
 		opt(builder)
 	}
@@ -179,6 +312,57 @@ func NewBuilder(fs afero.Fs, opts ...BuilderOpt) (*Builder, error) {
 		return nil, errors.New("VM image device must be defined")
 	}
 
+	if _, err := rootPartitionType(builder.Architecture); err != nil {
+		return nil, err
+	}
+
+	if builder.LoginCheck != LoginCheckWarn && builder.LoginCheck != LoginCheckFail {
+		return nil, fmt.Errorf("login check must be one of %s or %s: %s",
+			LoginCheckWarn, LoginCheckFail, builder.LoginCheck)
+	}
+
+	if len(builder.Users) > 0 && !slices.Contains(builder.Services, "ssh") {
+		return nil, errors.New("users require the ssh service")
+	}
+
+	if err := login.ValidateUserSpecs(builder.Users); err != nil {
+		return nil, err
+	}
+
+	if len(builder.LoginPassword) > 0 {
+		if !slices.Contains(builder.Services, "ssh") {
+			return nil, errors.New("login password requires the ssh service")
+		}
+		if err := login.ValidatePasswordHash(builder.LoginPassword); err != nil {
+			return nil, fmt.Errorf("login password: %w", err)
+		}
+	}
+
+	if err := privesc.ValidateMethod(builder.PrivilegeEscalation); err != nil {
+		return nil, err
+	}
+	if builder.PrivilegeEscalation != privesc.MethodNone &&
+		!slices.Contains(builder.Services, "ssh") {
+		return nil, errors.New("privilege escalation requires the ssh service")
+	}
+
+	if err := diskformat.ValidateFormat(builder.Format); err != nil {
+		return nil, err
+	}
+	if builder.Format != diskformat.FormatRaw && len(builder.Output) == 0 {
+		return nil, fmt.Errorf("output must be defined for %s format", builder.Format)
+	}
+
+	if err := imageconfig.ValidateChanges(builder.Changes); err != nil {
+		return nil, err
+	}
+
+	sidecars, err := imageconfig.ParseSidecars(builder.SidecarImages)
+	if err != nil {
+		return nil, err
+	}
+	builder.sidecars = sidecars
+
 	builder.pathBase = filepath.Join(builder.AssetDir, archiveBase)
 	builder.pathBootloader = filepath.Join(builder.AssetDir, archiveBootloader)
 	builder.pathChrony = filepath.Join(builder.AssetDir, archiveChrony)
@@ -236,6 +420,21 @@ func (b *Builder) MakeVMImage() (err error) {
 		return err
 	}
 
+	err = b.setupAccounts()
+	if err != nil {
+		return err
+	}
+
+	err = b.checkAccounts()
+	if err != nil {
+		return err
+	}
+
+	metadata, err := b.imageConfig(ctrImage)
+	if err != nil {
+		return err
+	}
+
 	err = untarFile(fs, b.pathBase, b.VMImageMount)
 	if err != nil {
 		return err
@@ -261,13 +460,38 @@ func (b *Builder) MakeVMImage() (err error) {
 		return err
 	}
 
-	err = b.setupMetadata(ctrImage, filepath.Join(b.VMImageMount, constants.DirETRoot,
+	err = b.setupPrivilegeEscalation()
+	if err != nil {
+		return err
+	}
+
+	err = b.setupVolumes(metadata, filepath.Join(b.VMImageMount, constants.DirETRoot,
+		constants.FileVolumes))
+	if err != nil {
+		return err
+	}
+
+	err = b.setupMetadata(metadata, filepath.Join(b.VMImageMount, constants.DirETRoot,
 		constants.FileMetadata))
 	if err != nil {
 		return err
 	}
 
-	return b.unmountPartitions()
+	err = b.setupSidecars(filepath.Join(b.VMImageMount, constants.DirETRoot,
+		constants.FileProcesses))
+	if err != nil {
+		return err
+	}
+
+	err = b.unmountPartitions()
+	if err != nil {
+		return err
+	}
+
+	if len(b.Output) > 0 {
+		return writeImage(fs, b.vmImageDevice, b.Output, b.Format)
+	}
+	return nil
 }
 
 func (b *Builder) partitionDisk() error {
@@ -299,6 +523,11 @@ func (b *Builder) partitionDisk() error {
 	}
 	b.uuidRoot = uuidRoot.String()
 
+	rootType, err := rootPartitionType(b.Architecture)
+	if err != nil {
+		return err
+	}
+
 	diskTotalSectors := disk.Size / sectorSize
 	diskUsableLastSector := uint64(diskTotalSectors - 34) // Leave room for the backup GPT.
 	rootMaxSize := diskUsableLastSector - rootStart + 1
@@ -318,12 +547,13 @@ func (b *Builder) partitionDisk() error {
 				GUID:  uuidEFI.String(),
 			},
 			{
-				Start: rootStart,
-				End:   rootLastSector,
-				Size:  (rootLastSector - rootStart + 1) * sectorSize,
-				Type:  gpt.LinuxFilesystem,
-				Name:  "root",
-				GUID:  b.uuidRoot,
+				Start:      rootStart,
+				End:        rootLastSector,
+				Size:       (rootLastSector - rootStart + 1) * sectorSize,
+				Type:       rootType,
+				Name:       "root",
+				GUID:       b.uuidRoot,
+				Attributes: b.rootPartitionAttributes(),
 			},
 		},
 	}
@@ -357,6 +587,35 @@ func (b *Builder) partitionDisk() error {
 	return nil
 }
 
+// rootPartitionType returns the Discoverable Partitions Specification root
+// partition type GUID for the given GOARCH, so that tools inspecting the disk
+// can identify the root partition without knowledge of easyto.
+func rootPartitionType(arch string) (gpt.Type, error) {
+	switch arch {
+	case "amd64":
+		return gpt.LinuxRootX86_64, nil
+	case "arm64":
+		return gpt.LinuxRootArm64, nil
+	case "386":
+		return gpt.LinuxRootX86, nil
+	case "arm":
+		return gpt.LinuxRootArm, nil
+	default:
+		return "", fmt.Errorf("unsupported architecture: %s", arch)
+	}
+}
+
+func (b *Builder) rootPartitionAttributes() uint64 {
+	var attributes uint64
+	if b.RootReadOnly {
+		attributes |= gptAttrReadOnly
+	}
+	if b.RootNoAuto {
+		attributes |= gptAttrNoAuto
+	}
+	return attributes
+}
+
 func (b *Builder) mountPartitions() error {
 	partBoot := partitionName(b.vmImageDevice, 1)
 	partRoot := partitionName(b.vmImageDevice, 2)
@@ -466,14 +725,51 @@ func (b *Builder) setupServices() error {
 	return nil
 }
 
-func (b *Builder) setupMetadata(ctrImage v1.Image, metadataPath string) (err error) {
-	var metadata *v1.ConfigFile
+// setupPrivilegeEscalation allows members of the wheel group, which includes
+// the login user, to run commands as root with sudo or doas from the image.
+func (b *Builder) setupPrivilegeEscalation() error {
+	if b.PrivilegeEscalation == privesc.MethodNone {
+		return nil
+	}
+	method, err := privesc.Setup(fs, b.VMImageMount, b.PrivilegeEscalation,
+		constants.GroupNameWheel)
+	if err != nil {
+		return fmt.Errorf("unable to setup privilege escalation: %w", err)
+	}
+	slog.Info("Configured privilege escalation", "method", method,
+		"group", constants.GroupNameWheel)
+	return nil
+}
 
-	metadata, err = ctrImage.ConfigFile()
+// imageConfig returns a copy of the container image's config with build time
+// changes applied, and with a named user resolved to numeric IDs from the
+// passwd and group files of the extracted image.
+func (b *Builder) imageConfig(ctrImage v1.Image) (*v1.ConfigFile, error) {
+	metadata, err := ctrImage.ConfigFile()
 	if err != nil {
-		return fmt.Errorf("unable to get metadata from image: %w", err)
+		return nil, fmt.Errorf("unable to get metadata from image: %w", err)
 	}
 
+	metadata = metadata.DeepCopy()
+	err = imageconfig.ApplyChanges(&metadata.Config, b.Changes)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadata.Config.User) > 0 {
+		uid, gid, err := login.ResolveUser(fs, metadata.Config.User, b.VMImageMount)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve image user %s: %w",
+				metadata.Config.User, err)
+		}
+		slog.Debug("Resolved image user", "user", metadata.Config.User, "uid", uid, "gid", gid)
+		metadata.Config.User = fmt.Sprintf("%d:%d", uid, gid)
+	}
+
+	return metadata, nil
+}
+
+func (b *Builder) setupMetadata(metadata *v1.ConfigFile, metadataPath string) (err error) {
 	metadataFile, err := os.Create(metadataPath)
 	if err != nil {
 		return fmt.Errorf("unable to create metadata file: %w", err)
@@ -493,11 +789,238 @@ func (b *Builder) setupMetadata(ctrImage v1.Image, metadataPath string) (err err
 	return nil
 }
 
+// setupSidecars extracts each sidecar image into its own subtree under the
+// easyto directory and writes the process manifest to manifestPath.
+func (b *Builder) setupSidecars(manifestPath string) error {
+	processes := []*Process{}
+
+	for _, sidecar := range b.sidecars {
+		ref, err := name.ParseReference(sidecar.Image)
+		if err != nil {
+			return fmt.Errorf("unable to parse sidecar image name: %w", err)
+		}
+		slog.Debug("Sidecar image reference", "name", sidecar.Name, "long", ref.Name())
+
+		img, err := loadImage(ref, b.CTRImageSource)
+		if err != nil {
+			return fmt.Errorf("unable to retrieve sidecar image %s: %w", sidecar.Image, err)
+		}
+
+		process, err := b.setupSidecar(img, sidecar)
+		if err != nil {
+			return err
+		}
+		processes = append(processes, process)
+	}
+
+	return writeJSON(manifestPath, processes)
+}
+
+func (b *Builder) setupSidecar(img v1.Image, sidecar imageconfig.Sidecar) (*Process, error) {
+	root := filepath.Join(constants.DirETRoot, constants.DirSidecars, sidecar.Name)
+	dest := filepath.Join(b.VMImageMount, root)
+	if err := fs.MkdirAll(dest, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create %s: %w", dest, err)
+	}
+
+	imageReader := mutate.Extract(img)
+	defer imageReader.Close()
+
+	err := untarReader(fs, imageReader, dest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract sidecar image %s: %w", sidecar.Image, err)
+	}
+
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get metadata from sidecar image %s: %w",
+			sidecar.Image, err)
+	}
+	config = config.DeepCopy()
+
+	if len(config.Config.User) > 0 {
+		uid, gid, err := login.ResolveUser(fs, config.Config.User, dest)
+		if err != nil {
+			return nil, fmt.Errorf("unable to resolve user %s of sidecar %s: %w",
+				config.Config.User, sidecar.Name, err)
+		}
+		config.Config.User = fmt.Sprintf("%d:%d", uid, gid)
+	}
+
+	return &Process{
+		Name:   sidecar.Name,
+		Image:  sidecar.Image,
+		Root:   root,
+		Config: config,
+	}, nil
+}
+
+func writeJSON(path string, v any) (err error) {
+	f, err := fs.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", path, err)
+	}
+	defer func() {
+		closeErr := f.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	err = json.NewEncoder(f).Encode(v)
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// setupVolumes creates the directories declared as volumes in the image config
+// if they do not exist in the image, owned by the image's user, and writes a
+// manifest of them to manifestPath. Directories that exist in the image keep
+// their ownership, which is recorded in the manifest. Symbolic links in volume
+// paths are followed within the image, never out of it onto the host.
+func (b *Builder) setupVolumes(metadata *v1.ConfigFile, manifestPath string) error {
+	uid, gid, err := userIDs(metadata.Config.User)
+	if err != nil {
+		return err
+	}
+
+	paths := []string{}
+	for volume := range metadata.Config.Volumes {
+		if !filepath.IsAbs(volume) {
+			return fmt.Errorf("volume path %s must be absolute", volume)
+		}
+		paths = append(paths, filepath.Clean(volume))
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+
+	volumes := []Volume{}
+	for _, volume := range paths {
+		resolved, err := rootfs.Resolve(fs, b.VMImageMount, volume)
+		if err != nil {
+			return fmt.Errorf("unable to resolve volume path %s: %w", volume, err)
+		}
+		dest := filepath.Join(b.VMImageMount, resolved)
+		exists, err := afero.DirExists(fs, dest)
+		if err != nil {
+			return fmt.Errorf("unable to stat %s: %w", dest, err)
+		}
+		if exists {
+			ownerUID, ownerGID, err := fileOwner(dest)
+			if err != nil {
+				return err
+			}
+			volumes = append(volumes, Volume{Path: volume, UserID: ownerUID, GroupID: ownerGID})
+			continue
+		}
+		slog.Debug("Creating volume directory", "path", volume, "uid", uid, "gid", gid)
+		if err = fs.MkdirAll(dest, 0755); err != nil {
+			return fmt.Errorf("unable to create volume directory %s: %w", dest, err)
+		}
+		if err = fs.Chown(dest, uid, gid); err != nil {
+			return fmt.Errorf("unable to change ownership of %s: %w", dest, err)
+		}
+		volumes = append(volumes, Volume{Path: volume, UserID: uid, GroupID: gid})
+	}
+
+	return writeJSON(manifestPath, volumes)
+}
+
+// fileOwner returns the user and group IDs that own path.
+func fileOwner(path string) (int, int, error) {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to stat %s: %w", path, err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, fmt.Errorf("unable to get owner of %s", path)
+	}
+	return int(stat.Uid), int(stat.Gid), nil
+}
+
+// userIDs parses a numeric user specification of the form `uid[:gid]`,
+// as written by imageConfig, defaulting to root when it is empty.
+func userIDs(user string) (int, int, error) {
+	if len(user) == 0 {
+		return 0, 0, nil
+	}
+	uidStr, gidStr, _ := strings.Cut(user, ":")
+	uid, err := strconv.Atoi(uidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to parse user ID from %s: %w", user, err)
+	}
+	gid := 0
+	if len(gidStr) > 0 {
+		gid, err = strconv.Atoi(gidStr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unable to parse group ID from %s: %w", user, err)
+		}
+	}
+	return uid, gid, nil
+}
+
 type ts struct {
 	atime time.Time
 	mtime time.Time
 }
 
+// setupAccounts locks and removes accounts that came with the container image.
+func (b *Builder) setupAccounts() error {
+	if len(b.LockUsers) == 0 && len(b.RemoveUsers) == 0 {
+		return nil
+	}
+
+	db, err := login.OpenDatabase(fs, b.VMImageMount)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range b.LockUsers {
+		if err = db.LockUser(user); err != nil {
+			return fmt.Errorf("unable to lock user %s: %w", user, err)
+		}
+	}
+
+	for _, user := range b.RemoveUsers {
+		if err = db.RemoveUser(user); err != nil {
+			return fmt.Errorf("unable to remove user %s: %w", user, err)
+		}
+	}
+
+	if err = db.Commit(); err != nil {
+		return fmt.Errorf("unable to write user database: %w", err)
+	}
+
+	return nil
+}
+
+// checkAccounts checks the consistency of the container image's login files.
+// Problems are logged, and fail the build if the login check policy is fail.
+func (b *Builder) checkAccounts() error {
+	problems, err := login.Check(fs, b.VMImageMount)
+	if err != nil {
+		if b.LoginCheck == LoginCheckFail {
+			return fmt.Errorf("unable to check login files: %w", err)
+		}
+		slog.Warn("Unable to check login files", "error", err)
+		return nil
+	}
+
+	for _, problem := range problems {
+		slog.Warn("Login file problem", "file", problem.File, "line", problem.Line,
+			"problem", problem.Message)
+	}
+
+	if len(problems) > 0 && b.LoginCheck == LoginCheckFail {
+		return fmt.Errorf("found %d problems in login files", len(problems))
+	}
+
+	return nil
+}
+
 func (b *Builder) setupChrony() error {
 	err := untarFile(fs, b.pathChrony, b.VMImageMount)
 	if err != nil {
@@ -522,20 +1045,55 @@ func (b *Builder) setupSSH() error {
 		return err
 	}
 
+	db, err := login.OpenDatabase(fs, b.VMImageMount)
+	if err != nil {
+		return err
+	}
+
 	// Root user is required in /etc/passwd for ssh-keygen to work on boot.
-	_, _, err = login.AddRootUser(fs, b.LoginShell, b.VMImageMount)
+	_, _, err = db.AddRootUser(b.LoginShell)
 	// ErrUsernameExists - root user exists.
 	// ErrNoAvailableIDs - UID 0 exists under a different username.
 	if !(err == nil || err == login.ErrUsernameExists || err == login.ErrNoAvailableIDs) {
 		return fmt.Errorf("unable to add root user: %w", err)
 	}
 
-	_, _, err = login.AddSystemUser(fs, constants.SSHPrivsepUser, constants.SSHPrivsepUser,
-		"/nonexistent", b.VMImageMount)
+	_, _, err = db.AddSystemUser(constants.SSHPrivsepUser, constants.SSHPrivsepUser,
+		"/nonexistent")
 	if err != nil {
 		return fmt.Errorf("unable to add ssh privsep user: %w", err)
 	}
 
+	// A user in the users file takes the place of the default login user.
+	hasLoginUser := slices.ContainsFunc(b.Users, func(spec login.UserSpec) bool {
+		return spec.Name == b.LoginUser
+	})
+	if !hasLoginUser {
+		homeDir := filepath.Join(constants.DirETHome, b.LoginUser)
+		_, _, err = db.AddLoginUser(b.LoginUser, b.LoginUser, homeDir, b.LoginShell)
+		if err != nil {
+			return fmt.Errorf("unable to add login user: %w", err)
+		}
+	}
+
+	for _, spec := range b.Users {
+		homeDir := filepath.Join(constants.DirETHome, spec.Name)
+		_, _, err = db.AddUserSpec(spec, homeDir, b.LoginShell)
+		if err != nil {
+			return fmt.Errorf("unable to add user %s: %w", spec.Name, err)
+		}
+	}
+
+	if len(b.LoginPassword) > 0 {
+		if err = db.SetPassword(b.LoginUser, b.LoginPassword); err != nil {
+			return fmt.Errorf("unable to set password of login user: %w", err)
+		}
+	}
+
+	if err = db.Commit(); err != nil {
+		return fmt.Errorf("unable to write user database: %w", err)
+	}
+
 	dirSSHPrivsep := filepath.Join(b.VMImageMount, constants.SSHPrivsepDir)
 	if err := fs.MkdirAll(dirSSHPrivsep, 0755); err != nil {
 		return fmt.Errorf("unable to create %s: %w", dirSSHPrivsep, err)
@@ -544,12 +1102,6 @@ func (b *Builder) setupSSH() error {
 		return fmt.Errorf("unable to set permissions on %s: %w", dirSSHPrivsep, err)
 	}
 
-	homeDir := filepath.Join(constants.DirETHome, b.LoginUser)
-	_, _, err = login.AddLoginUser(fs, b.LoginUser, b.LoginUser, homeDir, b.LoginShell, b.VMImageMount)
-	if err != nil {
-		return fmt.Errorf("unable to add login user: %w", err)
-	}
-
 	return nil
 }
 
@@ -733,6 +1285,34 @@ func untarFile(fs afero.Fs, srcFile, destDir string) error {
 	return nil
 }
 
+// writeImage writes the disk on device to the file output in the given format.
+func writeImage(fs afero.Fs, device, output, format string) error {
+	src, err := fs.Open(device)
+	if err != nil {
+		return fmt.Errorf("unable to open %s for reading: %w", device, err)
+	}
+	defer src.Close()
+
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("unable to determine size of %s: %w", device, err)
+	}
+
+	dest, err := fs.Create(output)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", output, err)
+	}
+	defer dest.Close()
+
+	slog.Info("Writing disk image", "output", output, "format", format)
+	err = diskformat.Convert(dest, src, size, format)
+	if err != nil {
+		return err
+	}
+
+	return dest.Close()
+}
+
 func partitionName(disk string, partition int) string {
 	lastChar := disk[len(disk)-1]
 	if lastChar >= '0' && lastChar <= '9' {
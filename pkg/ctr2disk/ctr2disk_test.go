@@ -3,11 +3,18 @@ package ctr2disk
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/cloudboss/easyto/pkg/diskformat"
+	"github.com/cloudboss/easyto/pkg/imageconfig"
+	"github.com/cloudboss/easyto/pkg/login"
 	"github.com/cloudboss/easyto/pkg/testutil"
+	"github.com/diskfs/go-diskfs/partition/gpt"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -87,6 +94,84 @@ func TestFormatBootEntry(t *testing.T) {
 	assert.Contains(t, string(lines[1]), "options")
 }
 
+func TestRootPartitionType(t *testing.T) {
+	testCases := []struct {
+		arch        string
+		expected    gpt.Type
+		expectError bool
+	}{
+		{
+			arch:     "amd64",
+			expected: gpt.LinuxRootX86_64,
+		},
+		{
+			arch:     "arm64",
+			expected: gpt.LinuxRootArm64,
+		},
+		{
+			arch:     "386",
+			expected: gpt.LinuxRootX86,
+		},
+		{
+			arch:     "arm",
+			expected: gpt.LinuxRootArm,
+		},
+		{
+			arch:        "riscv64",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.arch, func(t *testing.T) {
+			rootType, err := rootPartitionType(tc.arch)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, rootType)
+		})
+	}
+}
+
+func TestRootPartitionAttributes(t *testing.T) {
+	testCases := []struct {
+		description string
+		readOnly    bool
+		noAuto      bool
+		expected    uint64
+	}{
+		{
+			description: "No attributes",
+			expected:    0,
+		},
+		{
+			description: "Read-only",
+			readOnly:    true,
+			expected:    1 << 60,
+		},
+		{
+			description: "No-auto",
+			noAuto:      true,
+			expected:    1 << 63,
+		},
+		{
+			description: "Read-only and no-auto",
+			readOnly:    true,
+			noAuto:      true,
+			expected:    1<<60 | 1<<63,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			b := &Builder{RootReadOnly: tc.readOnly, RootNoAuto: tc.noAuto}
+			assert.Equal(t, tc.expected, b.rootPartitionAttributes())
+		})
+	}
+}
+
 func TestNewErrExtract(t *testing.T) {
 	testCases := []struct {
 		description string
@@ -406,6 +491,69 @@ func TestBuilderOptions(t *testing.T) {
 				assert.Equal(t, "/bin/bash", b.LoginShell)
 			},
 		},
+		{
+			description: "WithArchitecture",
+			opts:        []BuilderOpt{WithArchitecture("arm64")},
+			verify: func(t *testing.T, b *Builder) {
+				assert.Equal(t, "arm64", b.Architecture)
+			},
+		},
+		{
+			description: "WithRootReadOnly",
+			opts:        []BuilderOpt{WithRootReadOnly(true)},
+			verify: func(t *testing.T, b *Builder) {
+				assert.True(t, b.RootReadOnly)
+			},
+		},
+		{
+			description: "WithRootNoAuto",
+			opts:        []BuilderOpt{WithRootNoAuto(true)},
+			verify: func(t *testing.T, b *Builder) {
+				assert.True(t, b.RootNoAuto)
+			},
+		},
+		{
+			description: "WithChanges",
+			opts:        []BuilderOpt{WithChanges([]string{"ENV A=1"})},
+			verify: func(t *testing.T, b *Builder) {
+				assert.Equal(t, []string{"ENV A=1"}, b.Changes)
+			},
+		},
+		{
+			description: "WithSidecarImages",
+			opts:        []BuilderOpt{WithSidecarImages([]string{"logs=fluent/fluent-bit"})},
+			verify: func(t *testing.T, b *Builder) {
+				assert.Equal(t, []string{"logs=fluent/fluent-bit"}, b.SidecarImages)
+			},
+		},
+		{
+			description: "WithLoginPassword",
+			opts:        []BuilderOpt{WithLoginPassword("$6$salt$hash")},
+			verify: func(t *testing.T, b *Builder) {
+				assert.Equal(t, "$6$salt$hash", b.LoginPassword)
+			},
+		},
+		{
+			description: "WithPrivilegeEscalation",
+			opts:        []BuilderOpt{WithPrivilegeEscalation("doas")},
+			verify: func(t *testing.T, b *Builder) {
+				assert.Equal(t, "doas", b.PrivilegeEscalation)
+			},
+		},
+		{
+			description: "WithFormat",
+			opts:        []BuilderOpt{WithFormat("qcow2")},
+			verify: func(t *testing.T, b *Builder) {
+				assert.Equal(t, "qcow2", b.Format)
+			},
+		},
+		{
+			description: "WithOutput",
+			opts:        []BuilderOpt{WithOutput("/tmp/disk.qcow2")},
+			verify: func(t *testing.T, b *Builder) {
+				assert.Equal(t, "/tmp/disk.qcow2", b.Output)
+			},
+		},
 		{
 			description: "WithDebug",
 			opts:        []BuilderOpt{WithDebug(true)},
@@ -474,6 +622,130 @@ func TestNewBuilder(t *testing.T) {
 			expectError:   true,
 			errorContains: "VM image device must be defined",
 		},
+		{
+			description: "Unsupported architecture",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithArchitecture("s390x"),
+			},
+			expectError:   true,
+			errorContains: "unsupported architecture",
+		},
+		{
+			description: "Invalid changes",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithChanges([]string{"EXPOSE 80"}),
+			},
+			expectError:   true,
+			errorContains: "unsupported change instruction",
+		},
+		{
+			description: "Duplicate sidecar names",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithSidecarImages([]string{"fluent/fluent-bit", "other/fluent-bit"}),
+			},
+			expectError:   true,
+			errorContains: "duplicate sidecar name",
+		},
+		{
+			description: "Invalid login check",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithLoginCheck("ignore"),
+			},
+			expectError:   true,
+			errorContains: "login check must be one of warn or fail",
+		},
+		{
+			description: "Users without ssh",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithServices([]string{"chrony"}),
+				WithUsers([]login.UserSpec{{Name: "alice"}}),
+			},
+			expectError:   true,
+			errorContains: "users require the ssh service",
+		},
+		{
+			description: "Invalid user",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithServices([]string{"ssh"}),
+				WithUsers([]login.UserSpec{{Name: "a:b"}}),
+			},
+			expectError:   true,
+			errorContains: "invalid name",
+		},
+		{
+			description: "Login password without ssh",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithLoginPassword("$6$salt$hash"),
+			},
+			expectError:   true,
+			errorContains: "login password requires the ssh service",
+		},
+		{
+			description: "Invalid login password",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithServices([]string{"ssh"}),
+				WithLoginPassword("secret"),
+			},
+			expectError:   true,
+			errorContains: "invalid password hash",
+		},
+		{
+			description: "Privilege escalation without ssh",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithPrivilegeEscalation("sudo"),
+			},
+			expectError:   true,
+			errorContains: "privilege escalation requires the ssh service",
+		},
+		{
+			description: "Invalid privilege escalation",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithServices([]string{"ssh"}),
+				WithPrivilegeEscalation("su"),
+			},
+			expectError:   true,
+			errorContains: "invalid privilege escalation method",
+		},
+		{
+			description: "Invalid format",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithFormat("vdi"),
+			},
+			expectError:   true,
+			errorContains: "invalid disk image format",
+		},
+		{
+			description: "Format without output",
+			opts: []BuilderOpt{
+				WithAssetDir(tmpDir),
+				WithVMImageDevice("/dev/loop0"),
+				WithFormat("vmdk"),
+			},
+			expectError:   true,
+			errorContains: "output must be defined for vmdk format",
+		},
 		{
 			description: "Valid minimal builder",
 			opts: []BuilderOpt{
@@ -493,6 +765,8 @@ func TestNewBuilder(t *testing.T) {
 				WithServices([]string{"chrony"}),
 				WithLoginUser("testuser"),
 				WithLoginShell("/bin/sh"),
+				WithFormat("qcow2"),
+				WithOutput("/tmp/disk.qcow2"),
 				WithDebug(true),
 			},
 			expectError: false,
@@ -520,6 +794,60 @@ func TestNewBuilder(t *testing.T) {
 	}
 }
 
+func TestWriteImage(t *testing.T) {
+	testFS := afero.NewMemMapFs()
+	disk := make([]byte, 1024*1024)
+	copy(disk, "EFI PART")
+	copy(disk[len(disk)-512:], "EFI PART")
+	require.NoError(t, afero.WriteFile(testFS, "/dev/loop0", disk, 0644))
+
+	testCases := []struct {
+		description string
+		format      string
+		magic       []byte
+		magicOffset int64
+	}{
+		{
+			description: "Raw",
+			format:      diskformat.FormatRaw,
+			magic:       []byte("EFI PART"),
+		},
+		{
+			description: "QCOW2",
+			format:      diskformat.FormatQCOW2,
+			magic:       []byte("QFI\xfb"),
+		},
+		{
+			description: "VHD",
+			format:      diskformat.FormatVHD,
+			magic:       []byte("conectix"),
+			magicOffset: int64(len(disk)),
+		},
+		{
+			description: "VMDK",
+			format:      diskformat.FormatVMDK,
+			magic:       []byte("KDMV"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			output := "/out/disk." + tc.format
+			require.NoError(t, testFS.MkdirAll("/out", 0755))
+			err := writeImage(testFS, "/dev/loop0", output, tc.format)
+			require.NoError(t, err)
+			image, err := afero.ReadFile(testFS, output)
+			require.NoError(t, err)
+			require.Greater(t, int64(len(image)), tc.magicOffset)
+			assert.Equal(t, tc.magic, image[tc.magicOffset:tc.magicOffset+int64(len(tc.magic))])
+		})
+	}
+
+	t.Run("Missing device", func(t *testing.T) {
+		err := writeImage(testFS, "/dev/loop1", "/out/disk.raw", diskformat.FormatRaw)
+		assert.ErrorContains(t, err, "unable to open /dev/loop1")
+	})
+}
+
 func TestLoadImage(t *testing.T) {
 	t.Run("Unknown source", func(t *testing.T) {
 		_, err := loadImage(nil, "invalid")
@@ -618,7 +946,9 @@ func TestSetupMetadata(t *testing.T) {
 		tmpFile.Close()
 
 		b := &Builder{}
-		err = b.setupMetadata(img, tmpFile.Name())
+		metadata, err := b.imageConfig(img)
+		require.NoError(t, err)
+		err = b.setupMetadata(metadata, tmpFile.Name())
 		require.NoError(t, err)
 
 		data, err := os.ReadFile(tmpFile.Name())
@@ -633,7 +963,381 @@ func TestSetupMetadata(t *testing.T) {
 		require.NoError(t, err)
 
 		b := &Builder{}
-		err = b.setupMetadata(img, "/nonexistent/directory/metadata.json")
+		metadata, err := b.imageConfig(img)
+		require.NoError(t, err)
+		err = b.setupMetadata(metadata, "/nonexistent/directory/metadata.json")
 		assert.Error(t, err)
 	})
 }
+
+func TestImageConfig(t *testing.T) {
+	t.Run("Apply changes", func(t *testing.T) {
+		config := &v1.ConfigFile{
+			Config: v1.Config{
+				Env: []string{"PATH=/usr/bin", "MODE=web"},
+				Cmd: []string{"/app", "web"},
+			},
+		}
+		img, err := testutil.CreateTestImage(config)
+		require.NoError(t, err)
+
+		b := &Builder{
+			Changes: []string{
+				"ENV MODE=worker",
+				`CMD ["/app", "worker"]`,
+				"WORKDIR /srv",
+			},
+		}
+		metadata, err := b.imageConfig(img)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"PATH=/usr/bin", "MODE=worker"}, metadata.Config.Env)
+		assert.Equal(t, []string{"/app", "worker"}, metadata.Config.Cmd)
+		assert.Equal(t, "/srv", metadata.Config.WorkingDir)
+
+		// The image's own config is left unmodified.
+		original, err := img.ConfigFile()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"/app", "web"}, original.Config.Cmd)
+	})
+
+	rootDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "etc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "etc/passwd"),
+		[]byte("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1001:app:/app:/bin/sh\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "etc/group"),
+		[]byte("root:x:0:\napp:x:1001:\nstaff:x:50:\n"), 0644))
+
+	testCases := []struct {
+		description   string
+		user          string
+		changes       []string
+		expected      string
+		errorContains string
+	}{
+		{
+			description: "No user",
+			user:        "",
+			expected:    "",
+		},
+		{
+			description: "Named user",
+			user:        "app",
+			expected:    "1000:1001",
+		},
+		{
+			description: "Named user and group",
+			user:        "app:staff",
+			expected:    "1000:50",
+		},
+		{
+			description: "Numeric user",
+			user:        "1000",
+			expected:    "1000:1001",
+		},
+		{
+			description: "User from changes",
+			user:        "root",
+			changes:     []string{"USER app"},
+			expected:    "1000:1001",
+		},
+		{
+			description:   "Unknown user",
+			user:          "nobody",
+			errorContains: "unable to resolve image user nobody",
+		},
+		{
+			description:   "Unknown group",
+			user:          "app:wheel",
+			errorContains: "group not found",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			img, err := testutil.CreateTestImage(&v1.ConfigFile{
+				Config: v1.Config{User: tc.user},
+			})
+			require.NoError(t, err)
+
+			b := &Builder{VMImageMount: rootDir, Changes: tc.changes}
+			metadata, err := b.imageConfig(img)
+			if tc.errorContains != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, metadata.Config.User)
+		})
+	}
+}
+
+func TestSetupVolumes(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+
+	t.Run("Create volume directories and manifest", func(t *testing.T) {
+		rootDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "existing"), 0700))
+		manifestPath := filepath.Join(rootDir, "volumes.json")
+
+		metadata := &v1.ConfigFile{
+			Config: v1.Config{
+				User: fmt.Sprintf("%d:%d", uid, gid),
+				Volumes: map[string]struct{}{
+					"/var/lib/data": {},
+					"/existing/":    {},
+					"/cache":        {},
+				},
+			},
+		}
+
+		b := &Builder{VMImageMount: rootDir}
+		err := b.setupVolumes(metadata, manifestPath)
+		require.NoError(t, err)
+
+		info, err := os.Stat(filepath.Join(rootDir, "var/lib/data"))
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+		// Directories that exist in the image are left as they are.
+		info, err = os.Stat(filepath.Join(rootDir, "existing"))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+		data, err := os.ReadFile(manifestPath)
+		require.NoError(t, err)
+		volumes := []Volume{}
+		require.NoError(t, json.Unmarshal(data, &volumes))
+		assert.Equal(t, []Volume{
+			{Path: "/cache", UserID: uid, GroupID: gid},
+			{Path: "/existing", UserID: uid, GroupID: gid},
+			{Path: "/var/lib/data", UserID: uid, GroupID: gid},
+		}, volumes)
+	})
+
+	t.Run("Existing volume directory keeps its owner", func(t *testing.T) {
+		rootDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "srv"), 0755))
+		manifestPath := filepath.Join(rootDir, "volumes.json")
+
+		metadata := &v1.ConfigFile{
+			Config: v1.Config{
+				User:    fmt.Sprintf("%d:%d", uid+1000, gid+1000),
+				Volumes: map[string]struct{}{"/srv": {}},
+			},
+		}
+
+		b := &Builder{VMImageMount: rootDir}
+		err := b.setupVolumes(metadata, manifestPath)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(manifestPath)
+		require.NoError(t, err)
+		volumes := []Volume{}
+		require.NoError(t, json.Unmarshal(data, &volumes))
+		assert.Equal(t, []Volume{{Path: "/srv", UserID: uid, GroupID: gid}}, volumes)
+	})
+
+	t.Run("Symlinked volume path stays in the image", func(t *testing.T) {
+		rootDir := t.TempDir()
+		outside := t.TempDir()
+		require.NoError(t, os.Symlink("/var/lib/data", filepath.Join(rootDir, "data")))
+		require.NoError(t, os.Symlink(outside, filepath.Join(rootDir, "host")))
+		manifestPath := filepath.Join(rootDir, "volumes.json")
+
+		metadata := &v1.ConfigFile{
+			Config: v1.Config{
+				User: fmt.Sprintf("%d:%d", uid, gid),
+				Volumes: map[string]struct{}{
+					"/data":     {},
+					"/host/app": {},
+				},
+			},
+		}
+
+		b := &Builder{VMImageMount: rootDir}
+		err := b.setupVolumes(metadata, manifestPath)
+		require.NoError(t, err)
+
+		info, err := os.Stat(filepath.Join(rootDir, "var/lib/data"))
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+
+		// The absolute link target is followed within the image.
+		info, err = os.Stat(filepath.Join(rootDir, outside, "app"))
+		require.NoError(t, err)
+		assert.True(t, info.IsDir())
+		_, err = os.Stat(filepath.Join(outside, "app"))
+		assert.True(t, os.IsNotExist(err))
+
+		data, err := os.ReadFile(manifestPath)
+		require.NoError(t, err)
+		volumes := []Volume{}
+		require.NoError(t, json.Unmarshal(data, &volumes))
+		assert.Equal(t, []Volume{
+			{Path: "/data", UserID: uid, GroupID: gid},
+			{Path: "/host/app", UserID: uid, GroupID: gid},
+		}, volumes)
+	})
+
+	t.Run("Empty manifest without volumes", func(t *testing.T) {
+		rootDir := t.TempDir()
+		manifestPath := filepath.Join(rootDir, "volumes.json")
+
+		b := &Builder{VMImageMount: rootDir}
+		err := b.setupVolumes(&v1.ConfigFile{}, manifestPath)
+		require.NoError(t, err)
+
+		data, err := os.ReadFile(manifestPath)
+		require.NoError(t, err)
+		assert.Equal(t, "[]\n", string(data))
+	})
+
+	t.Run("Relative volume path", func(t *testing.T) {
+		rootDir := t.TempDir()
+		metadata := &v1.ConfigFile{
+			Config: v1.Config{
+				Volumes: map[string]struct{}{"data": {}},
+			},
+		}
+
+		b := &Builder{VMImageMount: rootDir}
+		err := b.setupVolumes(metadata, filepath.Join(rootDir, "volumes.json"))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "must be absolute")
+	})
+}
+
+func TestUserIDs(t *testing.T) {
+	testCases := []struct {
+		user        string
+		uid         int
+		gid         int
+		expectError bool
+	}{
+		{user: "", uid: 0, gid: 0},
+		{user: "1000", uid: 1000, gid: 0},
+		{user: "1000:1001", uid: 1000, gid: 1001},
+		{user: "app", expectError: true},
+		{user: "1000:app", expectError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.user, func(t *testing.T) {
+			uid, gid, err := userIDs(tc.user)
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.uid, uid)
+			assert.Equal(t, tc.gid, gid)
+		})
+	}
+}
+
+func TestSetupSidecar(t *testing.T) {
+	rootDir := t.TempDir()
+
+	img, err := testutil.CreateTestImage(&v1.ConfigFile{
+		Config: v1.Config{
+			Entrypoint: []string{"/fluent-bit/bin/fluent-bit"},
+			User:       "0",
+		},
+	})
+	require.NoError(t, err)
+
+	b := &Builder{VMImageMount: rootDir}
+	sidecar := imageconfig.Sidecar{Name: "logs", Image: "fluent/fluent-bit:3.0"}
+	process, err := b.setupSidecar(img, sidecar)
+	require.NoError(t, err)
+
+	root := filepath.Join(constants.DirETRoot, constants.DirSidecars, "logs")
+	assert.Equal(t, "logs", process.Name)
+	assert.Equal(t, "fluent/fluent-bit:3.0", process.Image)
+	assert.Equal(t, root, process.Root)
+	assert.Equal(t, []string{"/fluent-bit/bin/fluent-bit"}, process.Config.Config.Entrypoint)
+	assert.Equal(t, "0:0", process.Config.Config.User)
+
+	info, err := os.Stat(filepath.Join(rootDir, root))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	t.Run("Unknown sidecar user", func(t *testing.T) {
+		img, err := testutil.CreateTestImage(&v1.ConfigFile{
+			Config: v1.Config{User: "fluent"},
+		})
+		require.NoError(t, err)
+
+		_, err = b.setupSidecar(img, imageconfig.Sidecar{Name: "other", Image: "other"})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unable to resolve user fluent of sidecar other")
+	})
+}
+
+func TestSetupSidecarsManifest(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "processes.json")
+
+	b := &Builder{}
+	err := b.setupSidecars(manifestPath)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	assert.Equal(t, "[]\n", string(data))
+}
+
+func TestSetupAccounts(t *testing.T) {
+	rootDir := t.TempDir()
+	etcDir := filepath.Join(rootDir, "etc")
+	require.NoError(t, os.MkdirAll(etcDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(etcDir, "passwd"),
+		[]byte("root:x:0:0:root:/root:/bin/sh\nadmin:x:1000:1000::/home/admin:/bin/sh\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(etcDir, "shadow"),
+		[]byte("root:$6$salt$hash:19000:0:99999:7:::\nadmin:*:19000:0:99999:7:::\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(etcDir, "group"),
+		[]byte("root:x:0:\nwheel:x:10:admin\nadmin:x:1000:\n"), 0644))
+
+	b := &Builder{
+		VMImageMount: rootDir,
+		LockUsers:    []string{"root"},
+		RemoveUsers:  []string{"admin"},
+	}
+	require.NoError(t, b.setupAccounts())
+
+	passwd, err := os.ReadFile(filepath.Join(etcDir, "passwd"))
+	require.NoError(t, err)
+	assert.Equal(t, "root:x:0:0:root:/root:/bin/sh\n", string(passwd))
+
+	shadow, err := os.ReadFile(filepath.Join(etcDir, "shadow"))
+	require.NoError(t, err)
+	assert.Equal(t, "root:!$6$salt$hash:19000:0:99999:7:::\n", string(shadow))
+
+	group, err := os.ReadFile(filepath.Join(etcDir, "group"))
+	require.NoError(t, err)
+	assert.Equal(t, "root:x:0:\nwheel:x:10:\n", string(group))
+
+	b = &Builder{VMImageMount: rootDir, RemoveUsers: []string{"nobody"}}
+	assert.ErrorIs(t, b.setupAccounts(), login.ErrUserNotFound)
+}
+
+func TestCheckAccounts(t *testing.T) {
+	rootDir := t.TempDir()
+	etcDir := filepath.Join(rootDir, "etc")
+	require.NoError(t, os.MkdirAll(etcDir, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(etcDir, "passwd"),
+		[]byte("admin:x:1000:1000::/home/admin:/bin/sh\n"), 0644))
+
+	b := &Builder{VMImageMount: rootDir, LoginCheck: LoginCheckWarn}
+	assert.NoError(t, b.checkAccounts())
+
+	b.LoginCheck = LoginCheckFail
+	assert.ErrorContains(t, b.checkAccounts(), "found 2 problems in login files")
+
+	require.NoError(t, os.WriteFile(filepath.Join(etcDir, "passwd"), []byte("admin:x\n"), 0644))
+	assert.ErrorContains(t, b.checkAccounts(), "unable to check login files")
+
+	b.LoginCheck = LoginCheckWarn
+	assert.NoError(t, b.checkAccounts())
+}
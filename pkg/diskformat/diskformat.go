@@ -0,0 +1,123 @@
+package diskformat
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+const (
+	FormatRaw   = "raw"
+	FormatQCOW2 = "qcow2"
+	FormatVHD   = "vhd"
+	FormatVMDK  = "vmdk"
+
+	sectorSize = 512
+)
+
+var (
+	Formats = []string{FormatRaw, FormatQCOW2, FormatVHD, FormatVMDK}
+
+	ErrInvalidFormat = errors.New("invalid disk image format")
+	ErrInvalidSize   = errors.New("disk image size must be a positive multiple of 512")
+)
+
+// ValidateFormat returns an error if format is not a valid disk image format.
+func ValidateFormat(format string) error {
+	if !slices.Contains(Formats, format) {
+		return fmt.Errorf("%w %q, must be one of %v", ErrInvalidFormat, format, Formats)
+	}
+	return nil
+}
+
+// Convert writes the raw disk image in src, which is size bytes, to dest in
+// the given format. The qcow2 format is a sparse qcow2 version 3 image, vhd is
+// a fixed VHD, and vmdk is a streamOptimized VMDK. Blocks of zeros are left
+// out of the qcow2 and VMDK images.
+func Convert(dest io.Writer, src io.ReaderAt, size int64, format string) error {
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	if size <= 0 || size%sectorSize != 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidSize, size)
+	}
+
+	var err error
+	switch format {
+	case FormatRaw:
+		_, err = io.Copy(dest, io.NewSectionReader(src, 0, size))
+	case FormatQCOW2:
+		err = writeQCOW2(dest, src, size)
+	case FormatVHD:
+		err = writeVHD(dest, src, size)
+	case FormatVMDK:
+		err = writeVMDK(dest, src, size)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write %s image: %w", format, err)
+	}
+	return nil
+}
+
+// readBlock reads the block of src at offset into buf, filling the part of
+// buf past the end of src with zeros.
+func readBlock(src io.ReaderAt, buf []byte, offset, size int64) error {
+	n := int64(len(buf))
+	if offset+n > size {
+		n = size - offset
+		clear(buf[n:])
+	}
+	if _, err := src.ReadAt(buf[:n], offset); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for len(b) > 0 {
+		n := min(len(b), len(zeros))
+		if !bytes.Equal(b[:n], zeros[:n]) {
+			return false
+		}
+		b = b[n:]
+	}
+	return true
+}
+
+var zeros = make([]byte, 64*1024)
+
+func divRoundUp(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+// chsGeometry returns the disk geometry for a disk of size bytes, using the
+// algorithm from the VHD specification.
+func chsGeometry(size int64) (cylinders, heads, sectorsPerTrack int64) {
+	totalSectors := size / sectorSize
+	totalSectors = min(totalSectors, 65535*16*255)
+
+	var cylinderTimesHeads int64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack = 255
+		heads = 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = max((cylinderTimesHeads+1023)/1024, 4)
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack = 31
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack = 63
+			heads = 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+	cylinders = cylinderTimesHeads / heads
+	return cylinders, heads, sectorsPerTrack
+}
@@ -0,0 +1,214 @@
+package diskformat
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sparseDisk is a disk of zeros except for the data at the offsets in blocks.
+type sparseDisk struct {
+	size   int64
+	blocks map[int64][]byte
+}
+
+func (d *sparseDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= d.size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if off+int64(n) > d.size {
+		n = int(d.size - off)
+	}
+	clear(p[:n])
+	for blockOffset, data := range d.blocks {
+		start := max(blockOffset, off)
+		end := min(blockOffset+int64(len(data)), off+int64(n))
+		if start < end {
+			copy(p[start-off:end-off], data[start-blockOffset:end-blockOffset])
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// testDisk returns a disk that is not a whole number of clusters or grains,
+// with data in the first sector, across a cluster boundary, and in the last
+// sector.
+func testDisk() []byte {
+	disk := make([]byte, 3*1024*1024+3*sectorSize)
+	copy(disk, randomBytes(1, sectorSize))
+	copy(disk[qcow2ClusterSize-100:], randomBytes(2, 200))
+	copy(disk[len(disk)-sectorSize:], randomBytes(3, sectorSize))
+	return disk
+}
+
+// assemble returns the disk of size bytes with the data in blocks.
+func assemble(t *testing.T, blocks map[int64][]byte, size int64) []byte {
+	disk := make([]byte, size)
+	for offset, data := range blocks {
+		require.LessOrEqual(t, offset, size)
+		copy(disk[offset:], data[:min(int64(len(data)), size-offset)])
+	}
+	return disk
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	disk := testDisk()
+	size := int64(len(disk))
+	testCases := []struct {
+		format string
+		read   func(t *testing.T, image []byte) []byte
+	}{
+		{
+			format: FormatRaw,
+			read:   func(t *testing.T, image []byte) []byte { return image },
+		},
+		{
+			format: FormatQCOW2,
+			read: func(t *testing.T, image []byte) []byte {
+				virtualSize, blocks := readQCOW2(t, image)
+				assert.Equal(t, size, virtualSize)
+				return assemble(t, blocks, virtualSize)
+			},
+		},
+		{
+			format: FormatVHD,
+			read:   readVHD,
+		},
+		{
+			format: FormatVMDK,
+			read: func(t *testing.T, image []byte) []byte {
+				capacity, blocks := readVMDK(t, image)
+				assert.Equal(t, size, capacity)
+				return assemble(t, blocks, capacity)
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			image := &bytes.Buffer{}
+			err := Convert(image, bytes.NewReader(disk), size, tc.format)
+			require.NoError(t, err)
+			assert.Equal(t, disk, tc.read(t, image.Bytes()))
+		})
+	}
+}
+
+func TestConvertSparse(t *testing.T) {
+	// The disk is larger than the 512 MiB covered by one qcow2 L2 table.
+	disk := &sparseDisk{
+		size: 600 * 1024 * 1024,
+		blocks: map[int64][]byte{
+			0:                   randomBytes(1, 4096),
+			512*1024*1024 + 512: randomBytes(2, 70000),
+			600*1024*1024 - 512: randomBytes(3, 512),
+		},
+	}
+
+	t.Run(FormatQCOW2, func(t *testing.T) {
+		image := &bytes.Buffer{}
+		require.NoError(t, Convert(image, disk, disk.size, FormatQCOW2))
+		// Header, L1, refcount table and block, 2 L2 tables, 4 data clusters.
+		assert.Equal(t, 10*qcow2ClusterSize, image.Len())
+		virtualSize, blocks := readQCOW2(t, image.Bytes())
+		assert.Equal(t, disk.size, virtualSize)
+		assertSparseBlocks(t, disk, blocks, qcow2ClusterSize)
+	})
+
+	t.Run(FormatVMDK, func(t *testing.T) {
+		image := &bytes.Buffer{}
+		require.NoError(t, Convert(image, disk, disk.size, FormatVMDK))
+		assert.Less(t, image.Len(), 1024*1024)
+		capacity, blocks := readVMDK(t, image.Bytes())
+		assert.Equal(t, disk.size, capacity)
+		assertSparseBlocks(t, disk, blocks, vmdkGrainSize)
+	})
+}
+
+// assertSparseBlocks checks that blocks holds exactly the blocks of disk that
+// are not all zeros.
+func assertSparseBlocks(t *testing.T, disk *sparseDisk, blocks map[int64][]byte, blockSize int64) {
+	expected := map[int64][]byte{}
+	for offset, data := range disk.blocks {
+		first := offset / blockSize * blockSize
+		for start := first; start < offset+int64(len(data)); start += blockSize {
+			block := make([]byte, blockSize)
+			disk.ReadAt(block, start)
+			expected[start] = block
+		}
+	}
+	assert.Equal(t, len(expected), len(blocks))
+	for offset, block := range expected {
+		assert.Equal(t, block, blocks[offset], "block at offset %d", offset)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	testCases := []struct {
+		description string
+		size        int64
+		format      string
+		err         error
+	}{
+		{
+			description: "Invalid format",
+			size:        sectorSize,
+			format:      "vdi",
+			err:         ErrInvalidFormat,
+		},
+		{
+			description: "Unaligned size",
+			size:        sectorSize + 1,
+			format:      FormatVHD,
+			err:         ErrInvalidSize,
+		},
+		{
+			description: "Empty",
+			size:        0,
+			format:      FormatQCOW2,
+			err:         ErrInvalidSize,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			src := bytes.NewReader(make([]byte, tc.size))
+			err := Convert(io.Discard, src, tc.size, tc.format)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+}
+
+func TestCHSGeometry(t *testing.T) {
+	testCases := []struct {
+		size      int64
+		cylinders int64
+		heads     int64
+		sectors   int64
+	}{
+		{size: 10 * 1024 * 1024, cylinders: 301, heads: 4, sectors: 17},
+		{size: 200 * 1024 * 1024, cylinders: 825, heads: 16, sectors: 31},
+		{size: 1024 * 1024 * 1024, cylinders: 2080, heads: 16, sectors: 63},
+		{size: 10 * 1024 * 1024 * 1024, cylinders: 20805, heads: 16, sectors: 63},
+		{size: 64 * 1024 * 1024 * 1024, cylinders: 32896, heads: 16, sectors: 255},
+		{size: 4 * 1024 * 1024 * 1024 * 1024, cylinders: 65535, heads: 16, sectors: 255},
+	}
+	for _, tc := range testCases {
+		cylinders, heads, sectors := chsGeometry(tc.size)
+		assert.Equal(t, tc.cylinders, cylinders, "cylinders of %d", tc.size)
+		assert.Equal(t, tc.heads, heads, "heads of %d", tc.size)
+		assert.Equal(t, tc.sectors, sectors, "sectors of %d", tc.size)
+	}
+}
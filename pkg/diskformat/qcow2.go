@@ -0,0 +1,194 @@
+package diskformat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	qcow2Magic         = 0x514649fb
+	qcow2Version       = 3
+	qcow2ClusterBits   = 16
+	qcow2ClusterSize   = 1 << qcow2ClusterBits
+	qcow2RefcountOrder = 4
+	qcow2HeaderLength  = 104
+	// qcow2Copied is set on L1 and L2 entries of clusters with a refcount of 1.
+	qcow2Copied = uint64(1) << 63
+
+	qcow2L2Entries       = qcow2ClusterSize / 8
+	qcow2RefcountEntries = qcow2ClusterSize * 8 / (1 << qcow2RefcountOrder)
+)
+
+// qcow2Layout is the placement of clusters in a qcow2 image. The header is
+// followed by the L1 table, the refcount table, refcount blocks, L2 tables,
+// and data clusters, with the data clusters in guest order.
+type qcow2Layout struct {
+	size int64
+	// allocated is the guest index of each data cluster.
+	allocated []int64
+	// l2Tables is the L1 index of each L2 table.
+	l2Tables []int64
+
+	l1Size         int64
+	l1Clusters     int64
+	rtClusters     int64
+	refcountBlocks int64
+	totalClusters  int64
+}
+
+func newQCOW2Layout(src io.ReaderAt, size int64) (*qcow2Layout, error) {
+	layout := &qcow2Layout{size: size}
+	buf := make([]byte, qcow2ClusterSize)
+	guestClusters := divRoundUp(size, qcow2ClusterSize)
+	for i := int64(0); i < guestClusters; i++ {
+		if err := readBlock(src, buf, i*qcow2ClusterSize, size); err != nil {
+			return nil, err
+		}
+		if isZero(buf) {
+			continue
+		}
+		layout.allocated = append(layout.allocated, i)
+		l1Index := i / qcow2L2Entries
+		if n := len(layout.l2Tables); n == 0 || layout.l2Tables[n-1] != l1Index {
+			layout.l2Tables = append(layout.l2Tables, l1Index)
+		}
+	}
+
+	layout.l1Size = divRoundUp(guestClusters, qcow2L2Entries)
+	layout.l1Clusters = divRoundUp(layout.l1Size*8, qcow2ClusterSize)
+
+	// The refcount blocks must count themselves and the refcount table, so
+	// grow them until they cover every cluster.
+	fixed := 1 + layout.l1Clusters + int64(len(layout.l2Tables)) + int64(len(layout.allocated))
+	for {
+		total := fixed + layout.rtClusters + layout.refcountBlocks
+		refcountBlocks := divRoundUp(total, qcow2RefcountEntries)
+		rtClusters := divRoundUp(refcountBlocks*8, qcow2ClusterSize)
+		if refcountBlocks == layout.refcountBlocks && rtClusters == layout.rtClusters {
+			layout.totalClusters = total
+			break
+		}
+		layout.refcountBlocks, layout.rtClusters = refcountBlocks, rtClusters
+	}
+	return layout, nil
+}
+
+func (l *qcow2Layout) l1Offset() int64 {
+	return qcow2ClusterSize
+}
+
+func (l *qcow2Layout) refcountTableOffset() int64 {
+	return l.l1Offset() + l.l1Clusters*qcow2ClusterSize
+}
+
+func (l *qcow2Layout) refcountBlocksOffset() int64 {
+	return l.refcountTableOffset() + l.rtClusters*qcow2ClusterSize
+}
+
+func (l *qcow2Layout) l2TablesOffset() int64 {
+	return l.refcountBlocksOffset() + l.refcountBlocks*qcow2ClusterSize
+}
+
+func (l *qcow2Layout) dataOffset() int64 {
+	return l.l2TablesOffset() + int64(len(l.l2Tables))*qcow2ClusterSize
+}
+
+func (l *qcow2Layout) header() []byte {
+	header := make([]byte, qcow2ClusterSize)
+	binary.BigEndian.PutUint32(header[0:], qcow2Magic)
+	binary.BigEndian.PutUint32(header[4:], qcow2Version)
+	binary.BigEndian.PutUint32(header[20:], qcow2ClusterBits)
+	binary.BigEndian.PutUint64(header[24:], uint64(l.size))
+	binary.BigEndian.PutUint32(header[36:], uint32(l.l1Size))
+	binary.BigEndian.PutUint64(header[40:], uint64(l.l1Offset()))
+	binary.BigEndian.PutUint64(header[48:], uint64(l.refcountTableOffset()))
+	binary.BigEndian.PutUint32(header[56:], uint32(l.rtClusters))
+	binary.BigEndian.PutUint32(header[96:], qcow2RefcountOrder)
+	binary.BigEndian.PutUint32(header[100:], qcow2HeaderLength)
+	// The header is followed by an end of header extensions marker, which
+	// is all zeros.
+	return header
+}
+
+func (l *qcow2Layout) l1Table() []byte {
+	table := make([]byte, l.l1Clusters*qcow2ClusterSize)
+	for i, l1Index := range l.l2Tables {
+		offset := l.l2TablesOffset() + int64(i)*qcow2ClusterSize
+		binary.BigEndian.PutUint64(table[l1Index*8:], uint64(offset)|qcow2Copied)
+	}
+	return table
+}
+
+func (l *qcow2Layout) refcountTable() []byte {
+	table := make([]byte, l.rtClusters*qcow2ClusterSize)
+	for i := int64(0); i < l.refcountBlocks; i++ {
+		offset := l.refcountBlocksOffset() + i*qcow2ClusterSize
+		binary.BigEndian.PutUint64(table[i*8:], uint64(offset))
+	}
+	return table
+}
+
+func (l *qcow2Layout) refcountBlockData() []byte {
+	blocks := make([]byte, l.refcountBlocks*qcow2ClusterSize)
+	for i := int64(0); i < l.totalClusters; i++ {
+		binary.BigEndian.PutUint16(blocks[i*2:], 1)
+	}
+	return blocks
+}
+
+// l2Table returns the L2 table for the L1 entry at l1Index, where dataIndex
+// is the index in allocated of the first data cluster it maps.
+func (l *qcow2Layout) l2Table(l1Index int64, dataIndex int) ([]byte, int) {
+	table := make([]byte, qcow2ClusterSize)
+	for ; dataIndex < len(l.allocated); dataIndex++ {
+		guestIndex := l.allocated[dataIndex]
+		if guestIndex/qcow2L2Entries != l1Index {
+			break
+		}
+		offset := l.dataOffset() + int64(dataIndex)*qcow2ClusterSize
+		binary.BigEndian.PutUint64(table[(guestIndex%qcow2L2Entries)*8:], uint64(offset)|qcow2Copied)
+	}
+	return table, dataIndex
+}
+
+// writeQCOW2 writes a qcow2 version 3 image with 64 KiB clusters, in which
+// clusters of zeros are not allocated.
+func writeQCOW2(dest io.Writer, src io.ReaderAt, size int64) error {
+	layout, err := newQCOW2Layout(src, size)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriterSize(dest, 1024*1024)
+	for _, data := range [][]byte{
+		layout.header(),
+		layout.l1Table(),
+		layout.refcountTable(),
+		layout.refcountBlockData(),
+	} {
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	dataIndex := 0
+	for _, l1Index := range layout.l2Tables {
+		var table []byte
+		table, dataIndex = layout.l2Table(l1Index, dataIndex)
+		if _, err = w.Write(table); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, qcow2ClusterSize)
+	for _, guestIndex := range layout.allocated {
+		if err = readBlock(src, buf, guestIndex*qcow2ClusterSize, size); err != nil {
+			return err
+		}
+		if _, err = w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,106 @@
+package diskformat
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readQCOW2 checks the structure of a qcow2 image and returns its virtual
+// size and the data of its allocated clusters by guest offset. It fails if
+// any cluster in the image does not have a refcount of one, or if a cluster
+// is used more than once.
+func readQCOW2(t *testing.T, image []byte) (int64, map[int64][]byte) {
+	be := binary.BigEndian
+	require.GreaterOrEqual(t, len(image), qcow2HeaderLength)
+	require.Equal(t, uint32(qcow2Magic), be.Uint32(image[0:]))
+	require.Equal(t, uint32(3), be.Uint32(image[4:]))
+	require.Equal(t, uint64(0), be.Uint64(image[8:]), "backing file offset")
+	clusterBits := be.Uint32(image[20:])
+	clusterSize := int64(1) << clusterBits
+	size := int64(be.Uint64(image[24:]))
+	require.Equal(t, uint32(0), be.Uint32(image[32:]), "crypt method")
+	l1Size := int64(be.Uint32(image[36:]))
+	l1Offset := int64(be.Uint64(image[40:]))
+	rtOffset := int64(be.Uint64(image[48:]))
+	rtClusters := int64(be.Uint32(image[56:]))
+	require.Equal(t, uint32(0), be.Uint32(image[60:]), "snapshots")
+	require.Equal(t, uint64(0), be.Uint64(image[72:]), "incompatible features")
+	refcountOrder := be.Uint32(image[96:])
+	require.Equal(t, uint32(4), refcountOrder)
+	headerLength := be.Uint32(image[100:])
+	require.Equal(t, uint64(0), be.Uint64(image[headerLength:]), "end of header extensions")
+	require.Equal(t, int64(0), int64(len(image))%clusterSize, "image is whole clusters")
+
+	clusters := int64(len(image)) / clusterSize
+	refcounts := make([]uint16, clusters)
+	for i := int64(0); i < rtClusters*clusterSize/8; i++ {
+		blockOffset := int64(be.Uint64(image[rtOffset+i*8:]))
+		if blockOffset == 0 {
+			continue
+		}
+		for j := int64(0); j < clusterSize/2; j++ {
+			cluster := i*clusterSize/2 + j
+			refcount := be.Uint16(image[blockOffset+j*2:])
+			if cluster < clusters {
+				refcounts[cluster] = refcount
+			} else {
+				require.Zero(t, refcount, "refcount of cluster %d past the end", cluster)
+			}
+		}
+	}
+	for cluster, refcount := range refcounts {
+		require.Equal(t, uint16(1), refcount, "refcount of cluster %d", cluster)
+	}
+
+	used := map[int64]bool{}
+	use := func(offset int64) {
+		require.Zero(t, offset%clusterSize, "offset %d is not aligned", offset)
+		require.Less(t, offset, int64(len(image)))
+		require.False(t, used[offset], "cluster at %d is used more than once", offset)
+		used[offset] = true
+	}
+	use(0)
+	for i := int64(0); i < divRoundUp(l1Size*8, clusterSize); i++ {
+		use(l1Offset + i*clusterSize)
+	}
+	for i := int64(0); i < rtClusters; i++ {
+		use(rtOffset + i*clusterSize)
+	}
+	for i := int64(0); i < rtClusters*clusterSize/8; i++ {
+		if blockOffset := int64(be.Uint64(image[rtOffset+i*8:])); blockOffset != 0 {
+			use(blockOffset)
+		}
+	}
+
+	offsetMask := uint64(0x00fffffffffffe00)
+	blocks := map[int64][]byte{}
+	l2Entries := clusterSize / 8
+	for i := int64(0); i < l1Size; i++ {
+		l1Entry := be.Uint64(image[l1Offset+i*8:])
+		if l1Entry == 0 {
+			continue
+		}
+		require.Equal(t, qcow2Copied, l1Entry&qcow2Copied, "L1 entry %d copied flag", i)
+		l2Offset := int64(l1Entry & offsetMask)
+		use(l2Offset)
+		for j := int64(0); j < l2Entries; j++ {
+			l2Entry := be.Uint64(image[l2Offset+j*8:])
+			if l2Entry == 0 {
+				continue
+			}
+			require.Equal(t, qcow2Copied, l2Entry&qcow2Copied, "L2 entry %d copied flag", j)
+			require.Zero(t, l2Entry&(1<<62), "compressed cluster")
+			dataOffset := int64(l2Entry & offsetMask)
+			use(dataOffset)
+			guestOffset := (i*l2Entries + j) * clusterSize
+			require.Less(t, guestOffset, size)
+			blocks[guestOffset] = image[dataOffset : dataOffset+clusterSize]
+		}
+	}
+	assert.Equal(t, int(clusters), len(used), "every cluster is used")
+
+	return size, blocks
+}
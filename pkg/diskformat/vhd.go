@@ -0,0 +1,70 @@
+package diskformat
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	vhdCookie        = "conectix"
+	vhdFeatures      = 0x00000002
+	vhdVersion       = 0x00010000
+	vhdFixedOffset   = 0xffffffffffffffff
+	vhdCreatorApp    = "ezto"
+	vhdCreatorOS     = "Wi2k"
+	vhdDiskTypeFixed = 2
+)
+
+// vhdEpoch is the start of VHD timestamps.
+var vhdEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// now returns the time used in image metadata.
+var now = time.Now
+
+// writeVHD writes a fixed VHD, which is the raw disk followed by a footer.
+func writeVHD(dest io.Writer, src io.ReaderAt, size int64) error {
+	if _, err := io.Copy(dest, io.NewSectionReader(src, 0, size)); err != nil {
+		return err
+	}
+	_, err := dest.Write(vhdFooter(size))
+	return err
+}
+
+func vhdFooter(size int64) []byte {
+	footer := make([]byte, sectorSize)
+	copy(footer[0:], vhdCookie)
+	binary.BigEndian.PutUint32(footer[8:], vhdFeatures)
+	binary.BigEndian.PutUint32(footer[12:], vhdVersion)
+	binary.BigEndian.PutUint64(footer[16:], vhdFixedOffset)
+	binary.BigEndian.PutUint32(footer[24:], uint32(now().Sub(vhdEpoch)/time.Second))
+	copy(footer[28:], vhdCreatorApp)
+	binary.BigEndian.PutUint32(footer[32:], vhdVersion)
+	copy(footer[36:], vhdCreatorOS)
+	binary.BigEndian.PutUint64(footer[40:], uint64(size))
+	binary.BigEndian.PutUint64(footer[48:], uint64(size))
+	cylinders, heads, sectorsPerTrack := chsGeometry(size)
+	binary.BigEndian.PutUint16(footer[56:], uint16(cylinders))
+	footer[58] = byte(heads)
+	footer[59] = byte(sectorsPerTrack)
+	binary.BigEndian.PutUint32(footer[60:], vhdDiskTypeFixed)
+	id := uuid.New()
+	copy(footer[68:], id[:])
+	binary.BigEndian.PutUint32(footer[64:], vhdChecksum(footer))
+	return footer
+}
+
+// vhdChecksum returns the one's complement of the sum of the bytes in the
+// footer, leaving out the checksum field.
+func vhdChecksum(footer []byte) uint32 {
+	var sum uint32
+	for i, b := range footer {
+		if i >= 64 && i < 68 {
+			continue
+		}
+		sum += uint32(b)
+	}
+	return ^sum
+}
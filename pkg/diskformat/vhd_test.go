@@ -0,0 +1,48 @@
+package diskformat
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readVHD checks the footer of a fixed VHD and returns the disk it contains.
+func readVHD(t *testing.T, image []byte) []byte {
+	be := binary.BigEndian
+	require.GreaterOrEqual(t, len(image), sectorSize)
+	disk, footer := image[:len(image)-sectorSize], image[len(image)-sectorSize:]
+
+	require.Equal(t, vhdCookie, string(footer[0:8]))
+	assert.Equal(t, uint32(vhdFeatures), be.Uint32(footer[8:]))
+	assert.Equal(t, uint32(vhdVersion), be.Uint32(footer[12:]))
+	assert.Equal(t, uint64(vhdFixedOffset), be.Uint64(footer[16:]))
+	assert.Equal(t, uint64(len(disk)), be.Uint64(footer[40:]), "original size")
+	assert.Equal(t, uint64(len(disk)), be.Uint64(footer[48:]), "current size")
+	assert.Equal(t, uint32(vhdDiskTypeFixed), be.Uint32(footer[60:]))
+	assert.Equal(t, vhdChecksum(footer), be.Uint32(footer[64:]), "checksum")
+	assert.NotEqual(t, make([]byte, 16), footer[68:84], "unique ID")
+	return disk
+}
+
+func TestVHDFooter(t *testing.T) {
+	origNow := now
+	now = func() time.Time { return time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC) }
+	t.Cleanup(func() { now = origNow })
+
+	size := int64(10 * 1024 * 1024 * 1024)
+	footer := vhdFooter(size)
+	be := binary.BigEndian
+	assert.Equal(t, uint32(762566400), be.Uint32(footer[24:]), "timestamp")
+	assert.Equal(t, "ezto", string(footer[28:32]))
+	assert.Equal(t, "Wi2k", string(footer[36:40]))
+	assert.Equal(t, uint16(20805), be.Uint16(footer[56:]), "cylinders")
+	assert.Equal(t, byte(16), footer[58], "heads")
+	assert.Equal(t, byte(63), footer[59], "sectors per track")
+
+	// Changing any byte invalidates the checksum.
+	footer[40]++
+	assert.NotEqual(t, vhdChecksum(footer), be.Uint32(footer[64:]))
+}
@@ -0,0 +1,200 @@
+package diskformat
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+const (
+	vmdkMagic          = 0x564d444b
+	vmdkVersion        = 3
+	vmdkFlagNewline    = 1 << 0
+	vmdkFlagCompressed = 1 << 16
+	vmdkFlagMarkers    = 1 << 17
+	vmdkGrainSectors   = 128
+	vmdkGrainSize      = vmdkGrainSectors * sectorSize
+	vmdkGTEntries      = 512
+	vmdkDescriptorSize = 20
+	// vmdkOverhead is the number of sectors before the first grain, holding
+	// the header and the descriptor.
+	vmdkOverhead     = 128
+	vmdkGDAtEnd      = 0xffffffffffffffff
+	vmdkDeflate      = 1
+	vmdkExtent       = "disk.vmdk"
+	vmdkMaxCyl       = 16383
+	vmdkHeads        = 255
+	vmdkSectors      = 63
+	vmdkMarkerEOS    = 0
+	vmdkMarkerGT     = 1
+	vmdkMarkerGD     = 2
+	vmdkMarkerFooter = 3
+)
+
+// sectorWriter writes whole sectors and keeps track of the sector it is at.
+type sectorWriter struct {
+	w      *bufio.Writer
+	sector uint64
+}
+
+// write writes data padded with zeros to a sector boundary.
+func (s *sectorWriter) write(data []byte) error {
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	pad := (sectorSize - len(data)%sectorSize) % sectorSize
+	if _, err := s.w.Write(zeros[:pad]); err != nil {
+		return err
+	}
+	s.sector += uint64(len(data)+pad) / sectorSize
+	return nil
+}
+
+// writeMarker writes a metadata marker for the given number of sectors of
+// metadata that follow it.
+func (s *sectorWriter) writeMarker(markerType uint32, sectors uint64) error {
+	marker := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint64(marker[0:], sectors)
+	binary.LittleEndian.PutUint32(marker[12:], markerType)
+	return s.write(marker)
+}
+
+func vmdkHeader(capacity, gdOffset uint64) []byte {
+	header := make([]byte, sectorSize)
+	binary.LittleEndian.PutUint32(header[0:], vmdkMagic)
+	binary.LittleEndian.PutUint32(header[4:], vmdkVersion)
+	binary.LittleEndian.PutUint32(header[8:], vmdkFlagNewline|vmdkFlagCompressed|vmdkFlagMarkers)
+	binary.LittleEndian.PutUint64(header[12:], capacity)
+	binary.LittleEndian.PutUint64(header[20:], vmdkGrainSectors)
+	binary.LittleEndian.PutUint64(header[28:], 1)
+	binary.LittleEndian.PutUint64(header[36:], vmdkDescriptorSize)
+	binary.LittleEndian.PutUint32(header[44:], vmdkGTEntries)
+	binary.LittleEndian.PutUint64(header[56:], gdOffset)
+	binary.LittleEndian.PutUint64(header[64:], vmdkOverhead)
+	header[73] = '\n'
+	header[74] = ' '
+	header[75] = '\r'
+	header[76] = '\n'
+	binary.LittleEndian.PutUint16(header[77:], vmdkDeflate)
+	return header
+}
+
+func vmdkDescriptor(capacity uint64) []byte {
+	id := uuid.New()
+	cylinders := min(capacity/(vmdkHeads*vmdkSectors), vmdkMaxCyl)
+	descriptor := fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.virtualHWVersion = "4"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "%d"
+ddb.geometry.sectors = "%d"
+ddb.adapterType = "lsilogic"
+`, binary.LittleEndian.Uint32(id[:4]), capacity, vmdkExtent, cylinders, vmdkHeads, vmdkSectors)
+	return []byte(descriptor)
+}
+
+// writeVMDK writes a streamOptimized VMDK, in which each grain that is not
+// all zeros is compressed and preceded by a marker. The grain tables, grain
+// directory, and a footer with the location of the grain directory follow
+// the grains.
+func writeVMDK(dest io.Writer, src io.ReaderAt, size int64) error {
+	capacity := uint64(size / sectorSize)
+	grains := divRoundUp(size, vmdkGrainSize)
+	gtCount := divRoundUp(grains, vmdkGTEntries)
+	gts := make([]uint32, gtCount*vmdkGTEntries)
+
+	s := &sectorWriter{w: bufio.NewWriterSize(dest, 1024*1024)}
+	if err := s.write(vmdkHeader(capacity, vmdkGDAtEnd)); err != nil {
+		return err
+	}
+	descriptor := vmdkDescriptor(capacity)
+	if len(descriptor) > vmdkDescriptorSize*sectorSize {
+		return fmt.Errorf("descriptor is larger than %d sectors", vmdkDescriptorSize)
+	}
+	if err := s.write(descriptor); err != nil {
+		return err
+	}
+	padding := make([]byte, (vmdkOverhead-s.sector)*sectorSize)
+	if err := s.write(padding); err != nil {
+		return err
+	}
+
+	buf := make([]byte, vmdkGrainSize)
+	compressed := &bytes.Buffer{}
+	for i := int64(0); i < grains; i++ {
+		if err := readBlock(src, buf, i*vmdkGrainSize, size); err != nil {
+			return err
+		}
+		if isZero(buf) {
+			continue
+		}
+
+		compressed.Reset()
+		compressed.Write(make([]byte, 12))
+		zw := zlib.NewWriter(compressed)
+		if _, err := zw.Write(buf); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		grain := compressed.Bytes()
+		binary.LittleEndian.PutUint64(grain[0:], uint64(i*vmdkGrainSectors))
+		binary.LittleEndian.PutUint32(grain[8:], uint32(len(grain)-12))
+
+		gts[i] = uint32(s.sector)
+		if err := s.write(grain); err != nil {
+			return err
+		}
+	}
+
+	gd := make([]byte, gtCount*4)
+	gtSectors := uint64(vmdkGTEntries * 4 / sectorSize)
+	for i := int64(0); i < gtCount; i++ {
+		if err := s.writeMarker(vmdkMarkerGT, gtSectors); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(gd[i*4:], uint32(s.sector))
+		gt := make([]byte, vmdkGTEntries*4)
+		for j, entry := range gts[i*vmdkGTEntries : (i+1)*vmdkGTEntries] {
+			binary.LittleEndian.PutUint32(gt[j*4:], entry)
+		}
+		if err := s.write(gt); err != nil {
+			return err
+		}
+	}
+
+	if err := s.writeMarker(vmdkMarkerGD, uint64(divRoundUp(int64(len(gd)), sectorSize))); err != nil {
+		return err
+	}
+	gdOffset := s.sector
+	if err := s.write(gd); err != nil {
+		return err
+	}
+
+	if err := s.writeMarker(vmdkMarkerFooter, 1); err != nil {
+		return err
+	}
+	if err := s.write(vmdkHeader(capacity, gdOffset)); err != nil {
+		return err
+	}
+	if err := s.writeMarker(vmdkMarkerEOS, 0); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
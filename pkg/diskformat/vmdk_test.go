@@ -0,0 +1,99 @@
+package diskformat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readVMDK checks the structure of a streamOptimized VMDK and returns its
+// capacity in bytes and the data of its grains by guest offset.
+func readVMDK(t *testing.T, image []byte) (int64, map[int64][]byte) {
+	le := binary.LittleEndian
+	require.Zero(t, len(image)%sectorSize, "image is whole sectors")
+	sector := func(n uint64) []byte {
+		require.Less(t, n*sectorSize, uint64(len(image)))
+		return image[n*sectorSize:]
+	}
+
+	header := image[:sectorSize]
+	require.Equal(t, uint32(vmdkMagic), le.Uint32(header[0:]))
+	require.Equal(t, "KDMV", string(header[0:4]))
+	require.Equal(t, uint32(3), le.Uint32(header[4:]))
+	flags := le.Uint32(header[8:])
+	require.Equal(t, uint32(vmdkFlagNewline|vmdkFlagCompressed|vmdkFlagMarkers), flags)
+	require.Equal(t, uint64(vmdkGDAtEnd), le.Uint64(header[56:]), "header gd offset")
+	require.Equal(t, "\n \r\n", string(header[73:77]))
+
+	descriptorOffset := le.Uint64(header[28:])
+	descriptorSize := le.Uint64(header[36:])
+	descriptor := string(bytes.TrimRight(
+		sector(descriptorOffset)[:descriptorSize*sectorSize], "\x00"))
+	require.True(t, strings.HasPrefix(descriptor, "# Disk DescriptorFile\n"))
+	assert.Contains(t, descriptor, `createType="streamOptimized"`)
+
+	// The stream ends with a footer marker, the footer, and an end of
+	// stream marker.
+	eos := image[len(image)-sectorSize:]
+	require.Equal(t, make([]byte, sectorSize), eos, "end of stream marker")
+	footerMarker := image[len(image)-3*sectorSize : len(image)-2*sectorSize]
+	require.Equal(t, uint32(vmdkMarkerFooter), le.Uint32(footerMarker[12:]))
+	footer := image[len(image)-2*sectorSize : len(image)-sectorSize]
+	require.Equal(t, header[:56], footer[:56])
+	require.Equal(t, header[64:], footer[64:])
+
+	capacity := le.Uint64(footer[12:])
+	grainSectors := le.Uint64(footer[20:])
+	gtEntries := uint64(le.Uint32(footer[44:]))
+	gdOffset := le.Uint64(footer[56:])
+	overhead := le.Uint64(footer[64:])
+	assert.Contains(t, descriptor, fmt.Sprintf("RW %d SPARSE", capacity))
+
+	grains := (capacity + grainSectors - 1) / grainSectors
+	gtCount := (grains + gtEntries - 1) / gtEntries
+	gdMarker := sector(gdOffset - 1)[:sectorSize]
+	require.Equal(t, uint32(vmdkMarkerGD), le.Uint32(gdMarker[12:]))
+
+	blocks := map[int64][]byte{}
+	for i := uint64(0); i < gtCount; i++ {
+		gtOffset := le.Uint32(sector(gdOffset)[i*4:])
+		require.NotZero(t, gtOffset)
+		gtMarker := sector(uint64(gtOffset) - 1)[:sectorSize]
+		require.Equal(t, uint32(vmdkMarkerGT), le.Uint32(gtMarker[12:]))
+		for j := uint64(0); j < gtEntries; j++ {
+			grainOffset := uint64(le.Uint32(sector(uint64(gtOffset))[j*4:]))
+			if grainOffset == 0 {
+				continue
+			}
+			require.GreaterOrEqual(t, grainOffset, overhead)
+			marker := sector(grainOffset)
+			lba := le.Uint64(marker[0:])
+			size := le.Uint32(marker[8:])
+			require.Equal(t, (i*gtEntries+j)*grainSectors, lba, "grain lba")
+			reader, err := zlib.NewReader(bytes.NewReader(marker[12 : 12+size]))
+			require.NoError(t, err)
+			data, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, int(grainSectors*sectorSize), len(data))
+			blocks[int64(lba*sectorSize)] = data
+		}
+	}
+
+	return int64(capacity * sectorSize), blocks
+}
+
+func TestVMDKDescriptor(t *testing.T) {
+	descriptor := string(vmdkDescriptor(20971520))
+	assert.Contains(t, descriptor, "RW 20971520 SPARSE \"disk.vmdk\"\n")
+	assert.Contains(t, descriptor, "ddb.geometry.cylinders = \"1305\"\n")
+	assert.Contains(t, descriptor, "ddb.geometry.heads = \"255\"\n")
+	assert.Contains(t, descriptor, "ddb.geometry.sectors = \"63\"\n")
+	assert.LessOrEqual(t, len(descriptor), vmdkDescriptorSize*sectorSize)
+}
@@ -0,0 +1,199 @@
+package imageconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+var (
+	ErrEmptyChange       = errors.New("change must not be empty")
+	ErrUnknownChange     = errors.New("unsupported change instruction")
+	ErrMissingArgument   = errors.New("change instruction requires an argument")
+	ErrInvalidEnv        = errors.New("invalid ENV instruction")
+	ErrUnterminatedQuote = errors.New("unterminated quote")
+)
+
+// ApplyChanges modifies an image config with Dockerfile-style instructions,
+// similar to `docker commit --change`. The supported instructions are CMD,
+// ENTRYPOINT, ENV, USER, and WORKDIR.
+func ApplyChanges(cfg *v1.Config, changes []string) error {
+	for _, change := range changes {
+		if err := applyChange(cfg, change); err != nil {
+			return fmt.Errorf("unable to apply change %q: %w", change, err)
+		}
+	}
+	return nil
+}
+
+// ValidateChanges checks that changes can be applied, without an image config.
+func ValidateChanges(changes []string) error {
+	return ApplyChanges(&v1.Config{}, changes)
+}
+
+func applyChange(cfg *v1.Config, change string) error {
+	change = strings.TrimSpace(change)
+	if len(change) == 0 {
+		return ErrEmptyChange
+	}
+
+	instruction, arg := cutSpace(change)
+	if len(arg) == 0 {
+		return ErrMissingArgument
+	}
+
+	switch strings.ToUpper(instruction) {
+	case "CMD":
+		cmd, err := parseCommand(arg)
+		if err != nil {
+			return err
+		}
+		cfg.Cmd = cmd
+	case "ENTRYPOINT":
+		entrypoint, err := parseCommand(arg)
+		if err != nil {
+			return err
+		}
+		cfg.Entrypoint = entrypoint
+	case "ENV":
+		vars, err := parseEnv(arg)
+		if err != nil {
+			return err
+		}
+		for _, v := range vars {
+			cfg.Env = setEnv(cfg.Env, v)
+		}
+	case "USER":
+		cfg.User = arg
+	case "WORKDIR":
+		workingDir := arg
+		if !path.IsAbs(workingDir) {
+			base := cfg.WorkingDir
+			if len(base) == 0 {
+				base = "/"
+			}
+			workingDir = path.Join(base, workingDir)
+		}
+		cfg.WorkingDir = path.Clean(workingDir)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownChange, instruction)
+	}
+
+	return nil
+}
+
+// parseCommand parses the exec form of CMD and ENTRYPOINT, which is a JSON
+// array, falling back to the shell form, which is run with /bin/sh -c.
+func parseCommand(arg string) ([]string, error) {
+	if strings.HasPrefix(arg, "[") {
+		command := []string{}
+		if err := json.Unmarshal([]byte(arg), &command); err != nil {
+			return nil, fmt.Errorf("unable to parse exec form: %w", err)
+		}
+		return command, nil
+	}
+	return []string{"/bin/sh", "-c", arg}, nil
+}
+
+// parseEnv parses either the `ENV KEY=VALUE ...` form or the legacy
+// `ENV KEY VALUE` form into a list of KEY=VALUE strings.
+func parseEnv(arg string) ([]string, error) {
+	key, value := cutSpace(arg)
+	if !strings.Contains(key, "=") {
+		if len(value) == 0 {
+			return nil, fmt.Errorf("%w: missing value for %s", ErrInvalidEnv, key)
+		}
+		return []string{key + "=" + value}, nil
+	}
+
+	words, err := splitWords(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := []string{}
+	for _, word := range words {
+		key, _, ok := strings.Cut(word, "=")
+		if !ok || len(key) == 0 {
+			return nil, fmt.Errorf("%w: %s is not of the form KEY=VALUE", ErrInvalidEnv, word)
+		}
+		vars = append(vars, word)
+	}
+	return vars, nil
+}
+
+// splitWords splits s on whitespace, honoring single and double quotes
+// and backslash escapes.
+func splitWords(s string) ([]string, error) {
+	var (
+		words   = []string{}
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, ErrUnterminatedQuote
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// cutSpace slices s around the first run of whitespace, returning the text
+// before and after it.
+func cutSpace(s string) (string, string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+func setEnv(env []string, kv string) []string {
+	key, _, _ := strings.Cut(kv, "=")
+	for i, e := range env {
+		if k, _, _ := strings.Cut(e, "="); k == key {
+			env[i] = kv
+			return env
+		}
+	}
+	return append(env, kv)
+}
@@ -0,0 +1,181 @@
+package imageconfig
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyChanges(t *testing.T) {
+	testCases := []struct {
+		description string
+		config      v1.Config
+		changes     []string
+		expected    v1.Config
+		err         error
+	}{
+		{
+			description: "No changes",
+			config:      v1.Config{Cmd: []string{"/app"}},
+			changes:     []string{},
+			expected:    v1.Config{Cmd: []string{"/app"}},
+		},
+		{
+			description: "CMD exec form",
+			config:      v1.Config{Cmd: []string{"/app"}},
+			changes:     []string{`CMD ["/app", "worker"]`},
+			expected:    v1.Config{Cmd: []string{"/app", "worker"}},
+		},
+		{
+			description: "CMD shell form",
+			changes:     []string{"CMD echo hello world"},
+			expected:    v1.Config{Cmd: []string{"/bin/sh", "-c", "echo hello world"}},
+		},
+		{
+			description: "ENTRYPOINT exec form",
+			changes:     []string{`entrypoint ["/tini", "--"]`},
+			expected:    v1.Config{Entrypoint: []string{"/tini", "--"}},
+		},
+		{
+			description: "ENV replaces existing variable",
+			config:      v1.Config{Env: []string{"PATH=/bin", "MODE=web"}},
+			changes:     []string{"ENV MODE=worker"},
+			expected:    v1.Config{Env: []string{"PATH=/bin", "MODE=worker"}},
+		},
+		{
+			description: "ENV multiple variables with quotes",
+			config:      v1.Config{Env: []string{"PATH=/bin"}},
+			changes:     []string{`ENV A=1 B="two words" C='$x' D=a\ b`},
+			expected: v1.Config{
+				Env: []string{"PATH=/bin", "A=1", "B=two words", "C=$x", "D=a b"},
+			},
+		},
+		{
+			description: "ENV legacy form",
+			changes:     []string{"ENV GREETING hello there"},
+			expected:    v1.Config{Env: []string{"GREETING=hello there"}},
+		},
+		{
+			description: "ENV separated by a tab",
+			changes:     []string{"ENV\tA=1"},
+			expected:    v1.Config{Env: []string{"A=1"}},
+		},
+		{
+			description: "ENV legacy form separated by tabs",
+			changes:     []string{"ENV\tGREETING\thello there"},
+			expected:    v1.Config{Env: []string{"GREETING=hello there"}},
+		},
+		{
+			description: "USER",
+			changes:     []string{"USER app:app"},
+			expected:    v1.Config{User: "app:app"},
+		},
+		{
+			description: "WORKDIR absolute",
+			config:      v1.Config{WorkingDir: "/app"},
+			changes:     []string{"WORKDIR /srv/"},
+			expected:    v1.Config{WorkingDir: "/srv"},
+		},
+		{
+			description: "WORKDIR relative",
+			config:      v1.Config{WorkingDir: "/app"},
+			changes:     []string{"WORKDIR data"},
+			expected:    v1.Config{WorkingDir: "/app/data"},
+		},
+		{
+			description: "WORKDIR relative without existing working directory",
+			changes:     []string{"WORKDIR data"},
+			expected:    v1.Config{WorkingDir: "/data"},
+		},
+		{
+			description: "Multiple changes",
+			changes:     []string{"USER 1000", "CMD [\"/worker\"]", "ENV MODE=worker"},
+			expected: v1.Config{
+				User: "1000",
+				Cmd:  []string{"/worker"},
+				Env:  []string{"MODE=worker"},
+			},
+		},
+		{
+			description: "Empty change",
+			changes:     []string{"  "},
+			err:         ErrEmptyChange,
+		},
+		{
+			description: "Missing argument",
+			changes:     []string{"USER"},
+			err:         ErrMissingArgument,
+		},
+		{
+			description: "Unsupported instruction",
+			changes:     []string{"EXPOSE 80"},
+			err:         ErrUnknownChange,
+		},
+		{
+			description: "ENV without value",
+			changes:     []string{"ENV MODE"},
+			err:         ErrInvalidEnv,
+		},
+		{
+			description: "ENV with empty key",
+			changes:     []string{"ENV A=1 =2"},
+			err:         ErrInvalidEnv,
+		},
+		{
+			description: "ENV with unterminated quote",
+			changes:     []string{`ENV A="1`},
+			err:         ErrUnterminatedQuote,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := ApplyChanges(&tc.config, tc.changes)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, tc.config)
+		})
+	}
+}
+
+func TestApplyChangesInvalidExecForm(t *testing.T) {
+	err := ApplyChanges(&v1.Config{}, []string{`CMD ["/app"`})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to parse exec form")
+}
+
+func TestValidateChanges(t *testing.T) {
+	assert.NoError(t, ValidateChanges([]string{"ENV A=1", "WORKDIR /app"}))
+	assert.ErrorIs(t, ValidateChanges([]string{"LABEL a=b"}), ErrUnknownChange)
+}
+
+func TestSplitWords(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected []string
+		err      error
+	}{
+		{input: "", expected: []string{}},
+		{input: "a b  c", expected: []string{"a", "b", "c"}},
+		{input: `a="b c" d`, expected: []string{"a=b c", "d"}},
+		{input: `a='b\c'`, expected: []string{`a=b\c`}},
+		{input: `a=b\"c`, expected: []string{`a=b"c`}},
+		{input: `a=""`, expected: []string{"a="}},
+		{input: `a="b`, err: ErrUnterminatedQuote},
+		{input: `a\`, err: ErrUnterminatedQuote},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			words, err := splitWords(tc.input)
+			assert.Equal(t, tc.err, err)
+			if tc.err == nil {
+				assert.Equal(t, tc.expected, words)
+			}
+		})
+	}
+}
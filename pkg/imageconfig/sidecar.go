@@ -0,0 +1,60 @@
+package imageconfig
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+var (
+	ErrSidecarName      = errors.New("invalid sidecar name")
+	ErrDuplicateSidecar = errors.New("duplicate sidecar name")
+
+	sidecarNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+)
+
+// Sidecar is an additional container image to be merged into a VM image
+// alongside the main container image.
+type Sidecar struct {
+	Name  string
+	Image string
+}
+
+// ParseSidecars parses sidecar specifications of the form `[name=]image`.
+// If no name is given, it is derived from the last path element of the image
+// repository. Names must be unique.
+func ParseSidecars(specs []string) ([]Sidecar, error) {
+	sidecars := []Sidecar{}
+	seen := map[string]bool{}
+
+	for _, spec := range specs {
+		sidecarName, image, hasName := strings.Cut(spec, "=")
+		if !hasName {
+			image = spec
+		}
+
+		ref, err := name.ParseReference(image)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse sidecar image %s: %w", image, err)
+		}
+
+		if !hasName {
+			sidecarName = path.Base(ref.Context().RepositoryStr())
+		}
+		if !sidecarNameRegexp.MatchString(sidecarName) {
+			return nil, fmt.Errorf("%w: %q", ErrSidecarName, sidecarName)
+		}
+		if seen[sidecarName] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateSidecar, sidecarName)
+		}
+		seen[sidecarName] = true
+
+		sidecars = append(sidecars, Sidecar{Name: sidecarName, Image: image})
+	}
+
+	return sidecars, nil
+}
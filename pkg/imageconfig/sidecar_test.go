@@ -0,0 +1,77 @@
+package imageconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSidecars(t *testing.T) {
+	testCases := []struct {
+		description string
+		specs       []string
+		expected    []Sidecar
+		err         error
+		expectError bool
+	}{
+		{
+			description: "No sidecars",
+			specs:       []string{},
+			expected:    []Sidecar{},
+		},
+		{
+			description: "Name derived from image",
+			specs:       []string{"fluent/fluent-bit:2.2", "ghcr.io/abc/proxy@sha256:" + sha},
+			expected: []Sidecar{
+				{Name: "fluent-bit", Image: "fluent/fluent-bit:2.2"},
+				{Name: "proxy", Image: "ghcr.io/abc/proxy@sha256:" + sha},
+			},
+		},
+		{
+			description: "Explicit name",
+			specs:       []string{"logs=fluent/fluent-bit:2.2", "envoy=envoyproxy/envoy"},
+			expected: []Sidecar{
+				{Name: "logs", Image: "fluent/fluent-bit:2.2"},
+				{Name: "envoy", Image: "envoyproxy/envoy"},
+			},
+		},
+		{
+			description: "Duplicate derived name",
+			specs:       []string{"fluent/fluent-bit:2.2", "other/fluent-bit:3.0"},
+			err:         ErrDuplicateSidecar,
+		},
+		{
+			description: "Invalid name",
+			specs:       []string{"Logs/x=fluent/fluent-bit"},
+			err:         ErrSidecarName,
+		},
+		{
+			description: "Empty name",
+			specs:       []string{"=fluent/fluent-bit"},
+			err:         ErrSidecarName,
+		},
+		{
+			description: "Invalid image",
+			specs:       []string{"logs=Fluent Bit"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			sidecars, err := ParseSidecars(tc.specs)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			if tc.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, sidecars)
+		})
+	}
+}
+
+const sha = "0000000000000000000000000000000000000000000000000000000000000000"
@@ -0,0 +1,443 @@
+package imagetest
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+)
+
+const (
+	InterfacePublicIP  = "public_ip"
+	InterfacePrivateIP = "private_ip"
+
+	// DefaultSuccessPattern matches the console message logged by init
+	// when it starts the image's command.
+	DefaultSuccessPattern = `(?i)\b(starting|executing|running) command\b`
+	// DefaultFailurePattern matches the messages printed by the kernel when
+	// it panics and by a Rust program when it panics. Init runs as PID 1, so
+	// if it exits on an error, the kernel panics with "Attempted to kill
+	// init!".
+	DefaultFailurePattern = `Kernel panic - not syncing: |^thread '[^']*' panicked at `
+
+	instanceTimeout = 10 * time.Minute
+	dialTimeout     = 5 * time.Second
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid test configuration")
+	ErrFailed        = errors.New("image test failed")
+
+	// pollInterval is how long to wait between checks of the console
+	// output and between attempts to connect to the port.
+	pollInterval = 5 * time.Second
+
+	dial = (&net.Dialer{Timeout: dialTimeout}).DialContext
+)
+
+// EC2Client is the subset of the EC2 API used to test an image.
+type EC2Client interface {
+	RunInstances(
+		ctx context.Context,
+		params *ec2.RunInstancesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.RunInstancesOutput, error)
+	DescribeInstances(
+		ctx context.Context,
+		params *ec2.DescribeInstancesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.DescribeInstancesOutput, error)
+	GetConsoleOutput(
+		ctx context.Context,
+		params *ec2.GetConsoleOutputInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.GetConsoleOutputOutput, error)
+	TerminateInstances(
+		ctx context.Context,
+		params *ec2.TerminateInstancesInput,
+		optFns ...func(*ec2.Options),
+	) (*ec2.TerminateInstancesOutput, error)
+}
+
+type InstanceRunningWaiter interface {
+	Wait(
+		ctx context.Context,
+		params *ec2.DescribeInstancesInput,
+		maxWaitDur time.Duration,
+		optFns ...func(*ec2.InstanceRunningWaiterOptions),
+	) error
+}
+
+type InstanceTerminatedWaiter interface {
+	Wait(
+		ctx context.Context,
+		params *ec2.DescribeInstancesInput,
+		maxWaitDur time.Duration,
+		optFns ...func(*ec2.InstanceTerminatedWaiterOptions),
+	) error
+}
+
+// Waiters wait for the test instance to reach the states needed by the test.
+type Waiters struct {
+	InstanceRunning    InstanceRunningWaiter
+	InstanceTerminated InstanceTerminatedWaiter
+}
+
+// NewWaiters returns Waiters that use client.
+func NewWaiters(client *ec2.Client) Waiters {
+	return Waiters{
+		InstanceRunning:    ec2.NewInstanceRunningWaiter(client),
+		InstanceTerminated: ec2.NewInstanceTerminatedWaiter(client),
+	}
+}
+
+// Config is the configuration of an image test. The test passes when the
+// console output matches SuccessPattern and, if Port is set, a TCP connection
+// to Port on the instance succeeds, all within Timeout of the instance
+// running. It fails if the console output matches FailurePattern or the
+// instance stops first.
+type Config struct {
+	AMI              string
+	UserData         []byte
+	InstanceType     string
+	SubnetID         string
+	SecurityGroupIDs []string
+	InstanceProfile  string
+	Port             int
+	Interface        string
+	SuccessPattern   *regexp.Regexp
+	FailurePattern   *regexp.Regexp
+	Timeout          time.Duration
+	// Output receives progress messages.
+	Output io.Writer
+	// Console receives the instance's console output as it is read.
+	Console io.Writer
+}
+
+type Result struct {
+	InstanceID string
+}
+
+// Validate returns an error if the configuration cannot be used for a test.
+func (c *Config) Validate() error {
+	var errs []error
+	if len(c.AMI) == 0 {
+		errs = append(errs, errors.New("AMI must be defined"))
+	}
+	if len(c.InstanceType) == 0 {
+		errs = append(errs, errors.New("instance type must be defined"))
+	}
+	if c.SuccessPattern == nil {
+		errs = append(errs, errors.New("success pattern must be defined"))
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535: %d", c.Port))
+	}
+	if c.Port > 0 && c.Interface != InterfacePublicIP && c.Interface != InterfacePrivateIP {
+		errs = append(errs, fmt.Errorf("interface must be one of %s or %s: %s",
+			InterfacePublicIP, InterfacePrivateIP, c.Interface))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("timeout must be positive: %s", c.Timeout))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	return nil
+}
+
+// Run tests an image using clients from the default AWS configuration.
+func Run(ctx context.Context, cfg Config) (*Result, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	client := ec2.NewFromConfig(awsCfg)
+	return RunWithClients(ctx, cfg, client, NewWaiters(client))
+}
+
+// RunWithClients tests an image using the given clients. The test instance is
+// terminated when it returns, whether or not the test passed. If the test
+// fails, the returned error wraps ErrFailed.
+func RunWithClients(
+	ctx context.Context,
+	cfg Config,
+	client EC2Client,
+	waiters Waiters,
+) (result *Result, err error) {
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	t := &test{cfg: cfg, client: client, waiters: waiters}
+	defer func() {
+		err = errors.Join(err, t.cleanup())
+	}()
+
+	return t.run(ctx)
+}
+
+type test struct {
+	cfg        Config
+	client     EC2Client
+	waiters    Waiters
+	instanceID string
+	console    string
+}
+
+func (t *test) run(ctx context.Context) (*Result, error) {
+	if err := t.launchInstance(ctx); err != nil {
+		return nil, err
+	}
+	result := &Result{InstanceID: t.instanceID}
+
+	ctx, cancel := context.WithTimeout(ctx, t.cfg.Timeout)
+	defer cancel()
+
+	t.log("Waiting for the command to start on instance %s...\n", t.instanceID)
+	instance, err := t.watchConsole(ctx)
+	if err != nil {
+		return result, err
+	}
+	t.log("Command started on instance %s\n", t.instanceID)
+
+	if t.cfg.Port > 0 {
+		if err = t.probePort(ctx, instance); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func (t *test) launchInstance(ctx context.Context) error {
+	input := &ec2.RunInstancesInput{
+		ImageId:                           aws.String(t.cfg.AMI),
+		InstanceType:                      ec2types.InstanceType(t.cfg.InstanceType),
+		MinCount:                          aws.Int32(1),
+		MaxCount:                          aws.Int32(1),
+		InstanceInitiatedShutdownBehavior: ec2types.ShutdownBehaviorStop,
+		TagSpecifications: []ec2types.TagSpecification{
+			{
+				ResourceType: ec2types.ResourceTypeInstance,
+				Tags: []ec2types.Tag{
+					{Key: aws.String("Name"), Value: aws.String("easyto-test-" + t.cfg.AMI)},
+				},
+			},
+		},
+	}
+	if len(t.cfg.UserData) > 0 {
+		input.UserData = aws.String(base64.StdEncoding.EncodeToString(t.cfg.UserData))
+	}
+	if len(t.cfg.SubnetID) > 0 {
+		input.SubnetId = aws.String(t.cfg.SubnetID)
+	}
+	if len(t.cfg.SecurityGroupIDs) > 0 {
+		input.SecurityGroupIds = t.cfg.SecurityGroupIDs
+	}
+	if len(t.cfg.InstanceProfile) > 0 {
+		input.IamInstanceProfile = &ec2types.IamInstanceProfileSpecification{}
+		if strings.HasPrefix(t.cfg.InstanceProfile, "arn:") {
+			input.IamInstanceProfile.Arn = aws.String(t.cfg.InstanceProfile)
+		} else {
+			input.IamInstanceProfile.Name = aws.String(t.cfg.InstanceProfile)
+		}
+	}
+
+	t.log("Launching test instance from %s...\n", t.cfg.AMI)
+	out, err := t.client.RunInstances(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to launch test instance: %w", err)
+	}
+	if len(out.Instances) == 0 {
+		return errors.New("no test instance was launched")
+	}
+	t.instanceID = aws.ToString(out.Instances[0].InstanceId)
+
+	t.log("Waiting for test instance %s to be running...\n", t.instanceID)
+	err = t.waiters.InstanceRunning.Wait(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{t.instanceID},
+	}, instanceTimeout)
+	if err != nil {
+		return fmt.Errorf("failed waiting for test instance %s: %w", t.instanceID, err)
+	}
+	return nil
+}
+
+// watchConsole streams the console output until it matches the success or
+// failure pattern, returning the instance once the success pattern matches.
+func (t *test) watchConsole(ctx context.Context) (*ec2types.Instance, error) {
+	for {
+		if err := t.readConsole(ctx); err != nil {
+			return nil, err
+		}
+		if match := t.cfg.FailurePattern; match != nil {
+			if line := matchingLine(match, t.console); len(line) > 0 {
+				return nil, fmt.Errorf("%w: console output shows a failure: %s", ErrFailed, line)
+			}
+		}
+
+		instance, err := t.describeInstance(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if t.cfg.SuccessPattern.MatchString(t.console) {
+			return instance, nil
+		}
+		if state := instanceState(instance); state != ec2types.InstanceStateNameRunning {
+			return nil, fmt.Errorf("%w: instance %s is %s before the command started",
+				ErrFailed, t.instanceID, state)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: timed out waiting for the command to start", ErrFailed)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// readConsole reads the latest console output, writing what has not been
+// seen before to the Console writer.
+func (t *test) readConsole(ctx context.Context) error {
+	out, err := t.client.GetConsoleOutput(ctx, &ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(t.instanceID),
+		Latest:     aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get console output of %s: %w", t.instanceID, err)
+	}
+	if len(aws.ToString(out.Output)) == 0 {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(aws.ToString(out.Output))
+	if err != nil {
+		return fmt.Errorf("unable to decode console output of %s: %w", t.instanceID, err)
+	}
+
+	console := string(decoded)
+	if t.cfg.Console != nil {
+		io.WriteString(t.cfg.Console, unseen(t.console, console))
+	}
+	t.console = console
+	return nil
+}
+
+func (t *test) probePort(ctx context.Context, instance *ec2types.Instance) error {
+	address := aws.ToString(instance.PrivateIpAddress)
+	if t.cfg.Interface == InterfacePublicIP {
+		address = aws.ToString(instance.PublicIpAddress)
+	}
+	if len(address) == 0 {
+		return fmt.Errorf("instance %s has no %s address", t.instanceID, t.cfg.Interface)
+	}
+	addr := net.JoinHostPort(address, strconv.Itoa(t.cfg.Port))
+
+	t.log("Connecting to %s...\n", addr)
+	for {
+		conn, err := dial(ctx, "tcp", addr)
+		if err == nil {
+			conn.Close()
+			t.log("Connected to %s\n", addr)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: unable to connect to %s: %w", ErrFailed, addr, err)
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+func (t *test) describeInstance(ctx context.Context) (*ec2types.Instance, error) {
+	out, err := t.client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{t.instanceID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe test instance %s: %w", t.instanceID, err)
+	}
+	for _, reservation := range out.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.ToString(instance.InstanceId) == t.instanceID {
+				return &instance, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("test instance %s not found", t.instanceID)
+}
+
+// cleanup terminates the test instance. A fresh context is used so that
+// cleanup happens even if the test's context was canceled.
+func (t *test) cleanup() error {
+	if len(t.instanceID) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+
+	t.log("Terminating test instance %s...\n", t.instanceID)
+	_, err := t.client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
+		InstanceIds: []string{t.instanceID},
+	})
+	if err == nil {
+		err = t.waiters.InstanceTerminated.Wait(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: []string{t.instanceID},
+		}, instanceTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to terminate test instance %s: %w", t.instanceID, err)
+	}
+	return nil
+}
+
+func (t *test) log(format string, args ...any) {
+	if t.cfg.Output != nil {
+		fmt.Fprintf(t.cfg.Output, format, args...)
+	}
+}
+
+func instanceState(instance *ec2types.Instance) ec2types.InstanceStateName {
+	if instance.State == nil {
+		return ""
+	}
+	return instance.State.Name
+}
+
+// unseen returns the part of current that comes after previous. The console
+// output only holds the most recent 64 KB, so once it is full, the start of
+// previous is no longer in current, and the overlap is found from the end
+// of previous instead.
+func unseen(previous, current string) string {
+	if strings.HasPrefix(current, previous) {
+		return current[len(previous):]
+	}
+	tail := previous
+	if len(tail) > 256 {
+		tail = tail[len(tail)-256:]
+	}
+	if i := strings.LastIndex(current, tail); i >= 0 {
+		return current[i+len(tail):]
+	}
+	return current
+}
+
+// matchingLine returns the first line of s that matches re, or an empty
+// string if none do.
+func matchingLine(re *regexp.Regexp, s string) string {
+	for _, line := range strings.Split(s, "\n") {
+		if re.MatchString(line) {
+			return strings.TrimSpace(line)
+		}
+	}
+	return ""
+}
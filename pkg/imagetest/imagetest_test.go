@@ -0,0 +1,429 @@
+package imagetest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockEC2Client records the calls made to it and returns errors for the
+// operations named in errs. Each call to GetConsoleOutput returns the next
+// of consoles, repeating the last one when they run out.
+type mockEC2Client struct {
+	calls    []string
+	errs     map[string]error
+	consoles []string
+	state    ec2types.InstanceStateName
+
+	runInstancesInput *ec2.RunInstancesInput
+}
+
+func (m *mockEC2Client) call(name string) error {
+	m.calls = append(m.calls, name)
+	return m.errs[name]
+}
+
+func (m *mockEC2Client) RunInstances(
+	ctx context.Context,
+	input *ec2.RunInstancesInput,
+	opts ...func(*ec2.Options),
+) (*ec2.RunInstancesOutput, error) {
+	m.runInstancesInput = input
+	if err := m.call("RunInstances"); err != nil {
+		return nil, err
+	}
+	return &ec2.RunInstancesOutput{
+		Instances: []ec2types.Instance{{InstanceId: aws.String("i-123")}},
+	}, nil
+}
+
+func (m *mockEC2Client) DescribeInstances(
+	ctx context.Context,
+	input *ec2.DescribeInstancesInput,
+	opts ...func(*ec2.Options),
+) (*ec2.DescribeInstancesOutput, error) {
+	if err := m.call("DescribeInstances"); err != nil {
+		return nil, err
+	}
+	state := m.state
+	if len(state) == 0 {
+		state = ec2types.InstanceStateNameRunning
+	}
+	return &ec2.DescribeInstancesOutput{
+		Reservations: []ec2types.Reservation{
+			{
+				Instances: []ec2types.Instance{
+					{
+						InstanceId:       aws.String("i-123"),
+						PublicIpAddress:  aws.String("192.0.2.1"),
+						PrivateIpAddress: aws.String("10.0.0.1"),
+						State:            &ec2types.InstanceState{Name: state},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+func (m *mockEC2Client) GetConsoleOutput(
+	ctx context.Context,
+	input *ec2.GetConsoleOutputInput,
+	opts ...func(*ec2.Options),
+) (*ec2.GetConsoleOutputOutput, error) {
+	if err := m.call("GetConsoleOutput"); err != nil {
+		return nil, err
+	}
+	console := ""
+	if len(m.consoles) > 0 {
+		console = m.consoles[0]
+		if len(m.consoles) > 1 {
+			m.consoles = m.consoles[1:]
+		}
+	}
+	return &ec2.GetConsoleOutputOutput{
+		Output: aws.String(base64.StdEncoding.EncodeToString([]byte(console))),
+	}, nil
+}
+
+func (m *mockEC2Client) TerminateInstances(
+	ctx context.Context,
+	input *ec2.TerminateInstancesInput,
+	opts ...func(*ec2.Options),
+) (*ec2.TerminateInstancesOutput, error) {
+	return &ec2.TerminateInstancesOutput{}, m.call("TerminateInstances")
+}
+
+type mockInstanceRunningWaiter struct {
+	client *mockEC2Client
+}
+
+func (w *mockInstanceRunningWaiter) Wait(
+	ctx context.Context,
+	params *ec2.DescribeInstancesInput,
+	maxWaitDur time.Duration,
+	optFns ...func(*ec2.InstanceRunningWaiterOptions),
+) error {
+	return w.client.call("WaitInstanceRunning")
+}
+
+type mockInstanceTerminatedWaiter struct {
+	client *mockEC2Client
+}
+
+func (w *mockInstanceTerminatedWaiter) Wait(
+	ctx context.Context,
+	params *ec2.DescribeInstancesInput,
+	maxWaitDur time.Duration,
+	optFns ...func(*ec2.InstanceTerminatedWaiterOptions),
+) error {
+	return w.client.call("WaitInstanceTerminated")
+}
+
+func mockWaiters(client *mockEC2Client) Waiters {
+	return Waiters{
+		InstanceRunning:    &mockInstanceRunningWaiter{client: client},
+		InstanceTerminated: &mockInstanceTerminatedWaiter{client: client},
+	}
+}
+
+func testConfig() Config {
+	return Config{
+		AMI:            "ami-123",
+		UserData:       []byte("command: [/app]\n"),
+		InstanceType:   "t3.micro",
+		Interface:      InterfacePublicIP,
+		SuccessPattern: regexp.MustCompile(DefaultSuccessPattern),
+		FailurePattern: regexp.MustCompile(DefaultFailurePattern),
+		Timeout:        time.Second,
+	}
+}
+
+func setTestHooks(t *testing.T, dialErr error) *[]string {
+	dialed := []string{}
+	origPollInterval, origDial := pollInterval, dial
+	pollInterval = time.Millisecond
+	dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	t.Cleanup(func() {
+		pollInterval, dial = origPollInterval, origDial
+	})
+	return &dialed
+}
+
+func TestRunWithClients(t *testing.T) {
+	dialed := setTestHooks(t, nil)
+	client := &mockEC2Client{
+		consoles: []string{
+			"",
+			"Linux version 6.1\n",
+			"Linux version 6.1\ninit: Starting command [/app]\n",
+		},
+	}
+	console := &bytes.Buffer{}
+	cfg := testConfig()
+	cfg.Port = 8080
+	cfg.SubnetID = "subnet-123"
+	cfg.SecurityGroupIDs = []string{"sg-123"}
+	cfg.Console = console
+
+	result, err := RunWithClients(context.Background(), cfg, client, mockWaiters(client))
+	require.NoError(t, err)
+	assert.Equal(t, &Result{InstanceID: "i-123"}, result)
+	assert.Equal(t, []string{
+		"RunInstances",
+		"WaitInstanceRunning",
+		"GetConsoleOutput",
+		"DescribeInstances",
+		"GetConsoleOutput",
+		"DescribeInstances",
+		"GetConsoleOutput",
+		"DescribeInstances",
+		"TerminateInstances",
+		"WaitInstanceTerminated",
+	}, client.calls)
+	assert.Equal(t, "Linux version 6.1\ninit: Starting command [/app]\n", console.String())
+	assert.Equal(t, []string{"192.0.2.1:8080"}, *dialed)
+
+	input := client.runInstancesInput
+	assert.Equal(t, "ami-123", aws.ToString(input.ImageId))
+	assert.Equal(t, "subnet-123", aws.ToString(input.SubnetId))
+	assert.Equal(t, []string{"sg-123"}, input.SecurityGroupIds)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(cfg.UserData), aws.ToString(input.UserData))
+}
+
+func TestRunWithClientsFailures(t *testing.T) {
+	testCases := []struct {
+		description string
+		consoles    []string
+		state       ec2types.InstanceStateName
+		errs        map[string]error
+		port        int
+		dialErr     error
+		failed      bool
+		errContains string
+		launched    bool
+	}{
+		{
+			description: "Kernel panic",
+			consoles:    []string{"Kernel panic - not syncing: VFS: Unable to mount root fs\n"},
+			failed:      true,
+			errContains: "console output shows a failure: Kernel panic",
+			launched:    true,
+		},
+		{
+			description: "Init panic",
+			consoles: []string{
+				"thread 'main' panicked at src/main.rs:42:10:\n" +
+					"[    2.345678] Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000100\n",
+			},
+			failed:      true,
+			errContains: "thread 'main' panicked at src/main.rs:42:10:",
+			launched:    true,
+		},
+		{
+			description: "Instance stopped",
+			consoles:    []string{"booting\n"},
+			state:       ec2types.InstanceStateNameStopping,
+			failed:      true,
+			errContains: "instance i-123 is stopping before the command started",
+			launched:    true,
+		},
+		{
+			description: "Timed out",
+			consoles:    []string{"booting\n"},
+			failed:      true,
+			errContains: "timed out waiting for the command to start",
+			launched:    true,
+		},
+		{
+			description: "Port closed",
+			consoles:    []string{"Starting command\n"},
+			port:        80,
+			dialErr:     errors.New("connection refused"),
+			failed:      true,
+			errContains: "unable to connect to 192.0.2.1:80",
+			launched:    true,
+		},
+		{
+			description: "Launch error",
+			errs:        map[string]error{"RunInstances": errors.New("no capacity")},
+			errContains: "failed to launch test instance",
+		},
+		{
+			description: "Console error",
+			errs:        map[string]error{"GetConsoleOutput": errors.New("throttled")},
+			errContains: "failed to get console output of i-123",
+			launched:    true,
+		},
+		{
+			description: "Terminate error",
+			consoles:    []string{"Starting command\n"},
+			errs:        map[string]error{"TerminateInstances": errors.New("denied")},
+			errContains: "failed to terminate test instance i-123",
+			launched:    true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			setTestHooks(t, tc.dialErr)
+			client := &mockEC2Client{consoles: tc.consoles, state: tc.state, errs: tc.errs}
+			cfg := testConfig()
+			cfg.Timeout = 50 * time.Millisecond
+			cfg.Port = tc.port
+
+			_, err := RunWithClients(context.Background(), cfg, client, mockWaiters(client))
+			assert.ErrorContains(t, err, tc.errContains)
+			assert.Equal(t, tc.failed, errors.Is(err, ErrFailed))
+			if tc.launched {
+				assert.Contains(t, client.calls, "TerminateInstances")
+			} else {
+				assert.NotContains(t, client.calls, "TerminateInstances")
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	testCases := []struct {
+		description string
+		modify      func(cfg *Config)
+		errContains string
+	}{
+		{
+			description: "Valid",
+			modify:      func(cfg *Config) {},
+		},
+		{
+			description: "Missing AMI",
+			modify:      func(cfg *Config) { cfg.AMI = "" },
+			errContains: "AMI must be defined",
+		},
+		{
+			description: "Missing success pattern",
+			modify:      func(cfg *Config) { cfg.SuccessPattern = nil },
+			errContains: "success pattern must be defined",
+		},
+		{
+			description: "Invalid port",
+			modify:      func(cfg *Config) { cfg.Port = 70000 },
+			errContains: "port must be between 1 and 65535",
+		},
+		{
+			description: "Invalid interface",
+			modify:      func(cfg *Config) { cfg.Port = 80; cfg.Interface = "ipv6" },
+			errContains: "interface must be one of public_ip or private_ip",
+		},
+		{
+			description: "Invalid timeout",
+			modify:      func(cfg *Config) { cfg.Timeout = 0 },
+			errContains: "timeout must be positive",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			cfg := testConfig()
+			tc.modify(&cfg)
+			err := cfg.Validate()
+			if len(tc.errContains) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidConfig)
+			assert.ErrorContains(t, err, tc.errContains)
+		})
+	}
+}
+
+func TestDefaultFailurePattern(t *testing.T) {
+	failure := regexp.MustCompile(DefaultFailurePattern)
+
+	// Lines from the boot of an instance whose command ran successfully,
+	// including output of the command that mentions errors.
+	for _, line := range []string{
+		"[    0.000000] Linux version 6.1.112 (root@buildkitsandbox) (gcc 12.2.0) #1 SMP",
+		"[    0.004000] ACPI: Early table checksum verification disabled",
+		"[    0.212345] pci 0000:00:01.3: quirk: [io  0xb100-0xb10f] claimed by PIIX4 SMB",
+		"[    0.698765] Freeing unused kernel image (initmem) memory: 2740K",
+		"[    0.712345] Run /sbin/init as init process",
+		"[    1.234567] EXT4-fs (nvme0n1p2): mounted filesystem with ordered data mode. Quota mode: none.",
+		"[    1.345678] ena 0000:00:05.0: LLQ is not supported Fallback to host mode policy.",
+		"[    1.456789] random: crng init done",
+		"2026-10-18T12:00:00Z worker: cache init failed with error timeout, retrying",
+		"2026-10-18T12:00:01Z worker: task panicked at step 3, recovered",
+	} {
+		assert.False(t, failure.MatchString(line), line)
+	}
+
+	for _, line := range []string{
+		"[    0.912345] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(0,0)",
+		"[    1.567890] Kernel panic - not syncing: Attempted to kill init! exitcode=0x00000100",
+		"thread 'main' panicked at src/main.rs:42:10:",
+		"thread 'main' panicked at 'called `Result::unwrap()` on an `Err` value', src/main.rs:42:10",
+	} {
+		assert.True(t, failure.MatchString(line), line)
+	}
+}
+
+func TestUnseen(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	testCases := []struct {
+		description string
+		previous    string
+		current     string
+		result      string
+	}{
+		{
+			description: "Empty",
+			previous:    "",
+			current:     "abc\n",
+			result:      "abc\n",
+		},
+		{
+			description: "Appended",
+			previous:    "abc\n",
+			current:     "abc\ndef\n",
+			result:      "def\n",
+		},
+		{
+			description: "Unchanged",
+			previous:    "abc\n",
+			current:     "abc\n",
+			result:      "",
+		},
+		{
+			description: "Rolled over",
+			previous:    "abc\n" + long + "def\n",
+			current:     long + "def\nghi\n",
+			result:      "ghi\n",
+		},
+		{
+			description: "No overlap",
+			previous:    "abc\n",
+			current:     "xyz\n",
+			result:      "xyz\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.Equal(t, tc.result, unseen(tc.previous, tc.current))
+		})
+	}
+}
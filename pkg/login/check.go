@@ -0,0 +1,245 @@
+package login
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/cloudboss/easyto/pkg/rootfs"
+	"github.com/spf13/afero"
+)
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+}
+
+type checker struct {
+	fs       afero.Fs
+	baseDir  string
+	problems []Problem
+}
+
+func (c *checker) add(file string, line int, format string, args ...any) {
+	c.problems = append(c.problems, Problem{
+		File:    file,
+		Line:    line,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Check looks for inconsistencies in the passwd, group, shadow, and gshadow
+// files under baseDir, similar to pwck and grpck. It reports duplicate names
+// and IDs, primary GIDs with no group, group members with no user, missing or
+// orphaned shadow and gshadow entries, missing home directories, and shells
+// that are not executable. Files that do not exist are not checked. An error
+// is returned only if a file cannot be read or parsed.
+func Check(fs afero.Fs, baseDir string) ([]Problem, error) {
+	var (
+		c        = &checker{fs: fs, baseDir: baseDir}
+		passwd   []*PasswdEntry
+		group    []*GroupEntry
+		shadow   []*ShadowEntry
+		gshadow  []*GShadowEntry
+		hasGroup bool
+		hasShad  bool
+		hasGShad bool
+	)
+
+	fileEtcPasswd := filepath.Join(baseDir, constants.FileEtcPasswd)
+	fileEtcGroup := filepath.Join(baseDir, constants.FileEtcGroup)
+	fileEtcShadow := filepath.Join(baseDir, constants.FileEtcShadow)
+	fileEtcGShadow := filepath.Join(baseDir, constants.FileEtcGShadow)
+
+	hasPasswd, err := fileExists(fs, fileEtcPasswd)
+	if err != nil {
+		return nil, err
+	}
+	if hasPasswd {
+		if _, _, passwd, err = ParsePasswd(fs, fileEtcPasswd); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasGroup, err = fileExists(fs, fileEtcGroup); err != nil {
+		return nil, err
+	}
+	if hasGroup {
+		if _, _, group, err = ParseGroup(fs, fileEtcGroup); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasShad, err = fileExists(fs, fileEtcShadow); err != nil {
+		return nil, err
+	}
+	if hasShad {
+		if _, shadow, err = ParseShadow(fs, fileEtcShadow); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasGShad, err = fileExists(fs, fileEtcGShadow); err != nil {
+		return nil, err
+	}
+	if hasGShad {
+		if _, gshadow, err = ParseGShadow(fs, fileEtcGShadow); err != nil {
+			return nil, err
+		}
+	}
+
+	usernames := map[string]bool{}
+	uids := map[uint32]string{}
+	for i, entry := range passwd {
+		if entry.isVerbatim() {
+			continue
+		}
+		if usernames[entry.Username] {
+			c.add(constants.FileEtcPasswd, i+1, "duplicate user %s", entry.Username)
+		}
+		usernames[entry.Username] = true
+		if other, ok := uids[entry.UID]; ok {
+			c.add(constants.FileEtcPasswd, i+1, "user %s has the same UID %d as %s",
+				entry.Username, entry.UID, other)
+		} else {
+			uids[entry.UID] = entry.Username
+		}
+	}
+
+	groupnames := map[string]bool{}
+	gids := map[uint32]string{}
+	for i, entry := range group {
+		if entry.isVerbatim() {
+			continue
+		}
+		if groupnames[entry.Groupname] {
+			c.add(constants.FileEtcGroup, i+1, "duplicate group %s", entry.Groupname)
+		}
+		groupnames[entry.Groupname] = true
+		if other, ok := gids[entry.GID]; ok {
+			c.add(constants.FileEtcGroup, i+1, "group %s has the same GID %d as %s",
+				entry.Groupname, entry.GID, other)
+		} else {
+			gids[entry.GID] = entry.Groupname
+		}
+		for _, member := range entry.Users {
+			if !usernames[member] {
+				c.add(constants.FileEtcGroup, i+1, "group %s has member %s with no user",
+					entry.Groupname, member)
+			}
+		}
+	}
+
+	shadowNames := map[string]bool{}
+	for i, entry := range shadow {
+		if entry.isVerbatim() {
+			continue
+		}
+		if shadowNames[entry.Username] {
+			c.add(constants.FileEtcShadow, i+1, "duplicate user %s", entry.Username)
+		}
+		shadowNames[entry.Username] = true
+		if !usernames[entry.Username] {
+			c.add(constants.FileEtcShadow, i+1, "user %s has no passwd entry", entry.Username)
+		}
+	}
+
+	gshadowNames := map[string]bool{}
+	for i, entry := range gshadow {
+		if entry.isVerbatim() {
+			continue
+		}
+		if gshadowNames[entry.Groupname] {
+			c.add(constants.FileEtcGShadow, i+1, "duplicate group %s", entry.Groupname)
+		}
+		gshadowNames[entry.Groupname] = true
+		if !groupnames[entry.Groupname] {
+			c.add(constants.FileEtcGShadow, i+1, "group %s has no group entry", entry.Groupname)
+		}
+	}
+
+	for i, entry := range passwd {
+		if entry.isVerbatim() {
+			continue
+		}
+		if hasGroup {
+			if _, ok := gids[entry.GID]; !ok {
+				c.add(constants.FileEtcPasswd, i+1, "user %s has primary GID %d with no group",
+					entry.Username, entry.GID)
+			}
+		}
+		if hasShad && !shadowNames[entry.Username] {
+			c.add(constants.FileEtcPasswd, i+1, "user %s has no shadow entry", entry.Username)
+		}
+		if err := c.checkHomeDir(entry, i+1); err != nil {
+			return nil, err
+		}
+		if err := c.checkShell(entry, i+1); err != nil {
+			return nil, err
+		}
+	}
+
+	if hasGShad {
+		for i, entry := range group {
+			if !entry.isVerbatim() && !gshadowNames[entry.Groupname] {
+				c.add(constants.FileEtcGroup, i+1, "group %s has no gshadow entry",
+					entry.Groupname)
+			}
+		}
+	}
+
+	return c.problems, nil
+}
+
+func (c *checker) checkHomeDir(entry *PasswdEntry, line int) error {
+	if len(entry.HomeDir) == 0 || entry.HomeDir == "/nonexistent" {
+		return nil
+	}
+	fi, err := c.stat(entry.HomeDir)
+	if os.IsNotExist(err) {
+		c.add(constants.FileEtcPasswd, line, "user %s has home directory %s that does not exist",
+			entry.Username, entry.HomeDir)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		c.add(constants.FileEtcPasswd, line, "user %s has home directory %s that is not a directory",
+			entry.Username, entry.HomeDir)
+	}
+	return nil
+}
+
+func (c *checker) checkShell(entry *PasswdEntry, line int) error {
+	if len(entry.Shell) == 0 {
+		return nil
+	}
+	fi, err := c.stat(entry.Shell)
+	if os.IsNotExist(err) {
+		c.add(constants.FileEtcPasswd, line, "user %s has shell %s that does not exist",
+			entry.Username, entry.Shell)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() || fi.Mode().Perm()&0111 == 0 {
+		c.add(constants.FileEtcPasswd, line, "user %s has shell %s that is not executable",
+			entry.Username, entry.Shell)
+	}
+	return nil
+}
+
+// stat returns information about path within baseDir, following symbolic links
+// as if baseDir were the root directory.
+func (c *checker) stat(path string) (os.FileInfo, error) {
+	return rootfs.Stat(c.fs, c.baseDir, path)
+}
@@ -0,0 +1,133 @@
+package login
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func checkSetup(t *testing.T, passwd, shadow, group, gshadow *string) string {
+	rootDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "etc"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "usr/bin"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "root"), 0700))
+	require.NoError(t, os.MkdirAll(filepath.Join(rootDir, "home/abc"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "usr/bin/busybox"), nil, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(rootDir, "usr/bin/data"), nil, 0644))
+	// Absolute links must be resolved within the root directory.
+	require.NoError(t, os.Symlink("usr/bin", filepath.Join(rootDir, "bin")))
+	require.NoError(t, os.Symlink("/bin/busybox", filepath.Join(rootDir, "usr/bin/sh")))
+	require.NoError(t, os.Symlink("/nowhere", filepath.Join(rootDir, "usr/bin/dangling")))
+
+	files := map[string]*string{
+		constants.FileEtcPasswd:  passwd,
+		constants.FileEtcShadow:  shadow,
+		constants.FileEtcGroup:   group,
+		constants.FileEtcGShadow: gshadow,
+	}
+	for path, content := range files {
+		if content != nil {
+			require.NoError(t, os.WriteFile(filepath.Join(rootDir, path), []byte(*content), 0644))
+		}
+	}
+	return rootDir
+}
+
+func TestCheck(t *testing.T) {
+	p := func(s string) *string { return &s }
+	testCases := []struct {
+		description string
+		passwd      *string
+		shadow      *string
+		group       *string
+		gshadow     *string
+		problems    []Problem
+	}{
+		{
+			description: "No files",
+			problems:    nil,
+		},
+		{
+			description: "Consistent files",
+			passwd: p(`# comment
+root:x:0:0:root:/root:/bin/sh
+abc:x:1000:1000:abc:/home/abc:/usr/bin/sh
+nobody:x:65534:65534:nobody:/nonexistent:/usr/bin/busybox
+`),
+			shadow:  p("root:*:19000:0:99999:7:::\nabc:*:19000:0:99999:7:::\nnobody:*:19000:0:99999:7:::\n"),
+			group:   p("root:x:0:\nabc:x:1000:abc\nnogroup:x:65534:\n"),
+			gshadow: p("root:::\nabc:!!::abc\nnogroup:::\n"),
+		},
+		{
+			description: "Duplicate names and IDs",
+			passwd: p(`root:x:0:0:root:/root:/bin/sh
+root:x:1:0:root:/root:/bin/sh
+toor:x:0:0:root:/root:/bin/sh
+`),
+			group: p("root:x:0:\nroot:x:1:\nwheel:x:0:\n"),
+			problems: []Problem{
+				{File: "/etc/passwd", Line: 2, Message: "duplicate user root"},
+				{File: "/etc/passwd", Line: 3, Message: "user toor has the same UID 0 as root"},
+				{File: "/etc/group", Line: 2, Message: "duplicate group root"},
+				{File: "/etc/group", Line: 3, Message: "group wheel has the same GID 0 as root"},
+			},
+		},
+		{
+			description: "Dangling references",
+			passwd:      p("root:x:0:0:root:/root:/bin/sh\nabc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			shadow:      p("root:*:19000:0:99999:7:::\nxyz:*:19000:0:99999:7:::\n"),
+			group:       p("root:x:0:\nwheel:x:10:abc,xyz\n"),
+			gshadow:     p("root:::\nadm:::\n"),
+			problems: []Problem{
+				{File: "/etc/group", Line: 2, Message: "group wheel has member xyz with no user"},
+				{File: "/etc/shadow", Line: 2, Message: "user xyz has no passwd entry"},
+				{File: "/etc/gshadow", Line: 2, Message: "group adm has no group entry"},
+				{File: "/etc/passwd", Line: 2, Message: "user abc has primary GID 1000 with no group"},
+				{File: "/etc/passwd", Line: 2, Message: "user abc has no shadow entry"},
+				{File: "/etc/group", Line: 2, Message: "group wheel has no gshadow entry"},
+			},
+		},
+		{
+			description: "Bad home directories and shells",
+			passwd: p(`a:x:1:1:a:/home/missing:/bin/sh
+b:x:2:2:b:/usr/bin/busybox:/bin/missing
+c:x:3:3:c:/root:/usr/bin/data
+d:x:4:4:d:/root:/usr/bin
+e:x:5:5:e:/root:/bin/dangling
+`),
+			problems: []Problem{
+				{File: "/etc/passwd", Line: 1, Message: "user a has home directory /home/missing that does not exist"},
+				{File: "/etc/passwd", Line: 2, Message: "user b has home directory /usr/bin/busybox that is not a directory"},
+				{File: "/etc/passwd", Line: 2, Message: "user b has shell /bin/missing that does not exist"},
+				{File: "/etc/passwd", Line: 3, Message: "user c has shell /usr/bin/data that is not executable"},
+				{File: "/etc/passwd", Line: 4, Message: "user d has shell /usr/bin that is not executable"},
+				{File: "/etc/passwd", Line: 5, Message: "user e has shell /bin/dangling that does not exist"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			rootDir := checkSetup(t, tc.passwd, tc.shadow, tc.group, tc.gshadow)
+			problems, err := Check(afero.NewOsFs(), rootDir)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.problems, problems)
+		})
+	}
+}
+
+func TestCheckParseError(t *testing.T) {
+	p := func(s string) *string { return &s }
+	rootDir := checkSetup(t, p("root:x:0:0\n"), nil, nil, nil)
+	_, err := Check(afero.NewOsFs(), rootDir)
+	assert.Error(t, err)
+}
+
+func TestProblemString(t *testing.T) {
+	problem := Problem{File: "/etc/passwd", Line: 3, Message: "duplicate user root"}
+	assert.Equal(t, "/etc/passwd:3: duplicate user root", problem.String())
+}
@@ -0,0 +1,1017 @@
+package login
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/spf13/afero"
+)
+
+const (
+	suffixBackup = "-"
+	suffixTemp   = "+"
+)
+
+// entry is a line of one of the files, which may be a verbatim line such as
+// a comment rather than an entry.
+type entry interface {
+	fmt.Stringer
+	isVerbatim() bool
+}
+
+func (p *PasswdEntry) isVerbatim() bool  { return p.verbatim != nil }
+func (g *GroupEntry) isVerbatim() bool   { return g.verbatim != nil }
+func (s *ShadowEntry) isVerbatim() bool  { return s.verbatim != nil }
+func (g *GShadowEntry) isVerbatim() bool { return g.verbatim != nil }
+func (s *SubIDEntry) isVerbatim() bool   { return s.verbatim != nil }
+
+type dbFile[T entry] struct {
+	path     string
+	mode     os.FileMode
+	exists   bool
+	modified bool
+	entries  []T
+}
+
+// find returns the first entry that matches, skipping verbatim lines.
+func (d *dbFile[T]) find(match func(T) bool) (T, int, bool) {
+	for i, entry := range d.entries {
+		if !entry.isVerbatim() && match(entry) {
+			return entry, i, true
+		}
+	}
+	var zero T
+	return zero, -1, false
+}
+
+// list returns the entries, skipping verbatim lines.
+func (d *dbFile[T]) list() []T {
+	entries := []T{}
+	for _, entry := range d.entries {
+		if !entry.isVerbatim() {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// present returns true if the file exists on disk or will be created by Commit.
+func (d *dbFile[T]) present() bool {
+	return d.exists || d.modified
+}
+
+type homeDirEntry struct {
+	path           string
+	uid            uint32
+	gid            uint32
+	authorizedKeys []string
+}
+
+// Database holds the passwd, group, shadow, gshadow, subuid, and subgid files
+// under a base directory in memory. Changes are made to all of the files
+// together and are only written to disk by Commit.
+type Database struct {
+	fs       afero.Fs
+	baseDir  string
+	passwd   *dbFile[*PasswdEntry]
+	group    *dbFile[*GroupEntry]
+	shadow   *dbFile[*ShadowEntry]
+	gshadow  *dbFile[*GShadowEntry]
+	subuid   *dbFile[*SubIDEntry]
+	subgid   *dbFile[*SubIDEntry]
+	defs     *LoginDefs
+	homeDirs []homeDirEntry
+}
+
+// OpenDatabase loads the passwd, group, shadow, gshadow, subuid, and subgid
+// files under baseDir, and the ID ranges for new users and groups from
+// login.defs if it exists. Files that do not exist are treated as empty and are
+// only created if entries are added to them. Lines that are not entries are
+// preserved unless WithStrict is given.
+func OpenDatabase(fs afero.Fs, baseDir string, opts ...ParseOpt) (*Database, error) {
+	db := &Database{
+		fs:      fs,
+		baseDir: baseDir,
+		passwd: &dbFile[*PasswdEntry]{
+			path: filepath.Join(baseDir, constants.FileEtcPasswd),
+			mode: constants.ModeEtcPasswd,
+		},
+		group: &dbFile[*GroupEntry]{
+			path: filepath.Join(baseDir, constants.FileEtcGroup),
+			mode: constants.ModeEtcGroup,
+		},
+		shadow: &dbFile[*ShadowEntry]{
+			path: filepath.Join(baseDir, constants.FileEtcShadow),
+			mode: constants.ModeEtcShadow,
+		},
+		gshadow: &dbFile[*GShadowEntry]{
+			path: filepath.Join(baseDir, constants.FileEtcGShadow),
+			mode: constants.ModeEtcGShadow,
+		},
+		subuid: &dbFile[*SubIDEntry]{
+			path: filepath.Join(baseDir, constants.FileEtcSubUID),
+			mode: constants.ModeEtcSubUID,
+		},
+		subgid: &dbFile[*SubIDEntry]{
+			path: filepath.Join(baseDir, constants.FileEtcSubGID),
+			mode: constants.ModeEtcSubGID,
+		},
+	}
+
+	err := loadFile(fs, db.passwd, func(path string) ([]*PasswdEntry, error) {
+		_, _, entries, err := ParsePasswd(fs, path, opts...)
+		return entries, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = loadFile(fs, db.group, func(path string) ([]*GroupEntry, error) {
+		_, _, entries, err := ParseGroup(fs, path, opts...)
+		return entries, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = loadFile(fs, db.shadow, func(path string) ([]*ShadowEntry, error) {
+		_, entries, err := ParseShadow(fs, path, opts...)
+		return entries, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = loadFile(fs, db.gshadow, func(path string) ([]*GShadowEntry, error) {
+		_, entries, err := ParseGShadow(fs, path, opts...)
+		return entries, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range []*dbFile[*SubIDEntry]{db.subuid, db.subgid} {
+		err = loadFile(fs, file, func(path string) ([]*SubIDEntry, error) {
+			return ParseSubID(fs, path, opts...)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.defs = DefaultLoginDefs()
+	fileEtcLoginDefs := filepath.Join(baseDir, constants.FileEtcLoginDefs)
+	hasLoginDefs, err := fileExists(fs, fileEtcLoginDefs)
+	if err != nil {
+		return nil, err
+	}
+	if hasLoginDefs {
+		if db.defs, err = ParseLoginDefs(fs, fileEtcLoginDefs); err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+func loadFile[T entry](fs afero.Fs, file *dbFile[T], parse func(string) ([]T, error)) error {
+	exists, err := fileExists(fs, file.path)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	entries, err := parse(file.path)
+	if err != nil {
+		return err
+	}
+	file.exists = true
+	file.entries = entries
+	return nil
+}
+
+// LoginDefs returns the ID ranges used to allocate IDs for new users and groups.
+func (db *Database) LoginDefs() *LoginDefs {
+	return db.defs
+}
+
+// Users returns the entries in the passwd file.
+func (db *Database) Users() []*PasswdEntry {
+	return db.passwd.list()
+}
+
+// Groups returns the entries in the group file.
+func (db *Database) Groups() []*GroupEntry {
+	return db.group.list()
+}
+
+// User returns the passwd entry for username.
+func (db *Database) User(username string) (*PasswdEntry, bool) {
+	entry, _, ok := db.passwd.find(func(entry *PasswdEntry) bool {
+		return entry.Username == username
+	})
+	return entry, ok
+}
+
+// UserByUID returns the first passwd entry with the given UID.
+func (db *Database) UserByUID(uid uint32) (*PasswdEntry, bool) {
+	entry, _, ok := db.passwd.find(func(entry *PasswdEntry) bool {
+		return entry.UID == uid
+	})
+	return entry, ok
+}
+
+// Group returns the group entry for groupname.
+func (db *Database) Group(groupname string) (*GroupEntry, bool) {
+	entry, _, ok := db.group.find(func(entry *GroupEntry) bool {
+		return entry.Groupname == groupname
+	})
+	return entry, ok
+}
+
+// GroupByGID returns the first group entry with the given GID.
+func (db *Database) GroupByGID(gid uint32) (*GroupEntry, bool) {
+	entry, _, ok := db.group.find(func(entry *GroupEntry) bool {
+		return entry.GID == gid
+	})
+	return entry, ok
+}
+
+// Shadow returns the shadow entry for username.
+func (db *Database) Shadow(username string) (*ShadowEntry, bool) {
+	entry, _, ok := db.shadow.find(func(entry *ShadowEntry) bool {
+		return entry.Username == username
+	})
+	return entry, ok
+}
+
+// GShadow returns the gshadow entry for groupname.
+func (db *Database) GShadow(groupname string) (*GShadowEntry, bool) {
+	entry, _, ok := db.gshadow.find(func(entry *GShadowEntry) bool {
+		return entry.Groupname == groupname
+	})
+	return entry, ok
+}
+
+// SubUIDs returns the subordinate UID ranges of name.
+func (db *Database) SubUIDs(name string) []*SubIDEntry {
+	return subIDs(db.subuid, name)
+}
+
+// SubGIDs returns the subordinate GID ranges of name.
+func (db *Database) SubGIDs(name string) []*SubIDEntry {
+	return subIDs(db.subgid, name)
+}
+
+func subIDs(file *dbFile[*SubIDEntry], name string) []*SubIDEntry {
+	entries := []*SubIDEntry{}
+	for _, entry := range file.list() {
+		if entry.Name == name {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// NextUID returns the lowest UID between min and max that is not in use.
+func (db *Database) NextUID(min, max uint32) (uint32, error) {
+	used := make(map[uint32]struct{}, len(db.passwd.entries))
+	for _, entry := range db.passwd.list() {
+		used[entry.UID] = struct{}{}
+	}
+	return nextID(used, min, max)
+}
+
+// NextGID returns the lowest GID between min and max that is not in use.
+func (db *Database) NextGID(min, max uint32) (uint32, error) {
+	used := make(map[uint32]struct{}, len(db.group.entries))
+	for _, entry := range db.group.list() {
+		used[entry.GID] = struct{}{}
+	}
+	return nextID(used, min, max)
+}
+
+// AddPasswd appends an entry to the passwd file.
+func (db *Database) AddPasswd(entry *PasswdEntry) error {
+	if _, ok := db.User(entry.Username); ok {
+		return ErrUsernameExists
+	}
+	db.passwd.entries = append(db.passwd.entries, entry)
+	db.passwd.modified = true
+	return nil
+}
+
+// AddGroup appends an entry to the group file.
+func (db *Database) AddGroup(entry *GroupEntry) error {
+	if _, ok := db.Group(entry.Groupname); ok {
+		return ErrGroupnameExists
+	}
+	db.group.entries = append(db.group.entries, entry)
+	db.group.modified = true
+	return nil
+}
+
+// AddShadow appends an entry to the shadow file.
+func (db *Database) AddShadow(entry *ShadowEntry) error {
+	if _, ok := db.Shadow(entry.Username); ok {
+		return ErrUsernameExists
+	}
+	db.shadow.entries = append(db.shadow.entries, entry)
+	db.shadow.modified = true
+	return nil
+}
+
+// AddGShadow appends an entry to the gshadow file.
+func (db *Database) AddGShadow(entry *GShadowEntry) error {
+	if _, ok := db.GShadow(entry.Groupname); ok {
+		return ErrGroupnameExists
+	}
+	db.gshadow.entries = append(db.gshadow.entries, entry)
+	db.gshadow.modified = true
+	return nil
+}
+
+// ModifyPasswd calls modify with the passwd entry for username.
+func (db *Database) ModifyPasswd(username string, modify func(*PasswdEntry)) error {
+	entry, ok := db.User(username)
+	if !ok {
+		return ErrUserNotFound
+	}
+	modify(entry)
+	db.passwd.modified = true
+	return nil
+}
+
+// ModifyGroup calls modify with the group entry for groupname.
+func (db *Database) ModifyGroup(groupname string, modify func(*GroupEntry)) error {
+	entry, ok := db.Group(groupname)
+	if !ok {
+		return ErrGroupNotFound
+	}
+	modify(entry)
+	db.group.modified = true
+	return nil
+}
+
+// ModifyShadow calls modify with the shadow entry for username.
+func (db *Database) ModifyShadow(username string, modify func(*ShadowEntry)) error {
+	entry, ok := db.Shadow(username)
+	if !ok {
+		return ErrUserNotFound
+	}
+	modify(entry)
+	db.shadow.modified = true
+	return nil
+}
+
+// ModifyGShadow calls modify with the gshadow entry for groupname.
+func (db *Database) ModifyGShadow(groupname string, modify func(*GShadowEntry)) error {
+	entry, ok := db.GShadow(groupname)
+	if !ok {
+		return ErrGroupNotFound
+	}
+	modify(entry)
+	db.gshadow.modified = true
+	return nil
+}
+
+// RemovePasswdEntry removes the passwd entry for username.
+func (db *Database) RemovePasswdEntry(username string) error {
+	return removeEntry(db.passwd, func(entry *PasswdEntry) bool {
+		return entry.Username == username
+	}, ErrUserNotFound)
+}
+
+// RemoveGroupEntry removes the group entry for groupname.
+func (db *Database) RemoveGroupEntry(groupname string) error {
+	return removeEntry(db.group, func(entry *GroupEntry) bool {
+		return entry.Groupname == groupname
+	}, ErrGroupNotFound)
+}
+
+// RemoveShadowEntry removes the shadow entry for username.
+func (db *Database) RemoveShadowEntry(username string) error {
+	return removeEntry(db.shadow, func(entry *ShadowEntry) bool {
+		return entry.Username == username
+	}, ErrUserNotFound)
+}
+
+// RemoveGShadowEntry removes the gshadow entry for groupname.
+func (db *Database) RemoveGShadowEntry(groupname string) error {
+	return removeEntry(db.gshadow, func(entry *GShadowEntry) bool {
+		return entry.Groupname == groupname
+	}, ErrGroupNotFound)
+}
+
+func removeEntry[T entry](file *dbFile[T], match func(T) bool, notFound error) error {
+	_, i, ok := file.find(match)
+	if !ok {
+		return notFound
+	}
+	file.entries = append(file.entries[:i], file.entries[i+1:]...)
+	file.modified = true
+	return nil
+}
+
+// Commit writes the modified files to disk. All of the modified files are first
+// written to temporary files, and only if that succeeds are the originals backed
+// up with a "-" suffix and replaced. Home directories of added users are created
+// after the files are replaced.
+func (db *Database) Commit() error {
+	var (
+		files = []*commitFile{
+			newCommitFile(db.passwd),
+			newCommitFile(db.group),
+			newCommitFile(db.shadow),
+			newCommitFile(db.gshadow),
+			newCommitFile(db.subuid),
+			newCommitFile(db.subgid),
+		}
+		pending = []*commitFile{}
+	)
+
+	for _, file := range files {
+		if file.modified {
+			pending = append(pending, file)
+		}
+	}
+
+	for i, file := range pending {
+		if err := file.writeTemp(db.fs); err != nil {
+			for _, written := range pending[:i+1] {
+				db.fs.Remove(written.path + suffixTemp)
+			}
+			return err
+		}
+	}
+
+	for _, file := range pending {
+		if file.exists {
+			if err := copyFile(db.fs, file.path, file.path+suffixBackup, file.mode); err != nil {
+				return err
+			}
+		}
+		tmpPath := file.path + suffixTemp
+		if err := db.fs.Rename(tmpPath, file.path); err != nil {
+			return fmt.Errorf("unable to rename %s to %s: %w", tmpPath, file.path, err)
+		}
+		file.committed()
+	}
+
+	for _, home := range db.homeDirs {
+		if err := createHomeDir(db.fs, home.path, home.uid, home.gid); err != nil {
+			return err
+		}
+		if len(home.authorizedKeys) > 0 {
+			err := writeAuthorizedKeys(db.fs, home.path, home.authorizedKeys, home.uid, home.gid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	db.homeDirs = nil
+
+	return nil
+}
+
+// commitFile erases the entry type of a dbFile so the files can be committed together.
+type commitFile struct {
+	path      string
+	mode      os.FileMode
+	exists    bool
+	modified  bool
+	lines     func() []string
+	committed func()
+}
+
+func newCommitFile[T entry](file *dbFile[T]) *commitFile {
+	return &commitFile{
+		path:     file.path,
+		mode:     file.mode,
+		exists:   file.exists,
+		modified: file.modified,
+		lines: func() []string {
+			lines := make([]string, len(file.entries))
+			for i, entry := range file.entries {
+				lines[i] = entry.String()
+			}
+			return lines
+		},
+		committed: func() {
+			file.exists = true
+			file.modified = false
+		},
+	}
+}
+
+func (c *commitFile) writeTemp(fs afero.Fs) error {
+	return writeFile(fs, c.path+suffixTemp, c.lines(), c.mode)
+}
+
+func writeFile(fs afero.Fs, path string, lines []string, mode os.FileMode) error {
+	oldmask := syscall.Umask(0)
+	defer syscall.Umask(oldmask)
+
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	// File will normally be closed earlier if there are no errors.
+	defer f.Close()
+
+	for _, line := range lines {
+		if _, err = f.WriteString(line + "\n"); err != nil {
+			return fmt.Errorf("unable to write to %s: %w", path, err)
+		}
+	}
+
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func copyFile(fs afero.Fs, src, dest string, mode os.FileMode) error {
+	content, err := afero.ReadFile(fs, src)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", src, err)
+	}
+
+	oldmask := syscall.Umask(0)
+	defer syscall.Umask(oldmask)
+
+	f, err := fs.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", dest, err)
+	}
+	// File will normally be closed earlier if there are no errors.
+	defer f.Close()
+
+	if _, err = f.Write(content); err != nil {
+		return fmt.Errorf("unable to write to %s: %w", dest, err)
+	}
+
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("unable to close %s: %w", dest, err)
+	}
+
+	return nil
+}
+
+// AddUser adds a user, its primary group, and the corresponding shadow entries.
+// Login users are also added to the wheel group. The home directory, if
+// requested, is created on Commit.
+func (db *Database) AddUser(username, groupname, homeDir, shell string,
+	idMin, idMax uint32, createHome, isLoginUser, locked bool) (uint32, uint32, error) {
+	ids := idRange{min: idMin, max: idMax}
+	return db.addUser(username, groupname, homeDir, shell, ids, ids, createHome, isLoginUser, locked)
+}
+
+type idRange struct {
+	min uint32
+	max uint32
+}
+
+func (r idRange) overlaps(other idRange) bool {
+	return r.min <= other.max && other.min <= r.max
+}
+
+func (db *Database) addUser(username, groupname, homeDir, shell string,
+	uids, gids idRange, createHome, isLoginUser, locked bool) (uint32, uint32, error) {
+	var idStartWheel uint32 = 10
+
+	if len(username) == 0 {
+		return 0, 0, ErrUsernameLength
+	}
+
+	if len(groupname) == 0 {
+		return 0, 0, ErrGroupnameLength
+	}
+
+	if _, ok := db.User(username); ok {
+		return 0, 0, ErrUsernameExists
+	}
+
+	uid, err := db.NextUID(uids.min, uids.max)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// A shadow entry is only added if the shadow file is in use.
+	_, hasShadow := db.Shadow(username)
+	createShadowEntry := !hasShadow && (!db.passwd.present() || db.shadow.present())
+
+	group, hasGroup := db.Group(groupname)
+	createGroupEntry := !hasGroup
+	var gid uint32
+	if hasGroup {
+		gid = group.GID
+	} else {
+		gid, err = db.NextGID(gids.min, gids.max)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	_, hasGShadow := db.GShadow(groupname)
+	createGShadowEntry := !hasGShadow && (!db.group.present() || db.gshadow.present())
+
+	var wheelGID uint32
+	_, hasWheel := db.Group(constants.GroupNameWheel)
+	if isLoginUser && !hasWheel {
+		wheelGID, err = db.NextGID(idStartWheel, db.defs.SysGIDMax)
+		if err != nil {
+			return 0, 0, fmt.Errorf("unable to get next GID for %s: %w",
+				constants.GroupNameWheel, err)
+		}
+	}
+
+	if isLoginUser {
+		if hasWheel {
+			db.addGroupMember(constants.GroupNameWheel, username)
+		} else {
+			db.AddGroup(&GroupEntry{
+				Groupname: constants.GroupNameWheel,
+				Password:  "x",
+				GID:       wheelGID,
+				Users:     []string{username},
+			})
+		}
+
+		if createGShadowEntry {
+			if _, ok := db.GShadow(constants.GroupNameWheel); ok {
+				db.addGShadowMember(constants.GroupNameWheel, username)
+			} else {
+				db.AddGShadow(&GShadowEntry{
+					Groupname: constants.GroupNameWheel,
+					Users:     []string{username},
+				})
+			}
+		}
+	}
+
+	db.AddPasswd(&PasswdEntry{
+		Username: username,
+		Password: "x",
+		UID:      uid,
+		GID:      gid,
+		Comment:  username,
+		HomeDir:  homeDir,
+		Shell:    shell,
+	})
+
+	if createGroupEntry {
+		db.AddGroup(&GroupEntry{
+			Groupname: groupname,
+			Password:  "x",
+			GID:       gid,
+			Users:     []string{username},
+		})
+	}
+
+	if createShadowEntry {
+		shadowEntry := &ShadowEntry{
+			Username:         username,
+			Password:         "*",
+			LastChange:       0,
+			MinAge:           0,
+			MaxAge:           99999,
+			WarningPeriod:    7,
+			InactivityPeriod: -1,
+			Expiration:       -1,
+		}
+		if isLoginUser {
+			shadowEntry.LastChange = -1
+		}
+		if locked {
+			shadowEntry.Password = "!!"
+		}
+		db.AddShadow(shadowEntry)
+	}
+
+	if createGShadowEntry {
+		db.AddGShadow(&GShadowEntry{
+			Groupname: groupname,
+			Password:  "!!",
+			Admins:    []string{},
+			Users:     []string{username},
+		})
+	}
+
+	if createHome {
+		db.homeDirs = append(db.homeDirs, homeDirEntry{
+			path: filepath.Join(db.baseDir, homeDir),
+			uid:  uid,
+			gid:  gid,
+		})
+	}
+
+	return uid, gid, nil
+}
+
+// AddSystemUser adds a system user with no password or valid shell.
+func (db *Database) AddSystemUser(username, groupname, homeDir string) (uint32, uint32, error) {
+	return db.addUser(username, groupname, homeDir, "/bin/false", db.defs.sysUIDs(),
+		db.defs.sysGIDs(), false, false, true)
+}
+
+// UserOpt is an optional setting for AddLoginUser.
+type UserOpt func(*userConfig)
+
+type userConfig struct {
+	subIDCount uint32
+}
+
+// WithSubIDs grants the user ranges of count subordinate UIDs and GIDs.
+func WithSubIDs(count uint32) UserOpt {
+	return func(c *userConfig) {
+		c.subIDCount = count
+	}
+}
+
+// AddLoginUser adds a user that can log in with a valid shell and home directory.
+func (db *Database) AddLoginUser(username, groupname, homeDir, shell string,
+	opts ...UserOpt) (uint32, uint32, error) {
+	cfg := &userConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	uid, gid, err := db.addUser(username, groupname, homeDir, shell, db.defs.uids(),
+		db.defs.gids(), true, true, false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if cfg.subIDCount > 0 {
+		if _, _, err = db.AddSubIDs(username, cfg.subIDCount); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return uid, gid, nil
+}
+
+// AddSubIDs grants an existing user ranges of count subordinate UIDs and GIDs
+// that do not overlap those of other users, and returns the start of each.
+func (db *Database) AddSubIDs(username string, count uint32) (uint32, uint32, error) {
+	if _, ok := db.User(username); !ok {
+		return 0, 0, ErrUserNotFound
+	}
+	if len(db.SubUIDs(username)) > 0 || len(db.SubGIDs(username)) > 0 {
+		return 0, 0, ErrSubIDsExist
+	}
+
+	uidStart, err := nextSubIDRange(db.subuid.entries, count, db.defs.SubUIDMin,
+		db.defs.SubUIDMax)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to allocate subordinate UIDs: %w", err)
+	}
+	gidStart, err := nextSubIDRange(db.subgid.entries, count, db.defs.SubGIDMin,
+		db.defs.SubGIDMax)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to allocate subordinate GIDs: %w", err)
+	}
+
+	db.subuid.entries = append(db.subuid.entries,
+		&SubIDEntry{Name: username, Start: uidStart, Count: count})
+	db.subuid.modified = true
+	db.subgid.entries = append(db.subgid.entries,
+		&SubIDEntry{Name: username, Start: gidStart, Count: count})
+	db.subgid.modified = true
+
+	return uidStart, gidStart, nil
+}
+
+// AddRootUser adds the root user.
+func (db *Database) AddRootUser(shell string) (uint32, uint32, error) {
+	homeDir := filepath.Join(constants.DirETRoot, "/root")
+	return db.AddUser("root", "root", homeDir, shell, 0, 0, true, false, false)
+}
+
+func (db *Database) addGroupMember(groupname, username string) {
+	group, ok := db.Group(groupname)
+	if ok && !hasEntry(group.Users, username) {
+		group.Users = append(group.Users, username)
+		db.group.modified = true
+	}
+}
+
+func (db *Database) addGShadowMember(groupname, username string) {
+	gshadow, ok := db.GShadow(groupname)
+	if ok && !hasEntry(gshadow.Users, username) {
+		gshadow.Users = append(gshadow.Users, username)
+		db.gshadow.modified = true
+	}
+}
+
+// UserChanges describes changes to make to an existing user. Nil fields are
+// left unchanged.
+type UserChanges struct {
+	Shell   *string
+	HomeDir *string
+	Comment *string
+	// PasswordHash replaces the password with a hash in crypt format.
+	PasswordHash *string
+	// Locked locks the password when true and unlocks it when false.
+	Locked *bool
+	// Expiration is the account expiration in days since the epoch, or -1
+	// for no expiration.
+	Expiration *int
+}
+
+// ModifyUser applies changes to an existing user. Password changes apply to
+// the shadow entry if there is one, otherwise to the passwd entry. A new
+// password hash is set before any locking or unlocking.
+func (db *Database) ModifyUser(username string, changes UserChanges) error {
+	passwd, ok := db.User(username)
+	if !ok {
+		return ErrUserNotFound
+	}
+	shadow, hasShadow := db.Shadow(username)
+
+	if changes.Expiration != nil && !hasShadow {
+		return ErrShadowNotFound
+	}
+
+	if changes.PasswordHash != nil {
+		if err := ValidatePasswordHash(*changes.PasswordHash); err != nil {
+			return err
+		}
+	}
+
+	password := &passwd.Password
+	if hasShadow {
+		password = &shadow.Password
+	}
+	newPassword := *password
+	if changes.PasswordHash != nil {
+		newPassword = *changes.PasswordHash
+	}
+	if changes.Locked != nil {
+		if *changes.Locked {
+			newPassword = lockPassword(newPassword)
+		} else {
+			newPassword = strings.TrimPrefix(newPassword, "!")
+			if len(newPassword) == 0 {
+				return ErrPasswordless
+			}
+		}
+	}
+
+	db.ModifyPasswd(username, func(entry *PasswdEntry) {
+		if changes.Shell != nil {
+			entry.Shell = *changes.Shell
+		}
+		if changes.HomeDir != nil {
+			entry.HomeDir = *changes.HomeDir
+		}
+		if changes.Comment != nil {
+			entry.Comment = *changes.Comment
+		}
+		if !hasShadow {
+			entry.Password = newPassword
+		}
+	})
+
+	if hasShadow {
+		db.ModifyShadow(username, func(entry *ShadowEntry) {
+			entry.Password = newPassword
+			if changes.Expiration != nil {
+				entry.Expiration = *changes.Expiration
+			}
+		})
+	}
+
+	return nil
+}
+
+func lockPassword(password string) string {
+	if strings.HasPrefix(password, "!") {
+		return password
+	}
+	return "!" + password
+}
+
+// LockUser locks the password of an existing user.
+func (db *Database) LockUser(username string) error {
+	locked := true
+	return db.ModifyUser(username, UserChanges{Locked: &locked})
+}
+
+// SetPassword sets the password of an existing user to hash, which must be in
+// crypt format.
+func (db *Database) SetPassword(username, hash string) error {
+	return db.ModifyUser(username, UserChanges{PasswordHash: &hash})
+}
+
+// AddUserToGroups adds an existing user as a member of each of the groups,
+// which must all exist. The user is also added to the groups' gshadow entries
+// if they exist.
+func (db *Database) AddUserToGroups(username string, groupnames ...string) error {
+	if _, ok := db.User(username); !ok {
+		return ErrUserNotFound
+	}
+	for _, groupname := range groupnames {
+		if _, ok := db.Group(groupname); !ok {
+			return fmt.Errorf("%s: %w", groupname, ErrGroupNotFound)
+		}
+	}
+	for _, groupname := range groupnames {
+		db.addGroupMember(groupname, username)
+		db.addGShadowMember(groupname, username)
+	}
+	return nil
+}
+
+// RemoveUser removes a user from passwd, shadow, subuid, and subgid and from the
+// member lists of all groups, including wheel. The user's primary group is also removed if
+// it has the same name as the user and is not the primary group of any other
+// user. Home directories are not removed.
+func (db *Database) RemoveUser(username string) error {
+	passwd, ok := db.User(username)
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	db.RemovePasswdEntry(username)
+	if _, ok := db.Shadow(username); ok {
+		db.RemoveShadowEntry(username)
+	}
+
+	for _, group := range db.group.list() {
+		if hasEntry(group.Users, username) {
+			group.Users = removeString(group.Users, username)
+			db.group.modified = true
+		}
+	}
+	for _, gshadow := range db.gshadow.list() {
+		if hasEntry(gshadow.Users, username) || hasEntry(gshadow.Admins, username) {
+			gshadow.Users = removeString(gshadow.Users, username)
+			gshadow.Admins = removeString(gshadow.Admins, username)
+			db.gshadow.modified = true
+		}
+	}
+
+	for _, file := range []*dbFile[*SubIDEntry]{db.subuid, db.subgid} {
+		count := len(file.entries)
+		file.entries = slices.DeleteFunc(file.entries, func(entry *SubIDEntry) bool {
+			return !entry.isVerbatim() && entry.Name == username
+		})
+		if len(file.entries) < count {
+			file.modified = true
+		}
+	}
+
+	group, ok := db.Group(username)
+	if ok && group.GID == passwd.GID && !db.isPrimaryGroup(group.GID) {
+		return db.RemoveGroup(username)
+	}
+
+	return nil
+}
+
+// RemoveGroup removes a group from group and gshadow. A group that is the
+// primary group of a user cannot be removed.
+func (db *Database) RemoveGroup(groupname string) error {
+	group, ok := db.Group(groupname)
+	if !ok {
+		return ErrGroupNotFound
+	}
+	if db.isPrimaryGroup(group.GID) {
+		return ErrGroupInUse
+	}
+
+	db.RemoveGroupEntry(groupname)
+	if _, ok := db.GShadow(groupname); ok {
+		db.RemoveGShadowEntry(groupname)
+	}
+
+	return nil
+}
+
+func (db *Database) isPrimaryGroup(gid uint32) bool {
+	for _, user := range db.passwd.list() {
+		if user.GID == gid {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(strs []string, str string) []string {
+	result := []string{}
+	for _, s := range strs {
+		if s != str {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,427 @@
+package login
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failFs fails to open the file at path for writing.
+type failFs struct {
+	afero.Fs
+	path string
+}
+
+func (f *failFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if name == f.path && flag&os.O_WRONLY != 0 {
+		return nil, errors.New("write failure")
+	}
+	return f.Fs.OpenFile(name, flag, perm)
+}
+
+func TestOpenDatabase(t *testing.T) {
+	p := func(s string) *string { return &s }
+	fs := loginSetup(
+		p("root:x:0:0:root:/root:/bin/sh\nabc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+		p("root:*:0:0:99999:7:::\n"),
+		p("root:x:0:\nabc:x:1000:\n"),
+		nil,
+		"/base",
+	)
+
+	db, err := OpenDatabase(fs, "/base")
+	require.NoError(t, err)
+
+	assert.Len(t, db.Users(), 2)
+	assert.Len(t, db.Groups(), 2)
+
+	user, ok := db.User("abc")
+	assert.True(t, ok)
+	assert.Equal(t, uint32(1000), user.UID)
+
+	user, ok = db.UserByUID(0)
+	assert.True(t, ok)
+	assert.Equal(t, "root", user.Username)
+
+	group, ok := db.GroupByGID(1000)
+	assert.True(t, ok)
+	assert.Equal(t, "abc", group.Groupname)
+
+	_, ok = db.Shadow("root")
+	assert.True(t, ok)
+	_, ok = db.Shadow("abc")
+	assert.False(t, ok)
+	_, ok = db.GShadow("root")
+	assert.False(t, ok)
+
+	uid, err := db.NextUID(UID_GID_MIN, UID_GID_MAX)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1001), uid)
+
+	gid, err := db.NextGID(0, 0)
+	assert.ErrorIs(t, err, ErrNoAvailableIDs)
+	assert.Equal(t, uint32(0), gid)
+}
+
+func TestOpenDatabaseInvalidFile(t *testing.T) {
+	p := func(s string) *string { return &s }
+	fs := loginSetup(nil, nil, p("root:x:0\n"), nil, "")
+
+	_, err := OpenDatabase(fs, "")
+	assert.Error(t, err)
+}
+
+func TestDatabaseOperations(t *testing.T) {
+	p := func(s string) *string { return &s }
+	fs := loginSetup(
+		p("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+		p("abc:*::0:99999:7:::\n"),
+		p("abc:x:1000:\n"),
+		p("abc:!!::\n"),
+		"",
+	)
+
+	db, err := OpenDatabase(fs, "")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, db.AddPasswd(&PasswdEntry{Username: "abc"}), ErrUsernameExists)
+	assert.ErrorIs(t, db.AddShadow(&ShadowEntry{Username: "abc"}), ErrUsernameExists)
+	assert.ErrorIs(t, db.AddGroup(&GroupEntry{Groupname: "abc"}), ErrGroupnameExists)
+	assert.ErrorIs(t, db.AddGShadow(&GShadowEntry{Groupname: "abc"}), ErrGroupnameExists)
+
+	assert.ErrorIs(t, db.ModifyPasswd("xyz", func(*PasswdEntry) {}), ErrUserNotFound)
+	assert.ErrorIs(t, db.ModifyShadow("xyz", func(*ShadowEntry) {}), ErrUserNotFound)
+	assert.ErrorIs(t, db.ModifyGroup("xyz", func(*GroupEntry) {}), ErrGroupNotFound)
+	assert.ErrorIs(t, db.ModifyGShadow("xyz", func(*GShadowEntry) {}), ErrGroupNotFound)
+
+	assert.ErrorIs(t, db.RemovePasswdEntry("xyz"), ErrUserNotFound)
+	assert.ErrorIs(t, db.RemoveShadowEntry("xyz"), ErrUserNotFound)
+	assert.ErrorIs(t, db.RemoveGroupEntry("xyz"), ErrGroupNotFound)
+	assert.ErrorIs(t, db.RemoveGShadowEntry("xyz"), ErrGroupNotFound)
+
+	assert.NoError(t, db.ModifyPasswd("abc", func(entry *PasswdEntry) {
+		entry.Shell = "/bin/bash"
+	}))
+	assert.NoError(t, db.RemoveShadowEntry("abc"))
+	assert.NoError(t, db.AddGroup(&GroupEntry{Groupname: "xyz", Password: "x", GID: 1001}))
+
+	require.NoError(t, db.Commit())
+
+	assert.Equal(t, "abc:x:1000:1000:abc:/home/abc:/bin/bash\n",
+		*loginRead(fs, constants.FileEtcPasswd))
+	assert.Equal(t, "", *loginRead(fs, constants.FileEtcShadow))
+	assert.Equal(t, "abc:x:1000:\nxyz:x:1001:\n", *loginRead(fs, constants.FileEtcGroup))
+	assert.Equal(t, "abc:!!::\n", *loginRead(fs, constants.FileEtcGShadow))
+}
+
+func TestDatabaseCommit(t *testing.T) {
+	p := func(s string) *string { return &s }
+	passwd := "root:x:0:0:root:/root:/bin/sh\n"
+	fs := loginSetup(p(passwd), nil, p("root:x:0:\n"), nil, "")
+
+	db, err := OpenDatabase(fs, "")
+	require.NoError(t, err)
+
+	uid, gid, err := db.AddSystemUser("sshd", "sshd", "/nonexistent")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(UID_GID_MIN_SYS), uid)
+	assert.Equal(t, uint32(UID_GID_MIN_SYS), gid)
+
+	uid, gid, err = db.AddLoginUser("xyz", "xyz", "/home/xyz", "/bin/sh")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(UID_GID_MIN), uid)
+	assert.Equal(t, uint32(UID_GID_MIN), gid)
+
+	// Nothing is written before commit.
+	assert.Equal(t, passwd, *loginRead(fs, constants.FileEtcPasswd))
+	assert.False(t, loginExists(fs, "/home/xyz"))
+
+	require.NoError(t, db.Commit())
+
+	assert.Equal(t, passwd+`sshd:x:100:100:sshd:/nonexistent:/bin/false
+xyz:x:1000:1000:xyz:/home/xyz:/bin/sh
+`, *loginRead(fs, constants.FileEtcPasswd))
+	assert.Equal(t, "root:x:0:\nsshd:x:100:sshd\nwheel:x:10:xyz\nxyz:x:1000:xyz\n",
+		*loginRead(fs, constants.FileEtcGroup))
+
+	// Originals are kept as backups, files that did not exist have none.
+	assert.Equal(t, passwd, *loginRead(fs, constants.FileEtcPasswd+"-"))
+	assert.Equal(t, "root:x:0:\n", *loginRead(fs, constants.FileEtcGroup+"-"))
+	assert.False(t, loginExists(fs, constants.FileEtcShadow))
+	assert.False(t, loginExists(fs, constants.FileEtcGShadow))
+	assert.False(t, loginExists(fs, constants.FileEtcPasswd+"+"))
+	assert.False(t, loginExists(fs, constants.FileEtcGroup+"+"))
+
+	fi, err := fs.Stat(constants.FileEtcPasswd + "-")
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(constants.ModeEtcPasswd), fi.Mode().Perm())
+
+	assert.True(t, loginExists(fs, "/home/xyz/.ssh"))
+}
+
+func TestDatabaseCommitFailure(t *testing.T) {
+	p := func(s string) *string { return &s }
+	passwd := "root:x:0:0:root:/root:/bin/sh\n"
+	group := "root:x:0:\n"
+	memFs := loginSetup(p(passwd), nil, p(group), nil, "")
+	fs := &failFs{Fs: memFs, path: constants.FileEtcGroup + "+"}
+
+	db, err := OpenDatabase(fs, "")
+	require.NoError(t, err)
+
+	_, _, err = db.AddLoginUser("xyz", "xyz", "/home/xyz", "/bin/sh")
+	require.NoError(t, err)
+
+	assert.Error(t, db.Commit())
+
+	// No file is replaced if any of them cannot be written.
+	assert.Equal(t, passwd, *loginRead(fs, constants.FileEtcPasswd))
+	assert.Equal(t, group, *loginRead(fs, constants.FileEtcGroup))
+	assert.False(t, loginExists(fs, constants.FileEtcPasswd+"+"))
+	assert.False(t, loginExists(fs, constants.FileEtcPasswd+"-"))
+	assert.False(t, loginExists(fs, "/home/xyz"))
+}
+
+func TestModifyUser(t *testing.T) {
+	s := func(s string) *string { return &s }
+	b := func(b bool) *bool { return &b }
+	i := func(i int) *int { return &i }
+	testCases := []struct {
+		description  string
+		passwd       *string
+		shadow       *string
+		username     string
+		changes      UserChanges
+		passwdResult string
+		shadowResult string
+		err          error
+	}{
+		{
+			description:  "Change shell, home, and comment",
+			passwd:       s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			shadow:       s("abc:$6$salt$hash:19000:0:99999:7:::\n"),
+			username:     "abc",
+			changes:      UserChanges{Shell: s("/bin/bash"), HomeDir: s("/srv/abc"), Comment: s("A B C")},
+			passwdResult: "abc:x:1000:1000:A B C:/srv/abc:/bin/bash\n",
+			shadowResult: "abc:$6$salt$hash:19000:0:99999:7:::\n",
+		},
+		{
+			description:  "Lock and expire",
+			passwd:       s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			shadow:       s("abc:$6$salt$hash:19000:0:99999:7:::\n"),
+			username:     "abc",
+			changes:      UserChanges{Locked: b(true), Expiration: i(1)},
+			passwdResult: "abc:x:1000:1000:abc:/home/abc:/bin/sh\n",
+			shadowResult: "abc:!$6$salt$hash:19000:0:99999:7::1:\n",
+		},
+		{
+			description:  "Lock already locked",
+			passwd:       s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			shadow:       s("abc:!!:19000:0:99999:7:::\n"),
+			username:     "abc",
+			changes:      UserChanges{Locked: b(true)},
+			passwdResult: "abc:x:1000:1000:abc:/home/abc:/bin/sh\n",
+			shadowResult: "abc:!!:19000:0:99999:7:::\n",
+		},
+		{
+			description:  "Unlock and remove expiration",
+			passwd:       s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			shadow:       s("abc:!$6$salt$hash:19000:0:99999:7::1:\n"),
+			username:     "abc",
+			changes:      UserChanges{Locked: b(false), Expiration: i(-1)},
+			passwdResult: "abc:x:1000:1000:abc:/home/abc:/bin/sh\n",
+			shadowResult: "abc:$6$salt$hash:19000:0:99999:7:::\n",
+		},
+		{
+			description:  "Lock without shadow file",
+			passwd:       s("abc:$6$salt$hash:1000:1000:abc:/home/abc:/bin/sh\n"),
+			username:     "abc",
+			changes:      UserChanges{Locked: b(true)},
+			passwdResult: "abc:!$6$salt$hash:1000:1000:abc:/home/abc:/bin/sh\n",
+		},
+		{
+			description:  "Set password hash",
+			passwd:       s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			shadow:       s("abc:*::0:99999:7:::\n"),
+			username:     "abc",
+			changes:      UserChanges{PasswordHash: s("$6$new$hash")},
+			passwdResult: "abc:x:1000:1000:abc:/home/abc:/bin/sh\n",
+			shadowResult: "abc:$6$new$hash::0:99999:7:::\n",
+		},
+		{
+			description:  "Set password hash and lock without shadow file",
+			passwd:       s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			username:     "abc",
+			changes:      UserChanges{PasswordHash: s("$6$new$hash"), Locked: b(true)},
+			passwdResult: "abc:!$6$new$hash:1000:1000:abc:/home/abc:/bin/sh\n",
+		},
+		{
+			description: "Invalid password hash",
+			passwd:      s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			shadow:      s("abc:*::0:99999:7:::\n"),
+			username:    "abc",
+			changes:     UserChanges{PasswordHash: s("secret")},
+			err:         ErrInvalidPasswordHash,
+		},
+		{
+			description: "Unlock without password",
+			passwd:      s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			shadow:      s("abc:!:19000:0:99999:7:::\n"),
+			username:    "abc",
+			changes:     UserChanges{Locked: b(false)},
+			err:         ErrPasswordless,
+		},
+		{
+			description: "Expire without shadow entry",
+			passwd:      s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			username:    "abc",
+			changes:     UserChanges{Expiration: i(1)},
+			err:         ErrShadowNotFound,
+		},
+		{
+			description: "User not found",
+			passwd:      s("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+			username:    "xyz",
+			changes:     UserChanges{Shell: s("/bin/bash")},
+			err:         ErrUserNotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := loginSetup(tc.passwd, tc.shadow, nil, nil, "")
+			db, err := OpenDatabase(fs, "")
+			require.NoError(t, err)
+
+			err = db.ModifyUser(tc.username, tc.changes)
+			assert.ErrorIs(t, err, tc.err)
+			if tc.err != nil {
+				return
+			}
+			require.NoError(t, db.Commit())
+
+			assert.Equal(t, tc.passwdResult, *loginRead(fs, constants.FileEtcPasswd))
+			if tc.shadow != nil {
+				assert.Equal(t, tc.shadowResult, *loginRead(fs, constants.FileEtcShadow))
+			}
+		})
+	}
+}
+
+func TestAddUserToGroups(t *testing.T) {
+	p := func(s string) *string { return &s }
+	fs := loginSetup(
+		p("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+		nil,
+		p("abc:x:1000:abc\nadm:x:4:\ndocker:x:990:xyz\n"),
+		p("abc:!!::abc\nadm:!::\n"),
+		"",
+	)
+	db, err := OpenDatabase(fs, "")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, db.AddUserToGroups("xyz", "adm"), ErrUserNotFound)
+	assert.ErrorIs(t, db.AddUserToGroups("abc", "adm", "nope"), ErrGroupNotFound)
+
+	require.NoError(t, db.AddUserToGroups("abc", "abc", "adm", "docker"))
+	require.NoError(t, db.Commit())
+
+	assert.Equal(t, "abc:x:1000:abc\nadm:x:4:abc\ndocker:x:990:xyz,abc\n",
+		*loginRead(fs, constants.FileEtcGroup))
+	assert.Equal(t, "abc:!!::abc\nadm:!::abc\n", *loginRead(fs, constants.FileEtcGShadow))
+}
+
+func TestRemoveUser(t *testing.T) {
+	p := func(s string) *string { return &s }
+	fs := loginSetup(
+		p("admin:x:1000:1000:admin:/home/admin:/bin/sh\nabc:x:1001:1001:abc:/home/abc:/bin/sh\n"),
+		p("admin:*::0:99999:7:::\nabc:*::0:99999:7:::\n"),
+		p("wheel:x:10:admin,abc\nadmin:x:1000:admin\nabc:x:1001:abc\n"),
+		p("wheel:::admin,abc\nadmin:!!:admin:admin\nabc:!!::abc\n"),
+		"",
+	)
+	db, err := OpenDatabase(fs, "")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, db.RemoveUser("xyz"), ErrUserNotFound)
+	require.NoError(t, db.RemoveUser("admin"))
+	require.NoError(t, db.Commit())
+
+	assert.Equal(t, "abc:x:1001:1001:abc:/home/abc:/bin/sh\n",
+		*loginRead(fs, constants.FileEtcPasswd))
+	assert.Equal(t, "abc:*::0:99999:7:::\n", *loginRead(fs, constants.FileEtcShadow))
+	assert.Equal(t, "wheel:x:10:abc\nabc:x:1001:abc\n", *loginRead(fs, constants.FileEtcGroup))
+	assert.Equal(t, "wheel:::abc\nabc:!!::abc\n", *loginRead(fs, constants.FileEtcGShadow))
+}
+
+func TestRemoveUserSharedGroup(t *testing.T) {
+	p := func(s string) *string { return &s }
+	fs := loginSetup(
+		p("admin:x:1000:1000:admin:/home/admin:/bin/sh\nabc:x:1001:1000:abc:/home/abc:/bin/sh\n"),
+		nil,
+		p("admin:x:1000:\n"),
+		nil,
+		"",
+	)
+	db, err := OpenDatabase(fs, "")
+	require.NoError(t, err)
+
+	require.NoError(t, db.RemoveUser("admin"))
+
+	// The group is still the primary group of abc.
+	_, ok := db.Group("admin")
+	assert.True(t, ok)
+}
+
+func TestRemoveGroup(t *testing.T) {
+	p := func(s string) *string { return &s }
+	fs := loginSetup(
+		p("abc:x:1000:1000:abc:/home/abc:/bin/sh\n"),
+		nil,
+		p("abc:x:1000:\ndocker:x:990:abc\n"),
+		p("abc:!!::\ndocker:!::abc\n"),
+		"",
+	)
+	db, err := OpenDatabase(fs, "")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, db.RemoveGroup("nope"), ErrGroupNotFound)
+	assert.ErrorIs(t, db.RemoveGroup("abc"), ErrGroupInUse)
+	require.NoError(t, db.RemoveGroup("docker"))
+	require.NoError(t, db.Commit())
+
+	assert.Equal(t, "abc:x:1000:\n", *loginRead(fs, constants.FileEtcGroup))
+	assert.Equal(t, "abc:!!::\n", *loginRead(fs, constants.FileEtcGShadow))
+}
+
+func TestDatabasePreservesVerbatimLines(t *testing.T) {
+	p := func(s string) *string { return &s }
+	passwd := "# local users\nroot:x:0:0:root:/root:/bin/sh\n\n+@admins\n-baduser\n"
+	group := "root:x:0:\n+\n"
+	fs := loginSetup(p(passwd), nil, p(group), nil, "")
+
+	_, err := OpenDatabase(fs, "", WithStrict())
+	assert.Error(t, err)
+
+	db, err := OpenDatabase(fs, "")
+	require.NoError(t, err)
+	assert.Len(t, db.Users(), 1)
+	assert.Len(t, db.Groups(), 1)
+
+	_, ok := db.User("")
+	assert.False(t, ok)
+
+	uid, gid, err := db.AddSystemUser("sshd", "sshd", "/nonexistent")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(UID_GID_MIN_SYS), uid)
+	assert.Equal(t, uint32(UID_GID_MIN_SYS), gid)
+	require.NoError(t, db.Commit())
+
+	assert.Equal(t, passwd+"sshd:x:100:100:sshd:/nonexistent:/bin/false\n",
+		*loginRead(fs, constants.FileEtcPasswd))
+	assert.Equal(t, group+"sshd:x:100:sshd\n", *loginRead(fs, constants.FileEtcGroup))
+}
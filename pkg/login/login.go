@@ -2,10 +2,12 @@ package login
 
 import (
 	"bufio"
+	"cmp"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -19,26 +21,41 @@ var (
 	ErrUsernameExists  = errors.New("username exists")
 	ErrUsernameLength  = errors.New("username must be longer than 0")
 	ErrGroupnameLength = errors.New("group name must be longer than 0")
+	ErrGroupnameExists = errors.New("group name exists")
+	ErrUserNotFound    = errors.New("user not found")
+	ErrGroupNotFound   = errors.New("group not found")
+	ErrGroupInUse      = errors.New("group is the primary group of a user")
+	ErrShadowNotFound  = errors.New("shadow entry not found")
+	ErrPasswordless    = errors.New("unlocking would leave the account without a password")
+	ErrSubIDsExist     = errors.New("subordinate IDs already granted")
+	ErrSubIDCount      = errors.New("subordinate ID count must be greater than 0")
 )
 
 const (
 	UID_GID_MIN            = 1000
-	UID_GID_MAX     uint16 = 1<<15 - 1
+	UID_GID_MAX     uint32 = 1<<15 - 1
 	UID_GID_MIN_SYS        = 100
 	UID_GID_MAX_SYS        = 999
+	SUB_ID_MIN             = 100000
+	SUB_ID_MAX      uint32 = 600100000
+	SUB_ID_COUNT           = 65536
 )
 
 type PasswdEntry struct {
 	Username string
 	Password string
-	UID      uint16
-	GID      uint16
+	UID      uint32
+	GID      uint32
 	Comment  string
 	HomeDir  string
 	Shell    string
+	verbatim *string
 }
 
 func (p PasswdEntry) String() string {
+	if p.verbatim != nil {
+		return *p.verbatim
+	}
 	return fmt.Sprintf("%s:%s:%d:%d:%s:%s:%s",
 		p.Username, p.Password, p.UID, p.GID, p.Comment, p.HomeDir, p.Shell)
 }
@@ -46,12 +63,15 @@ func (p PasswdEntry) String() string {
 type GroupEntry struct {
 	Groupname string
 	Password  string
-	GID       uint16
+	GID       uint32
 	Users     []string
-	index     int
+	verbatim  *string
 }
 
 func (g *GroupEntry) String() string {
+	if g.verbatim != nil {
+		return *g.verbatim
+	}
 	return fmt.Sprintf("%s:%s:%d:%s",
 		g.Groupname, g.Password, g.GID, strings.Join(g.Users, ","))
 }
@@ -66,10 +86,13 @@ type ShadowEntry struct {
 	InactivityPeriod int
 	Expiration       int
 	Unused           string
+	verbatim         *string
 }
 
 func (s ShadowEntry) String() string {
-	syscall.Getpid()
+	if s.verbatim != nil {
+		return *s.verbatim
+	}
 	inactivityPeriod := ""
 	if s.InactivityPeriod >= 0 {
 		inactivityPeriod = strconv.Itoa(s.InactivityPeriod)
@@ -104,42 +127,102 @@ type GShadowEntry struct {
 	Password  string
 	Admins    []string
 	Users     []string
-	index     int
+	verbatim  *string
 }
 
 func (g GShadowEntry) String() string {
+	if g.verbatim != nil {
+		return *g.verbatim
+	}
 	return fmt.Sprintf("%s:%s:%s:%s",
 		g.Groupname, g.Password, strings.Join(g.Admins, ","), strings.Join(g.Users, ","))
 }
 
-func ParsePasswd(fs afero.Fs, passwdFile string) (map[uint16]*PasswdEntry, map[string]*PasswdEntry, []*PasswdEntry, error) {
+// SubIDEntry is a range of subordinate IDs in a subuid or subgid file. Name is
+// usually a username, but may also be a UID.
+type SubIDEntry struct {
+	Name     string
+	Start    uint32
+	Count    uint32
+	verbatim *string
+}
+
+func (s SubIDEntry) String() string {
+	if s.verbatim != nil {
+		return *s.verbatim
+	}
+	return fmt.Sprintf("%s:%d:%d", s.Name, s.Start, s.Count)
+}
+
+type ParseOpt func(*parseConfig)
+
+type parseConfig struct {
+	strict bool
+}
+
+// WithStrict makes parsing fail on comments, blank lines, and NIS compat lines
+// beginning with + or -, instead of preserving them.
+func WithStrict() ParseOpt {
+	return func(c *parseConfig) {
+		c.strict = true
+	}
+}
+
+func newParseConfig(opts []ParseOpt) *parseConfig {
+	cfg := &parseConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// isVerbatim returns true if line is not an entry and should be kept as it is.
+func (c *parseConfig) isVerbatim(line string) bool {
+	if c.strict {
+		return false
+	}
+	trimmed := strings.TrimSpace(line)
+	return len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") ||
+		strings.HasPrefix(trimmed, "+") || strings.HasPrefix(trimmed, "-")
+}
+
+// ParsePasswd parses a passwd file. Comments, blank lines, and NIS compat lines
+// are not entries and are left out of the maps, but are kept in the list so
+// they are preserved when the list is written back.
+func ParsePasswd(fs afero.Fs, passwdFile string, opts ...ParseOpt) (map[uint32]*PasswdEntry, map[string]*PasswdEntry, []*PasswdEntry, error) {
 	f, err := fs.Open(passwdFile)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("unable to open %s: %w", passwdFile, err)
 	}
 	defer f.Close()
 
-	entryMapUID := make(map[uint16]*PasswdEntry)
+	entryMapUID := make(map[uint32]*PasswdEntry)
 	entryMapName := make(map[string]*PasswdEntry)
 	entryList := []*PasswdEntry{}
 
+	cfg := newParseConfig(opts)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		if cfg.isVerbatim(line) {
+			entryList = append(entryList, &PasswdEntry{verbatim: &line})
+			continue
+		}
+
 		fields := strings.Split(line, ":")
 		if len(fields) != 7 {
 			return nil, nil, nil, fmt.Errorf("unexpected number of fields in %s: %d",
 				passwdFile, len(fields))
 		}
 
-		uid, err := strconv.ParseUint(fields[2], 10, 16)
+		uid, err := strconv.ParseUint(fields[2], 10, 32)
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("error parsing third field of line in %s: %w",
 				passwdFile, err)
 		}
 
-		gid, err := strconv.ParseUint(fields[3], 10, 16)
+		gid, err := strconv.ParseUint(fields[3], 10, 32)
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("error parsing fourth field of line in %s: %w",
 				passwdFile, err)
@@ -148,13 +231,13 @@ func ParsePasswd(fs afero.Fs, passwdFile string) (map[uint16]*PasswdEntry, map[s
 		pwent := &PasswdEntry{
 			Username: fields[0],
 			Password: fields[1],
-			UID:      uint16(uid),
-			GID:      uint16(gid),
+			UID:      uint32(uid),
+			GID:      uint32(gid),
 			Comment:  fields[4],
 			HomeDir:  fields[5],
 			Shell:    fields[6],
 		}
-		entryMapUID[uint16(uid)] = pwent
+		entryMapUID[uint32(uid)] = pwent
 		entryMapName[pwent.Username] = pwent
 		entryList = append(entryList, pwent)
 	}
@@ -166,29 +249,36 @@ func ParsePasswd(fs afero.Fs, passwdFile string) (map[uint16]*PasswdEntry, map[s
 	return entryMapUID, entryMapName, entryList, nil
 }
 
-func ParseGroup(fs afero.Fs, groupFile string) (map[uint16]*GroupEntry, map[string]*GroupEntry, []*GroupEntry, error) {
+// ParseGroup parses a group file, keeping lines that are not entries in the
+// list as ParsePasswd does.
+func ParseGroup(fs afero.Fs, groupFile string, opts ...ParseOpt) (map[uint32]*GroupEntry, map[string]*GroupEntry, []*GroupEntry, error) {
 	f, err := fs.Open(groupFile)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("unable to open %s: %w", groupFile, err)
 	}
 	defer f.Close()
 
-	entryMapGID := make(map[uint16]*GroupEntry)
+	entryMapGID := make(map[uint32]*GroupEntry)
 	entryMapName := make(map[string]*GroupEntry)
 	entryList := []*GroupEntry{}
 
-	i := 0
+	cfg := newParseConfig(opts)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		if cfg.isVerbatim(line) {
+			entryList = append(entryList, &GroupEntry{verbatim: &line})
+			continue
+		}
+
 		fields := strings.Split(line, ":")
 		if len(fields) != 4 {
 			return nil, nil, nil, fmt.Errorf("unexpected number of fields in %s: %d",
 				groupFile, len(fields))
 		}
 
-		gid, err := strconv.ParseUint(fields[2], 10, 16)
+		gid, err := strconv.ParseUint(fields[2], 10, 32)
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("error parsing third field of line in %s: %w",
 				groupFile, err)
@@ -197,14 +287,12 @@ func ParseGroup(fs afero.Fs, groupFile string) (map[uint16]*GroupEntry, map[stri
 		groupEntry := &GroupEntry{
 			Groupname: fields[0],
 			Password:  fields[1],
-			GID:       uint16(gid),
+			GID:       uint32(gid),
 			Users:     nonEmptyStrings(strings.Split(fields[3], ",")),
-			index:     i,
 		}
-		entryMapGID[uint16(gid)] = groupEntry
+		entryMapGID[uint32(gid)] = groupEntry
 		entryMapName[groupEntry.Groupname] = groupEntry
 		entryList = append(entryList, groupEntry)
-		i++
 	}
 
 	if err = scanner.Err(); err != nil {
@@ -214,7 +302,9 @@ func ParseGroup(fs afero.Fs, groupFile string) (map[uint16]*GroupEntry, map[stri
 	return entryMapGID, entryMapName, entryList, nil
 }
 
-func ParseShadow(fs afero.Fs, shadowFile string) (map[string]*ShadowEntry, []*ShadowEntry, error) {
+// ParseShadow parses a shadow file, keeping lines that are not entries in the
+// list as ParsePasswd does.
+func ParseShadow(fs afero.Fs, shadowFile string, opts ...ParseOpt) (map[string]*ShadowEntry, []*ShadowEntry, error) {
 	f, err := fs.Open(shadowFile)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to open %s: %w", shadowFile, err)
@@ -224,10 +314,16 @@ func ParseShadow(fs afero.Fs, shadowFile string) (map[string]*ShadowEntry, []*Sh
 	entryMap := make(map[string]*ShadowEntry)
 	entryList := []*ShadowEntry{}
 
+	cfg := newParseConfig(opts)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		if cfg.isVerbatim(line) {
+			entryList = append(entryList, &ShadowEntry{verbatim: &line})
+			continue
+		}
+
 		fields := strings.Split(line, ":")
 		if len(fields) != 9 {
 			return nil, nil, fmt.Errorf("unexpected number of fields in %s: %d",
@@ -311,7 +407,9 @@ func ParseShadow(fs afero.Fs, shadowFile string) (map[string]*ShadowEntry, []*Sh
 	return entryMap, entryList, nil
 }
 
-func ParseGShadow(fs afero.Fs, shadowFile string) (map[string]*GShadowEntry, []*GShadowEntry, error) {
+// ParseGShadow parses a gshadow file, keeping lines that are not entries in the
+// list as ParsePasswd does.
+func ParseGShadow(fs afero.Fs, shadowFile string, opts ...ParseOpt) (map[string]*GShadowEntry, []*GShadowEntry, error) {
 	f, err := fs.Open(shadowFile)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to open %s: %w", shadowFile, err)
@@ -321,11 +419,16 @@ func ParseGShadow(fs afero.Fs, shadowFile string) (map[string]*GShadowEntry, []*
 	entryMap := make(map[string]*GShadowEntry)
 	entryList := []*GShadowEntry{}
 
-	i := 0
+	cfg := newParseConfig(opts)
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
 
+		if cfg.isVerbatim(line) {
+			entryList = append(entryList, &GShadowEntry{verbatim: &line})
+			continue
+		}
+
 		fields := strings.Split(line, ":")
 		if len(fields) != 4 {
 			return nil, nil, fmt.Errorf("unexpected number of fields in %s: %d",
@@ -338,11 +441,9 @@ func ParseGShadow(fs afero.Fs, shadowFile string) (map[string]*GShadowEntry, []*
 			Password:  fields[1],
 			Admins:    nonEmptyStrings(strings.Split(fields[2], ",")),
 			Users:     nonEmptyStrings(strings.Split(fields[3], ",")),
-			index:     i,
 		}
 		entryMap[groupname] = entry
 		entryList = append(entryList, entry)
-		i++
 	}
 
 	if err = scanner.Err(); err != nil {
@@ -352,7 +453,95 @@ func ParseGShadow(fs afero.Fs, shadowFile string) (map[string]*GShadowEntry, []*
 	return entryMap, entryList, nil
 }
 
-func nextID[T any](entries map[uint16]T, min, max uint16) (uint16, error) {
+// ParseSubID parses a subuid or subgid file, keeping lines that are not entries
+// in the list as ParsePasswd does.
+func ParseSubID(fs afero.Fs, subIDFile string, opts ...ParseOpt) ([]*SubIDEntry, error) {
+	f, err := fs.Open(subIDFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", subIDFile, err)
+	}
+	defer f.Close()
+
+	entryList := []*SubIDEntry{}
+
+	cfg := newParseConfig(opts)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if cfg.isVerbatim(line) {
+			entryList = append(entryList, &SubIDEntry{verbatim: &line})
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected number of fields in %s: %d",
+				subIDFile, len(fields))
+		}
+
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse start %s in %s: %w",
+				fields[1], subIDFile, err)
+		}
+
+		count, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse count %s in %s: %w",
+				fields[2], subIDFile, err)
+		}
+
+		entryList = append(entryList, &SubIDEntry{
+			Name:  fields[0],
+			Start: uint32(start),
+			Count: uint32(count),
+		})
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", subIDFile, err)
+	}
+
+	return entryList, nil
+}
+
+// nextSubIDRange returns the lowest start of a range of count IDs between min
+// and max that does not overlap any of the ranges in entries.
+func nextSubIDRange(entries []*SubIDEntry, count, min, max uint32) (uint32, error) {
+	if count == 0 {
+		return 0, ErrSubIDCount
+	}
+
+	ranges := []*SubIDEntry{}
+	for _, entry := range entries {
+		if entry.verbatim == nil && entry.Count > 0 {
+			ranges = append(ranges, entry)
+		}
+	}
+	slices.SortFunc(ranges, func(a, b *SubIDEntry) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	start := uint64(min)
+	for _, r := range ranges {
+		end := uint64(r.Start) + uint64(r.Count)
+		if end <= start {
+			continue
+		}
+		if uint64(r.Start) >= start+uint64(count) {
+			break
+		}
+		start = end
+	}
+
+	if start+uint64(count)-1 > uint64(max) {
+		return 0, ErrNoAvailableIDs
+	}
+	return uint32(start), nil
+}
+
+func nextID[T any](entries map[uint32]T, min, max uint32) (uint32, error) {
 	id := min
 	for {
 		if _, ok := entries[id]; !ok {
@@ -385,38 +574,7 @@ func fileExists(fs afero.Fs, path string) (bool, error) {
 	return true, nil
 }
 
-func writeLines[T fmt.Stringer](fs afero.Fs, path string, lines []T, mode os.FileMode) error {
-	oldmask := syscall.Umask(0)
-	defer syscall.Umask(oldmask)
-
-	tmpPath := path + "+"
-	tf, err := fs.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, mode)
-	if err != nil {
-		return fmt.Errorf("unable to open %s: %w", tmpPath, err)
-	}
-	// File will normally be closed earlier if there are no errors.
-	defer tf.Close()
-
-	for _, line := range lines {
-		if _, err = tf.WriteString(fmt.Sprintf("%s\n", line)); err != nil {
-			return fmt.Errorf("unable to write to %s: %w", tmpPath, err)
-		}
-
-	}
-
-	if err = tf.Close(); err != nil {
-		return fmt.Errorf("unable to close %s: %w", tmpPath, err)
-	}
-
-	err = fs.Rename(tmpPath, path)
-	if err != nil {
-		return fmt.Errorf("unable to rename %s to %s: %w", tmpPath, path, err)
-	}
-
-	return nil
-}
-
-func createHomeDir(fs afero.Fs, homeDir string, uid, gid uint16) error {
+func createHomeDir(fs afero.Fs, homeDir string, uid, gid uint32) error {
 	oldmask := syscall.Umask(0)
 	defer syscall.Umask(oldmask)
 
@@ -442,266 +600,131 @@ func createHomeDir(fs afero.Fs, homeDir string, uid, gid uint16) error {
 	return nil
 }
 
-// AddSystemUser adds a system user with no password or valid shell.
-func AddSystemUser(fs afero.Fs, username, groupname, homeDir, baseDir string) (uint16, uint16, error) {
-	return AddUser(fs, username, groupname, homeDir, "/bin/false", baseDir, UID_GID_MIN_SYS,
-		UID_GID_MAX_SYS, false, false, true)
+// AddSystemUser adds a system user with no password or valid shell. IDs are
+// allocated from the system ranges in login.defs under baseDir, if it exists.
+func AddSystemUser(fs afero.Fs, username, groupname, homeDir, baseDir string) (uint32, uint32, error) {
+	return addWithDatabase(fs, baseDir, func(db *Database) (uint32, uint32, error) {
+		return db.AddSystemUser(username, groupname, homeDir)
+	})
 }
 
 // AddLoginUser adds a user that can log in with a valid shell and home directory.
-func AddLoginUser(fs afero.Fs, username, groupname, homeDir, shell, baseDir string) (uint16, uint16, error) {
-	return AddUser(fs, username, groupname, homeDir, shell, baseDir, UID_GID_MIN, UID_GID_MAX,
-		true, true, false)
+// IDs are allocated from the ranges in login.defs under baseDir, if it exists.
+func AddLoginUser(fs afero.Fs, username, groupname, homeDir, shell, baseDir string,
+	opts ...UserOpt) (uint32, uint32, error) {
+	return addWithDatabase(fs, baseDir, func(db *Database) (uint32, uint32, error) {
+		return db.AddLoginUser(username, groupname, homeDir, shell, opts...)
+	})
 }
 
 // AddRootUser adds the root user.
-func AddRootUser(fs afero.Fs, shell, baseDir string) (uint16, uint16, error) {
+func AddRootUser(fs afero.Fs, shell, baseDir string) (uint32, uint32, error) {
 	homeDir := filepath.Join(constants.DirETRoot, "/root")
 	return AddUser(fs, "root", "root", homeDir, shell, baseDir, 0, 0, true, false, false)
 }
 
-// AddUser adds a user to the system.
+// AddUser adds a user to the system. It opens a Database under baseDir, adds
+// the user, and commits the changes.
 func AddUser(fs afero.Fs, username, groupname, homeDir, shell, baseDir string,
-	idMin, idMax uint16, createHome, isLoginUser, locked bool) (uint16, uint16, error) {
-	var (
-		createShadowEntry  = true
-		createGroupEntry   = true
-		createGShadowEntry = true
-		modifiedGroup      = false
-		modifiedShadow     = false
-		modifiedGShadow    = false
-		passwdByUID        map[uint16]*PasswdEntry
-		passwdByName       map[string]*PasswdEntry
-		passwdList         []*PasswdEntry
-		shadowByName       map[string]*ShadowEntry
-		shadowList         []*ShadowEntry
-		groupByGID         map[uint16]*GroupEntry
-		groupByName        map[string]*GroupEntry
-		groupList          []*GroupEntry
-		gShadowByName      map[string]*GShadowEntry
-		gShadowList        []*GShadowEntry
-		uid                uint16 = idMin
-		gid                uint16 = idMin
-		idStartWheel       uint16 = 10
-	)
-
-	if len(username) == 0 {
-		return 0, 0, ErrUsernameLength
-	}
-
-	if len(groupname) == 0 {
-		return 0, 0, ErrGroupnameLength
-	}
-
-	fileEtcPasswd := filepath.Join(baseDir, constants.FileEtcPasswd)
-	fileEtcGroup := filepath.Join(baseDir, constants.FileEtcGroup)
-	fileEtcShadow := filepath.Join(baseDir, constants.FileEtcShadow)
-	fileEtcGShadow := filepath.Join(baseDir, constants.FileEtcGShadow)
+	idMin, idMax uint32, createHome, isLoginUser, locked bool) (uint32, uint32, error) {
+	return addWithDatabase(fs, baseDir, func(db *Database) (uint32, uint32, error) {
+		return db.AddUser(username, groupname, homeDir, shell, idMin, idMax,
+			createHome, isLoginUser, locked)
+	})
+}
 
-	passwdFileExists, err := fileExists(fs, fileEtcPasswd)
+func addWithDatabase(fs afero.Fs, baseDir string,
+	add func(*Database) (uint32, uint32, error)) (uint32, uint32, error) {
+	db, err := OpenDatabase(fs, baseDir)
 	if err != nil {
 		return 0, 0, err
 	}
-	groupFileExists, err := fileExists(fs, fileEtcGroup)
-	if err != nil {
-		return 0, 0, err
-	}
-	shadowFileExists, err := fileExists(fs, fileEtcShadow)
-	if err != nil {
-		return 0, 0, err
-	}
-	gShadowFileExists, err := fileExists(fs, fileEtcGShadow)
+
+	uid, gid, err := add(db)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	if passwdFileExists {
-		passwdByUID, passwdByName, passwdList, err = ParsePasswd(fs, fileEtcPasswd)
-		if err != nil {
-			return 0, 0, err
-		}
-
-		if _, ok := passwdByName[username]; ok {
-			return 0, 0, ErrUsernameExists
-		} else {
-			uid, err = nextID(passwdByUID, uid, idMax)
-			if err != nil {
-				return 0, 0, err
-			}
-		}
-
-		if !shadowFileExists {
-			createShadowEntry = false
-		} else {
-			shadowByName, shadowList, err = ParseShadow(fs, fileEtcShadow)
-			if err != nil {
-				return 0, 0, err
-			}
-			if _, ok := shadowByName[username]; ok {
-				createShadowEntry = false
-			}
-		}
+	if err = db.Commit(); err != nil {
+		return 0, 0, err
 	}
 
-	if groupFileExists {
-		groupByGID, groupByName, groupList, err = ParseGroup(fs, fileEtcGroup)
-		if err != nil {
-			return 0, 0, err
-		}
-
-		if _, ok := groupByName[groupname]; ok {
-			createGroupEntry = false
-		} else {
-			gid, err = nextID(groupByGID, gid, idMax)
-			if err != nil {
-				return 0, 0, err
-			}
-		}
+	return uid, gid, nil
+}
 
-		if !gShadowFileExists {
-			createGShadowEntry = false
-		} else {
-			gShadowByName, gShadowList, err = ParseGShadow(fs, fileEtcGShadow)
-			if err != nil {
-				return 0, 0, err
-			}
-			if _, ok := gShadowByName[groupname]; ok {
-				createGShadowEntry = false
-			}
-		}
+// ResolveUser resolves a user specification in the form of a container image's
+// USER, which may be `user` or `user:group` with either names or numeric IDs,
+// to numeric IDs using the passwd and group files under baseDir. When no group
+// is given, the user's primary group is used, or 0 if a numeric user has no
+// passwd entry. Names that cannot be found result in an error.
+func ResolveUser(fs afero.Fs, userSpec, baseDir string) (uint32, uint32, error) {
+	user, group, hasGroup := strings.Cut(userSpec, ":")
+	if len(user) == 0 {
+		return 0, 0, ErrUsernameLength
 	}
-
-	if isLoginUser {
-		wheelGroup, ok := groupByName[constants.GroupNameWheel]
-		if ok {
-			i := wheelGroup.index
-			if !hasEntry(groupList[i].Users, username) {
-				groupList[i].Users = append(groupList[i].Users, username)
-				modifiedGroup = true
-			}
-		} else {
-			wheelGID, err := nextID(groupByGID, idStartWheel, UID_GID_MAX_SYS)
-			if err != nil {
-				return 0, 0, fmt.Errorf("unable to get next GID for %s: %w",
-					constants.GroupNameWheel, err)
-			}
-			wheelGroup = &GroupEntry{
-				Groupname: constants.GroupNameWheel,
-				Password:  "x",
-				GID:       wheelGID,
-				Users:     []string{username},
-			}
-			groupList = append(groupList, wheelGroup)
-			modifiedGroup = true
-		}
-
-		if createGShadowEntry {
-			wheelGShadow, ok := gShadowByName[constants.GroupNameWheel]
-			if ok {
-				i := wheelGShadow.index
-				if !hasEntry(gShadowList[i].Users, username) {
-					gShadowList[i].Users = append(gShadowList[i].Users, username)
-					modifiedGShadow = true
-				}
-			} else {
-				wheelGShadow = &GShadowEntry{
-					Groupname: constants.GroupNameWheel,
-					Users:     []string{username},
-				}
-				gShadowList = append(gShadowList, wheelGShadow)
-				modifiedGShadow = true
-			}
-		}
+	if hasGroup && len(group) == 0 {
+		return 0, 0, ErrGroupnameLength
 	}
 
-	passwdEntry := &PasswdEntry{
-		Username: username,
-		Password: "x",
-		UID:      uid,
-		GID:      gid,
-		Comment:  username,
-		HomeDir:  homeDir,
-		Shell:    shell,
-	}
-	passwdList = append(passwdList, passwdEntry)
+	var (
+		uid          uint32
+		gid          uint32
+		passwdByUID  map[uint32]*PasswdEntry
+		passwdByName map[string]*PasswdEntry
+	)
 
-	err = writeLines(fs, fileEtcPasswd, passwdList, constants.ModeEtcPasswd)
+	fileEtcPasswd := filepath.Join(baseDir, constants.FileEtcPasswd)
+	passwdFileExists, err := fileExists(fs, fileEtcPasswd)
 	if err != nil {
 		return 0, 0, err
 	}
-
-	if createGroupEntry {
-		groupEntry := &GroupEntry{
-			Groupname: groupname,
-			Password:  "x",
-			GID:       gid,
-			Users:     []string{username},
+	if passwdFileExists {
+		passwdByUID, passwdByName, _, err = ParsePasswd(fs, fileEtcPasswd)
+		if err != nil {
+			return 0, 0, err
 		}
-		groupList = append(groupList, groupEntry)
-		modifiedGroup = true
 	}
 
-	if createShadowEntry {
-		shadowEntry := &ShadowEntry{
-			Username:         username,
-			Password:         "*",
-			LastChange:       0,
-			MinAge:           0,
-			MaxAge:           99999,
-			WarningPeriod:    7,
-			InactivityPeriod: -1,
-			Expiration:       -1,
-		}
-		if isLoginUser {
-			shadowEntry.LastChange = -1
+	if id, err := strconv.ParseUint(user, 10, 32); err == nil {
+		uid = uint32(id)
+		if entry, ok := passwdByUID[uid]; ok {
+			gid = entry.GID
 		}
-		if locked {
-			shadowEntry.Password = "!!"
+	} else {
+		entry, ok := passwdByName[user]
+		if !ok {
+			return 0, 0, fmt.Errorf("%w: %s", ErrUserNotFound, user)
 		}
-		shadowList = append(shadowList, shadowEntry)
-		modifiedShadow = true
+		uid = entry.UID
+		gid = entry.GID
 	}
 
-	if createGShadowEntry {
-		gShadowEntry := &GShadowEntry{
-			Groupname: groupname,
-			Password:  "!!",
-			Admins:    []string{},
-			Users:     []string{username},
-		}
-		gShadowList = append(gShadowList, gShadowEntry)
-		modifiedGShadow = true
+	if !hasGroup {
+		return uid, gid, nil
 	}
 
-	if modifiedGroup {
-		err := writeLines(fs, fileEtcGroup, groupList, constants.ModeEtcGroup)
-		if err != nil {
-			return 0, 0, err
-		}
+	if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+		return uid, uint32(id), nil
 	}
 
-	if modifiedShadow {
-		err := writeLines(fs, fileEtcShadow, shadowList, constants.ModeEtcShadow)
-		if err != nil {
-			return 0, 0, err
-		}
+	fileEtcGroup := filepath.Join(baseDir, constants.FileEtcGroup)
+	groupFileExists, err := fileExists(fs, fileEtcGroup)
+	if err != nil {
+		return 0, 0, err
 	}
-
-	if modifiedGShadow {
-		err := writeLines(fs, fileEtcGShadow, gShadowList, constants.ModeEtcGShadow)
-		if err != nil {
-			return 0, 0, err
-		}
+	if !groupFileExists {
+		return 0, 0, fmt.Errorf("%w: %s", ErrGroupNotFound, group)
 	}
-
-	if createHome {
-		err := createHomeDir(fs, filepath.Join(baseDir, homeDir), uid, gid)
-		if err != nil {
-			return 0, 0, err
-		}
+	_, groupByName, _, err := ParseGroup(fs, fileEtcGroup)
+	if err != nil {
+		return 0, 0, err
+	}
+	entry, ok := groupByName[group]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: %s", ErrGroupNotFound, group)
 	}
 
-	return uid, gid, nil
+	return uid, entry.GID, nil
 }
 
 func hasEntry(entries []string, entry string) bool {
@@ -1,6 +1,7 @@
 package login
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -484,7 +485,7 @@ func TestParsePasswd(t *testing.T) {
 		description string
 		content     string
 		wantErr     bool
-		wantUIDs    []uint16
+		wantUIDs    []uint32
 		wantNames   []string
 	}{
 		{
@@ -494,7 +495,7 @@ bin:x:1:1:bin:/bin:/sbin/nologin
 daemon:x:2:2:daemon:/sbin:/sbin/nologin
 `,
 			wantErr:   false,
-			wantUIDs:  []uint16{0, 1, 2},
+			wantUIDs:  []uint32{0, 1, 2},
 			wantNames: []string{"root", "bin", "daemon"},
 		},
 		{
@@ -516,12 +517,21 @@ daemon:x:2:2:daemon:/sbin:/sbin/nologin
 			description: "Empty file",
 			content:     "",
 			wantErr:     false,
-			wantUIDs:    []uint16{},
+			wantUIDs:    []uint32{},
 			wantNames:   []string{},
 		},
+		{
+			description: "IDs above 16 bits",
+			content: `nobody:x:4294967294:4294967294:nobody:/:/sbin/nologin
+ldap:x:70000:70000:ldap:/home/ldap:/bin/sh
+`,
+			wantErr:   false,
+			wantUIDs:  []uint32{4294967294, 70000},
+			wantNames: []string{"nobody", "ldap"},
+		},
 		{
 			description: "UID overflow",
-			content:     "test:x:70000:0:test:/:/bin/sh\n",
+			content:     "test:x:4294967296:0:test:/:/bin/sh\n",
 			wantErr:     true,
 		},
 	}
@@ -564,7 +574,7 @@ func TestParseGroup(t *testing.T) {
 		description string
 		content     string
 		wantErr     bool
-		wantGIDs    []uint16
+		wantGIDs    []uint32
 		wantNames   []string
 	}{
 		{
@@ -574,7 +584,7 @@ bin:x:1:root,bin,daemon
 wheel:x:10:alice,bob
 `,
 			wantErr:   false,
-			wantGIDs:  []uint16{0, 1, 10},
+			wantGIDs:  []uint32{0, 1, 10},
 			wantNames: []string{"root", "bin", "wheel"},
 		},
 		{
@@ -591,14 +601,26 @@ wheel:x:10:alice,bob
 			description: "Empty users list",
 			content:     "root:x:0:\n",
 			wantErr:     false,
-			wantGIDs:    []uint16{0},
+			wantGIDs:    []uint32{0},
 			wantNames:   []string{"root"},
 		},
+		{
+			description: "GID above 16 bits",
+			content:     "nogroup:x:4294967294:\n",
+			wantErr:     false,
+			wantGIDs:    []uint32{4294967294},
+			wantNames:   []string{"nogroup"},
+		},
+		{
+			description: "GID overflow",
+			content:     "big:x:4294967296:\n",
+			wantErr:     true,
+		},
 		{
 			description: "Multiple users",
 			content:     "wheel:x:10:alice,bob,charlie\n",
 			wantErr:     false,
-			wantGIDs:    []uint16{10},
+			wantGIDs:    []uint32{10},
 			wantNames:   []string{"wheel"},
 		},
 	}
@@ -788,6 +810,100 @@ func TestParseGShadowFileNotFound(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestParseVerbatimLines(t *testing.T) {
+	parsers := []struct {
+		description string
+		entry       string
+		parse       func(fs afero.Fs, path string, opts ...ParseOpt) ([]fmt.Stringer, int, error)
+	}{
+		{
+			description: "passwd",
+			entry:       "root:x:0:0:root:/root:/bin/sh",
+			parse: func(fs afero.Fs, path string, opts ...ParseOpt) ([]fmt.Stringer, int, error) {
+				_, byName, list, err := ParsePasswd(fs, path, opts...)
+				return stringers(list), len(byName), err
+			},
+		},
+		{
+			description: "group",
+			entry:       "root:x:0:",
+			parse: func(fs afero.Fs, path string, opts ...ParseOpt) ([]fmt.Stringer, int, error) {
+				_, byName, list, err := ParseGroup(fs, path, opts...)
+				return stringers(list), len(byName), err
+			},
+		},
+		{
+			description: "shadow",
+			entry:       "root:*:19000:0:99999:7:::",
+			parse: func(fs afero.Fs, path string, opts ...ParseOpt) ([]fmt.Stringer, int, error) {
+				byName, list, err := ParseShadow(fs, path, opts...)
+				return stringers(list), len(byName), err
+			},
+		},
+		{
+			description: "gshadow",
+			entry:       "root:::",
+			parse: func(fs afero.Fs, path string, opts ...ParseOpt) ([]fmt.Stringer, int, error) {
+				byName, list, err := ParseGShadow(fs, path, opts...)
+				return stringers(list), len(byName), err
+			},
+		},
+		{
+			description: "subid",
+			entry:       "root:100000:65536",
+			parse: func(fs afero.Fs, path string, opts ...ParseOpt) ([]fmt.Stringer, int, error) {
+				list, err := ParseSubID(fs, path, opts...)
+				entries := 0
+				for _, entry := range list {
+					if !entry.isVerbatim() {
+						entries++
+					}
+				}
+				return stringers(list), entries, err
+			},
+		},
+	}
+	lines := []struct {
+		description string
+		line        string
+	}{
+		{description: "Comment", line: "# managed by hand"},
+		{description: "Indented comment", line: "  #comment"},
+		{description: "Blank line", line: ""},
+		{description: "Whitespace line", line: " \t"},
+		{description: "NIS include all", line: "+"},
+		{description: "NIS include netgroup", line: "+@admins"},
+		{description: "NIS exclude user", line: "-baduser"},
+	}
+	for _, p := range parsers {
+		for _, l := range lines {
+			t.Run(p.description+" "+l.description, func(t *testing.T) {
+				fs := afero.NewMemMapFs()
+				content := l.line + "\n" + p.entry + "\n"
+				afero.WriteFile(fs, "/etc/file", []byte(content), 0644)
+
+				list, entries, err := p.parse(fs, "/etc/file")
+				assert.NoError(t, err)
+				assert.Equal(t, 1, entries)
+				assert.Len(t, list, 2)
+				assert.Equal(t, l.line, list[0].String())
+				assert.Equal(t, p.entry, list[1].String())
+
+				_, _, err = p.parse(fs, "/etc/file", WithStrict())
+				assert.Error(t, err)
+			})
+		}
+	}
+}
+
+func stringers[T fmt.Stringer](list []T) []fmt.Stringer {
+	result := make([]fmt.Stringer, len(list))
+	for i, item := range list {
+		result[i] = item
+	}
+	return result
+}
+
 // Test String() methods
 
 func TestPasswdEntryString(t *testing.T) {
@@ -899,6 +1015,89 @@ func TestShadowEntryString(t *testing.T) {
 	}
 }
 
+func TestParseSubID(t *testing.T) {
+	testCases := []struct {
+		description string
+		content     string
+		wantErr     bool
+		wantEntries []SubIDEntry
+	}{
+		{
+			description: "Valid subid file",
+			content:     "alice:100000:65536\nbob:165536:65536\n1002:231072:1000\n",
+			wantEntries: []SubIDEntry{
+				{Name: "alice", Start: 100000, Count: 65536},
+				{Name: "bob", Start: 165536, Count: 65536},
+				{Name: "1002", Start: 231072, Count: 1000},
+			},
+		},
+		{
+			description: "Top of 32 bit range",
+			content:     "alice:4294901760:65535\n",
+			wantEntries: []SubIDEntry{
+				{Name: "alice", Start: 4294901760, Count: 65535},
+			},
+		},
+		{
+			description: "Empty file",
+			content:     "",
+			wantEntries: []SubIDEntry{},
+		},
+		{
+			description: "Invalid field count",
+			content:     "alice:100000\n",
+			wantErr:     true,
+		},
+		{
+			description: "Invalid start",
+			content:     "alice:abc:65536\n",
+			wantErr:     true,
+		},
+		{
+			description: "Invalid count",
+			content:     "alice:100000:-1\n",
+			wantErr:     true,
+		},
+		{
+			description: "Start out of range",
+			content:     "alice:4294967296:1\n",
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			subIDFile := "/etc/subuid"
+			afero.WriteFile(fs, subIDFile, []byte(tc.content), 0644)
+
+			list, err := ParseSubID(fs, subIDFile)
+
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				entries := []SubIDEntry{}
+				for _, entry := range list {
+					entries = append(entries, *entry)
+				}
+				assert.Equal(t, tc.wantEntries, entries)
+			}
+		})
+	}
+}
+
+func TestParseSubIDFileNotFound(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	_, err := ParseSubID(fs, "/nonexistent")
+	assert.Error(t, err)
+}
+
+func TestSubIDEntryString(t *testing.T) {
+	entry := SubIDEntry{Name: "alice", Start: 100000, Count: 65536}
+	assert.Equal(t, "alice:100000:65536", entry.String())
+}
+
 func TestGShadowEntryString(t *testing.T) {
 	testCases := []struct {
 		description string
@@ -939,15 +1138,15 @@ func TestGShadowEntryString(t *testing.T) {
 func TestNextID(t *testing.T) {
 	testCases := []struct {
 		description string
-		entries     map[uint16]string
-		min         uint16
-		max         uint16
-		wantID      uint16
+		entries     map[uint32]string
+		min         uint32
+		max         uint32
+		wantID      uint32
 		wantErr     error
 	}{
 		{
 			description: "Find first available ID",
-			entries:     map[uint16]string{},
+			entries:     map[uint32]string{},
 			min:         100,
 			max:         105,
 			wantID:      100,
@@ -955,7 +1154,7 @@ func TestNextID(t *testing.T) {
 		},
 		{
 			description: "Skip used IDs",
-			entries: map[uint16]string{
+			entries: map[uint32]string{
 				100: "used",
 				101: "used",
 			},
@@ -966,7 +1165,7 @@ func TestNextID(t *testing.T) {
 		},
 		{
 			description: "No available IDs",
-			entries: map[uint16]string{
+			entries: map[uint32]string{
 				100: "used",
 				101: "used",
 				102: "used",
@@ -978,7 +1177,7 @@ func TestNextID(t *testing.T) {
 		},
 		{
 			description: "Last available ID",
-			entries: map[uint16]string{
+			entries: map[uint32]string{
 				100: "used",
 				101: "used",
 			},
@@ -989,7 +1188,7 @@ func TestNextID(t *testing.T) {
 		},
 		{
 			description: "All IDs in range are used",
-			entries: map[uint16]string{
+			entries: map[uint32]string{
 				1000: "used",
 				1001: "used",
 				1002: "used",
@@ -1000,6 +1199,26 @@ func TestNextID(t *testing.T) {
 			wantID:  0,
 			wantErr: ErrNoAvailableIDs,
 		},
+		{
+			description: "IDs above 16 bits",
+			entries: map[uint32]string{
+				100000: "used",
+			},
+			min:     100000,
+			max:     200000,
+			wantID:  100001,
+			wantErr: nil,
+		},
+		{
+			description: "Top of 32 bit range is used",
+			entries: map[uint32]string{
+				4294967295: "used",
+			},
+			min:     4294967295,
+			max:     4294967295,
+			wantID:  0,
+			wantErr: ErrNoAvailableIDs,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -1013,6 +1232,142 @@ func TestNextID(t *testing.T) {
 	}
 }
 
+func TestNextSubIDRange(t *testing.T) {
+	comment := "# comment"
+	testCases := []struct {
+		description string
+		entries     []*SubIDEntry
+		count       uint32
+		min         uint32
+		max         uint32
+		wantStart   uint32
+		wantErr     error
+	}{
+		{
+			description: "No ranges",
+			entries:     []*SubIDEntry{},
+			count:       65536,
+			min:         100000,
+			max:         600100000,
+			wantStart:   100000,
+		},
+		{
+			description: "After existing range",
+			entries: []*SubIDEntry{
+				{Name: "alice", Start: 100000, Count: 65536},
+			},
+			count:     65536,
+			min:       100000,
+			max:       600100000,
+			wantStart: 165536,
+		},
+		{
+			description: "Fill gap between ranges",
+			entries: []*SubIDEntry{
+				{Name: "carol", Start: 300000, Count: 1000},
+				{Name: "alice", Start: 100000, Count: 1000},
+				{Name: "bob", Start: 102000, Count: 1000},
+			},
+			count:     1000,
+			min:       100000,
+			max:       600100000,
+			wantStart: 101000,
+		},
+		{
+			description: "Gap too small",
+			entries: []*SubIDEntry{
+				{Name: "alice", Start: 100000, Count: 1000},
+				{Name: "bob", Start: 101500, Count: 1000},
+			},
+			count:     1000,
+			min:       100000,
+			max:       600100000,
+			wantStart: 102500,
+		},
+		{
+			description: "Overlapping and nested ranges",
+			entries: []*SubIDEntry{
+				{Name: "alice", Start: 100000, Count: 10000},
+				{Name: "bob", Start: 101000, Count: 1000},
+				{Name: "carol", Start: 109000, Count: 2000},
+			},
+			count:     1000,
+			min:       100000,
+			max:       600100000,
+			wantStart: 111000,
+		},
+		{
+			description: "Range below minimum",
+			entries: []*SubIDEntry{
+				{Name: "alice", Start: 90000, Count: 20000},
+			},
+			count:     1000,
+			min:       100000,
+			max:       600100000,
+			wantStart: 110000,
+		},
+		{
+			description: "Verbatim lines and empty ranges are ignored",
+			entries: []*SubIDEntry{
+				{verbatim: &comment},
+				{Name: "alice", Start: 100000, Count: 0},
+			},
+			count:     1000,
+			min:       100000,
+			max:       600100000,
+			wantStart: 100000,
+		},
+		{
+			description: "Exactly fills remaining space",
+			entries: []*SubIDEntry{
+				{Name: "alice", Start: 100000, Count: 1000},
+			},
+			count:     1000,
+			min:       100000,
+			max:       101999,
+			wantStart: 101000,
+		},
+		{
+			description: "No space left",
+			entries: []*SubIDEntry{
+				{Name: "alice", Start: 100000, Count: 1000},
+			},
+			count:   1000,
+			min:     100000,
+			max:     101998,
+			wantErr: ErrNoAvailableIDs,
+		},
+		{
+			description: "Top of 32 bit range",
+			entries: []*SubIDEntry{
+				{Name: "alice", Start: 4294901760, Count: 65535},
+			},
+			count:   2,
+			min:     4294901760,
+			max:     4294967295,
+			wantErr: ErrNoAvailableIDs,
+		},
+		{
+			description: "Zero count",
+			entries:     []*SubIDEntry{},
+			count:       0,
+			min:         100000,
+			max:         600100000,
+			wantErr:     ErrSubIDCount,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			start, err := nextSubIDRange(tc.entries, tc.count, tc.min, tc.max)
+			assert.Equal(t, tc.wantErr, err)
+			if err == nil {
+				assert.Equal(t, tc.wantStart, start)
+			}
+		})
+	}
+}
+
 func TestNonEmptyStrings(t *testing.T) {
 	testCases := []struct {
 		description string
@@ -1080,40 +1435,6 @@ func TestFileExists(t *testing.T) {
 	assert.False(t, exists)
 }
 
-func TestWriteLines(t *testing.T) {
-	fs := afero.NewMemMapFs()
-
-	entries := []PasswdEntry{
-		{Username: "root", Password: "x", UID: 0, GID: 0, Comment: "root", HomeDir: "/root", Shell: "/bin/bash"},
-		{Username: "bin", Password: "x", UID: 1, GID: 1, Comment: "bin", HomeDir: "/bin", Shell: "/sbin/nologin"},
-	}
-
-	err := writeLines(fs, "/tmp/passwd", entries, 0644)
-	assert.NoError(t, err)
-
-	content, err := afero.ReadFile(fs, "/tmp/passwd")
-	assert.NoError(t, err)
-
-	expected := "root:x:0:0:root:/root:/bin/bash\nbin:x:1:1:bin:/bin:/sbin/nologin\n"
-	assert.Equal(t, expected, string(content))
-
-	// Verify temp file was cleaned up
-	exists, _ := fileExists(fs, "/tmp/passwd+")
-	assert.False(t, exists)
-}
-
-func TestWriteLinesEmptyList(t *testing.T) {
-	fs := afero.NewMemMapFs()
-
-	entries := []PasswdEntry{}
-	err := writeLines(fs, "/tmp/passwd", entries, 0644)
-	assert.NoError(t, err)
-
-	content, err := afero.ReadFile(fs, "/tmp/passwd")
-	assert.NoError(t, err)
-	assert.Equal(t, "", string(content))
-}
-
 func TestCreateHomeDir(t *testing.T) {
 	fs := afero.NewMemMapFs()
 
@@ -1201,8 +1522,8 @@ func TestAddLoginUserWheelGroupIntegration(t *testing.T) {
 	// Add first login user - should create wheel group
 	uid1, gid1, err := AddLoginUser(fs, "alice", "alice", "/home/alice", "/bin/bash", "")
 	assert.NoError(t, err)
-	assert.Equal(t, uint16(1000), uid1)
-	assert.Equal(t, uint16(1000), gid1)
+	assert.Equal(t, uint32(1000), uid1)
+	assert.Equal(t, uint32(1000), gid1)
 
 	// Verify wheel group was created
 	_, groupByName, _, err := ParseGroup(fs, constants.FileEtcGroup)
@@ -1214,8 +1535,8 @@ func TestAddLoginUserWheelGroupIntegration(t *testing.T) {
 	// Add second login user - should add to existing wheel group
 	uid2, gid2, err := AddLoginUser(fs, "bob", "bob", "/home/bob", "/bin/bash", "")
 	assert.NoError(t, err)
-	assert.Equal(t, uint16(1001), uid2)
-	assert.Equal(t, uint16(1001), gid2)
+	assert.Equal(t, uint32(1001), uid2)
+	assert.Equal(t, uint32(1001), gid2)
 
 	// Verify both users in wheel group
 	_, groupByName, _, err = ParseGroup(fs, constants.FileEtcGroup)
@@ -1224,3 +1545,207 @@ func TestAddLoginUserWheelGroupIntegration(t *testing.T) {
 	assert.Contains(t, wheelGroup.Users, "alice")
 	assert.Contains(t, wheelGroup.Users, "bob")
 }
+
+func TestResolveUser(t *testing.T) {
+	passwd := `root:x:0:0:root:/root:/bin/sh
+app:x:1000:1001:app:/home/app:/bin/sh
+`
+	group := `root:x:0:
+app:x:1001:
+staff:x:50:app
+`
+	testCases := []struct {
+		description string
+		passwd      *string
+		group       *string
+		userSpec    string
+		uid         uint32
+		gid         uint32
+		err         error
+	}{
+		{
+			description: "Named user",
+			passwd:      &passwd,
+			group:       &group,
+			userSpec:    "app",
+			uid:         1000,
+			gid:         1001,
+		},
+		{
+			description: "Named user and group",
+			passwd:      &passwd,
+			group:       &group,
+			userSpec:    "app:staff",
+			uid:         1000,
+			gid:         50,
+		},
+		{
+			description: "Named user and numeric group",
+			passwd:      &passwd,
+			group:       &group,
+			userSpec:    "app:2000",
+			uid:         1000,
+			gid:         2000,
+		},
+		{
+			description: "Numeric user with passwd entry",
+			passwd:      &passwd,
+			group:       &group,
+			userSpec:    "1000",
+			uid:         1000,
+			gid:         1001,
+		},
+		{
+			description: "Numeric user without passwd entry",
+			passwd:      &passwd,
+			group:       &group,
+			userSpec:    "5000",
+			uid:         5000,
+			gid:         0,
+		},
+		{
+			description: "Numeric user and group without files",
+			userSpec:    "5000:5000",
+			uid:         5000,
+			gid:         5000,
+		},
+		{
+			description: "Unknown user",
+			passwd:      &passwd,
+			group:       &group,
+			userSpec:    "nobody",
+			err:         ErrUserNotFound,
+		},
+		{
+			description: "Named user without passwd file",
+			userSpec:    "app",
+			err:         ErrUserNotFound,
+		},
+		{
+			description: "Unknown group",
+			passwd:      &passwd,
+			group:       &group,
+			userSpec:    "app:wheel",
+			err:         ErrGroupNotFound,
+		},
+		{
+			description: "Named group without group file",
+			passwd:      &passwd,
+			userSpec:    "app:staff",
+			err:         ErrGroupNotFound,
+		},
+		{
+			description: "Empty user",
+			userSpec:    ":staff",
+			err:         ErrUsernameLength,
+		},
+		{
+			description: "Empty group",
+			userSpec:    "app:",
+			err:         ErrGroupnameLength,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := loginSetup(tc.passwd, nil, tc.group, nil, "/base")
+			uid, gid, err := ResolveUser(fs, tc.userSpec, "/base")
+			assert.ErrorIs(t, err, tc.err)
+			if tc.err == nil {
+				assert.Equal(t, tc.uid, uid)
+				assert.Equal(t, tc.gid, gid)
+			}
+		})
+	}
+}
+
+func TestAddLoginUserWith32BitIDs(t *testing.T) {
+	passwd := `nobody:x:4294967294:4294967294:nobody:/:/sbin/nologin
+ldap:x:70000:70000:ldap:/home/ldap:/bin/sh
+`
+	group := "nogroup:x:4294967294:\nldap:x:70000:\n"
+	fs := loginSetup(&passwd, nil, &group, nil, "")
+
+	uid, gid, err := AddLoginUser(fs, "xyz", "xyz", "/home/xyz", "/bin/sh", "")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(UID_GID_MIN), uid)
+	assert.Equal(t, uint32(UID_GID_MIN), gid)
+
+	assert.Equal(t, passwd+"xyz:x:1000:1000:xyz:/home/xyz:/bin/sh\n",
+		*loginRead(fs, constants.FileEtcPasswd))
+	assert.Equal(t, group+"wheel:x:10:xyz\nxyz:x:1000:xyz\n",
+		*loginRead(fs, constants.FileEtcGroup))
+
+	uid, gid, err = ResolveUser(fs, "nobody:ldap", "")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4294967294), uid)
+	assert.Equal(t, uint32(70000), gid)
+}
+
+func TestAddLoginUserWithSubIDs(t *testing.T) {
+	passwd := "alice:x:1000:1000:alice:/home/alice:/bin/sh\n"
+	group := "alice:x:1000:\n"
+	subuid := "# subordinate UIDs\nalice:100000:65536\n"
+	subgid := "alice:100000:1000\nbuild:200000:65536\n"
+	fs := loginSetup(&passwd, nil, &group, nil, "/base")
+	afero.WriteFile(fs, "/base"+constants.FileEtcSubUID, []byte(subuid), constants.ModeEtcSubUID)
+	afero.WriteFile(fs, "/base"+constants.FileEtcSubGID, []byte(subgid), constants.ModeEtcSubGID)
+
+	uid, gid, err := AddLoginUser(fs, "bob", "bob", "/home/bob", "/bin/sh", "/base",
+		WithSubIDs(SUB_ID_COUNT))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1001), uid)
+	assert.Equal(t, uint32(1001), gid)
+
+	assert.Equal(t, subuid+"bob:165536:65536\n",
+		*loginRead(fs, "/base"+constants.FileEtcSubUID))
+	assert.Equal(t, subgid+"bob:101000:65536\n",
+		*loginRead(fs, "/base"+constants.FileEtcSubGID))
+
+	// Without WithSubIDs, no ranges are granted.
+	_, _, err = AddLoginUser(fs, "carol", "carol", "/home/carol", "/bin/sh", "/base")
+	assert.NoError(t, err)
+	assert.Equal(t, subuid+"bob:165536:65536\n",
+		*loginRead(fs, "/base"+constants.FileEtcSubUID))
+
+	// Files are created if they do not exist.
+	fs = loginSetup(nil, nil, nil, nil, "")
+	_, _, err = AddLoginUser(fs, "bob", "bob", "/home/bob", "/bin/sh", "", WithSubIDs(1000))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob:100000:1000\n", *loginRead(fs, constants.FileEtcSubUID))
+	assert.Equal(t, "bob:100000:1000\n", *loginRead(fs, constants.FileEtcSubGID))
+}
+
+func TestAddSubIDs(t *testing.T) {
+	passwd := "alice:x:1000:1000:alice:/home/alice:/bin/sh\nbob:x:1001:1001:bob:/home/bob:/bin/sh\n"
+	fs := loginSetup(&passwd, nil, nil, nil, "")
+	afero.WriteFile(fs, constants.FileEtcSubGID, []byte("alice:100000:65536\n"), constants.ModeEtcSubGID)
+
+	db, err := OpenDatabase(fs, "")
+	assert.NoError(t, err)
+
+	_, _, err = db.AddSubIDs("carol", SUB_ID_COUNT)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	_, _, err = db.AddSubIDs("alice", SUB_ID_COUNT)
+	assert.ErrorIs(t, err, ErrSubIDsExist)
+
+	_, _, err = db.AddSubIDs("bob", 0)
+	assert.ErrorIs(t, err, ErrSubIDCount)
+
+	uidStart, gidStart, err := db.AddSubIDs("bob", SUB_ID_COUNT)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(100000), uidStart)
+	assert.Equal(t, uint32(165536), gidStart)
+	assert.Equal(t, []*SubIDEntry{{Name: "bob", Start: 100000, Count: SUB_ID_COUNT}}, db.SubUIDs("bob"))
+	assert.Equal(t, []*SubIDEntry{{Name: "bob", Start: 165536, Count: SUB_ID_COUNT}}, db.SubGIDs("bob"))
+
+	_, _, err = db.AddSubIDs("bob", SUB_ID_COUNT)
+	assert.ErrorIs(t, err, ErrSubIDsExist)
+
+	assert.NoError(t, db.RemoveUser("alice"))
+	assert.Empty(t, db.SubGIDs("alice"))
+	assert.NoError(t, db.Commit())
+	assert.Equal(t, "bob:100000:65536\n", *loginRead(fs, constants.FileEtcSubUID))
+	assert.Equal(t, "bob:165536:65536\n", *loginRead(fs, constants.FileEtcSubGID))
+}
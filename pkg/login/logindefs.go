@@ -0,0 +1,166 @@
+package login
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// LoginDefs holds the ID ranges from a login.defs file that are used to
+// allocate IDs for new users and groups.
+type LoginDefs struct {
+	UIDMin    uint32
+	UIDMax    uint32
+	SysUIDMin uint32
+	SysUIDMax uint32
+	GIDMin    uint32
+	GIDMax    uint32
+	SysGIDMin uint32
+	SysGIDMax uint32
+	SubUIDMin uint32
+	SubUIDMax uint32
+	SubGIDMin uint32
+	SubGIDMax uint32
+}
+
+// DefaultLoginDefs returns the ranges used when there is no login.defs file or
+// a key is not set in it.
+func DefaultLoginDefs() *LoginDefs {
+	return &LoginDefs{
+		UIDMin:    UID_GID_MIN,
+		UIDMax:    UID_GID_MAX,
+		SysUIDMin: UID_GID_MIN_SYS,
+		SysUIDMax: UID_GID_MAX_SYS,
+		GIDMin:    UID_GID_MIN,
+		GIDMax:    UID_GID_MAX,
+		SysGIDMin: UID_GID_MIN_SYS,
+		SysGIDMax: UID_GID_MAX_SYS,
+		SubUIDMin: SUB_ID_MIN,
+		SubUIDMax: SUB_ID_MAX,
+		SubGIDMin: SUB_ID_MIN,
+		SubGIDMax: SUB_ID_MAX,
+	}
+}
+
+func (d *LoginDefs) fields() map[string]*uint32 {
+	return map[string]*uint32{
+		"UID_MIN":     &d.UIDMin,
+		"UID_MAX":     &d.UIDMax,
+		"SYS_UID_MIN": &d.SysUIDMin,
+		"SYS_UID_MAX": &d.SysUIDMax,
+		"GID_MIN":     &d.GIDMin,
+		"GID_MAX":     &d.GIDMax,
+		"SYS_GID_MIN": &d.SysGIDMin,
+		"SYS_GID_MAX": &d.SysGIDMax,
+		"SUB_UID_MIN": &d.SubUIDMin,
+		"SUB_UID_MAX": &d.SubUIDMax,
+		"SUB_GID_MIN": &d.SubGIDMin,
+		"SUB_GID_MAX": &d.SubGIDMax,
+	}
+}
+
+// ParseLoginDefs parses the ID ranges from a login.defs file. Keys that are
+// not set keep the values from DefaultLoginDefs, and other keys are ignored,
+// except that as in shadow-utils, SYS_UID_MAX and SYS_GID_MAX default to one
+// less than UID_MIN and GID_MIN when those are set. Numbers may be given in
+// decimal, octal with a leading 0, or hexadecimal with a leading 0x.
+func ParseLoginDefs(fs afero.Fs, loginDefsFile string) (*LoginDefs, error) {
+	f, err := fs.Open(loginDefsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open %s: %w", loginDefsFile, err)
+	}
+	defer f.Close()
+
+	defs := DefaultLoginDefs()
+	fields := defs.fields()
+	set := map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, _ := strings.Cut(strings.Join(strings.Fields(line), " "), " ")
+		field, ok := fields[key]
+		if !ok {
+			continue
+		}
+
+		value = strings.Trim(value, `"`)
+		n, err := strconv.ParseUint(value, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s %s in %s: %w", key, value,
+				loginDefsFile, err)
+		}
+		*field = uint32(n)
+		set[key] = true
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", loginDefsFile, err)
+	}
+
+	if set["UID_MIN"] && !set["SYS_UID_MAX"] && defs.UIDMin > 0 {
+		defs.SysUIDMax = defs.UIDMin - 1
+	}
+	if set["GID_MIN"] && !set["SYS_GID_MAX"] && defs.GIDMin > 0 {
+		defs.SysGIDMax = defs.GIDMin - 1
+	}
+
+	if err = defs.validate(); err != nil {
+		return nil, fmt.Errorf("invalid ranges in %s: %w", loginDefsFile, err)
+	}
+
+	return defs, nil
+}
+
+func (d *LoginDefs) validate() error {
+	ranges := []struct {
+		name     string
+		min, max uint32
+	}{
+		{"UID", d.UIDMin, d.UIDMax},
+		{"SYS_UID", d.SysUIDMin, d.SysUIDMax},
+		{"GID", d.GIDMin, d.GIDMax},
+		{"SYS_GID", d.SysGIDMin, d.SysGIDMax},
+		{"SUB_UID", d.SubUIDMin, d.SubUIDMax},
+		{"SUB_GID", d.SubGIDMin, d.SubGIDMax},
+	}
+	for _, r := range ranges {
+		if r.min > r.max {
+			return fmt.Errorf("%s_MIN %d is greater than %s_MAX %d", r.name, r.min,
+				r.name, r.max)
+		}
+	}
+
+	if d.sysUIDs().overlaps(d.uids()) {
+		return fmt.Errorf("SYS_UID range %d-%d overlaps UID range %d-%d", d.SysUIDMin,
+			d.SysUIDMax, d.UIDMin, d.UIDMax)
+	}
+	if d.sysGIDs().overlaps(d.gids()) {
+		return fmt.Errorf("SYS_GID range %d-%d overlaps GID range %d-%d", d.SysGIDMin,
+			d.SysGIDMax, d.GIDMin, d.GIDMax)
+	}
+	return nil
+}
+
+func (d *LoginDefs) uids() idRange {
+	return idRange{min: d.UIDMin, max: d.UIDMax}
+}
+
+func (d *LoginDefs) gids() idRange {
+	return idRange{min: d.GIDMin, max: d.GIDMax}
+}
+
+func (d *LoginDefs) sysUIDs() idRange {
+	return idRange{min: d.SysUIDMin, max: d.SysUIDMax}
+}
+
+func (d *LoginDefs) sysGIDs() idRange {
+	return idRange{min: d.SysGIDMin, max: d.SysGIDMax}
+}
@@ -0,0 +1,226 @@
+package login
+
+import (
+	"testing"
+
+	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLoginDefs(t *testing.T) {
+	withDefaults := func(modify func(*LoginDefs)) *LoginDefs {
+		defs := DefaultLoginDefs()
+		modify(defs)
+		return defs
+	}
+	testCases := []struct {
+		description string
+		content     string
+		defs        *LoginDefs
+		errContains string
+	}{
+		{
+			description: "Empty file",
+			content:     "",
+			defs:        DefaultLoginDefs(),
+		},
+		{
+			description: "Debian style",
+			content: `#
+# /etc/login.defs - Configuration control definitions for the login package.
+#
+MAIL_DIR        /var/mail
+UMASK           022
+
+# Min/max values for automatic uid selection in useradd
+UID_MIN                  1000
+UID_MAX                 60000
+#SYS_UID_MIN              100
+SYS_UID_MAX               499
+GID_MIN                  1000
+GID_MAX                 60000
+SYS_GID_MIN               101
+SYS_GID_MAX               499
+ENCRYPT_METHOD SHA512
+`,
+			defs: withDefaults(func(d *LoginDefs) {
+				d.UIDMax = 60000
+				d.SysUIDMax = 499
+				d.GIDMax = 60000
+				d.SysGIDMin = 101
+				d.SysGIDMax = 499
+			}),
+		},
+		{
+			description: "Subordinate IDs",
+			content: `SUB_UID_MIN 200000
+SUB_UID_MAX 300000
+SUB_GID_MIN 400000
+SUB_GID_MAX 500000
+`,
+			defs: withDefaults(func(d *LoginDefs) {
+				d.SubUIDMin = 200000
+				d.SubUIDMax = 300000
+				d.SubGIDMin = 400000
+				d.SubGIDMax = 500000
+			}),
+		},
+		{
+			description: "Octal, hexadecimal, and quoted values",
+			content:     "UID_MIN\t0x3e8\nUID_MAX 077777\n  GID_MIN   \"2000\"  \n",
+			defs: withDefaults(func(d *LoginDefs) {
+				d.UIDMin = 1000
+				d.UIDMax = 32767
+				d.GIDMin = 2000
+				d.SysGIDMax = 1999
+			}),
+		},
+		{
+			description: "Later value wins",
+			content:     "UID_MIN 2000\nUID_MIN 3000\n",
+			defs: withDefaults(func(d *LoginDefs) {
+				d.UIDMin = 3000
+				d.SysUIDMax = 2999
+			}),
+		},
+		{
+			description: "System maximum derived from minimum",
+			content:     "UID_MIN 500\nGID_MIN 500\n",
+			defs: withDefaults(func(d *LoginDefs) {
+				d.UIDMin = 500
+				d.SysUIDMax = 499
+				d.GIDMin = 500
+				d.SysGIDMax = 499
+			}),
+		},
+		{
+			description: "System maximum set explicitly",
+			content:     "UID_MIN 2000\nSYS_UID_MAX 999\n",
+			defs: withDefaults(func(d *LoginDefs) {
+				d.UIDMin = 2000
+			}),
+		},
+		{
+			description: "32 bit maximum",
+			content:     "UID_MAX 4294967295\n",
+			defs: withDefaults(func(d *LoginDefs) {
+				d.UIDMax = 4294967295
+			}),
+		},
+		{
+			description: "Invalid value",
+			content:     "UID_MIN one\n",
+			errContains: "unable to parse UID_MIN one",
+		},
+		{
+			description: "Missing value",
+			content:     "UID_MIN\n",
+			errContains: "unable to parse UID_MIN",
+		},
+		{
+			description: "Value out of range",
+			content:     "UID_MAX 4294967296\n",
+			errContains: "unable to parse UID_MAX",
+		},
+		{
+			description: "Minimum greater than maximum",
+			content:     "SYS_UID_MIN 500\nSYS_UID_MAX 499\n",
+			errContains: "SYS_UID_MIN 500 is greater than SYS_UID_MAX 499",
+		},
+		{
+			description: "System UIDs overlap user UIDs",
+			content:     "UID_MIN 500\nSYS_UID_MAX 999\n",
+			errContains: "SYS_UID range 100-999 overlaps UID range 500-32767",
+		},
+		{
+			description: "System GIDs overlap user GIDs",
+			content:     "GID_MAX 999\nGID_MIN 200\nSYS_GID_MIN 900\nSYS_GID_MAX 2000\n",
+			errContains: "SYS_GID range 900-2000 overlaps GID range 200-999",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			afero.WriteFile(fs, constants.FileEtcLoginDefs, []byte(tc.content), 0644)
+
+			defs, err := ParseLoginDefs(fs, constants.FileEtcLoginDefs)
+			if tc.errContains != "" {
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.defs, defs)
+		})
+	}
+}
+
+func TestParseLoginDefsFileNotFound(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	_, err := ParseLoginDefs(fs, "/nonexistent")
+	assert.Error(t, err)
+}
+
+func TestLoginDefsAllocation(t *testing.T) {
+	passwd := "root:x:0:0:root:/root:/bin/sh\n"
+	group := "root:x:0:\n"
+	loginDefs := `SYS_UID_MIN 200
+SYS_UID_MAX 499
+SYS_GID_MIN 300
+SYS_GID_MAX 499
+UID_MIN 5000
+GID_MIN 6000
+SUB_UID_MIN 1000000
+SUB_GID_MIN 2000000
+`
+	fs := loginSetup(&passwd, nil, &group, nil, "/base")
+	afero.WriteFile(fs, "/base"+constants.FileEtcLoginDefs, []byte(loginDefs), 0644)
+
+	uid, gid, err := AddSystemUser(fs, "sshd", "sshd", "/nonexistent", "/base")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(200), uid)
+	assert.Equal(t, uint32(300), gid)
+
+	uid, gid, err = AddLoginUser(fs, "alice", "alice", "/home/alice", "/bin/sh", "/base",
+		WithSubIDs(SUB_ID_COUNT))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(5000), uid)
+	assert.Equal(t, uint32(6000), gid)
+
+	db, err := OpenDatabase(fs, "/base")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(499), db.LoginDefs().SysGIDMax)
+	wheel, ok := db.Group(constants.GroupNameWheel)
+	require.True(t, ok)
+	assert.Equal(t, uint32(10), wheel.GID)
+	assert.Equal(t, uint32(1000000), db.SubUIDs("alice")[0].Start)
+	assert.Equal(t, uint32(2000000), db.SubGIDs("alice")[0].Start)
+
+	_, _, err = db.AddUserSpec(UserSpec{Name: "bob"}, "/home/bob", "/bin/sh")
+	require.NoError(t, err)
+	bob, ok := db.User("bob")
+	require.True(t, ok)
+	assert.Equal(t, uint32(5001), bob.UID)
+	assert.Equal(t, uint32(6001), bob.GID)
+}
+
+func TestLoginDefsSystemRangeFull(t *testing.T) {
+	passwd := "a:x:200:200::/:/bin/false\nb:x:201:201::/:/bin/false\n"
+	fs := loginSetup(&passwd, nil, nil, nil, "")
+	afero.WriteFile(fs, constants.FileEtcLoginDefs, []byte("SYS_UID_MIN 200\nSYS_UID_MAX 201\n"), 0644)
+
+	_, _, err := AddSystemUser(fs, "sshd", "sshd", "/nonexistent", "")
+	assert.ErrorIs(t, err, ErrNoAvailableIDs)
+}
+
+func TestOpenDatabaseInvalidLoginDefs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, constants.FileEtcLoginDefs, []byte("UID_MIN abc\n"), 0644)
+
+	_, err := OpenDatabase(fs, "")
+	assert.Error(t, err)
+
+	_, _, err = AddLoginUser(fs, "alice", "alice", "/home/alice", "/bin/sh", "")
+	assert.Error(t, err)
+}
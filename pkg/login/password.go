@@ -0,0 +1,191 @@
+package login
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	cryptAlphabet  = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	sha512Prefix   = "$6$"
+	sha512Rounds   = 5000
+	sha512SaltSize = 16
+)
+
+var (
+	ErrEmptyPassword       = errors.New("password must not be empty")
+	ErrInvalidPasswordHash = errors.New("invalid password hash")
+)
+
+// sha512Order is the order in which bytes of the final SHA-512 digest are
+// encoded, three at a time.
+var sha512Order = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// HashPassword hashes password with SHA-512 crypt and a random salt. The
+// result can be used as the password field of a shadow entry.
+func HashPassword(password string) (string, error) {
+	if len(password) == 0 {
+		return "", ErrEmptyPassword
+	}
+	salt := make([]byte, sha512SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("unable to generate salt: %w", err)
+	}
+	for i, b := range salt {
+		salt[i] = cryptAlphabet[int(b)%len(cryptAlphabet)]
+	}
+	return sha512Crypt(password, string(salt), sha512Rounds), nil
+}
+
+// HashPasswordFile hashes the plaintext password in the file at path. A single
+// trailing newline is not considered part of the password.
+func HashPasswordFile(fs afero.Fs, path string) (string, error) {
+	password, err := readPasswordFile(fs, path)
+	if err != nil {
+		return "", err
+	}
+	return HashPassword(password)
+}
+
+// ReadPasswordHashFile reads a password hash in crypt format from the file at
+// path, checking it with ValidatePasswordHash. A single trailing newline is
+// not considered part of the hash.
+func ReadPasswordHashFile(fs afero.Fs, path string) (string, error) {
+	hash, err := readPasswordFile(fs, path)
+	if err != nil {
+		return "", err
+	}
+	if err = ValidatePasswordHash(hash); err != nil {
+		return "", fmt.Errorf("unable to use password hash in %s: %w", path, err)
+	}
+	return hash, nil
+}
+
+func readPasswordFile(fs afero.Fs, path string) (string, error) {
+	data, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read password file %s: %w", path, err)
+	}
+	password := strings.TrimSuffix(string(data), "\n")
+	return strings.TrimSuffix(password, "\r"), nil
+}
+
+// ValidatePasswordHash checks that hash is in the crypt format, as produced by
+// HashPassword or by tools such as mkpasswd, and can be written to a shadow entry.
+func ValidatePasswordHash(hash string) error {
+	fields := strings.Split(hash, "$")
+	if len(fields) < 4 || len(fields[0]) > 0 || len(fields[1]) == 0 ||
+		len(fields[len(fields)-1]) == 0 || strings.ContainsAny(hash, ":\r\n") {
+		return ErrInvalidPasswordHash
+	}
+	return nil
+}
+
+// sha512Crypt implements the SHA-512 crypt algorithm described at
+// https://www.akkadia.org/drepper/SHA-crypt.txt.
+func sha512Crypt(password, salt string, rounds int) string {
+	if len(salt) > sha512SaltSize {
+		salt = salt[:sha512SaltSize]
+	}
+	p := []byte(password)
+	s := []byte(salt)
+
+	hashB := sha512.New()
+	hashB.Write(p)
+	hashB.Write(s)
+	hashB.Write(p)
+	sumB := hashB.Sum(nil)
+
+	hashA := sha512.New()
+	hashA.Write(p)
+	hashA.Write(s)
+	i := len(p)
+	for ; i > sha512.Size; i -= sha512.Size {
+		hashA.Write(sumB)
+	}
+	hashA.Write(sumB[:i])
+	for i = len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			hashA.Write(sumB)
+		} else {
+			hashA.Write(p)
+		}
+	}
+	sumA := hashA.Sum(nil)
+
+	hashDP := sha512.New()
+	for range len(p) {
+		hashDP.Write(p)
+	}
+	seqP := repeatBytes(hashDP.Sum(nil), len(p))
+
+	hashDS := sha512.New()
+	for range 16 + int(sumA[0]) {
+		hashDS.Write(s)
+	}
+	seqS := repeatBytes(hashDS.Sum(nil), len(s))
+
+	sumC := sumA
+	for r := range rounds {
+		hashC := sha512.New()
+		if r&1 != 0 {
+			hashC.Write(seqP)
+		} else {
+			hashC.Write(sumC)
+		}
+		if r%3 != 0 {
+			hashC.Write(seqS)
+		}
+		if r%7 != 0 {
+			hashC.Write(seqP)
+		}
+		if r&1 != 0 {
+			hashC.Write(sumC)
+		} else {
+			hashC.Write(seqP)
+		}
+		sumC = hashC.Sum(nil)
+	}
+
+	b := strings.Builder{}
+	b.WriteString(sha512Prefix)
+	if rounds != sha512Rounds {
+		b.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	b.WriteString(salt)
+	b.WriteString("$")
+	for _, order := range sha512Order {
+		encode24(&b, sumC[order[0]], sumC[order[1]], sumC[order[2]], 4)
+	}
+	encode24(&b, 0, 0, sumC[63], 2)
+	return b.String()
+}
+
+// repeatBytes returns a sequence of length n made of repeated copies of data.
+func repeatBytes(data []byte, n int) []byte {
+	seq := make([]byte, 0, n)
+	for len(seq) < n {
+		seq = append(seq, data[:min(len(data), n-len(seq))]...)
+	}
+	return seq
+}
+
+func encode24(b *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for range n {
+		b.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,197 @@
+package login
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+	// Test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt, with
+	// the default rounds omitted from the result.
+	testCases := []struct {
+		password string
+		salt     string
+		rounds   int
+		result   string
+	}{
+		{
+			password: "Hello world!",
+			salt:     "saltstring",
+			rounds:   5000,
+			result:   "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		},
+		{
+			password: "Hello world!",
+			salt:     "saltstringsaltstring",
+			rounds:   10000,
+			result:   "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+		},
+		{
+			password: "This is just a test",
+			salt:     "toolongsaltstring",
+			rounds:   5000,
+			result:   "$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0",
+		},
+		{
+			password: "we have a short salt string but not a short password",
+			salt:     "short",
+			rounds:   77777,
+			result:   "$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.salt, func(t *testing.T) {
+			assert.Equal(t, tc.result, sha512Crypt(tc.password, tc.salt, tc.rounds))
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	require.NoError(t, err)
+	assert.NoError(t, ValidatePasswordHash(hash))
+
+	fields := strings.Split(hash, "$")
+	require.Len(t, fields, 4)
+	assert.Equal(t, "6", fields[1])
+	assert.Len(t, fields[2], sha512SaltSize)
+	assert.Equal(t, hash, sha512Crypt("secret", fields[2], sha512Rounds))
+
+	other, err := HashPassword("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+
+	_, err = HashPassword("")
+	assert.ErrorIs(t, err, ErrEmptyPassword)
+}
+
+func TestHashPasswordFile(t *testing.T) {
+	testCases := []struct {
+		description string
+		content     string
+		password    string
+		err         error
+	}{
+		{
+			description: "No newline",
+			content:     "secret",
+			password:    "secret",
+		},
+		{
+			description: "Trailing newline",
+			content:     "secret\n",
+			password:    "secret",
+		},
+		{
+			description: "Trailing carriage return",
+			content:     "secret\r\n",
+			password:    "secret",
+		},
+		{
+			description: "Only newline",
+			content:     "\n",
+			err:         ErrEmptyPassword,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, "/password", []byte(tc.content), 0600))
+			hash, err := HashPasswordFile(fs, "/password")
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			salt := strings.Split(hash, "$")[2]
+			assert.Equal(t, sha512Crypt(tc.password, salt, sha512Rounds), hash)
+		})
+	}
+
+	_, err := HashPasswordFile(afero.NewMemMapFs(), "/missing")
+	assert.Error(t, err)
+}
+
+func TestReadPasswordHashFile(t *testing.T) {
+	testCases := []struct {
+		description string
+		content     string
+		hash        string
+		err         error
+	}{
+		{
+			description: "No newline",
+			content:     "$6$salt$hash",
+			hash:        "$6$salt$hash",
+		},
+		{
+			description: "Trailing newline",
+			content:     "$6$salt$hash\n",
+			hash:        "$6$salt$hash",
+		},
+		{
+			description: "Trailing carriage return",
+			content:     "$y$j9T$salt$hash\r\n",
+			hash:        "$y$j9T$salt$hash",
+		},
+		{
+			description: "Plaintext password",
+			content:     "secret\n",
+			err:         ErrInvalidPasswordHash,
+		},
+		{
+			description: "Multiple lines",
+			content:     "$6$salt$hash\n\n",
+			err:         ErrInvalidPasswordHash,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, "/password", []byte(tc.content), 0600))
+			hash, err := ReadPasswordHashFile(fs, "/password")
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.hash, hash)
+		})
+	}
+
+	_, err := ReadPasswordHashFile(afero.NewMemMapFs(), "/missing")
+	assert.Error(t, err)
+}
+
+func TestValidatePasswordHash(t *testing.T) {
+	testCases := []struct {
+		hash  string
+		valid bool
+	}{
+		{hash: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl", valid: true},
+		{hash: "$6$rounds=10000$salt$hash", valid: true},
+		{hash: "$y$j9T$salt$hash", valid: true},
+		{hash: "", valid: false},
+		{hash: "secret", valid: false},
+		{hash: "$6$salt", valid: false},
+		{hash: "$6$salt$", valid: false},
+		{hash: "$$salt$hash", valid: false},
+		{hash: "x$6$salt$hash", valid: false},
+		{hash: "$6$salt$ha:sh", valid: false},
+		{hash: "$6$salt$hash\n", valid: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.hash, func(t *testing.T) {
+			err := ValidatePasswordHash(tc.hash)
+			if tc.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidPasswordHash)
+			}
+		})
+	}
+}
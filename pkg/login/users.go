@@ -0,0 +1,174 @@
+package login
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+const fileAuthorizedKeys = "authorized_keys"
+
+var (
+	ErrInvalidName          = errors.New("invalid name")
+	ErrDuplicateUser        = errors.New("duplicate user")
+	ErrInvalidShell         = errors.New("shell must be an absolute path")
+	ErrInvalidAuthorizedKey = errors.New("invalid authorized key")
+)
+
+// UsersFile is the declarative file that defines login users for an image.
+type UsersFile struct {
+	Users []UserSpec `yaml:"users"`
+}
+
+// UserSpec defines a login user. Optional fields are left empty to use the
+// defaults, which are the next free IDs in the login user range, the default
+// login shell, no password, and no subordinate IDs.
+type UserSpec struct {
+	Name           string   `json:"name" yaml:"name"`
+	UID            *uint32  `json:"uid,omitempty" yaml:"uid"`
+	GID            *uint32  `json:"gid,omitempty" yaml:"gid"`
+	Shell          string   `json:"shell,omitempty" yaml:"shell"`
+	Groups         []string `json:"groups,omitempty" yaml:"groups"`
+	AuthorizedKeys []string `json:"authorized-keys,omitempty" yaml:"authorized-keys"`
+	PasswordHash   string   `json:"password-hash,omitempty" yaml:"password-hash"`
+	SubIDs         uint32   `json:"sub-ids,omitempty" yaml:"sub-ids"`
+}
+
+// ParseUsersFile parses and validates a users file.
+func ParseUsersFile(data []byte) ([]UserSpec, error) {
+	usersFile := &UsersFile{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(usersFile); err != nil {
+		return nil, fmt.Errorf("unable to parse users file: %w", err)
+	}
+	if err := ValidateUserSpecs(usersFile.Users); err != nil {
+		return nil, err
+	}
+	return usersFile.Users, nil
+}
+
+// ValidateUserSpecs checks that the user specs can be written to the login files.
+func ValidateUserSpecs(specs []UserSpec) error {
+	names := map[string]bool{}
+	for _, spec := range specs {
+		if !validName(spec.Name) {
+			return fmt.Errorf("%w: user %q", ErrInvalidName, spec.Name)
+		}
+		if names[spec.Name] {
+			return fmt.Errorf("%w: %s", ErrDuplicateUser, spec.Name)
+		}
+		names[spec.Name] = true
+		if len(spec.Shell) > 0 && !filepath.IsAbs(spec.Shell) {
+			return fmt.Errorf("%w: user %s has shell %s", ErrInvalidShell, spec.Name, spec.Shell)
+		}
+		for _, group := range spec.Groups {
+			if !validName(group) {
+				return fmt.Errorf("%w: user %s has group %q", ErrInvalidName, spec.Name, group)
+			}
+		}
+		for _, key := range spec.AuthorizedKeys {
+			if len(strings.TrimSpace(key)) == 0 || strings.ContainsAny(key, "\r\n") {
+				return fmt.Errorf("%w: user %s", ErrInvalidAuthorizedKey, spec.Name)
+			}
+		}
+		if len(spec.PasswordHash) > 0 {
+			if err := ValidatePasswordHash(spec.PasswordHash); err != nil {
+				return fmt.Errorf("%w: user %s", err, spec.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// validName returns true if name can be used as a user or group name in the
+// login files.
+func validName(name string) bool {
+	return len(name) > 0 && !strings.HasPrefix(name, "-") && !strings.HasPrefix(name, "+") &&
+		!strings.ContainsAny(name, ":,/ \t\r\n")
+}
+
+// AddUserSpec adds a login user defined by spec, with home directory homeDir
+// and a shell of defaultShell unless the spec gives one. The user is added to
+// the wheel group and to the supplementary groups in the spec, which must exist.
+// The authorized keys are written to the user's home directory on Commit.
+func (db *Database) AddUserSpec(spec UserSpec, homeDir, defaultShell string) (uint32, uint32, error) {
+	shell := defaultShell
+	if len(spec.Shell) > 0 {
+		shell = spec.Shell
+	}
+
+	uids := db.defs.uids()
+	if spec.UID != nil {
+		if _, ok := db.UserByUID(*spec.UID); ok {
+			return 0, 0, fmt.Errorf("UID %d is in use: %w", *spec.UID, ErrNoAvailableIDs)
+		}
+		uids = idRange{min: *spec.UID, max: *spec.UID}
+	}
+
+	// The primary group is a group with the user's name, unless a GID is given
+	// that belongs to an existing group.
+	groupname := spec.Name
+	gids := db.defs.gids()
+	if spec.GID != nil {
+		gids = idRange{min: *spec.GID, max: *spec.GID}
+		if group, ok := db.GroupByGID(*spec.GID); ok {
+			groupname = group.Groupname
+		} else if _, ok := db.Group(groupname); ok {
+			return 0, 0, fmt.Errorf("group %s exists without GID %d: %w", groupname,
+				*spec.GID, ErrGroupnameExists)
+		}
+	}
+
+	for _, group := range spec.Groups {
+		if _, ok := db.Group(group); !ok && group != constants.GroupNameWheel {
+			return 0, 0, fmt.Errorf("%s: %w", group, ErrGroupNotFound)
+		}
+	}
+
+	uid, gid, err := db.addUser(spec.Name, groupname, homeDir, shell, uids, gids,
+		true, true, false)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err = db.AddUserToGroups(spec.Name, spec.Groups...); err != nil {
+		return 0, 0, err
+	}
+
+	if len(spec.PasswordHash) > 0 {
+		if err = db.SetPassword(spec.Name, spec.PasswordHash); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if spec.SubIDs > 0 {
+		if _, _, err = db.AddSubIDs(spec.Name, spec.SubIDs); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if len(spec.AuthorizedKeys) > 0 {
+		home := &db.homeDirs[len(db.homeDirs)-1]
+		home.authorizedKeys = spec.AuthorizedKeys
+	}
+
+	return uid, gid, nil
+}
+
+func writeAuthorizedKeys(fs afero.Fs, homeDir string, keys []string, uid, gid uint32) error {
+	path := filepath.Join(homeDir, ".ssh", fileAuthorizedKeys)
+	if err := writeFile(fs, path, keys, 0600); err != nil {
+		return err
+	}
+	if err := fs.Chown(path, int(uid), int(gid)); err != nil {
+		return fmt.Errorf("unable to change ownership of %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package login
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cloudboss/easyto/pkg/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUsersFile(t *testing.T) {
+	u := func(i uint32) *uint32 { return &i }
+	testCases := []struct {
+		description string
+		content     string
+		users       []UserSpec
+		err         error
+		errContains string
+	}{
+		{
+			description: "Empty file",
+			content:     "",
+			errContains: "unable to parse users file",
+		},
+		{
+			description: "No users",
+			content:     "users: []\n",
+			users:       []UserSpec{},
+		},
+		{
+			description: "All fields",
+			content: `users:
+  - name: alice
+    uid: 2000
+    gid: 2001
+    shell: /bin/bash
+    groups: [adm, docker]
+    authorized-keys:
+      - ssh-ed25519 AAAA alice@laptop
+    password-hash: $6$salt$hash
+    sub-ids: 65536
+  - name: bob
+`,
+			users: []UserSpec{
+				{
+					Name:           "alice",
+					UID:            u(2000),
+					GID:            u(2001),
+					Shell:          "/bin/bash",
+					Groups:         []string{"adm", "docker"},
+					AuthorizedKeys: []string{"ssh-ed25519 AAAA alice@laptop"},
+					PasswordHash:   "$6$salt$hash",
+					SubIDs:         65536,
+				},
+				{Name: "bob"},
+			},
+		},
+		{
+			description: "Unknown field",
+			content:     "users:\n  - name: alice\n    home: /home/alice\n",
+			errContains: "field home not found",
+		},
+		{
+			description: "Negative UID",
+			content:     "users:\n  - name: alice\n    uid: -1\n",
+			errContains: "unable to parse users file",
+		},
+		{
+			description: "Missing name",
+			content:     "users:\n  - shell: /bin/sh\n",
+			err:         ErrInvalidName,
+		},
+		{
+			description: "Invalid name",
+			content:     "users:\n  - name: 'a:b'\n",
+			err:         ErrInvalidName,
+		},
+		{
+			description: "NIS style name",
+			content:     "users:\n  - name: +alice\n",
+			err:         ErrInvalidName,
+		},
+		{
+			description: "Invalid group",
+			content:     "users:\n  - name: alice\n    groups: ['a,b']\n",
+			err:         ErrInvalidName,
+		},
+		{
+			description: "Duplicate user",
+			content:     "users:\n  - name: alice\n  - name: alice\n",
+			err:         ErrDuplicateUser,
+		},
+		{
+			description: "Relative shell",
+			content:     "users:\n  - name: alice\n    shell: bash\n",
+			err:         ErrInvalidShell,
+		},
+		{
+			description: "Empty authorized key",
+			content:     "users:\n  - name: alice\n    authorized-keys: ['']\n",
+			err:         ErrInvalidAuthorizedKey,
+		},
+		{
+			description: "Multiline authorized key",
+			content:     "users:\n  - name: alice\n    authorized-keys: [\"ssh-rsa A\\nssh-rsa B\"]\n",
+			err:         ErrInvalidAuthorizedKey,
+		},
+		{
+			description: "Invalid password hash",
+			content:     "users:\n  - name: alice\n    password-hash: secret\n",
+			err:         ErrInvalidPasswordHash,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			users, err := ParseUsersFile([]byte(tc.content))
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			if tc.errContains != "" {
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.users, users)
+		})
+	}
+}
+
+func TestAddUserSpec(t *testing.T) {
+	p := func(s string) *string { return &s }
+	u := func(i uint32) *uint32 { return &i }
+	testCases := []struct {
+		description   string
+		spec          UserSpec
+		uid           uint32
+		gid           uint32
+		passwdResult  string
+		groupResult   string
+		gshadowResult string
+		err           error
+	}{
+		{
+			description:   "Defaults",
+			spec:          UserSpec{Name: "alice"},
+			uid:           1001,
+			gid:           1001,
+			passwdResult:  "alice:x:1001:1001:alice:/home/alice:/bin/sh\n",
+			groupResult:   "wheel:x:10:xyz,alice\nadm:x:4:\nxyz:x:1000:xyz\nusers:x:100:\nalice:x:1001:alice\n",
+			gshadowResult: "wheel:::xyz,alice\nadm:::\nxyz:!!::xyz\nalice:!!::alice\n",
+		},
+		{
+			description:   "Supplementary groups and shell",
+			spec:          UserSpec{Name: "alice", Shell: "/bin/bash", Groups: []string{"adm", "wheel"}},
+			uid:           1001,
+			gid:           1001,
+			passwdResult:  "alice:x:1001:1001:alice:/home/alice:/bin/bash\n",
+			groupResult:   "wheel:x:10:xyz,alice\nadm:x:4:alice\nxyz:x:1000:xyz\nusers:x:100:\nalice:x:1001:alice\n",
+			gshadowResult: "wheel:::xyz,alice\nadm:::alice\nxyz:!!::xyz\nalice:!!::alice\n",
+		},
+		{
+			description:   "UID and new GID",
+			spec:          UserSpec{Name: "alice", UID: u(2000), GID: u(3000)},
+			uid:           2000,
+			gid:           3000,
+			passwdResult:  "alice:x:2000:3000:alice:/home/alice:/bin/sh\n",
+			groupResult:   "wheel:x:10:xyz,alice\nadm:x:4:\nxyz:x:1000:xyz\nusers:x:100:\nalice:x:3000:alice\n",
+			gshadowResult: "wheel:::xyz,alice\nadm:::\nxyz:!!::xyz\nalice:!!::alice\n",
+		},
+		{
+			description:   "GID of existing group",
+			spec:          UserSpec{Name: "alice", GID: u(100)},
+			uid:           1001,
+			gid:           100,
+			passwdResult:  "alice:x:1001:100:alice:/home/alice:/bin/sh\n",
+			groupResult:   "wheel:x:10:xyz,alice\nadm:x:4:\nxyz:x:1000:xyz\nusers:x:100:\n",
+			gshadowResult: "wheel:::xyz,alice\nadm:::\nxyz:!!::xyz\nusers:!!::alice\n",
+		},
+		{
+			description:   "Password hash",
+			spec:          UserSpec{Name: "alice", PasswordHash: "$6$salt$hash"},
+			uid:           1001,
+			gid:           1001,
+			passwdResult:  "alice:$6$salt$hash:1001:1001:alice:/home/alice:/bin/sh\n",
+			groupResult:   "wheel:x:10:xyz,alice\nadm:x:4:\nxyz:x:1000:xyz\nusers:x:100:\nalice:x:1001:alice\n",
+			gshadowResult: "wheel:::xyz,alice\nadm:::\nxyz:!!::xyz\nalice:!!::alice\n",
+		},
+		{
+			description: "UID in use",
+			spec:        UserSpec{Name: "alice", UID: u(1000)},
+			err:         ErrNoAvailableIDs,
+		},
+		{
+			description:   "GID for new group",
+			spec:          UserSpec{Name: "xyz2", GID: u(3000)},
+			uid:           1001,
+			gid:           3000,
+			passwdResult:  "xyz2:x:1001:3000:xyz2:/home/xyz2:/bin/sh\n",
+			groupResult:   "wheel:x:10:xyz,xyz2\nadm:x:4:\nxyz:x:1000:xyz\nusers:x:100:\nxyz2:x:3000:xyz2\n",
+			gshadowResult: "wheel:::xyz,xyz2\nadm:::\nxyz:!!::xyz\nxyz2:!!::xyz2\n",
+		},
+		{
+			description: "Conflicting group name",
+			spec:        UserSpec{Name: "adm", GID: u(3000)},
+			err:         ErrGroupnameExists,
+		},
+		{
+			description: "Missing supplementary group",
+			spec:        UserSpec{Name: "alice", Groups: []string{"docker"}},
+			err:         ErrGroupNotFound,
+		},
+		{
+			description: "User exists",
+			spec:        UserSpec{Name: "xyz"},
+			err:         ErrUsernameExists,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			passwd := "xyz:x:1000:1000:xyz:/home/xyz:/bin/sh\n"
+			group := "wheel:x:10:xyz\nadm:x:4:\nxyz:x:1000:xyz\nusers:x:100:\n"
+			gshadow := "wheel:::xyz\nadm:::\nxyz:!!::xyz\n"
+			fs := loginSetup(p(passwd), nil, p(group), p(gshadow), "")
+			db, err := OpenDatabase(fs, "")
+			require.NoError(t, err)
+
+			homeDir := "/home/" + tc.spec.Name
+			uid, gid, err := db.AddUserSpec(tc.spec, homeDir, "/bin/sh")
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.uid, uid)
+			assert.Equal(t, tc.gid, gid)
+
+			require.NoError(t, db.Commit())
+			assert.Equal(t, passwd+tc.passwdResult, *loginRead(fs, constants.FileEtcPasswd))
+			assert.Equal(t, tc.groupResult, *loginRead(fs, constants.FileEtcGroup))
+			assert.Equal(t, tc.gshadowResult, *loginRead(fs, constants.FileEtcGShadow))
+			assert.True(t, loginExists(fs, homeDir+"/.ssh"))
+		})
+	}
+}
+
+func TestAddUserSpecAuthorizedKeys(t *testing.T) {
+	fs := loginSetup(nil, nil, nil, nil, "/base")
+	db, err := OpenDatabase(fs, "/base")
+	require.NoError(t, err)
+
+	spec := UserSpec{
+		Name:           "alice",
+		AuthorizedKeys: []string{"ssh-ed25519 AAAA alice@laptop", "ssh-rsa BBBB alice@desktop"},
+	}
+	_, _, err = db.AddUserSpec(spec, "/home/alice", "/bin/sh")
+	require.NoError(t, err)
+	_, _, err = db.AddUserSpec(UserSpec{Name: "bob"}, "/home/bob", "/bin/sh")
+	require.NoError(t, err)
+
+	keysFile := "/base/home/alice/.ssh/authorized_keys"
+	assert.False(t, loginExists(fs, keysFile))
+
+	require.NoError(t, db.Commit())
+
+	assert.Equal(t, "ssh-ed25519 AAAA alice@laptop\nssh-rsa BBBB alice@desktop\n",
+		*loginRead(fs, keysFile))
+	fi, err := fs.Stat(keysFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	assert.False(t, loginExists(fs, "/base/home/bob/.ssh/authorized_keys"))
+}
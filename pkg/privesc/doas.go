@@ -0,0 +1,166 @@
+package privesc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrDoasSyntax = errors.New("doas.conf syntax error")
+
+// ParseDoasConf checks the syntax of doas.conf content. Each rule has the form
+// `permit|deny [options] identity [as target] [cmd command [args ...]]`.
+func ParseDoasConf(content string) error {
+	for i, line := range strings.Split(content, "\n") {
+		tokens, err := doasTokens(line)
+		if err != nil {
+			return fmt.Errorf("%w on line %d: %s", ErrDoasSyntax, i+1, err)
+		}
+		if len(tokens) == 0 {
+			continue
+		}
+		if err = parseDoasRule(tokens); err != nil {
+			return fmt.Errorf("%w on line %d: %s", ErrDoasSyntax, i+1, err)
+		}
+	}
+	return nil
+}
+
+// doasTokens splits a line into words, handling double quoted strings,
+// backslash escapes, and comments.
+func doasTokens(line string) ([]string, error) {
+	var (
+		tokens  []string
+		current strings.Builder
+		inToken bool
+		quoted  bool
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(line) {
+				return nil, errors.New("unexpected end of line after \\")
+			}
+			i++
+			current.WriteByte(line[i])
+			inToken = true
+		case c == '"':
+			quoted = !quoted
+			inToken = true
+		case quoted:
+			current.WriteByte(c)
+		case c == '#':
+			i = len(line)
+		case c == ' ' || c == '\t':
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+		case c == '{' || c == '}':
+			if inToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				inToken = false
+			}
+			tokens = append(tokens, string(c))
+		default:
+			current.WriteByte(c)
+			inToken = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inToken {
+		tokens = append(tokens, current.String())
+	}
+	return tokens, nil
+}
+
+func parseDoasRule(tokens []string) error {
+	action := tokens[0]
+	if action != "permit" && action != "deny" {
+		return fmt.Errorf("expected permit or deny, got %q", action)
+	}
+	tokens = tokens[1:]
+
+	for len(tokens) > 0 {
+		switch tokens[0] {
+		case "nopass", "nolog", "persist", "keepenv":
+			if action == "deny" {
+				return fmt.Errorf("option %s is not allowed with deny", tokens[0])
+			}
+			tokens = tokens[1:]
+			continue
+		case "setenv":
+			if action == "deny" {
+				return errors.New("option setenv is not allowed with deny")
+			}
+			if len(tokens) < 2 || tokens[1] != "{" {
+				return errors.New("setenv requires a list in braces")
+			}
+			end := -1
+			for i, token := range tokens[2:] {
+				if token == "}" {
+					end = i + 2
+					break
+				}
+				if token == "{" {
+					return errors.New("unexpected { in setenv list")
+				}
+			}
+			if end == -1 {
+				return errors.New("missing } in setenv list")
+			}
+			tokens = tokens[end+1:]
+			continue
+		}
+		break
+	}
+
+	if len(tokens) == 0 {
+		return errors.New("missing identity")
+	}
+	if err := checkDoasIdentity(tokens[0], "identity"); err != nil {
+		return err
+	}
+	tokens = tokens[1:]
+
+	if len(tokens) > 0 && tokens[0] == "as" {
+		if len(tokens) < 2 {
+			return errors.New("missing target after as")
+		}
+		if err := checkDoasIdentity(tokens[1], "target"); err != nil {
+			return err
+		}
+		tokens = tokens[2:]
+	}
+
+	if len(tokens) > 0 && tokens[0] == "cmd" {
+		if len(tokens) < 2 || tokens[1] == "args" {
+			return errors.New("missing command after cmd")
+		}
+		tokens = tokens[2:]
+		if len(tokens) > 0 && tokens[0] == "args" {
+			tokens = nil
+		}
+	}
+
+	if len(tokens) > 0 {
+		return fmt.Errorf("unexpected %q", tokens[0])
+	}
+	return nil
+}
+
+func checkDoasIdentity(identity, kind string) error {
+	name := identity
+	if kind == "identity" {
+		name = strings.TrimPrefix(identity, ":")
+	}
+	if len(name) == 0 || strings.ContainsAny(name, "{}:") {
+		return fmt.Errorf("invalid %s %q", kind, identity)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+// Package privesc configures sudo or doas in an image so that members of a
+// group can run commands as root.
+package privesc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudboss/easyto/pkg/rootfs"
+	"github.com/spf13/afero"
+)
+
+const (
+	// MethodNone does not configure privilege escalation.
+	MethodNone = "none"
+	// MethodAuto configures sudo if it is in the image, otherwise doas.
+	MethodAuto = "auto"
+	// MethodSudo configures sudo, which must be in the image.
+	MethodSudo = "sudo"
+	// MethodDoas configures doas, which must be in the image.
+	MethodDoas = "doas"
+
+	FileSudoers       = "/etc/sudoers"
+	FileSudoersDropIn = "/etc/sudoers.d/easyto-wheel"
+	FileDoasConf      = "/etc/doas.conf"
+
+	modeSudoers  = 0440
+	modeDoasConf = 0600
+)
+
+var (
+	ErrInvalidMethod = errors.New("invalid privilege escalation method")
+	ErrNoBinary      = errors.New("privilege escalation binary not found in image")
+
+	binDirs = []string{"/usr/bin", "/bin", "/usr/sbin", "/sbin", "/usr/local/bin", "/usr/local/sbin"}
+)
+
+// ValidateMethod returns an error if method is not one of the known methods.
+func ValidateMethod(method string) error {
+	switch method {
+	case MethodNone, MethodAuto, MethodSudo, MethodDoas:
+		return nil
+	default:
+		return fmt.Errorf("%w %q, must be one of %s, %s, %s, or %s", ErrInvalidMethod, method,
+			MethodNone, MethodAuto, MethodSudo, MethodDoas)
+	}
+}
+
+// Setup allows members of group to run any command as root without a password,
+// using method in the image under baseDir. The configuration is validated
+// before it is written. The method that was configured is returned, which is
+// only different from method if it is MethodAuto.
+func Setup(fs afero.Fs, baseDir, method, group string) (string, error) {
+	if err := ValidateMethod(method); err != nil {
+		return "", err
+	}
+	if method == MethodNone {
+		return MethodNone, nil
+	}
+
+	hasSudo, err := hasBinary(fs, baseDir, MethodSudo)
+	if err != nil {
+		return "", err
+	}
+	hasDoas, err := hasBinary(fs, baseDir, MethodDoas)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case method == MethodAuto && hasSudo, method == MethodSudo && hasSudo:
+		return MethodSudo, setupSudo(fs, baseDir, group)
+	case method == MethodAuto && hasDoas, method == MethodDoas && hasDoas:
+		return MethodDoas, setupDoas(fs, baseDir, group)
+	case method == MethodAuto:
+		return "", fmt.Errorf("%w: neither sudo nor doas is installed", ErrNoBinary)
+	default:
+		return "", fmt.Errorf("%w: %s", ErrNoBinary, method)
+	}
+}
+
+// hasBinary returns true if an executable regular file with the given name is
+// in one of the usual directories under baseDir. Symbolic links are resolved
+// within baseDir, as they would be in the running image.
+func hasBinary(fs afero.Fs, baseDir, name string) (bool, error) {
+	for _, dir := range binDirs {
+		path := filepath.Join(dir, name)
+		fi, err := rootfs.Stat(fs, baseDir, path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("unable to stat %s: %w", path, err)
+		}
+		if fi.Mode().IsRegular() && fi.Mode().Perm()&0111 != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func setupSudo(fs afero.Fs, baseDir, group string) error {
+	rule := fmt.Sprintf("%%%s ALL=(ALL:ALL) NOPASSWD: ALL", group)
+
+	fileSudoers := filepath.Join(baseDir, FileSudoers)
+	sudoers, err := afero.ReadFile(fs, fileSudoers)
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %w", fileSudoers, err)
+	}
+
+	// The rule goes in a drop-in file if sudoers includes the directory,
+	// otherwise it is appended to sudoers itself.
+	path := filepath.Join(baseDir, FileSudoersDropIn)
+	content := "# Added by easyto.\n" + rule + "\n"
+	mode := os.FileMode(modeSudoers)
+	if !includesDir(string(sudoers), filepath.Dir(FileSudoersDropIn)) {
+		path = fileSudoers
+		content = appendLine(string(sudoers), rule)
+		fi, err := fs.Stat(fileSudoers)
+		if err != nil {
+			return fmt.Errorf("unable to stat %s: %w", fileSudoers, err)
+		}
+		mode = fi.Mode().Perm()
+	}
+
+	if err := ParseSudoers(content); err != nil {
+		return fmt.Errorf("invalid sudoers configuration: %w", err)
+	}
+	if err := fs.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return fmt.Errorf("unable to create %s: %w", filepath.Dir(path), err)
+	}
+	return writeFile(fs, path, content, mode)
+}
+
+func setupDoas(fs afero.Fs, baseDir, group string) error {
+	rule := fmt.Sprintf("permit nopass :%s", group)
+
+	path := filepath.Join(baseDir, FileDoasConf)
+	content := ""
+	mode := os.FileMode(modeDoasConf)
+	fi, err := fs.Stat(path)
+	switch {
+	case err == nil:
+		existing, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %w", path, err)
+		}
+		content = string(existing)
+		mode = fi.Mode().Perm()
+	case !os.IsNotExist(err):
+		return fmt.Errorf("unable to stat %s: %w", path, err)
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		if strings.Join(strings.Fields(line), " ") == rule {
+			return nil
+		}
+	}
+	content = appendLine(content, rule)
+
+	if err := ParseDoasConf(content); err != nil {
+		return fmt.Errorf("invalid doas configuration: %w", err)
+	}
+	return writeFile(fs, path, content, mode)
+}
+
+// includesDir returns true if sudoers has an includedir directive for dir.
+func includesDir(sudoers, dir string) bool {
+	for _, line := range strings.Split(sudoers, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && (fields[0] == "#includedir" || fields[0] == "@includedir") &&
+			filepath.Clean(fields[1]) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func appendLine(content, line string) string {
+	if len(content) > 0 && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + line + "\n"
+}
+
+func writeFile(fs afero.Fs, path, content string, mode os.FileMode) error {
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("unable to open %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(content); err != nil {
+		return fmt.Errorf("unable to write %s: %w", path, err)
+	}
+	if err = fs.Chmod(path, mode); err != nil {
+		return fmt.Errorf("unable to set permissions on %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,431 @@
+package privesc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSudoers(t *testing.T) {
+	testCases := []struct {
+		description string
+		content     string
+		errContains string
+	}{
+		{
+			description: "Empty",
+			content:     "",
+		},
+		{
+			description: "Debian sudoers",
+			content: `#
+# This file MUST be edited with the 'visudo' command as root.
+#
+Defaults	env_reset
+Defaults	mail_badpass
+Defaults	secure_path="/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+Defaults:%sudo env_keep += "EDITOR"
+
+# User privilege specification
+root	ALL=(ALL:ALL) ALL
+
+# Allow members of group sudo to execute any command
+%sudo	ALL=(ALL:ALL) ALL
+
+@includedir /etc/sudoers.d
+`,
+		},
+		{
+			description: "Aliases and tags",
+			content: `User_Alias ADMINS = alice, bob
+Cmnd_Alias SERVICES = /usr/bin/systemctl restart *, \
+	/usr/bin/systemctl status *
+ADMINS ALL = (root) NOPASSWD: SETENV: SERVICES, /usr/bin/id
+#1000 ALL = (ALL) ALL
+#include /etc/sudoers.local
+`,
+		},
+		{
+			description: "Wheel rule",
+			content:     "%wheel ALL=(ALL:ALL) NOPASSWD: ALL",
+		},
+		{
+			description: "Missing equals",
+			content:     "root ALL ALL\n",
+			errContains: "line 1: missing = in user specification",
+		},
+		{
+			description: "Missing host",
+			content:     "\n%wheel = ALL\n",
+			errContains: "line 2: expected a user list and a host list before =",
+		},
+		{
+			description: "Unterminated runas",
+			content:     "%wheel ALL=(ALL ALL\n",
+			errContains: "missing ) in runas specification",
+		},
+		{
+			description: "Relative command",
+			content:     "%wheel ALL=(ALL) NOPASSWD: id\n",
+			errContains: `invalid command "id"`,
+		},
+		{
+			description: "Unknown tag",
+			content:     "%wheel ALL=(ALL) NOPASSWORD: ALL\n",
+			errContains: `invalid command "NOPASSWORD: ALL"`,
+		},
+		{
+			description: "Missing command",
+			content:     "%wheel ALL=(ALL) NOPASSWD:\n",
+			errContains: "missing command list",
+		},
+		{
+			description: "Include without path",
+			content:     "@includedir\n",
+			errContains: "@includedir requires a single path",
+		},
+		{
+			description: "Invalid alias name",
+			content:     "User_Alias admins = alice\n",
+			errContains: "invalid User_Alias",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := ParseSudoers(tc.content)
+			if tc.errContains != "" {
+				assert.ErrorIs(t, err, ErrSudoersSyntax)
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestParseDoasConf(t *testing.T) {
+	testCases := []struct {
+		description string
+		content     string
+		errContains string
+	}{
+		{
+			description: "Empty",
+			content:     "",
+		},
+		{
+			description: "Typical rules",
+			content: `# Allow wheel to do anything.
+permit persist keepenv :wheel
+permit nopass alice as root cmd /usr/bin/id
+permit setenv { -ENV PS1=$DOAS_PS1 SSH_AUTH_SOCK } :wheel
+permit nolog bob cmd "/usr/bin/systemctl" args restart nginx  # comment
+deny carol
+permit nopass dave cmd reboot args
+`,
+		},
+		{
+			description: "Wheel rule",
+			content:     "permit nopass :wheel",
+		},
+		{
+			description: "Unknown action",
+			content:     "allow :wheel\n",
+			errContains: `line 1: expected permit or deny, got "allow"`,
+		},
+		{
+			description: "Option with deny",
+			content:     "\ndeny nopass :wheel\n",
+			errContains: "line 2: option nopass is not allowed with deny",
+		},
+		{
+			description: "Missing identity",
+			content:     "permit nopass\n",
+			errContains: "missing identity",
+		},
+		{
+			description: "Empty group",
+			content:     "permit :\n",
+			errContains: `invalid identity ":"`,
+		},
+		{
+			description: "Missing target",
+			content:     "permit alice as\n",
+			errContains: "missing target after as",
+		},
+		{
+			description: "Args without cmd",
+			content:     "permit alice args foo\n",
+			errContains: `unexpected "args"`,
+		},
+		{
+			description: "Missing command",
+			content:     "permit alice cmd\n",
+			errContains: "missing command after cmd",
+		},
+		{
+			description: "Unterminated setenv",
+			content:     "permit setenv { FOO :wheel\n",
+			errContains: "missing } in setenv list",
+		},
+		{
+			description: "Unterminated quote",
+			content:     `permit alice cmd "/usr/bin/id` + "\n",
+			errContains: "unterminated quoted string",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := ParseDoasConf(tc.content)
+			if tc.errContains != "" {
+				assert.ErrorIs(t, err, ErrDoasSyntax)
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestSetup(t *testing.T) {
+	type file struct {
+		content string
+		mode    os.FileMode
+	}
+	const sudoersIncludeDir = "root ALL=(ALL:ALL) ALL\n@includedir /etc/sudoers.d\n"
+	testCases := []struct {
+		description string
+		method      string
+		files       map[string]file
+		result      string
+		expected    map[string]file
+		absent      []string
+		errIs       error
+	}{
+		{
+			description: "None",
+			method:      MethodNone,
+			result:      MethodNone,
+			absent:      []string{FileSudoersDropIn, FileDoasConf},
+		},
+		{
+			description: "Sudo with includedir",
+			method:      MethodSudo,
+			files: map[string]file{
+				"/usr/bin/sudo": {"", 0755},
+				FileSudoers:     {sudoersIncludeDir, 0440},
+			},
+			result: MethodSudo,
+			expected: map[string]file{
+				FileSudoers: {sudoersIncludeDir, 0440},
+				FileSudoersDropIn: {
+					"# Added by easyto.\n%wheel ALL=(ALL:ALL) NOPASSWD: ALL\n", 0440,
+				},
+			},
+		},
+		{
+			description: "Sudo without includedir",
+			method:      MethodSudo,
+			files: map[string]file{
+				"/usr/bin/sudo": {"", 0755},
+				FileSudoers:     {"root ALL=(ALL:ALL) ALL\n# @includedir /etc/sudoers.d", 0400},
+			},
+			result: MethodSudo,
+			expected: map[string]file{
+				FileSudoers: {
+					"root ALL=(ALL:ALL) ALL\n# @includedir /etc/sudoers.d\n" +
+						"%wheel ALL=(ALL:ALL) NOPASSWD: ALL\n",
+					0400,
+				},
+			},
+			absent: []string{FileSudoersDropIn},
+		},
+		{
+			description: "Sudo without sudoers",
+			method:      MethodSudo,
+			files: map[string]file{
+				"/usr/bin/sudo": {"", 0755},
+			},
+			errIs: os.ErrNotExist,
+		},
+		{
+			description: "Sudo with invalid sudoers",
+			method:      MethodSudo,
+			files: map[string]file{
+				"/usr/bin/sudo": {"", 0755},
+				FileSudoers:     {"root ALL ALL\n", 0440},
+			},
+			errIs: ErrSudoersSyntax,
+		},
+		{
+			description: "Sudo not installed",
+			method:      MethodSudo,
+			files: map[string]file{
+				"/usr/bin/doas": {"", 0755},
+			},
+			errIs: ErrNoBinary,
+		},
+		{
+			description: "Sudo not executable",
+			method:      MethodSudo,
+			files: map[string]file{
+				"/usr/bin/sudo": {"", 0644},
+				FileSudoers:     {sudoersIncludeDir, 0440},
+			},
+			errIs: ErrNoBinary,
+		},
+		{
+			description: "Doas without doas.conf",
+			method:      MethodDoas,
+			files: map[string]file{
+				"/bin/doas": {"", 0755},
+			},
+			result: MethodDoas,
+			expected: map[string]file{
+				FileDoasConf: {"permit nopass :wheel\n", 0600},
+			},
+		},
+		{
+			description: "Doas with doas.conf",
+			method:      MethodDoas,
+			files: map[string]file{
+				"/bin/doas":  {"", 0755},
+				FileDoasConf: {"permit persist alice", 0640},
+			},
+			result: MethodDoas,
+			expected: map[string]file{
+				FileDoasConf: {"permit persist alice\npermit nopass :wheel\n", 0640},
+			},
+		},
+		{
+			description: "Doas rule already present",
+			method:      MethodDoas,
+			files: map[string]file{
+				"/bin/doas":  {"", 0755},
+				FileDoasConf: {"permit  nopass\t:wheel\n", 0600},
+			},
+			result: MethodDoas,
+			expected: map[string]file{
+				FileDoasConf: {"permit  nopass\t:wheel\n", 0600},
+			},
+		},
+		{
+			description: "Doas with invalid doas.conf",
+			method:      MethodDoas,
+			files: map[string]file{
+				"/bin/doas":  {"", 0755},
+				FileDoasConf: {"allow alice\n", 0600},
+			},
+			errIs: ErrDoasSyntax,
+		},
+		{
+			description: "Auto prefers sudo",
+			method:      MethodAuto,
+			files: map[string]file{
+				"/usr/bin/sudo": {"", 0755},
+				"/usr/bin/doas": {"", 0755},
+				FileSudoers:     {sudoersIncludeDir, 0440},
+			},
+			result: MethodSudo,
+			absent: []string{FileDoasConf},
+		},
+		{
+			description: "Auto falls back to doas",
+			method:      MethodAuto,
+			files: map[string]file{
+				"/usr/local/bin/doas": {"", 0755},
+			},
+			result: MethodDoas,
+			expected: map[string]file{
+				FileDoasConf: {"permit nopass :wheel\n", 0600},
+			},
+		},
+		{
+			description: "Auto with nothing installed",
+			method:      MethodAuto,
+			errIs:       ErrNoBinary,
+		},
+		{
+			description: "Invalid method",
+			method:      "su",
+			errIs:       ErrInvalidMethod,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			baseDir := "/base"
+			fs := afero.NewMemMapFs()
+			for path, f := range tc.files {
+				require.NoError(t, afero.WriteFile(fs, baseDir+path, []byte(f.content), f.mode))
+			}
+
+			result, err := Setup(fs, baseDir, tc.method, "wheel")
+			if tc.errIs != nil {
+				assert.ErrorIs(t, err, tc.errIs)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.result, result)
+
+			for path, f := range tc.expected {
+				content, err := afero.ReadFile(fs, baseDir+path)
+				require.NoError(t, err)
+				assert.Equal(t, f.content, string(content))
+				fi, err := fs.Stat(baseDir + path)
+				require.NoError(t, err)
+				assert.Equal(t, f.mode, fi.Mode().Perm())
+			}
+			for _, path := range tc.absent {
+				_, err := fs.Stat(baseDir + path)
+				assert.True(t, os.IsNotExist(err))
+			}
+		})
+	}
+}
+
+func TestHasBinary(t *testing.T) {
+	baseDir := t.TempDir()
+	for _, dir := range []string{"usr/bin", "usr/libexec", "bin"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(baseDir, dir), 0755))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(baseDir, "usr/libexec/sudo"), nil, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(baseDir, "usr/libexec/doas"), nil, 0644))
+	require.NoError(t, os.Symlink("/usr/libexec/sudo", filepath.Join(baseDir, "usr/bin/sudo")))
+	require.NoError(t, os.Symlink("../usr/libexec/doas", filepath.Join(baseDir, "bin/doas")))
+	require.NoError(t, os.Symlink("/usr/libexec", filepath.Join(baseDir, "usr/bin/su")))
+
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "busybox"), nil, 0755))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "busybox"),
+		filepath.Join(baseDir, "usr/bin/busybox")))
+
+	testCases := []struct {
+		name  string
+		found bool
+	}{
+		{name: "sudo", found: true},
+		{name: "doas", found: false},
+		{name: "su", found: false},
+		{name: "busybox", found: false},
+		{name: "missing", found: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			found, err := hasBinary(afero.NewOsFs(), baseDir, tc.name)
+			require.NoError(t, err)
+			assert.Equal(t, tc.found, found)
+		})
+	}
+}
+
+func TestValidateMethod(t *testing.T) {
+	for _, method := range []string{MethodNone, MethodAuto, MethodSudo, MethodDoas} {
+		assert.NoError(t, ValidateMethod(method))
+	}
+	assert.ErrorIs(t, ValidateMethod(""), ErrInvalidMethod)
+	assert.ErrorIs(t, ValidateMethod("su"), ErrInvalidMethod)
+}
@@ -0,0 +1,154 @@
+package privesc
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrSudoersSyntax = errors.New("sudoers syntax error")
+
+	sudoersAliasName = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	sudoersUser      = regexp.MustCompile(`^!*(ALL|%:?[^\s,:=()!]+|#[0-9]+|\+[^\s,:=()!]+|[^\s,:=()!#%+][^\s,:=()!]*)$`)
+	sudoersHost      = regexp.MustCompile(`^!*[^\s,:=()!]+$`)
+	sudoersCommand   = regexp.MustCompile(`^!*(ALL|sudoedit(\s.*)?|/\S*(\s.*)?|[A-Z][A-Z0-9_]*)$`)
+	sudoersUIDSpec   = regexp.MustCompile(`^#[0-9]+\s`)
+	sudoersListSep   = regexp.MustCompile(`\s*,\s*`)
+
+	sudoersTags = map[string]bool{
+		"EXEC": true, "NOEXEC": true, "FOLLOW": true, "NOFOLLOW": true,
+		"INTERCEPT": true, "NOINTERCEPT": true, "LOG_INPUT": true, "NOLOG_INPUT": true,
+		"LOG_OUTPUT": true, "NOLOG_OUTPUT": true, "MAIL": true, "NOMAIL": true,
+		"PASSWD": true, "NOPASSWD": true, "SETENV": true, "NOSETENV": true,
+	}
+)
+
+// ParseSudoers checks the syntax of sudoers content. It supports the subset
+// of the sudoers format needed for simple rules: comments, include directives,
+// Defaults lines, aliases, and user specifications of the form
+// `users hosts = [(runas)] [TAG:...] commands`.
+func ParseSudoers(content string) error {
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNum := i + 1
+		line := lines[i]
+		for strings.HasSuffix(line, `\`) && i+1 < len(lines) {
+			i++
+			line = strings.TrimSuffix(line, `\`) + " " + lines[i]
+		}
+		if err := parseSudoersLine(strings.TrimSpace(line)); err != nil {
+			return fmt.Errorf("%w on line %d: %s", ErrSudoersSyntax, lineNum, err)
+		}
+	}
+	return nil
+}
+
+func parseSudoersLine(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "#include", "#includedir", "@include", "@includedir":
+		if len(fields) != 2 {
+			return fmt.Errorf("%s requires a single path", fields[0])
+		}
+		return nil
+	case "User_Alias", "Runas_Alias", "Host_Alias", "Cmnd_Alias", "Cmd_Alias":
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, fields[0]), "=")
+		if !ok || !sudoersAliasName.MatchString(strings.TrimSpace(name)) ||
+			len(strings.TrimSpace(value)) == 0 {
+			return fmt.Errorf("invalid %s", fields[0])
+		}
+		return nil
+	}
+
+	// A # followed by digits is a UID in a user specification, otherwise it
+	// begins a comment.
+	if strings.HasPrefix(line, "#") && !sudoersUIDSpec.MatchString(line) {
+		return nil
+	}
+
+	if strings.HasPrefix(fields[0], "Defaults") {
+		if len(fields) < 2 {
+			return errors.New("Defaults requires a parameter")
+		}
+		return nil
+	}
+
+	return parseSudoersUserSpec(line)
+}
+
+func parseSudoersUserSpec(line string) error {
+	lhs, rhs, ok := strings.Cut(line, "=")
+	if !ok {
+		return errors.New("missing = in user specification")
+	}
+
+	lists := strings.Fields(normalizeLists(lhs))
+	if len(lists) != 2 {
+		return errors.New("expected a user list and a host list before =")
+	}
+	if err := checkList(lists[0], sudoersUser, "user"); err != nil {
+		return err
+	}
+	if err := checkList(lists[1], sudoersHost, "host"); err != nil {
+		return err
+	}
+
+	rhs = strings.TrimSpace(rhs)
+	if strings.HasPrefix(rhs, "(") {
+		runas, rest, ok := strings.Cut(rhs[1:], ")")
+		if !ok {
+			return errors.New("missing ) in runas specification")
+		}
+		users, groups, _ := strings.Cut(runas, ":")
+		for _, list := range []string{users, groups} {
+			list = strings.TrimSpace(normalizeLists(list))
+			if len(list) == 0 {
+				continue
+			}
+			if err := checkList(list, sudoersUser, "runas"); err != nil {
+				return err
+			}
+		}
+		rhs = strings.TrimSpace(rest)
+	}
+
+	for {
+		tag, rest, ok := strings.Cut(rhs, ":")
+		if !ok || !sudoersTags[strings.TrimSpace(tag)] {
+			break
+		}
+		rhs = strings.TrimSpace(rest)
+	}
+
+	if len(rhs) == 0 {
+		return errors.New("missing command list")
+	}
+	for _, command := range strings.Split(rhs, ",") {
+		command = strings.TrimSpace(command)
+		if !sudoersCommand.MatchString(command) {
+			return fmt.Errorf("invalid command %q", command)
+		}
+	}
+	return nil
+}
+
+// normalizeLists removes whitespace around commas so that each list is a
+// single field.
+func normalizeLists(s string) string {
+	return sudoersListSep.ReplaceAllString(s, ",")
+}
+
+func checkList(list string, item *regexp.Regexp, kind string) error {
+	for _, entry := range strings.Split(list, ",") {
+		if !item.MatchString(entry) {
+			return fmt.Errorf("invalid %s %q", kind, entry)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+// Package rootfs looks up paths in a directory tree that is the root
+// filesystem of an image, without following symbolic links out of it.
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const maxSymlinks = 40
+
+// Stat returns information about path within baseDir, following symbolic links
+// as if baseDir were the root directory. If fs does not support symbolic
+// links, path is joined to baseDir and stat'd directly.
+func Stat(fs afero.Fs, baseDir, path string) (os.FileInfo, error) {
+	resolved, err := Resolve(fs, baseDir, path)
+	if err != nil {
+		return nil, err
+	}
+	return fs.Stat(filepath.Join(baseDir, resolved))
+}
+
+// Resolve returns path with the symbolic links in it followed as if baseDir
+// were the root directory. The result is an absolute path relative to
+// baseDir, whose components are not symbolic links. Components that do not
+// exist are kept as they are, so that path may be created by joining the
+// result to baseDir. If fs does not support symbolic links, path is cleaned
+// and returned.
+func Resolve(fs afero.Fs, baseDir, path string) (string, error) {
+	lstater, canLstat := fs.(afero.Lstater)
+	linkReader, canReadlink := fs.(afero.LinkReader)
+	if !canLstat || !canReadlink {
+		return filepath.Join("/", path), nil
+	}
+
+	var (
+		resolved  = "/"
+		remaining = strings.Split(path, "/")
+		links     = 0
+	)
+	for len(remaining) > 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		fullPath := filepath.Join(baseDir, next)
+		fi, _, err := lstater.LstatIfPossible(fullPath)
+		if os.IsNotExist(err) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", path)
+		}
+		target, err := linkReader.ReadlinkIfPossible(fullPath)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		remaining = append(strings.Split(target, "/"), remaining...)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,156 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStat(t *testing.T) {
+	baseDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(baseDir, "usr/bin"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(baseDir, "usr/bin/busybox"), nil, 0755))
+	require.NoError(t, os.Symlink("usr/bin", filepath.Join(baseDir, "bin")))
+	require.NoError(t, os.Symlink("busybox", filepath.Join(baseDir, "usr/bin/relative")))
+	require.NoError(t, os.Symlink("/usr/bin/busybox", filepath.Join(baseDir, "usr/bin/absolute")))
+	require.NoError(t, os.Symlink("../../../../usr/bin/busybox",
+		filepath.Join(baseDir, "usr/bin/dotdot")))
+	require.NoError(t, os.Symlink("loop", filepath.Join(baseDir, "usr/bin/loop")))
+
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "sudo"), nil, 0755))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "sudo"),
+		filepath.Join(baseDir, "usr/bin/outside")))
+
+	testCases := []struct {
+		description string
+		path        string
+		isDir       bool
+		notExist    bool
+		errContains string
+	}{
+		{
+			description: "Regular file",
+			path:        "/usr/bin/busybox",
+		},
+		{
+			description: "Directory",
+			path:        "/usr/bin",
+			isDir:       true,
+		},
+		{
+			description: "Relative link",
+			path:        "/usr/bin/relative",
+		},
+		{
+			description: "Absolute link",
+			path:        "/usr/bin/absolute",
+		},
+		{
+			description: "Link in a parent directory",
+			path:        "/bin/relative",
+		},
+		{
+			description: "Link above the root",
+			path:        "/usr/bin/dotdot",
+		},
+		{
+			description: "Link outside of the root",
+			path:        "/usr/bin/outside",
+			notExist:    true,
+		},
+		{
+			description: "Missing file",
+			path:        "/usr/bin/sudo",
+			notExist:    true,
+		},
+		{
+			description: "Link loop",
+			path:        "/usr/bin/loop",
+			errContains: "too many levels of symbolic links",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			fi, err := Stat(afero.NewOsFs(), baseDir, tc.path)
+			switch {
+			case tc.notExist:
+				assert.True(t, os.IsNotExist(err))
+			case len(tc.errContains) > 0:
+				assert.ErrorContains(t, err, tc.errContains)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, tc.isDir, fi.IsDir())
+				assert.Equal(t, os.FileMode(0), fi.Mode()&os.ModeSymlink)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	baseDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(baseDir, "var/lib"), 0755))
+	require.NoError(t, os.Symlink("/var/lib/data", filepath.Join(baseDir, "data")))
+	require.NoError(t, os.Symlink("lib", filepath.Join(baseDir, "var/relative")))
+	require.NoError(t, os.Symlink("/etc", filepath.Join(baseDir, "etc-link")))
+	require.NoError(t, os.Symlink("../../../../srv", filepath.Join(baseDir, "var/lib/dotdot")))
+	require.NoError(t, os.Symlink("loop", filepath.Join(baseDir, "loop")))
+
+	testCases := []struct {
+		description string
+		path        string
+		resolved    string
+		errContains string
+	}{
+		{
+			description: "Existing directory",
+			path:        "/var/lib",
+			resolved:    "/var/lib",
+		},
+		{
+			description: "Missing components are kept",
+			path:        "/var/lib/app/cache",
+			resolved:    "/var/lib/app/cache",
+		},
+		{
+			description: "Absolute link to a missing path",
+			path:        "/data",
+			resolved:    "/var/lib/data",
+		},
+		{
+			description: "Relative link with missing components",
+			path:        "/var/relative/app",
+			resolved:    "/var/lib/app",
+		},
+		{
+			description: "Absolute link to a host path",
+			path:        "/etc-link/app",
+			resolved:    "/etc/app",
+		},
+		{
+			description: "Link above the root",
+			path:        "/var/lib/dotdot/app",
+			resolved:    "/srv/app",
+		},
+		{
+			description: "Link loop",
+			path:        "/loop/app",
+			errContains: "too many levels of symbolic links",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			resolved, err := Resolve(afero.NewOsFs(), baseDir, tc.path)
+			if len(tc.errContains) > 0 {
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.resolved, resolved)
+		})
+	}
+}
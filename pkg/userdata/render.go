@@ -0,0 +1,90 @@
+package userdata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatRaw    = "raw"
+	FormatGzip   = "gzip"
+	FormatBase64 = "base64"
+
+	// MaxSize is the EC2 limit on the size of user data before it is
+	// base64 encoded.
+	MaxSize = 16 * 1024
+)
+
+var (
+	Formats = []string{FormatRaw, FormatGzip, FormatBase64}
+
+	ErrInvalidFormat = errors.New("invalid user data format")
+)
+
+// ValidateFormat returns an error if format is not a valid user data format.
+func ValidateFormat(format string) error {
+	if !slices.Contains(Formats, format) {
+		return fmt.Errorf("%w %q, must be one of %v", ErrInvalidFormat, format, Formats)
+	}
+	return nil
+}
+
+// Render validates userData and encodes it as YAML in the given format. The
+// gzip format is gzipped YAML, and the base64 format is base64 encoded gzipped
+// YAML, as used in launch templates. The output is the same for the same
+// input. The size of the user data as counted against MaxSize, which is its
+// size before base64 encoding, is returned with the rendered user data.
+func Render(userData *UserData, format string) ([]byte, int, error) {
+	if err := ValidateFormat(format); err != nil {
+		return nil, 0, err
+	}
+
+	buf := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(userData); err != nil {
+		return nil, 0, fmt.Errorf("unable to encode user data: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, 0, fmt.Errorf("unable to encode user data: %w", err)
+	}
+	rendered := buf.Bytes()
+
+	problems, err := validate(rendered)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(problems) > 0 {
+		return nil, 0, &ValidationError{Problems: problems}
+	}
+
+	if format == FormatRaw {
+		return rendered, len(rendered), nil
+	}
+
+	compressed := &bytes.Buffer{}
+	writer, err := gzip.NewWriterLevel(compressed, gzip.BestCompression)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to compress user data: %w", err)
+	}
+	if _, err = writer.Write(rendered); err != nil {
+		return nil, 0, fmt.Errorf("unable to compress user data: %w", err)
+	}
+	if err = writer.Close(); err != nil {
+		return nil, 0, fmt.Errorf("unable to compress user data: %w", err)
+	}
+	rendered = compressed.Bytes()
+
+	if format == FormatGzip {
+		return rendered, len(rendered), nil
+	}
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(rendered)))
+	base64.StdEncoding.Encode(encoded, rendered)
+	return encoded, len(rendered), nil
+}
@@ -0,0 +1,113 @@
+package userdata
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	userData := &UserData{
+		Args:    StringList{},
+		Command: StringList{"/app", "$(IPV4_ADDRESS):8080"},
+		EnvFrom: []EnvFrom{
+			{IMDS: &IMDSEnv{Name: "IPV4_ADDRESS", Path: "local-ipv4"}},
+		},
+		Volumes: []Volume{
+			{
+				SSM: &SSMVolume{
+					Path:  "/abc",
+					Mount: Mount{Destination: "/abc", Mode: "0700"},
+				},
+			},
+		},
+	}
+	raw := `args: []
+command:
+  - /app
+  - $(IPV4_ADDRESS):8080
+env-from:
+  - imds:
+      name: IPV4_ADDRESS
+      path: local-ipv4
+volumes:
+  - ssm:
+      path: /abc
+      mount:
+        destination: /abc
+        mode: "0700"
+`
+
+	testCases := []struct {
+		description string
+		userData    *UserData
+		format      string
+		err         error
+		errContains string
+	}{
+		{
+			description: "Raw",
+			userData:    userData,
+			format:      FormatRaw,
+		},
+		{
+			description: "Gzip",
+			userData:    userData,
+			format:      FormatGzip,
+		},
+		{
+			description: "Base64",
+			userData:    userData,
+			format:      FormatBase64,
+		},
+		{
+			description: "Invalid format",
+			userData:    userData,
+			format:      "zip",
+			err:         ErrInvalidFormat,
+		},
+		{
+			description: "Invalid user data",
+			userData: &UserData{
+				Volumes: []Volume{{EBS: &EBSVolume{}, S3: &S3Volume{Bucket: "abc"}}},
+			},
+			format:      FormatRaw,
+			errContains: "volume must define only one of",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			rendered, size, err := Render(tc.userData, tc.format)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+			if len(tc.errContains) > 0 {
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			require.NoError(t, err)
+
+			again, _, err := Render(tc.userData, tc.format)
+			require.NoError(t, err)
+			assert.Equal(t, rendered, again)
+
+			sized := rendered
+			if tc.format == FormatBase64 {
+				sized, err = base64.StdEncoding.DecodeString(string(rendered))
+				require.NoError(t, err)
+			}
+			assert.Equal(t, len(sized), size)
+
+			decompressed, err := Decompress(sized)
+			require.NoError(t, err)
+			assert.Equal(t, raw, string(decompressed))
+
+			parsed, err := Parse(sized)
+			require.NoError(t, err)
+			assert.Equal(t, tc.userData, parsed)
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package userdata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// UserData is the user data read by init when an instance boots.
+type UserData struct {
+	Args                StringList  `json:"args,omitzero" yaml:"args,omitempty"`
+	Command             StringList  `json:"command,omitzero" yaml:"command,omitempty"`
+	Debug               bool        `json:"debug,omitempty" yaml:"debug,omitempty"`
+	DisableServices     []string    `json:"disable-services,omitempty" yaml:"disable-services,omitempty"`
+	Env                 []NameValue `json:"env,omitempty" yaml:"env,omitempty"`
+	EnvFrom             []EnvFrom   `json:"env-from,omitempty" yaml:"env-from,omitempty"`
+	InitScripts         []string    `json:"init-scripts,omitempty" yaml:"init-scripts,omitempty"`
+	Modules             []string    `json:"modules,omitempty" yaml:"modules,omitempty"`
+	ReplaceInit         bool        `json:"replace-init,omitempty" yaml:"replace-init,omitempty"`
+	Security            *Security   `json:"security,omitempty" yaml:"security,omitempty"`
+	ShutdownGracePeriod *int        `json:"shutdown-grace-period,omitempty" yaml:"shutdown-grace-period,omitempty"`
+	Sysctls             []NameValue `json:"sysctls,omitempty" yaml:"sysctls,omitempty"`
+	Volumes             []Volume    `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	WorkingDir          string      `json:"working-dir,omitempty" yaml:"working-dir,omitempty"`
+}
+
+// StringList is a list of strings for which an empty list is distinct from
+// one that is not defined, such as args, which defaults to the image's cmd
+// only if it is not defined.
+type StringList []string
+
+func (l StringList) IsZero() bool {
+	return l == nil
+}
+
+type NameValue struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// EnvFrom is a source of environment variables. Exactly one source is defined.
+type EnvFrom struct {
+	IMDS           *IMDSEnv           `json:"imds,omitempty" yaml:"imds,omitempty"`
+	S3             *S3Env             `json:"s3,omitempty" yaml:"s3,omitempty"`
+	SSM            *SSMEnv            `json:"ssm,omitempty" yaml:"ssm,omitempty"`
+	SecretsManager *SecretsManagerEnv `json:"secrets-manager,omitempty" yaml:"secrets-manager,omitempty"`
+}
+
+type IMDSEnv struct {
+	Name     string `json:"name" yaml:"name"`
+	Path     string `json:"path" yaml:"path"`
+	Optional bool   `json:"optional,omitempty" yaml:"optional,omitempty"`
+}
+
+type S3Env struct {
+	Base64Encode bool   `json:"base64-encode,omitempty" yaml:"base64-encode,omitempty"`
+	Bucket       string `json:"bucket" yaml:"bucket"`
+	Key          string `json:"key" yaml:"key"`
+	Name         string `json:"name,omitempty" yaml:"name,omitempty"`
+	Optional     bool   `json:"optional,omitempty" yaml:"optional,omitempty"`
+}
+
+type SSMEnv struct {
+	Base64Encode bool   `json:"base64-encode,omitempty" yaml:"base64-encode,omitempty"`
+	Name         string `json:"name,omitempty" yaml:"name,omitempty"`
+	Optional     bool   `json:"optional,omitempty" yaml:"optional,omitempty"`
+	Path         string `json:"path" yaml:"path"`
+}
+
+type SecretsManagerEnv struct {
+	Base64Encode bool   `json:"base64-encode,omitempty" yaml:"base64-encode,omitempty"`
+	Name         string `json:"name,omitempty" yaml:"name,omitempty"`
+	Optional     bool   `json:"optional,omitempty" yaml:"optional,omitempty"`
+	SecretID     string `json:"secret-id" yaml:"secret-id"`
+}
+
+type Security struct {
+	ReadonlyRootFS bool `json:"readonly-root-fs,omitempty" yaml:"readonly-root-fs,omitempty"`
+	RunAsGroupID   *int `json:"run-as-group-id,omitempty" yaml:"run-as-group-id,omitempty"`
+	RunAsUserID    *int `json:"run-as-user-id,omitempty" yaml:"run-as-user-id,omitempty"`
+}
+
+// Volume is a volume or pseudo-volume. Exactly one type is defined.
+type Volume struct {
+	EBS            *EBSVolume            `json:"ebs,omitempty" yaml:"ebs,omitempty"`
+	S3             *S3Volume             `json:"s3,omitempty" yaml:"s3,omitempty"`
+	SSM            *SSMVolume            `json:"ssm,omitempty" yaml:"ssm,omitempty"`
+	SecretsManager *SecretsManagerVolume `json:"secrets-manager,omitempty" yaml:"secrets-manager,omitempty"`
+	Template       *TemplateVolume       `json:"template,omitempty" yaml:"template,omitempty"`
+}
+
+type EBSVolume struct {
+	Attachment []EBSAttachment `json:"attachment,omitempty" yaml:"attachment,omitempty"`
+	Device     string          `json:"device" yaml:"device"`
+	Mount      *Mount          `json:"mount,omitempty" yaml:"mount,omitempty"`
+}
+
+type S3Volume struct {
+	Bucket    string `json:"bucket" yaml:"bucket"`
+	KeyPrefix string `json:"key-prefix,omitempty" yaml:"key-prefix,omitempty"`
+	Mount     Mount  `json:"mount" yaml:"mount"`
+	Optional  bool   `json:"optional,omitempty" yaml:"optional,omitempty"`
+}
+
+type SSMVolume struct {
+	Path     string `json:"path" yaml:"path"`
+	Mount    Mount  `json:"mount" yaml:"mount"`
+	Optional bool   `json:"optional,omitempty" yaml:"optional,omitempty"`
+}
+
+type SecretsManagerVolume struct {
+	Mount    Mount  `json:"mount" yaml:"mount"`
+	Optional bool   `json:"optional,omitempty" yaml:"optional,omitempty"`
+	SecretID string `json:"secret-id" yaml:"secret-id"`
+}
+
+type TemplateVolume struct {
+	Content   string         `json:"content" yaml:"content"`
+	Mount     Mount          `json:"mount" yaml:"mount"`
+	Optional  bool           `json:"optional,omitempty" yaml:"optional,omitempty"`
+	Variables map[string]any `json:"variables,omitempty" yaml:"variables,omitempty"`
+}
+
+type EBSAttachment struct {
+	Tags    []TagKeyValue `json:"tags" yaml:"tags"`
+	Timeout *int          `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+type TagKeyValue struct {
+	Key   string `json:"key" yaml:"key"`
+	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+}
+
+type Mount struct {
+	Destination string   `json:"destination" yaml:"destination"`
+	FSType      string   `json:"fs-type,omitempty" yaml:"fs-type,omitempty"`
+	GroupID     *int     `json:"group-id,omitempty" yaml:"group-id,omitempty"`
+	Mode        string   `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Options     []string `json:"options,omitempty" yaml:"options,omitempty"`
+	UserID      *int     `json:"user-id,omitempty" yaml:"user-id,omitempty"`
+}
+
+// Decompress returns data uncompressed if it is gzipped, as init accepts
+// user data either way, otherwise it returns data unchanged.
+func Decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipMagic) {
+		return data, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress user data: %w", err)
+	}
+	defer reader.Close()
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress user data: %w", err)
+	}
+	return decompressed, nil
+}
+
+// Parse validates user data, which may be gzipped, and decodes it. If the
+// user data is invalid, the returned error is a *ValidationError.
+func Parse(data []byte) (*UserData, error) {
+	data, err := Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := validate(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	userData := &UserData{}
+	if err := yaml.Unmarshal(data, userData); err != nil {
+		return nil, fmt.Errorf("unable to parse user data: %w", err)
+	}
+	return userData, nil
+}
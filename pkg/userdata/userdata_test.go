@@ -0,0 +1,136 @@
+package userdata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(t *testing.T, data string) []byte {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	_, err := writer.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func TestDecompress(t *testing.T) {
+	testCases := []struct {
+		description string
+		data        []byte
+		result      []byte
+		errContains string
+	}{
+		{
+			description: "Plain",
+			data:        []byte("debug: true\n"),
+			result:      []byte("debug: true\n"),
+		},
+		{
+			description: "Gzipped",
+			data:        gzipped(t, "debug: true\n"),
+			result:      []byte("debug: true\n"),
+		},
+		{
+			description: "Truncated gzip",
+			data:        gzipped(t, "debug: true\n")[:12],
+			errContains: "unable to decompress user data",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			result, err := Decompress(tc.data)
+			if len(tc.errContains) > 0 {
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.result, result)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	i := func(n int) *int { return &n }
+	testCases := []struct {
+		description string
+		data        []byte
+		userData    *UserData
+		problems    []Problem
+	}{
+		{
+			description: "Gzipped",
+			data: gzipped(t, `command: [/app]
+env:
+  - name: A
+    value: 1
+security:
+  run-as-user-id: 0
+volumes:
+  - ebs:
+      device: /dev/sdb
+      mount:
+        destination: /data
+        fs-type: xfs
+        mode: 0700
+`),
+			userData: &UserData{
+				Command:  StringList{"/app"},
+				Env:      []NameValue{{Name: "A", Value: "1"}},
+				Security: &Security{RunAsUserID: i(0)},
+				Volumes: []Volume{
+					{
+						EBS: &EBSVolume{
+							Device: "/dev/sdb",
+							Mount: &Mount{
+								Destination: "/data",
+								FSType:      "xfs",
+								Mode:        "0700",
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			description: "Invalid",
+			data:        []byte("env:\n  - name: A\n"),
+			problems: []Problem{
+				{Line: 2, Column: 5, Path: "env[0]", Message: "missing required field value in name-value"},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			userData, err := Parse(tc.data)
+			if len(tc.problems) > 0 {
+				validationErr := &ValidationError{}
+				require.ErrorAs(t, err, &validationErr)
+				assert.Equal(t, tc.problems, validationErr.Problems)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.userData, userData)
+		})
+	}
+}
+
+func TestParseExamples(t *testing.T) {
+	paths, err := filepath.Glob("../../examples/*.yml")
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			_, err = Parse(data)
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,624 @@
+package userdata
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var fsTypes = []string{"ext2", "ext3", "ext4", "btrfs", "xfs"}
+
+// Problem is a problem found in user data. Path is the location of the
+// problem in the document, such as volumes[0].ebs.mount.
+type Problem struct {
+	Line    int
+	Column  int
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if len(p.Path) == 0 {
+		return fmt.Sprintf("%d:%d: %s", p.Line, p.Column, p.Message)
+	}
+	return fmt.Sprintf("%d:%d: %s: %s", p.Line, p.Column, p.Path, p.Message)
+}
+
+// ValidationError is returned by Parse when user data does not match the schema.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.String()
+	}
+	return "invalid user data:\n" + strings.Join(problems, "\n")
+}
+
+// Validate checks user data, which may be gzipped, against the schema and
+// returns any problems found, ordered by their position in the document. An
+// error is returned if the data cannot be decompressed or is not valid YAML.
+func Validate(data []byte) ([]Problem, error) {
+	data, err := Decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	return validate(data)
+}
+
+func validate(data []byte) ([]Problem, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return nil, fmt.Errorf("unable to parse user data: %w", err)
+	}
+	// An empty document is valid, as every field is optional.
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	v := &validator{}
+	root := resolve(doc.Content[0])
+	v.check(root, userDataSchema, "")
+	if len(v.problems) == 0 {
+		v.checkVariables(root)
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i], v.problems[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return v.problems, nil
+}
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindBool
+	kindInt
+	kindList
+	kindMap
+	kindObject
+	kindAny
+)
+
+var kindNames = map[kind]string{
+	kindString: "a string",
+	kindBool:   "a boolean",
+	kindInt:    "an integer",
+	kindList:   "a list",
+	kindMap:    "a mapping",
+	kindObject: "a mapping",
+	kindAny:    "a value",
+}
+
+// schema describes the expected shape of a node.
+type schema struct {
+	kind kind
+	// elem is the schema of list elements and mapping values.
+	elem *schema
+	// name is the name of an object, used in messages.
+	name   string
+	fields map[string]*field
+	// oneOf is set on objects that must define exactly one of their fields.
+	oneOf bool
+	// extra is an additional check run after the node's fields are checked.
+	extra func(node *yaml.Node, path string, v *validator)
+}
+
+type field struct {
+	schema   *schema
+	required bool
+}
+
+var (
+	stringSchema     = &schema{kind: kindString}
+	boolSchema       = &schema{kind: kindBool}
+	intSchema        = &schema{kind: kindInt}
+	anySchema        = &schema{kind: kindAny}
+	stringListSchema = &schema{kind: kindList, elem: stringSchema}
+
+	nameValueSchema = &schema{
+		kind: kindObject,
+		name: "name-value",
+		fields: map[string]*field{
+			"name":  {schema: stringSchema, required: true},
+			"value": {schema: stringSchema, required: true},
+		},
+	}
+
+	mountSchema = &schema{
+		kind: kindObject,
+		name: "mount",
+		fields: map[string]*field{
+			"destination": {schema: stringSchema, required: true},
+			"fs-type":     {schema: stringSchema},
+			"group-id":    {schema: intSchema},
+			"mode":        {schema: stringSchema},
+			"options":     {schema: stringListSchema},
+			"user-id":     {schema: intSchema},
+		},
+		extra: checkMount,
+	}
+
+	envFromSchema = &schema{
+		kind:  kindObject,
+		name:  "env-from",
+		oneOf: true,
+		fields: map[string]*field{
+			"imds": {schema: &schema{
+				kind: kindObject,
+				name: "imds-env",
+				fields: map[string]*field{
+					"name":     {schema: stringSchema, required: true},
+					"optional": {schema: boolSchema},
+					"path":     {schema: stringSchema, required: true},
+				},
+			}},
+			"s3": {schema: &schema{
+				kind: kindObject,
+				name: "s3-env",
+				fields: map[string]*field{
+					"base64-encode": {schema: boolSchema},
+					"bucket":        {schema: stringSchema, required: true},
+					"key":           {schema: stringSchema, required: true},
+					"name":          {schema: stringSchema},
+					"optional":      {schema: boolSchema},
+				},
+			}},
+			"ssm": {schema: &schema{
+				kind: kindObject,
+				name: "ssm-env",
+				fields: map[string]*field{
+					"base64-encode": {schema: boolSchema},
+					"name":          {schema: stringSchema},
+					"optional":      {schema: boolSchema},
+					"path":          {schema: stringSchema, required: true},
+				},
+			}},
+			"secrets-manager": {schema: &schema{
+				kind: kindObject,
+				name: "secrets-manager-env",
+				fields: map[string]*field{
+					"base64-encode": {schema: boolSchema},
+					"name":          {schema: stringSchema},
+					"optional":      {schema: boolSchema},
+					"secret-id":     {schema: stringSchema, required: true},
+				},
+			}},
+		},
+	}
+
+	volumeSchema = &schema{
+		kind:  kindObject,
+		name:  "volume",
+		oneOf: true,
+		fields: map[string]*field{
+			"ebs": {schema: &schema{
+				kind: kindObject,
+				name: "ebs-volume",
+				fields: map[string]*field{
+					"attachment": {schema: &schema{
+						kind: kindList,
+						elem: &schema{
+							kind: kindObject,
+							name: "ebs-attachment",
+							fields: map[string]*field{
+								"tags": {
+									schema: &schema{
+										kind: kindList,
+										elem: &schema{
+											kind: kindObject,
+											name: "tag-key-value",
+											fields: map[string]*field{
+												"key":   {schema: stringSchema, required: true},
+												"value": {schema: stringSchema},
+											},
+										},
+									},
+									required: true,
+								},
+								"timeout": {schema: intSchema},
+							},
+						},
+					}},
+					"device": {schema: stringSchema, required: true},
+					"mount":  {schema: mountSchema},
+				},
+				extra: checkEBSVolume,
+			}},
+			"s3": {schema: &schema{
+				kind: kindObject,
+				name: "s3-volume",
+				fields: map[string]*field{
+					"bucket":     {schema: stringSchema, required: true},
+					"key-prefix": {schema: stringSchema},
+					"mount":      {schema: mountSchema, required: true},
+					"optional":   {schema: boolSchema},
+				},
+			}},
+			"ssm": {schema: &schema{
+				kind: kindObject,
+				name: "ssm-volume",
+				fields: map[string]*field{
+					"mount":    {schema: mountSchema, required: true},
+					"optional": {schema: boolSchema},
+					"path":     {schema: stringSchema, required: true},
+				},
+			}},
+			"secrets-manager": {schema: &schema{
+				kind: kindObject,
+				name: "secrets-manager-volume",
+				fields: map[string]*field{
+					"mount":     {schema: mountSchema, required: true},
+					"optional":  {schema: boolSchema},
+					"secret-id": {schema: stringSchema, required: true},
+				},
+			}},
+			"template": {schema: &schema{
+				kind: kindObject,
+				name: "template-volume",
+				fields: map[string]*field{
+					"content":   {schema: stringSchema, required: true},
+					"mount":     {schema: mountSchema, required: true},
+					"optional":  {schema: boolSchema},
+					"variables": {schema: &schema{kind: kindMap, elem: anySchema}},
+				},
+			}},
+		},
+	}
+
+	userDataSchema = &schema{
+		kind: kindObject,
+		name: "user data",
+		fields: map[string]*field{
+			"args":             {schema: stringListSchema},
+			"command":          {schema: stringListSchema},
+			"debug":            {schema: boolSchema},
+			"disable-services": {schema: stringListSchema},
+			"env":              {schema: &schema{kind: kindList, elem: nameValueSchema}},
+			"env-from":         {schema: &schema{kind: kindList, elem: envFromSchema}},
+			"init-scripts": {schema: &schema{
+				kind: kindList,
+				elem: &schema{kind: kindString, extra: checkInitScript},
+			}},
+			"modules":      {schema: stringListSchema},
+			"replace-init": {schema: boolSchema},
+			"security": {schema: &schema{
+				kind: kindObject,
+				name: "security",
+				fields: map[string]*field{
+					"readonly-root-fs": {schema: boolSchema},
+					"run-as-group-id":  {schema: intSchema},
+					"run-as-user-id":   {schema: intSchema},
+				},
+			}},
+			"shutdown-grace-period": {schema: intSchema},
+			"sysctls":               {schema: &schema{kind: kindList, elem: nameValueSchema}},
+			"volumes":               {schema: &schema{kind: kindList, elem: volumeSchema}},
+			"working-dir":           {schema: stringSchema},
+		},
+	}
+)
+
+type validator struct {
+	problems []Problem
+}
+
+func (v *validator) add(node *yaml.Node, path, format string, args ...any) {
+	v.problems = append(v.problems, Problem{
+		Line:    node.Line,
+		Column:  node.Column,
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// check checks node against s, adding any problems found.
+func (v *validator) check(node *yaml.Node, s *schema, path string) {
+	if !v.checkKind(node, s, path) {
+		return
+	}
+
+	switch s.kind {
+	case kindList:
+		for i, item := range node.Content {
+			v.check(resolve(item), s.elem, fmt.Sprintf("%s[%d]", path, i))
+		}
+	case kindMap:
+		for i := 0; i < len(node.Content); i += 2 {
+			key, value := node.Content[i], resolve(node.Content[i+1])
+			v.check(value, s.elem, joinPath(path, key.Value))
+		}
+	case kindObject:
+		v.checkObject(node, s, path)
+	}
+
+	if s.extra != nil {
+		s.extra(node, path, v)
+	}
+}
+
+// checkKind returns true if node is of the kind expected by s. A null value
+// is treated the same as a missing field.
+func (v *validator) checkKind(node *yaml.Node, s *schema, path string) bool {
+	if isNull(node) {
+		return false
+	}
+	ok := false
+	switch s.kind {
+	case kindString:
+		ok = node.Kind == yaml.ScalarNode
+	case kindBool:
+		ok = node.Kind == yaml.ScalarNode && node.Tag == "!!bool"
+	case kindInt:
+		if node.Kind == yaml.ScalarNode && node.Tag == "!!int" {
+			var n int64
+			if err := node.Decode(&n); err != nil || n < 0 {
+				v.add(node, path, "must be a non-negative integer")
+				return false
+			}
+			ok = true
+		}
+	case kindList:
+		ok = node.Kind == yaml.SequenceNode
+	case kindMap, kindObject:
+		ok = node.Kind == yaml.MappingNode
+	case kindAny:
+		ok = true
+	}
+	if !ok {
+		v.add(node, path, "must be %s, found %s", kindNames[s.kind], describe(node))
+	}
+	return ok
+}
+
+func (v *validator) checkObject(node *yaml.Node, s *schema, path string) {
+	seen := map[string]bool{}
+	defined := []string{}
+	for i := 0; i < len(node.Content); i += 2 {
+		key, value := node.Content[i], resolve(node.Content[i+1])
+		fieldPath := joinPath(path, key.Value)
+		f, ok := s.fields[key.Value]
+		if !ok {
+			v.add(key, path, "unknown field %s in %s", key.Value, s.name)
+			continue
+		}
+		if seen[key.Value] {
+			v.add(key, path, "field %s is defined more than once", key.Value)
+			continue
+		}
+		seen[key.Value] = true
+		if !isNull(value) {
+			defined = append(defined, key.Value)
+		}
+		v.check(value, f.schema, fieldPath)
+	}
+
+	for _, name := range sortedKeys(s.fields) {
+		if s.fields[name].required && !slices.Contains(defined, name) {
+			v.add(node, path, "missing required field %s in %s", name, s.name)
+		}
+	}
+
+	if s.oneOf && len(defined) != 1 {
+		names := strings.Join(sortedKeys(s.fields), ", ")
+		if len(defined) == 0 {
+			v.add(node, path, "%s must define one of %s", s.name, names)
+		} else {
+			v.add(node, path, "%s must define only one of %s, found %s",
+				s.name, names, strings.Join(defined, ", "))
+		}
+	}
+}
+
+func checkMount(node *yaml.Node, path string, v *validator) {
+	if fsType := mappingValue(node, "fs-type"); fsType != nil && fsType.Kind == yaml.ScalarNode {
+		if !slices.Contains(fsTypes, fsType.Value) {
+			v.add(fsType, joinPath(path, "fs-type"), "must be one of %s",
+				strings.Join(fsTypes, ", "))
+		}
+	}
+	if mode := mappingValue(node, "mode"); mode != nil && mode.Kind == yaml.ScalarNode {
+		if n, err := strconv.ParseUint(mode.Value, 8, 32); err != nil || n > 07777 {
+			v.add(mode, joinPath(path, "mode"), "must be an octal file mode such as 0755")
+		}
+	}
+}
+
+func checkEBSVolume(node *yaml.Node, path string, v *validator) {
+	mount := mappingValue(node, "mount")
+	if mount == nil || mount.Kind != yaml.MappingNode {
+		return
+	}
+	if mappingValue(mount, "fs-type") == nil {
+		v.add(mount, joinPath(path, "mount"), "fs-type is required for ebs volumes")
+	}
+}
+
+func checkInitScript(node *yaml.Node, path string, v *validator) {
+	if !strings.HasPrefix(node.Value, "#!") {
+		v.add(node, path, "init script must start with #!")
+	}
+}
+
+// checkVariables checks that $(VAR) references in env, command, args, and
+// template variables refer to variables defined in env or env-from. Variables
+// in env may only refer to variables in env that are defined before them. The
+// check is skipped if env-from has a source without a name, as the names of
+// its variables are not known until boot.
+func (v *validator) checkVariables(root *yaml.Node) {
+	fromEnvFrom := map[string]bool{}
+	for _, source := range items(mappingValue(root, "env-from")) {
+		for i := 0; i < len(source.Content); i += 2 {
+			name := mappingValue(resolve(source.Content[i+1]), "name")
+			if isNull(name) {
+				return
+			}
+			fromEnvFrom[name.Value] = true
+		}
+	}
+
+	env := items(mappingValue(root, "env"))
+	fromEnv := map[string]int{}
+	for i, item := range env {
+		name := mappingValue(item, "name").Value
+		if _, ok := fromEnv[name]; !ok {
+			fromEnv[name] = i
+		}
+	}
+
+	checkString := func(node *yaml.Node, path string, envIndex int) {
+		for _, name := range references(node.Value) {
+			if fromEnvFrom[name] {
+				continue
+			}
+			i, ok := fromEnv[name]
+			switch {
+			case !ok:
+				v.add(node, path, "variable %s is not defined in env or env-from", name)
+			case envIndex >= 0 && i >= envIndex:
+				v.add(node, path, "variable %s is referenced before it is defined in env", name)
+			}
+		}
+	}
+
+	for i, item := range env {
+		checkString(resolve(mappingValue(item, "value")), fmt.Sprintf("env[%d].value", i), i)
+	}
+	for _, key := range []string{"command", "args"} {
+		for i, item := range items(mappingValue(root, key)) {
+			checkString(item, fmt.Sprintf("%s[%d]", key, i), -1)
+		}
+	}
+	for i, volume := range items(mappingValue(root, "volumes")) {
+		variables := mappingValue(mappingValue(volume, "template"), "variables")
+		path := fmt.Sprintf("volumes[%d].template.variables", i)
+		walkScalars(variables, path, func(node *yaml.Node, path string) {
+			checkString(node, path, -1)
+		})
+	}
+}
+
+// references returns the names of variables referenced as $(VAR) in s,
+// skipping those escaped as $$(VAR).
+func references(s string) []string {
+	names := []string{}
+	for i := 0; i < len(s)-1; i++ {
+		if s[i] != '$' {
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			i++
+		case '(':
+			end := strings.IndexByte(s[i+2:], ')')
+			if end < 0 {
+				return names
+			}
+			names = append(names, s[i+2:i+2+end])
+			i += end + 2
+		}
+	}
+	return names
+}
+
+func walkScalars(node *yaml.Node, path string, fn func(node *yaml.Node, path string)) {
+	node = resolve(node)
+	if node == nil {
+		return
+	}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		fn(node, path)
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			walkScalars(item, fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			walkScalars(node.Content[i+1], joinPath(path, node.Content[i].Value), fn)
+		}
+	}
+}
+
+// resolve follows aliases to the node they refer to.
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// mappingValue returns the value of key in a mapping node, or nil if node is
+// not a mapping or does not contain key.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	node = resolve(node)
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return resolve(node.Content[i+1])
+		}
+	}
+	return nil
+}
+
+// items returns the resolved items of a sequence node.
+func items(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	resolved := make([]*yaml.Node, len(node.Content))
+	for i, item := range node.Content {
+		resolved[i] = resolve(item)
+	}
+	return resolved
+}
+
+func isNull(node *yaml.Node) bool {
+	return node == nil || (node.Kind == yaml.ScalarNode && node.Tag == "!!null")
+}
+
+func describe(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		return "a list"
+	case yaml.MappingNode:
+		return "a mapping"
+	}
+	switch node.Tag {
+	case "!!bool":
+		return "a boolean"
+	case "!!int":
+		return "an integer"
+	case "!!float":
+		return "a number"
+	}
+	return "a string"
+}
+
+func joinPath(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(fields map[string]*field) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,283 @@
+package userdata
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		description string
+		content     string
+		problems    []Problem
+		errContains string
+	}{
+		{
+			description: "Empty document",
+			content:     "",
+		},
+		{
+			description: "Valid user data",
+			content: `command: [/app, $(IPV4_ADDRESS)]
+args: [$$(NOT_A_VAR)]
+env:
+  - name: A
+    value: 123
+  - name: B
+    value: $(A) and $(IPV4_ADDRESS)
+env-from:
+  - imds:
+      name: IPV4_ADDRESS
+      path: local-ipv4
+init-scripts:
+  - |
+    #!/.easyto/bin/busybox sh
+    echo hi
+security:
+  run-as-user-id: 1000
+volumes:
+  - ebs:
+      device: /dev/sdb
+      mount:
+        destination: /data
+        fs-type: ext4
+        mode: 0750
+  - template:
+      content: "{{a}}"
+      variables:
+        a: $(B)
+      mount:
+        destination: /a.txt
+`,
+		},
+		{
+			description: "Syntax error",
+			content:     "env:\n  - name: A\n   value: B\n",
+			errContains: "unable to parse user data",
+		},
+		{
+			description: "Not a mapping",
+			content:     "- a\n- b\n",
+			problems: []Problem{
+				{Line: 1, Column: 1, Message: "must be a mapping, found a list"},
+			},
+		},
+		{
+			description: "Unknown field",
+			content:     "command: [/app]\nenv-form:\n  - imds: {}\n",
+			problems: []Problem{
+				{Line: 2, Column: 1, Message: "unknown field env-form in user data"},
+			},
+		},
+		{
+			description: "Wrong types",
+			content:     "command: /app\ndebug: yes please\nshutdown-grace-period: -1\n",
+			problems: []Problem{
+				{Line: 1, Column: 10, Path: "command", Message: "must be a list, found a string"},
+				{Line: 2, Column: 8, Path: "debug", Message: "must be a boolean, found a string"},
+				{
+					Line:    3,
+					Column:  24,
+					Path:    "shutdown-grace-period",
+					Message: "must be a non-negative integer",
+				},
+			},
+		},
+		{
+			description: "Missing mount destination",
+			content: `volumes:
+  - s3:
+      bucket: abc
+      mount:
+        mode: "0755"
+`,
+			problems: []Problem{
+				{
+					Line:    5,
+					Column:  9,
+					Path:    "volumes[0].s3.mount",
+					Message: "missing required field destination in mount",
+				},
+			},
+		},
+		{
+			description: "Mutually exclusive volume types",
+			content: `volumes:
+  - ebs:
+      device: /dev/sdb
+    ssm:
+      path: /abc
+      mount:
+        destination: /abc
+  - {}
+`,
+			problems: []Problem{
+				{
+					Line:    2,
+					Column:  5,
+					Path:    "volumes[0]",
+					Message: "volume must define only one of ebs, s3, secrets-manager, ssm, template, found ebs, ssm",
+				},
+				{
+					Line:    8,
+					Column:  5,
+					Path:    "volumes[1]",
+					Message: "volume must define one of ebs, s3, secrets-manager, ssm, template",
+				},
+			},
+		},
+		{
+			description: "Mutually exclusive env-from sources",
+			content:     "env-from:\n  - imds: {name: A, path: a}\n    ssm: {path: /b}\n",
+			problems: []Problem{
+				{
+					Line:    2,
+					Column:  5,
+					Path:    "env-from[0]",
+					Message: "env-from must define only one of imds, s3, secrets-manager, ssm, found imds, ssm",
+				},
+			},
+		},
+		{
+			description: "EBS mount without fs-type",
+			content: `volumes:
+  - ebs:
+      device: /dev/sdb
+      mount:
+        destination: /data
+`,
+			problems: []Problem{
+				{
+					Line:    5,
+					Column:  9,
+					Path:    "volumes[0].ebs.mount",
+					Message: "fs-type is required for ebs volumes",
+				},
+			},
+		},
+		{
+			description: "Invalid mount fields",
+			content: `volumes:
+  - ebs:
+      device: /dev/sdb
+      mount:
+        destination: /data
+        fs-type: ntfs
+        mode: rwx
+`,
+			problems: []Problem{
+				{
+					Line:    6,
+					Column:  18,
+					Path:    "volumes[0].ebs.mount.fs-type",
+					Message: "must be one of ext2, ext3, ext4, btrfs, xfs",
+				},
+				{
+					Line:    7,
+					Column:  15,
+					Path:    "volumes[0].ebs.mount.mode",
+					Message: "must be an octal file mode such as 0755",
+				},
+			},
+		},
+		{
+			description: "Init script without interpreter",
+			content:     "init-scripts:\n  - echo hi\n",
+			problems: []Problem{
+				{Line: 2, Column: 5, Path: "init-scripts[0]", Message: "init script must start with #!"},
+			},
+		},
+		{
+			description: "Duplicate field",
+			content:     "debug: true\ndebug: false\n",
+			problems: []Problem{
+				{Line: 2, Column: 1, Message: "field debug is defined more than once"},
+			},
+		},
+		{
+			description: "Undefined variables",
+			content: `command: [/app, $(PORT)]
+env:
+  - name: A
+    value: $(B)
+  - name: B
+    value: b
+volumes:
+  - template:
+      content: "{{x}}"
+      variables:
+        x: [$(C)]
+      mount:
+        destination: /x
+`,
+			problems: []Problem{
+				{
+					Line:    1,
+					Column:  17,
+					Path:    "command[1]",
+					Message: "variable PORT is not defined in env or env-from",
+				},
+				{
+					Line:    4,
+					Column:  12,
+					Path:    "env[0].value",
+					Message: "variable B is referenced before it is defined in env",
+				},
+				{
+					Line:    11,
+					Column:  13,
+					Path:    "volumes[0].template.variables.x[0]",
+					Message: "variable C is not defined in env or env-from",
+				},
+			},
+		},
+		{
+			description: "Variables not checked with unnamed env-from",
+			content:     "command: [$(ANYTHING)]\nenv-from:\n  - ssm:\n      path: /abc\n",
+		},
+		{
+			description: "Alias",
+			content: `volumes:
+  - ssm:
+      path: /abc
+      mount: &mount
+        destination: /abc
+  - ssm:
+      path: /def
+      mount: *mount
+`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			problems, err := Validate([]byte(tc.content))
+			if len(tc.errContains) > 0 {
+				assert.ErrorContains(t, err, tc.errContains)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.problems, problems)
+		})
+	}
+}
+
+func TestReferences(t *testing.T) {
+	testCases := []struct {
+		s     string
+		names []string
+	}{
+		{s: "", names: []string{}},
+		{s: "$", names: []string{}},
+		{s: "$(A)", names: []string{"A"}},
+		{s: "$(A)$(B) and $(C", names: []string{"A", "B"}},
+		{s: "$$(A) $$$(B)", names: []string{"B"}},
+		{s: "$A ${B}", names: []string{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.s, func(t *testing.T) {
+			assert.Equal(t, tc.names, references(tc.s))
+		})
+	}
+}